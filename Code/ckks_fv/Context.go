@@ -2,30 +2,36 @@ package ckks_fv
 
 import (
 	"fmt"
-	"math/rand"
 )
 
+// Context holds the key material of all parties including the secret key,
+// AuthBundle, EvaluationBundle and ClientBundle separate it by role.
 type Context struct {
 	ID         string
 	PK         *PublicKey
 	SK         *SecretKey
-	Nonces     [][]byte
+	Cipher     int
 	PDcds      [][]*PtDiagMatrixT
 	NumRound   int
 	ParamIndex int
 	Radix      int
 	FullCoeffs bool
 	RelinKey   *RelinearizationKey
-	//BootstrappingKey BootstrappingKey
+	RotKeys    *RotationKeySet
+	// BootstrappingKey is nil if it consists of RelinKey and RotKeys, which saves storing them twice
+	BootstrappingKey *BootstrappingKey
+	HalfBootMatrices []*PtDiagMatrix
 }
 
 type SaveFile interface {
 	PrintContext()
 	GetContextID() string
+	GetCipher() int
 	GetClientParameters() (*SecretKey, *PublicKey)
-	GetSharedParameters() (int, int, int, bool, [][]*PtDiagMatrixT, [][]byte)
-	//TODO: Add rotation key set here
+	GetSharedParameters() (int, int, int, bool, [][]*PtDiagMatrixT)
 	GetRelinKey() *RelinearizationKey
+	GetEvaluationKeys() (*PublicKey, *RotationKeySet, *RelinearizationKey, BootstrappingKey)
+	GetHalfBootMatrices() []*PtDiagMatrix
 }
 
 func CreateNewContext(shared Shared, Pk *PublicKey, Sk *SecretKey) SaveFile {
@@ -33,37 +39,44 @@ func CreateNewContext(shared Shared, Pk *PublicKey, Sk *SecretKey) SaveFile {
 	context.ID = "0"
 	context.SK = Sk
 	context.PK = Pk
-	context.Nonces = shared.GetNonces()
+	context.Cipher = shared.GetCipher()
 	context.PDcds = shared.GetPDcds()
 	context.NumRound = shared.GetNumRounds()
 	context.Radix = shared.GetRadix()
 	context.ParamIndex = shared.GetParamIndex()
 	context.FullCoeffs = shared.GetFullCoeffs()
 
-	//context.rotKeys = RotKeys.RotationKeySet
-	//_, RotKeys, RelinKey, BootstrappingKey := shared.GetAllPublicKeys()
-	//context.RotationKeys = RotKeys
-	//_, _, RelinKey, BootstrappingKey := shared.GetAllPublicKeys()
-	_, _, RelinKey, _ := shared.GetAllPublicKeys()
+	_, RotKeys, RelinKey, BootstrappingKey := shared.GetAllPublicKeys()
 	context.RelinKey = RelinKey
-	//context.BootstrappingKey = BootstrappingKey
-	fmt.Println("Context Created")
+	context.RotKeys = RotKeys
+	if BootstrappingKey.Rlk != RelinKey || BootstrappingKey.Rtks != RotKeys {
+		context.BootstrappingKey = &BootstrappingKey
+	}
+	context.HalfBootMatrices = shared.GetHalfBootMatrices()
+	logMessage(shared.GetLogger(), LogDebug, "context created", Field{"context", context.ID})
 	return context
 }
 func (context *Context) GetContextID() string {
 	return context.ID
 }
+
+// GetCipher returns the symmetric cipher of the context, contexts saved before Rubato support default to HERA
+func (context *Context) GetCipher() int {
+	return context.Cipher
+}
+
 func (context *Context) PrintContext() {
 	fmt.Println("ID: ", context.ID)
-	fmt.Println("SK: ", context.SK)
+	fmt.Println("SK set: ", context.SK != nil)
 	fmt.Println("PK: ", context.PK)
-	//fmt.Println("Nonces: ", context.Nonces)
 	fmt.Println("NumRound: ", context.NumRound)
 	fmt.Println("Radix: ", context.Radix)
 	fmt.Println("Relin: ", context.RelinKey)
 	fmt.Println("PCDS: ", context.PDcds)
-	//fmt.Println("Bootstrapping Key: ", context.BootstrappingKey)
-	//fmt.Println("Rotation Keys: ", context.rotKeys)
+	if context.RotKeys != nil {
+		fmt.Println("Rotation Keys (len): ", len(context.RotKeys.Keys))
+	}
+	fmt.Println("HalfBoot Matrices (len): ", len(context.HalfBootMatrices))
 	//fmt.Println("FullCoeffs: ", context.FullCoeffs)
 }
 
@@ -75,13 +88,22 @@ func (context *Context) GetRelinKey() *RelinearizationKey {
 	return context.RelinKey
 }
 
-func (context *Context) GetSharedParameters() (int, int, int, bool, [][]*PtDiagMatrixT, [][]byte) {
+// GetSharedParameters returns the parameters and the SlotsToCoeffs matrices of the context
+func (context *Context) GetSharedParameters() (int, int, int, bool, [][]*PtDiagMatrixT) {
+	return context.NumRound, context.ParamIndex, context.Radix, context.FullCoeffs, context.PDcds
+}
 
-	nonces := make([][]byte, 3)
-	for i := 0; i < 3; i++ {
-		nonces[i] = make([]byte, 64)
-		rand.Read(nonces[i])
+// GetEvaluationKeys returns the public, rotation, relinearization and bootstrapping keys,
+// the keys are nil for a context saved without them
+func (context *Context) GetEvaluationKeys() (*PublicKey, *RotationKeySet, *RelinearizationKey, BootstrappingKey) {
+	bootstrappingKey := BootstrappingKey{Rlk: context.RelinKey, Rtks: context.RotKeys}
+	if context.BootstrappingKey != nil {
+		bootstrappingKey = *context.BootstrappingKey
 	}
-	//return context.NumRound, context.ParamIndex, context.Radix, context.FullCoeffs, context.PDcds, context.Nonces
-	return context.NumRound, context.ParamIndex, context.Radix, context.FullCoeffs, context.PDcds, nonces
+	return context.PK, context.RotKeys, context.RelinKey, bootstrappingKey
+}
+
+// GetHalfBootMatrices returns the CoeffsToSlots matrices of the half bootstrapper, nil for a context saved without them
+func (context *Context) GetHalfBootMatrices() []*PtDiagMatrix {
+	return context.HalfBootMatrices
 }
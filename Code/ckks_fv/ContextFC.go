@@ -2,14 +2,14 @@ package ckks_fv
 
 import (
 	"fmt"
-	"math/rand"
 )
 
+// ContextFC is the Context for full coefficients, see the role-separated bundles for distributing it.
 type ContextFC struct {
 	ID     string
 	PK     *PublicKey
 	SK     *SecretKey
-	Nonces [][]byte
+	Cipher int
 
 	NumRound   int
 	ParamIndex int
@@ -22,8 +22,9 @@ type ContextFC struct {
 type SaveFileFC interface {
 	PrintContext()
 	GetContextID() string
+	GetCipher() int
 	GetAuthServerParameters() (*SecretKey, *PublicKey)
-	GetSharedParameters() (int, int, int, bool, [][]byte)
+	GetSharedParameters() (int, int, int, bool)
 }
 
 func CreateNewContextFC(shared Shared, Pk *PublicKey, Sk *SecretKey) SaveFileFC {
@@ -31,43 +32,36 @@ func CreateNewContextFC(shared Shared, Pk *PublicKey, Sk *SecretKey) SaveFileFC
 	context.ID = "0"
 	context.SK = Sk
 	context.PK = Pk
-	context.Nonces = shared.GetNonces()
+	context.Cipher = shared.GetCipher()
 	context.NumRound = shared.GetNumRounds()
 	context.Radix = shared.GetRadix()
 	context.ParamIndex = shared.GetParamIndex()
 	context.FullCoeffs = shared.GetFullCoeffs()
-	fmt.Println("Context Created")
+	logMessage(shared.GetLogger(), LogDebug, "context created", Field{"context", context.ID})
 	return context
 }
 func (context *ContextFC) GetContextID() string {
 	return context.ID
 }
+
+// GetCipher returns the symmetric cipher of the context, contexts saved before Rubato support default to HERA
+func (context *ContextFC) GetCipher() int {
+	return context.Cipher
+}
+
 func (context *ContextFC) PrintContext() {
 	fmt.Println("ID: ", context.ID)
-	fmt.Println("SK: ", context.SK)
+	fmt.Println("SK set: ", context.SK != nil)
 	fmt.Println("PK: ", context.PK)
 	fmt.Println("NumRound: ", context.NumRound)
 	fmt.Println("Radix: ", context.Radix)
-	fmt.Println("Nonces (len): ", len(context.Nonces))
 }
 
 func (context *ContextFC) GetAuthServerParameters() (*SecretKey, *PublicKey) {
 	return context.SK, context.PK
 }
 
-func (context *ContextFC) GetSharedParameters() (int, int, int, bool, [][]byte) {
-	var nonces [][]byte
-	if len(context.Nonces) == 0 {
-		println("Nonce is empty")
-		nonces := make([][]byte, 3)
-		for i := 0; i < 3; i++ {
-			nonces[i] = make([]byte, 64)
-			rand.Read(nonces[i])
-		}
-	} else {
-		nonces = context.Nonces
-	}
-
-	//return context.NumRound, context.ParamIndex, context.Radix, context.FullCoeffs, context.PDcds, context.Nonces
-	return context.NumRound, context.ParamIndex, context.Radix, context.FullCoeffs, nonces
+// GetSharedParameters returns the parameters of the context
+func (context *ContextFC) GetSharedParameters() (int, int, int, bool) {
+	return context.NumRound, context.ParamIndex, context.Radix, context.FullCoeffs
 }
@@ -245,8 +245,12 @@ func (eval *ckksEvaluator) permuteNTTIndexesForKey(rtks *RotationKeySet) *map[ui
 // shared with the receiver and the temporary buffers are reallocated. The receiver and the returned
 // Evaluators can be used concurrently.
 func (eval *ckksEvaluator) ShallowCopy() CKKSEvaluator {
+	// the reference scale of the base is changed by SetScale and the bootstrapping and the rings hold a
+	// polynomial pool, so the base is copied as well
+	base := *eval.ckksEvaluatorBase
+	base.ringQ, base.ringP = eval.ringQ.ShallowCopy(), eval.ringP.ShallowCopy()
 	return &ckksEvaluator{
-		ckksEvaluatorBase:    eval.ckksEvaluatorBase,
+		ckksEvaluatorBase:    &base,
 		ckksEvaluatorBuffers: newCKKSEvaluatorBuffers(eval.ckksEvaluatorBase),
 		rlk:                  eval.rlk,
 		rtks:                 eval.rtks,
@@ -1,81 +1,94 @@
 package ckks_fv
 
 import (
-	"fmt"
-	"math/rand"
-	"time"
+	"crypto/rand"
+	"errors"
 
 	"github.com/ldsec/lattigo/v2/utils"
 )
 
 type Client interface {
-	EncryptMessage(message [][]float64, key []uint64) ([]*PlaintextRingT, []*Ciphertext)
+	EncryptMessage(message [][]float64, key []uint64) ([]*PlaintextRingT, []*Ciphertext, *NonceSet)
 	GenerateRandomKey() []uint64
-	EncryptTemplate(template Template, key []uint64) ([]*PlaintextRingT, []*Ciphertext)
-	EncryptMultipleTemplates(templates []Template, key []uint64, rows int, columns int) ([]*PlaintextRingT, []*Ciphertext)
-	EncryptMultipleTemplatesTiming(templates []Template, key []uint64, rows int, columns int) ([]*PlaintextRingT, []*Ciphertext, float64, float64)
+	EncryptKey(key []uint64) []*Ciphertext
+	EncryptTemplate(template Template, key []uint64) ([]*PlaintextRingT, []*Ciphertext, *NonceSet)
+	EncryptMultipleTemplatesWithNonces(templates []Template, key []uint64, rows int, columns int) ([]*PlaintextRingT, []*Ciphertext, *NonceSet)
+	EncryptMultipleTemplatesSymmetric(templates []Template, key []uint64, rows int, columns int) ([]*PlaintextRingT, *NonceSet)
+	SetNonceManager(manager NonceManager)
 	//DataToComplex(data [][]float64) []complex128
+	SetLogger(logger Logger)
 }
 type client struct {
-	hera        MFVHera
+	cipher      TranscipherCipher
 	shared      Shared
 	ckksEncoder CKKSEncoder
-	needReset   bool
+	nonces      NonceManager
+
+	partyLogger
 }
 
-func NewClient(shared Shared) Client {
+// NewClient creates a client, shared needs the public key to encrypt the symmetric keys
+func NewClient(shared Shared) (Client, error) {
+	if shared.GetFvEncryptor() == nil {
+		return nil, errors.New("shared without public key, the keys of the authentication server must be set first")
+	}
 	nclient := new(client)
 	nclient.shared = shared
-	nclient.hera = NewMFVHera(shared.GetNumRounds(), shared.GetParams(), shared.GetFvEncoder(), shared.GetFvEncryptor(), shared.GetFvEvaluator(), shared.GetHeraModDown()[0])
+	nclient.cipher = NewTranscipherCipher(shared)
 	nclient.ckksEncoder = NewCKKSEncoder(shared.GetParams())
-	nclient.needReset = false
-	return nclient
+	nclient.nonces = NewNonceManager(NewSessionID(), 0, shared.GetMessagesSize())
+	return nclient, nil
 }
 
-func (client *client) generateKeyStreamFromNoncesAndKey(numRound int, nonces [][]byte, key []uint64, plainModulus uint64) [][]uint64 {
+func (client *client) generateKeyStreamFromNoncesAndKey(nonces [][]byte, counter []byte, key []uint64) [][]uint64 {
 	keystream := make([][]uint64, client.shared.GetMessagesSize())
 	for i := 0; i < client.shared.GetMessagesSize(); i++ {
-		keystream[i] = plHera(numRound, nonces[i], key, plainModulus)
+		keystream[i] = client.cipher.KeyStream(nonces[i], counter, key)
 	}
 	return keystream
 }
 
+// GenerateRandomKey samples a symmetric key uniformly from Z_t with crypto/rand, t being the plaintext modulus
 func (client *client) GenerateRandomKey() []uint64 {
-	maxKey := 99999999999
-	if client.shared.GetFullCoeffs() {
-		maxKey = 999
-	}
-	//var key []uint64
-	key := make([]uint64, 16)
-	for i := 0; i < 16; i++ {
-		//key[i] = uint64(i + 2) // Use (1, ..., 16) for testing
-		key[i] = uint64(rand.Intn(maxKey)) // if we use randint it get's too big and the result is far off (result is like 299 instead of 13)
+	plainModulus := client.shared.GetParams().PlainModulus()
+	key := make([]uint64, client.cipher.BlockSize())
+	for i := range key {
+		key[i] = SampleZqx(rand.Reader, plainModulus)
 	}
 	return key
 }
 func (client *client) generateCoeffsFromData(data [][]float64) [][]float64 {
-	coeffs := make([][]float64, 16)
-	for s := 0; s < 16; s++ {
+	coeffs := make([][]float64, len(data))
+	for s := 0; s < len(data); s++ {
 		coeffs[s] = make([]float64, client.shared.GetParams().N())
 	}
 
-	for s := 0; s < 16; s++ {
-		for i := 0; i < client.shared.GetMessagesSize()/2; i++ {
-			j := utils.BitReverse64(uint64(i), uint64(client.shared.GetParams().logN-1))
-			coeffs[s][j] = data[s][i]
-			coeffs[s][j+uint64(client.shared.GetParams().N()/2)] = data[s][i+client.shared.GetMessagesSize()/2]
+	for s := 0; s < len(data); s++ {
+		for i := 0; i < client.shared.GetMessagesSize(); i++ {
+			coeffs[s][messageCoefficient(client.shared.GetParams().LogN(), client.shared.GetMessagesSize(), i)] = data[s][i]
 		}
 	}
 	return coeffs
 }
 
+// messageCoefficient returns the coefficient of message element i, the half-bootstrapping brings it back to slot i
+// (to slot i - messageSize/2 of the second ciphertext with full coefficients). The halves of the message are
+// bit-reversed into the halves of the coefficients.
+func messageCoefficient(logN int, messageSize int, i int) int {
+	half := messageSize / 2
+	if i < half {
+		return int(utils.BitReverse64(uint64(i), uint64(logN-1)))
+	}
+	return int(utils.BitReverse64(uint64(i-half), uint64(logN-1))) + 1<<(logN-1)
+}
+
 func (client *client) encCoeffsKeystreamToCkksPtRing(coeffs [][]float64, keystream [][]uint64) []*PlaintextRingT {
 	var plainCKKSRingTs []*PlaintextRingT
 	//var ckksEncoder CKKSEncoder
 
-	plainCKKSRingTs = make([]*PlaintextRingT, 16)
+	plainCKKSRingTs = make([]*PlaintextRingT, len(coeffs))
 
-	for s := 0; s < 16; s++ {
+	for s := 0; s < len(coeffs); s++ {
 		plainCKKSRingTs[s] = client.ckksEncoder.EncodeCoeffsRingTNew(coeffs[s], client.shared.GetMessageScaling())
 		poly := plainCKKSRingTs[s].Value()[0]
 		for i := 0; i < client.shared.GetMessagesSize(); i++ {
@@ -86,8 +99,16 @@ func (client *client) encCoeffsKeystreamToCkksPtRing(coeffs [][]float64, keystre
 	return plainCKKSRingTs
 }
 
-func (client *client) encryptPlain(message [][]float64, key []uint64) []*PlaintextRingT {
-	keystream := client.generateKeyStreamFromNoncesAndKey(client.shared.GetNumRounds(), client.shared.GetNonces(), key, client.shared.GetParams().plainModulus)
+// encryptPlain encrypts the message with the next nonces of the session, which have to be sent with it
+func (client *client) encryptPlain(message [][]float64, key []uint64) ([]*PlaintextRingT, *NonceSet) {
+	nonces := client.nonces.Next()
+	return client.encryptPlainWithNonces(message, key, nonces.Nonces, nonces.Counter), nonces
+}
+
+func (client *client) encryptPlainWithNonces(message [][]float64, key []uint64, nonces [][]byte, counter []byte) []*PlaintextRingT {
+	timer := startStage(client.log(client.shared), StageSymEncrypt)
+	defer timer.done(nil)
+	keystream := client.generateKeyStreamFromNoncesAndKey(nonces, counter, key)
 	coeffs := client.generateCoeffsFromData(message)
 	plainCKKSRingTs := client.encCoeffsKeystreamToCkksPtRing(coeffs, keystream)
 	return plainCKKSRingTs
@@ -97,8 +118,8 @@ func (client *client) encCoeffsHeraCt(coeffs [][]float64, keystream []*Ciphertex
 	var plainCKKSRingTs []*PlaintextRingT
 	//var ckksEncoder CKKSEncoder
 
-	plainCKKSRingTs = make([]*PlaintextRingT, 16)
-	for s := 0; s < 16; s++ {
+	plainCKKSRingTs = make([]*PlaintextRingT, len(coeffs))
+	for s := 0; s < len(coeffs); s++ {
 		plainCKKSRingTs[s] = client.ckksEncoder.EncodeCoeffsRingTNew(coeffs[s], client.shared.GetMessageScaling())
 		poly := plainCKKSRingTs[s].Value()[0]
 		for i := 0; i < client.shared.GetMessagesSize(); i++ {
@@ -110,20 +131,41 @@ func (client *client) encCoeffsHeraCt(coeffs [][]float64, keystream []*Ciphertex
 	return plainCKKSRingTs
 }
 
-func (client *client) EncryptMessage(message [][]float64, key []uint64) ([]*PlaintextRingT, []*Ciphertext) {
-	//call reset before encrypting a second message
-	//if !client.needReset {
-	//	client.hera.Reset(client.shared.HeraModDown()[0])
-	//}
-	encKey := client.hera.EncKey(key)
-	client.needReset = true
-	fmt.Printf("Key plain: %v \nKey HeraEnc: %v\n", key, encKey)
-	return client.encryptPlain(message, key), encKey
+// encKey encrypts the symmetric key under FV
+func (client *client) encKey(key []uint64) []*Ciphertext {
+	timer := startStage(client.log(client.shared), StageKeyEncrypt)
+	encKey := client.cipher.EncKey(key)
+	timer.done(encKey[0])
+	return encKey
+}
+
+// EncryptKey encrypts the symmetric key under FV, the encrypted key can be registered once and used for many messages
+// encrypted with EncryptMultipleTemplatesSymmetric
+func (client *client) EncryptKey(key []uint64) []*Ciphertext {
+	encKey := client.encKey(key)
+	client.logKeyEncrypted(encKey)
+	return encKey
+}
+
+// logKeyEncrypted logs the encryption of the symmetric key, without the key
+func (client *client) logKeyEncrypted(encKey []*Ciphertext) {
+	level := -1
+	if len(encKey) > 0 {
+		level = encKey[0].Level()
+	}
+	logMessage(client.log(client.shared), LogDebug, "symmetric key encrypted", Field{"elements", len(encKey)}, Field{"level", level})
+}
+
+// EncryptMessage encrypts the message with the next nonces of the session and the key under FV
+func (client *client) EncryptMessage(message [][]float64, key []uint64) ([]*PlaintextRingT, []*Ciphertext, *NonceSet) {
+	encKey := client.EncryptKey(key)
+	symCiphertexts, nonces := client.encryptPlain(message, key)
+	return symCiphertexts, encKey, nonces
 }
 
 func (client *client) TemplateToData(template []float64, rows int, columns int) [][]float64 {
-	data := make([][]float64, 16)
-	for s := 0; s < 16; s++ {
+	data := make([][]float64, client.shared.GetOutputSize())
+	for s := 0; s < client.shared.GetOutputSize(); s++ {
 		data[s] = make([]float64, client.shared.GetMessagesSize())
 		for i := 0; i < client.shared.GetMessagesSize(); i++ {
 			if s >= rows || i >= columns {
@@ -151,48 +193,37 @@ func (client *client) TemplateToData(template []float64, rows int, columns int)
 	return data
 }
 
-func (client *client) EncryptTemplate(template Template, key []uint64) ([]*PlaintextRingT, []*Ciphertext) {
+func (client *client) EncryptTemplate(template Template, key []uint64) ([]*PlaintextRingT, []*Ciphertext, *NonceSet) {
 	templen := 16
 	if client.shared.GetFullCoeffs() {
-		templen = len(template.GetData())
+		templen = len(template.GetMessage())
 	}
-	data := client.TemplateToData(template.GetData(), 16, templen)
+	data := client.TemplateToData(template.GetMessage(), client.shared.GetOutputSize(), templen)
 	//println("template Converted: ", data)
-	encKey := client.hera.EncKey(key)
-	client.needReset = true
-	fmt.Printf("Key plain: %v \nKey HeraEnc: %v\n", key, encKey)
-	return client.encryptPlain(data, key), encKey
+	return client.EncryptMessage(data, key)
 }
 
-func (client *client) EncryptTemplatRowsColumns(template Template, key []uint64, rows int, columns int) ([]*PlaintextRingT, []*Ciphertext) {
-	data := client.TemplateToData(template.GetData(), rows, columns)
+func (client *client) EncryptTemplatRowsColumns(template Template, key []uint64, rows int, columns int) ([]*PlaintextRingT, []*Ciphertext, *NonceSet) {
+	data := client.TemplateToData(template.GetMessage(), rows, columns)
 	//println("template Converted: ", data)
-	encKey := client.hera.EncKey(key)
-	client.needReset = true
-	fmt.Printf("Key plain: %v \nKey HeraEnc: %v\n", key, encKey)
-	return client.encryptPlain(data, key), encKey
+	return client.EncryptMessage(data, key)
 }
 
-func (client *client) EncryptMultipleTemplates(templates []Template, key []uint64, rows int, columns int) ([]*PlaintextRingT, []*Ciphertext) {
-	data := client.TemplateToData(ConnectTemplates(templates), rows, columns)
-	//println("template Converted: ", data)
-	encKey := client.hera.EncKey(key)
-	client.needReset = true
-	fmt.Printf("Key plain: %v \nKey HeraEnc: %v\n", key, encKey)
-	return client.encryptPlain(data, key), encKey
+// EncryptMultipleTemplatesWithNonces encrypts the connected templates and the key with the next nonces of the
+// session of the client. The nonces have to be sent with the ciphertext.
+func (client *client) EncryptMultipleTemplatesWithNonces(templates []Template, key []uint64, rows int, columns int) ([]*PlaintextRingT, []*Ciphertext, *NonceSet) {
+	encKey := client.EncryptKey(key)
+	symCiphertexts, nonces := client.EncryptMultipleTemplatesSymmetric(templates, key, rows, columns)
+	return symCiphertexts, encKey, nonces
 }
 
-//sym, encKey, symTime, heTime
-func (client *client) EncryptMultipleTemplatesTiming(templates []Template, key []uint64, rows int, columns int) ([]*PlaintextRingT, []*Ciphertext, float64, float64) {
-	data := client.TemplateToData(ConnectTemplates(templates), rows, columns)
-	//println("template Converted: ", data)
-	start := time.Now()
-	encKey := client.hera.EncKey(key)
-	heTime := time.Since(start).Seconds()
-	start = time.Now()
-	sym := client.encryptPlain(data, key)
-	symTime := time.Since(start).Seconds()
-	client.needReset = true
-	//fmt.Printf("Key plain: %v \nKey HeraEnc: %v\n", key, encKey)
-	return sym, encKey, symTime, heTime
+// EncryptMultipleTemplatesSymmetric encrypts the templates with the next nonces of the session without encrypting the
+// key, for a key whose encryption the computation server already holds
+func (client *client) EncryptMultipleTemplatesSymmetric(templates []Template, key []uint64, rows int, columns int) ([]*PlaintextRingT, *NonceSet) {
+	return client.encryptPlain(client.TemplateToData(ConnectTemplates(templates), rows, columns), key)
+}
+
+// SetNonceManager replaces the session of the client, e.g. to resume a session after its last sequence number
+func (client *client) SetNonceManager(manager NonceManager) {
+	client.nonces = manager
 }
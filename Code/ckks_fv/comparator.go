@@ -0,0 +1,87 @@
+package ckks_fv
+
+import (
+	"math"
+)
+
+// InverseSqrtApproximation configures the approximation of 1/sqrt(x) for x in [Min, Max], which normalizes
+// the inner product of templates to their cosine similarity under encryption.
+// A Chebyshev interpolation gives the initial guess, every Newton iteration y = y*(3 - x*y^2)/2 refines it.
+// Besides the interpolation, the norms and the division take several levels and each iteration 4 more,
+// with few levels left after transciphering templates normalized by the client are preferable.
+type InverseSqrtApproximation struct {
+	Min         float64
+	Max         float64
+	ChebyDegree int
+	Iterations  int
+}
+
+// NewInverseSqrtApproximation returns the default InverseSqrtApproximation for products of squared norms in [min, max]
+func NewInverseSqrtApproximation(min float64, max float64) *InverseSqrtApproximation {
+	return &InverseSqrtApproximation{
+		Min:         min,
+		Max:         max,
+		ChebyDegree: 7,
+		Iterations:  0,
+	}
+}
+
+func (approx *InverseSqrtApproximation) chebyshev() *ChebyshevInterpolation {
+	return Approximate(func(x complex128) complex128 {
+		return complex(1/math.Sqrt(real(x)), 0)
+	}, complex(approx.Min, 0), complex(approx.Max, 0), approx.ChebyDegree)
+}
+
+// InverseApproximation configures the approximation of 1/x for x in [Min, Max], which divides the masked
+// Hamming distance of binary templates by the number of valid bits under encryption.
+// A Chebyshev interpolation gives the initial guess, every Newton iteration y = y*(2 - x*y) refines it.
+type InverseApproximation struct {
+	Min         float64
+	Max         float64
+	ChebyDegree int
+	Iterations  int
+}
+
+// NewInverseApproximation returns the default InverseApproximation for numbers of valid bits in [min, max]
+func NewInverseApproximation(min float64, max float64) *InverseApproximation {
+	return &InverseApproximation{
+		Min:         min,
+		Max:         max,
+		ChebyDegree: 15,
+		Iterations:  2,
+	}
+}
+
+func (approx *InverseApproximation) chebyshev() *ChebyshevInterpolation {
+	return Approximate(func(x complex128) complex128 {
+		return complex(1/real(x), 0)
+	}, complex(approx.Min, 0), complex(approx.Max, 0), approx.ChebyDegree)
+}
+
+// MaskedHammingOptions configure the fractional Hamming distance of binary templates with occlusion masks.
+// The probe is barrel shifted by every entry of Shifts, the number of disagreeing valid bits is divided by
+// the number of valid bits using Inverse and the minimum over the shifts is selected with Comparison.
+// Without Inverse the score is the number of disagreeing valid bits without shifts.
+type MaskedHammingOptions struct {
+	Shifts     []int
+	Inverse    *InverseApproximation
+	Comparison SignApproximation
+}
+
+// NewMaskedHammingOptions returns MaskedHammingOptions for templates of the given length with at least
+// minValidBits valid bits in common
+func NewMaskedHammingOptions(templateLength int, minValidBits float64, shifts []int) *MaskedHammingOptions {
+	return &MaskedHammingOptions{
+		Shifts:     shifts,
+		Inverse:    NewInverseApproximation(minValidBits, float64(templateLength)),
+		Comparison: NewSignApproximation(),
+	}
+}
+
+// shifts returns the barrel shifts to evaluate, at least the unshifted probe
+func (options *MaskedHammingOptions) shifts() []int {
+	if options == nil || options.Inverse == nil || len(options.Shifts) == 0 {
+		return []int{0}
+	}
+	return options.Shifts
+}
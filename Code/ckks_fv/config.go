@@ -0,0 +1,349 @@
+package ckks_fv
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/ldsec/lattigo/v2/utils"
+	"gopkg.in/yaml.v3"
+)
+
+// Config describes an MT-Pro deployment: the RtF parameter set, the slot mode, the modalities in the order of the
+// message and the thresholds. It is read from YAML or JSON, e.g.
+//
+//	parameters: HERA-80f
+//	slots: full
+//	modalities:
+//	  - {name: iris, template_length: 512, comparator: euclidean}
+//	  - {name: finger, template_length: 256, comparator: euclidean, weight: 2, half: true}
+//	threshold: {distance: 0.5, max_distance: 4, identification: true}
+type Config struct {
+	// Parameters names the parameter set, HERA-<80|128><f|s|af|as> or Rubato-<80|128><S|M|L>
+	Parameters string `yaml:"parameters"`
+	// Cipher optionally repeats the cipher of Parameters, hera or rubato
+	Cipher string `yaml:"cipher"`
+	// Radix of the SlotsToCoeffs factorization, the radix of the mod down parameters of the set if omitted
+	Radix *int `yaml:"radix"`
+	// Slots is full to encode the message in all coefficients or slots to use the CKKS slots only
+	Slots      string            `yaml:"slots"`
+	Modalities []*ModalityConfig `yaml:"modalities"`
+	Threshold  ThresholdConfig   `yaml:"threshold"`
+}
+
+// ModalityConfig describes one template of the message. Comparator is one of euclidean, hamming, inner_product,
+// cosine and masked_hamming, Half reads only the first half of the template files of this modality.
+type ModalityConfig struct {
+	Name           string   `yaml:"name"`
+	TemplateLength int      `yaml:"template_length"`
+	Binary         bool     `yaml:"binary"`
+	Comparator     string   `yaml:"comparator"`
+	Weight         *float64 `yaml:"weight"`
+	Offset         float64  `yaml:"offset"`
+	Scale          *float64 `yaml:"scale"`
+	Half           bool     `yaml:"half"`
+	// InverseSqrt normalizes cosine similarities under encryption, without it the client normalizes the templates
+	InverseSqrt *RangeConfig `yaml:"inverse_sqrt"`
+	// MinValidBits and Shifts configure the fractional distance of masked_hamming
+	MinValidBits float64 `yaml:"min_valid_bits"`
+	Shifts       []int   `yaml:"shifts"`
+}
+
+// RangeConfig is the input range of an approximation
+type RangeConfig struct {
+	Min float64 `yaml:"min"`
+	Max float64 `yaml:"max"`
+}
+
+// ThresholdConfig sets the threshold of the fused distance, which is bounded by MaxDistance
+type ThresholdConfig struct {
+	Distance       float64 `yaml:"distance"`
+	MaxDistance    float64 `yaml:"max_distance"`
+	Identification bool    `yaml:"identification"`
+}
+
+// parameterSet is a named combination of cipher, parameter index, rounds and default radix
+type parameterSet struct {
+	cipher     int
+	paramIndex int
+	numRound   int
+	radix      int
+}
+
+// parameterSets maps the names of the parameter sets to InitWithCipher arguments, the default radix is the one
+// the mod down parameters were optimized for
+var parameterSets = map[string]parameterSet{
+	"HERA-80f":    {HERA, 0, 4, 2},
+	"HERA-80s":    {HERA, 1, 4, 0},
+	"HERA-80af":   {HERA, 2, 4, 2},
+	"HERA-80as":   {HERA, 3, 4, 0},
+	"HERA-128f":   {HERA, 0, 5, 2},
+	"HERA-128s":   {HERA, 1, 5, 0},
+	"HERA-128af":  {HERA, 2, 5, 2},
+	"HERA-128as":  {HERA, 3, 5, 2},
+	"Rubato-80S":  {RUBATO, RUBATO80S, 0, 2},
+	"Rubato-80M":  {RUBATO, RUBATO80M, 0, 2},
+	"Rubato-80L":  {RUBATO, RUBATO80L, 0, 2},
+	"Rubato-128S": {RUBATO, RUBATO128S, 0, 2},
+	"Rubato-128M": {RUBATO, RUBATO128M, 0, 2},
+	"Rubato-128L": {RUBATO, RUBATO128L, 0, 2},
+}
+
+var comparators = map[string]int{
+	"euclidean":      EUCLIDEAN,
+	"hamming":        HAMMING,
+	"inner_product":  INNER_PRODUCT,
+	"cosine":         COSINE,
+	"masked_hamming": MASKED_HAMMING,
+}
+
+var cipherNames = map[string]int{
+	"hera":   HERA,
+	"rubato": RUBATO,
+}
+
+// DefaultConfig returns the configuration of the iris and finger evaluation with HERA-80f
+func DefaultConfig() *Config {
+	radix := 2
+	weight := 2.0
+	return &Config{
+		Parameters: "HERA-80f",
+		Cipher:     "hera",
+		Radix:      &radix,
+		Slots:      "full",
+		Modalities: []*ModalityConfig{
+			{Name: "iris", TemplateLength: 512, Comparator: "euclidean"},
+			{Name: "finger", TemplateLength: 256, Comparator: "euclidean", Weight: &weight, Half: true},
+		},
+		Threshold: ThresholdConfig{Distance: 0.5, MaxDistance: 4, Identification: true},
+	}
+}
+
+// LoadConfig reads and validates a configuration file, JSON is read as YAML.
+// Unknown fields and invalid values return an error matching ErrInvalidConfig.
+func LoadConfig(path string) (*Config, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fileError("read", path, err)
+	}
+	config := new(Config)
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err = decoder.Decode(config); err != nil {
+		return nil, fmt.Errorf("%w: %s: %v", ErrInvalidConfig, path, err)
+	}
+	if err = config.Validate(); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return config, nil
+}
+
+func configError(format string, a ...interface{}) error {
+	return fmt.Errorf("%w: %s", ErrInvalidConfig, fmt.Sprintf(format, a...))
+}
+
+// Validate checks the configuration without generating parameters, the total message length is checked by Shared
+func (config *Config) Validate() error {
+	set, ok := parameterSets[config.Parameters]
+	if !ok {
+		return configError("unknown parameter set %q", config.Parameters)
+	}
+	if config.Cipher != "" {
+		cipher, ok := cipherNames[strings.ToLower(config.Cipher)]
+		if !ok {
+			return configError("unknown cipher %q", config.Cipher)
+		}
+		if cipher != set.cipher {
+			return configError("cipher %s does not match parameter set %s", config.Cipher, config.Parameters)
+		}
+	}
+	if config.Radix != nil && (*config.Radix < 0 || *config.Radix > 2 || set.cipher == RUBATO && *config.Radix == 0) {
+		return configError("no mod down parameters of %s for radix %d", config.Parameters, *config.Radix)
+	}
+	switch config.Slots {
+	case "", "full":
+	case "slots":
+		if set.cipher == RUBATO {
+			return configError("Rubato is only available with full coefficients")
+		}
+	default:
+		return configError("slot mode %q is neither full nor slots", config.Slots)
+	}
+	if len(config.Modalities) == 0 {
+		return configError("no modalities")
+	}
+	names := make(map[string]bool)
+	for i, m := range config.Modalities {
+		if m.Name == "" || names[m.Name] {
+			return configError("modality %d without name or with duplicate name %q", i, m.Name)
+		}
+		names[m.Name] = true
+		if err := m.validate(); err != nil {
+			return err
+		}
+	}
+	t := config.Threshold
+	if t.MaxDistance <= 0 || t.Distance <= 0 || t.Distance >= t.MaxDistance {
+		return configError("threshold %v is not in (0, max_distance %v)", t.Distance, t.MaxDistance)
+	}
+	return nil
+}
+
+func (m *ModalityConfig) validate() error {
+	if m.TemplateLength <= 0 {
+		return configError("modality %s: template length %d", m.Name, m.TemplateLength)
+	}
+	comparator, ok := comparators[strings.ToLower(m.Comparator)]
+	if m.Comparator != "" && !ok {
+		return configError("modality %s: unknown comparator %q", m.Name, m.Comparator)
+	}
+	if (comparator == HAMMING || comparator == MASKED_HAMMING) && !m.Binary {
+		return configError("modality %s: %s compares binary templates", m.Name, m.Comparator)
+	}
+	if m.InverseSqrt != nil && (comparator != COSINE || m.InverseSqrt.Min <= 0 || m.InverseSqrt.Min >= m.InverseSqrt.Max) {
+		return configError("modality %s: inverse_sqrt needs the cosine comparator and 0 < min < max", m.Name)
+	}
+	if comparator == MASKED_HAMMING && (m.MinValidBits <= 0 || m.MinValidBits > float64(m.TemplateLength)) {
+		return configError("modality %s: min_valid_bits %v is not in (0, %d]", m.Name, m.MinValidBits, m.TemplateLength)
+	}
+	if comparator != MASKED_HAMMING && (m.MinValidBits != 0 || len(m.Shifts) != 0) {
+		return configError("modality %s: min_valid_bits and shifts need the masked_hamming comparator", m.Name)
+	}
+	return nil
+}
+
+// comparator returns the comparator of the modality, binary templates default to HAMMING and all others to EUCLIDEAN
+func (m *ModalityConfig) comparator() int {
+	if m.Comparator == "" {
+		if m.Binary {
+			return HAMMING
+		}
+		return EUCLIDEAN
+	}
+	return comparators[strings.ToLower(m.Comparator)]
+}
+
+// ReadTemplate reads a template file of the modality with NewTemplate
+func (m *ModalityConfig) ReadTemplate(path string) (Template, error) {
+	if m.Half {
+		return NewTemplate(path, true)
+	}
+	return NewTemplate(path)
+}
+
+// SharedParameters returns the arguments of InitWithCipher
+func (config *Config) SharedParameters() (cipher int, numRound int, paramIndex int, radix int, fullCoeffs bool) {
+	set := parameterSets[config.Parameters]
+	radix = set.radix
+	if config.Radix != nil {
+		radix = *config.Radix
+	}
+	return set.cipher, set.numRound, set.paramIndex, radix, config.Slots != "slots"
+}
+
+// Shared sets up the shared parameters of the configuration and checks that the modalities fit into a message
+func (config *Config) Shared() (Shared, error) {
+	shared, err := InitWithCipher(config.SharedParameters())
+	if err != nil {
+		return nil, err
+	}
+	shared.SetTemplateLengths(config.TemplateLengths())
+	if err = config.CheckShared(shared); err != nil {
+		return nil, err
+	}
+	return shared, nil
+}
+
+// CheckShared checks that shared parameters, e.g. restored from a context or bundle, were set up from this
+// configuration, that the modalities fit into a message and that the rotation keys, if set, sum the templates
+func (config *Config) CheckShared(shared Shared) error {
+	cipher, numRound, paramIndex, radix, fullCoeffs := config.SharedParameters()
+	if shared.GetCipher() != cipher || shared.GetParamIndex() != paramIndex || shared.GetRadix() != radix ||
+		shared.GetFullCoeffs() != fullCoeffs || cipher == HERA && shared.GetNumRounds() != numRound {
+		return fmt.Errorf("%w: shared parameters are not %s", ErrParameterMismatch, config.Parameters)
+	}
+	length := 0
+	for _, ins := range config.Instructions() {
+		length += ins.MessageLength()
+	}
+	if length > shared.GetMessagesSize() {
+		return configError("modalities take %d message elements but %s holds %d", length, config.Parameters, shared.GetMessagesSize())
+	}
+	if rotKeys := shared.GetRotationKeys(); rotKeys != nil {
+		rotations := templateSumRotations(NewKeyGenerator(shared.GetParams()), config.TemplateLengths())
+		if err := checkRotationKeys(shared.GetParams(), rotKeys, rotations); err != nil {
+			return fmt.Errorf("%w: the keys of %s do not sum the templates: %v", ErrParameterMismatch, config.Parameters, err)
+		}
+	}
+	return nil
+}
+
+// TemplateLengths returns the lengths summed by the comparisons of the modalities. A masked template takes twice
+// its length in the message but only its bits are summed, the mask is moved onto them first.
+func (config *Config) TemplateLengths() []int {
+	lengths := []int{}
+	for _, m := range config.Modalities {
+		if !utils.IsInSliceInt(m.TemplateLength, lengths) {
+			lengths = append(lengths, m.TemplateLength)
+		}
+	}
+	return lengths
+}
+
+// Instructions returns the template instructions of the modalities, placed one after another in the message
+func (config *Config) Instructions() []*TemplateInstruction {
+	instructions := make([]*TemplateInstruction, len(config.Modalities))
+	index := 0
+	for i, m := range config.Modalities {
+		ins := NewTemplateInstruction(index, m.TemplateLength, m.Binary)
+		switch comparator := m.comparator(); comparator {
+		case MASKED_HAMMING:
+			ins.SetMaskedHamming(NewMaskedHammingOptions(m.TemplateLength, m.MinValidBits, m.Shifts))
+		case COSINE:
+			var inverseSqrt *InverseSqrtApproximation
+			if m.InverseSqrt != nil {
+				inverseSqrt = NewInverseSqrtApproximation(m.InverseSqrt.Min, m.InverseSqrt.Max)
+			}
+			ins.SetComparator(comparator, inverseSqrt)
+		default:
+			ins.SetComparator(comparator, nil)
+		}
+		scale := 1.0
+		if m.Scale != nil {
+			scale = *m.Scale
+		}
+		ins.SetNormalization(m.Offset, scale)
+		if m.Weight != nil {
+			ins.SetWeight(*m.Weight)
+		}
+		instructions[i] = ins
+		index += ins.MessageLength()
+	}
+	return instructions
+}
+
+// ModalityNames returns the names of the modalities in the order of the message
+func (config *Config) ModalityNames() []string {
+	names := make([]string, len(config.Modalities))
+	for i, m := range config.Modalities {
+		names[i] = m.Name
+	}
+	return names
+}
+
+// ThresholdParameters returns the threshold of the verification
+func (config *Config) ThresholdParameters() *ThresholdParameters {
+	return NewThresholdParameters(config.Threshold.Distance, config.Threshold.MaxDistance)
+}
+
+// ArgminParameters returns the parameters of the identification with the threshold of the verification,
+// nil if identification is disabled
+func (config *Config) ArgminParameters() *ArgminParameters {
+	if !config.Threshold.Identification {
+		return nil
+	}
+	argminParams := NewArgminParameters(config.Threshold.MaxDistance)
+	argminParams.Threshold = config.ThresholdParameters()
+	return argminParams
+}
@@ -0,0 +1,112 @@
+package ckks_fv
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func writeConfig(t *testing.T, dir string, name string, content string) string {
+	p := path.Join(dir, name)
+	if err := ioutil.WriteFile(p, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+// TestLoadConfig reads the same configuration from YAML and JSON and rejects invalid ones
+func TestLoadConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	yamlPath := writeConfig(t, dir, "config.yaml", `
+parameters: HERA-80af
+slots: full
+modalities:
+  - {name: iris, template_length: 512, binary: true, comparator: masked_hamming, min_valid_bits: 100, shifts: [-1, 0, 1]}
+  - {name: finger, template_length: 256, comparator: euclidean, weight: 2, half: true}
+threshold: {distance: 0.5, max_distance: 4}
+`)
+	jsonPath := writeConfig(t, dir, "config.json", `{
+	"parameters": "HERA-80af",
+	"slots": "full",
+	"modalities": [
+		{"name": "iris", "template_length": 512, "binary": true, "comparator": "masked_hamming", "min_valid_bits": 100, "shifts": [-1, 0, 1]},
+		{"name": "finger", "template_length": 256, "comparator": "euclidean", "weight": 2, "half": true}
+	],
+	"threshold": {"distance": 0.5, "max_distance": 4}
+}`)
+	for _, p := range []string{yamlPath, jsonPath} {
+		config, err := LoadConfig(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cipher, numRound, paramIndex, radix, fullCoeffs := config.SharedParameters()
+		if cipher != HERA || numRound != 4 || paramIndex != 2 || radix != 2 || !fullCoeffs {
+			t.Errorf("%s: parameters %v %v %v %v %v", p, cipher, numRound, paramIndex, radix, fullCoeffs)
+		}
+		ins := config.Instructions()
+		if ins[0].Comparator != MASKED_HAMMING || ins[0].MessageLength() != 1024 {
+			t.Errorf("%s: iris instruction %+v", p, ins[0])
+		}
+		if ins[1].Index != 1024 || ins[1].Weight != 2 || ins[1].Scale != 1 {
+			t.Errorf("%s: finger instruction %+v", p, ins[1])
+		}
+		if config.ArgminParameters() != nil {
+			t.Errorf("%s: identification is not enabled", p)
+		}
+	}
+
+	for name, content := range map[string]string{
+		"unknown_set.yaml":   "parameters: HERA-64\nmodalities: [{name: a, template_length: 8}]\nthreshold: {distance: 1, max_distance: 2}\n",
+		"rubato_slots.yaml":  "parameters: Rubato-80S\nslots: slots\nmodalities: [{name: a, template_length: 8}]\nthreshold: {distance: 1, max_distance: 2}\n",
+		"hamming.yaml":       "parameters: HERA-80f\nmodalities: [{name: a, template_length: 8, comparator: hamming}]\nthreshold: {distance: 1, max_distance: 2}\n",
+		"threshold.yaml":     "parameters: HERA-80f\nmodalities: [{name: a, template_length: 8}]\nthreshold: {distance: 3, max_distance: 2}\n",
+		"unknown_field.yaml": "parameters: HERA-80f\nrounds: 4\nmodalities: [{name: a, template_length: 8}]\nthreshold: {distance: 1, max_distance: 2}\n",
+	} {
+		if _, err := LoadConfig(writeConfig(t, dir, name, content)); !errors.Is(err, ErrInvalidConfig) {
+			t.Errorf("%s: got %v, want ErrInvalidConfig", name, err)
+		}
+	}
+}
+
+// TestConfigTemplateLengths checks that the InnerSum rotations follow the configured template lengths and that
+// CheckShared refuses rotation keys which do not sum them
+func TestConfigTemplateLengths(t *testing.T) {
+	config := DefaultConfig()
+	config.Modalities = []*ModalityConfig{
+		{Name: "face", TemplateLength: 300},
+		{Name: "iris", TemplateLength: 200, Binary: true, Comparator: "masked_hamming", MinValidBits: 10},
+	}
+	if err := config.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	lengths := config.TemplateLengths()
+	if len(lengths) != 2 || lengths[0] != 300 || lengths[1] != 200 {
+		t.Fatalf("template lengths %v", lengths)
+	}
+
+	params, err := NewParametersFromLogModuli(10, &LogModuli{LogQi: []int{50, 40}, LogPi: []int{50}}, 65537)
+	if err != nil {
+		t.Fatal(err)
+	}
+	params.SetLogSlots(9)
+	cipher, numRound, paramIndex, radix, fullCoeffs := config.SharedParameters()
+	shared := &Ishared{Params: params, Cipher: cipher, NumRound: numRound, ParamIndex: paramIndex, radix: radix, FullCoeffs: fullCoeffs, MessageSize: 1 << 15}
+	kgen := NewKeyGenerator(params)
+	sk := kgen.GenSecretKey()
+
+	shared.SetRotationKeyset(kgen.GenRotationKeysForRotations(templateSumRotations(kgen, TemplateLengths), false, sk))
+	if err = config.CheckShared(shared); !errors.Is(err, ErrParameterMismatch) {
+		t.Errorf("keys of the predefined lengths: got %v, want ErrParameterMismatch", err)
+	}
+	shared.SetRotationKeyset(kgen.GenRotationKeysForRotations(templateSumRotations(kgen, lengths), false, sk))
+	if err = config.CheckShared(shared); err != nil {
+		t.Errorf("keys of the configured lengths: %v", err)
+	}
+}
@@ -0,0 +1,72 @@
+package ckks_fv
+
+import (
+	"errors"
+	"fmt"
+	"os"
+)
+
+// Errors of the MT-Pro layer, the returned errors wrap them and can be matched with errors.Is
+var (
+	ErrMissingFile        = errors.New("missing file")
+	ErrParameterMismatch  = errors.New("parameter mismatch")
+	ErrContextMismatch    = errors.New("context mismatch")
+	ErrInsufficientLevels = errors.New("insufficient levels")
+	ErrMissingRotationKey = errors.New("missing rotation key")
+	ErrInvalidConfig      = errors.New("invalid configuration")
+)
+
+// FileError reports a failed operation on a file, it matches ErrMissingFile if the file does not exist
+type FileError struct {
+	Op   string
+	Path string
+	Err  error
+}
+
+func (e *FileError) Error() string {
+	return fmt.Sprintf("%s %s: %v", e.Op, e.Path, e.Err)
+}
+
+func (e *FileError) Unwrap() error {
+	return e.Err
+}
+
+func (e *FileError) Is(target error) bool {
+	return target == ErrMissingFile && os.IsNotExist(e.Err)
+}
+
+// fileError wraps err of the operation op on path into a FileError, nil stays nil
+func fileError(op string, path string, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &FileError{Op: op, Path: path, Err: err}
+}
+
+// LevelError reports a ciphertext with fewer levels than an operation consumes, it matches ErrInsufficientLevels
+type LevelError struct {
+	Op        string
+	Needed    int
+	Available int
+}
+
+func (e *LevelError) Error() string {
+	return fmt.Sprintf("%s: %d levels needed but only %d available", e.Op, e.Needed, e.Available)
+}
+
+func (e *LevelError) Is(target error) bool {
+	return target == ErrInsufficientLevels
+}
+
+// RotationKeyError reports rotations without a key, it matches ErrMissingRotationKey
+type RotationKeyError struct {
+	Rotations []int
+}
+
+func (e *RotationKeyError) Error() string {
+	return fmt.Sprintf("rotation key(s) missing: %v", e.Rotations)
+}
+
+func (e *RotationKeyError) Is(target error) bool {
+	return target == ErrMissingRotationKey
+}
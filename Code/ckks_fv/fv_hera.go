@@ -13,6 +13,7 @@ type MFVHera interface {
 	CryptAutoModSwitch(nonce [][]byte, kCt []*Ciphertext, noiseEstimator MFVNoiseEstimator) (res []*Ciphertext, heraModDown []int)
 	Reset(nbInitModDown int)
 	EncKey(key []uint64) (res []*Ciphertext)
+	SetEvaluators(evaluators []MFVEvaluator)
 }
 
 type mfvHera struct {
@@ -24,7 +25,10 @@ type mfvHera struct {
 	encoder   MFVEncoder
 	encryptor MFVEncryptor
 	evaluator MFVEvaluator
+	// Evaluators of the goroutines evaluating the state words, evaluators[0] is evaluator
+	evaluators []MFVEvaluator
 
+	icCt []*Ciphertext // Initial states at the starting level, copied into stCt for each keystream
 	stCt []*Ciphertext
 	mkCt []*Ciphertext
 	rkCt []*Ciphertext   // Buffer for round key
@@ -44,7 +48,9 @@ func NewMFVHera(numRound int, params *Parameters, encoder MFVEncoder, encryptor
 	hera.encoder = encoder
 	hera.encryptor = encryptor
 	hera.evaluator = evaluator
+	hera.evaluators = []MFVEvaluator{evaluator}
 
+	hera.icCt = make([]*Ciphertext, 16)
 	hera.stCt = make([]*Ciphertext, 16)
 	hera.mkCt = make([]*Ciphertext, 16)
 	hera.rkCt = make([]*Ciphertext, 16)
@@ -69,9 +75,9 @@ func NewMFVHera(numRound int, params *Parameters, encoder MFVEncoder, encryptor
 		icPT := NewPlaintextFV(params)
 		encoder.EncodeUintSmall(state, icPT)
 		encryptor.EncryptNew(icPT)
-		hera.stCt[i] = encryptor.EncryptNew(icPT)
+		hera.icCt[i] = encryptor.EncryptNew(icPT)
 		if nbInitModDown > 0 {
-			evaluator.ModSwitchMany(hera.stCt[i], hera.stCt[i], nbInitModDown)
+			evaluator.ModSwitchMany(hera.icCt[i], hera.icCt[i], nbInitModDown)
 		}
 	}
 	return hera
@@ -89,15 +95,35 @@ func (hera *mfvHera) Reset(nbInitModDown int) {
 		icPT := NewPlaintextFV(hera.params)
 		hera.encoder.EncodeUintSmall(state, icPT)
 		hera.encryptor.EncryptNew(icPT)
-		hera.stCt[i] = hera.encryptor.EncryptNew(icPT)
+		hera.icCt[i] = hera.encryptor.EncryptNew(icPT)
 		if nbInitModDown > 0 {
-			hera.evaluator.ModSwitchMany(hera.stCt[i], hera.stCt[i], nbInitModDown)
+			hera.evaluator.ModSwitchMany(hera.icCt[i], hera.icCt[i], nbInitModDown)
 		}
 	}
 }
 
-// Compute Round Constants
+// SetEvaluators evaluates the state words on one goroutine per evaluator, which must be shallow copies of the evaluator
+// of the cipher. The keystream is the same as with a single evaluator.
+func (hera *mfvHera) SetEvaluators(evaluators []MFVEvaluator) {
+	if len(evaluators) == 0 {
+		evaluators = []MFVEvaluator{hera.evaluator}
+	}
+	hera.evaluator = evaluators[0]
+	hera.evaluators = evaluators
+}
+
+// initState copies the initial states into a new state, so that the keystream of every call starts from them
+// and the states returned by earlier calls are left untouched
+func (hera *mfvHera) initState() {
+	hera.stCt = make([]*Ciphertext, len(hera.icCt))
+	for i := range hera.icCt {
+		hera.stCt[i] = hera.icCt[i].CopyNew().Ciphertext()
+	}
+}
+
+// Compute Round Constants and start from the initial states
 func (hera *mfvHera) init(nonce [][]byte) {
+	hera.initState()
 	slots := hera.slots
 	for i := 0; i < slots; i++ {
 		hera.xof[i] = sha3.NewShake256()
@@ -112,12 +138,12 @@ func (hera *mfvHera) init(nonce [][]byte) {
 		}
 	}
 
-	for st := 0; st < 16; st++ {
+	forEachParallel(len(hera.evaluators), 16, func(worker, st int) {
 		nbSwitch := hera.mkCt[st].Level() - hera.stCt[st].Level()
 		if nbSwitch > 0 {
-			hera.evaluator.ModSwitchMany(hera.mkCt[st], hera.mkCt[st], nbSwitch)
+			hera.evaluators[worker].ModSwitchMany(hera.mkCt[st], hera.mkCt[st], nbSwitch)
 		}
-	}
+	})
 }
 
 func (hera *mfvHera) findBudgetInfo(noiseEstimator MFVNoiseEstimator) (maxInvBudget, minErrorBits int) {
@@ -184,10 +210,10 @@ func (hera *mfvHera) modSwitch(nbSwitch int) {
 	if nbSwitch <= 0 {
 		return
 	}
-	for i := 0; i < 16; i++ {
-		hera.evaluator.ModSwitchMany(hera.stCt[i], hera.stCt[i], nbSwitch)
-		hera.evaluator.ModSwitchMany(hera.mkCt[i], hera.mkCt[i], nbSwitch)
-	}
+	forEachParallel(len(hera.evaluators), 16, func(worker, i int) {
+		hera.evaluators[worker].ModSwitchMany(hera.stCt[i], hera.stCt[i], nbSwitch)
+		hera.evaluators[worker].ModSwitchMany(hera.mkCt[i], hera.mkCt[i], nbSwitch)
+	})
 }
 
 // Compute ciphertexts without modulus switching
@@ -262,24 +288,20 @@ func (hera *mfvHera) Crypt(nonce [][]byte, kCt []*Ciphertext, heraModDown []int)
 }
 
 func (hera *mfvHera) addRoundKey(round int, reduce bool) {
-	ev := hera.evaluator
-
 	for st := 0; st < 16; st++ {
 		hera.rcPt[st] = NewPlaintextMulLvl(hera.params, hera.stCt[st].Level())
 		hera.encoder.EncodeUintMulSmall(hera.rc[round][st], hera.rcPt[st])
 	}
 
-	for st := 0; st < 16; st++ {
-		hera.rkCt[st] = hera.evaluator.MulNew(hera.mkCt[st], hera.rcPt[st])
-	}
-
-	for st := 0; st < 16; st++ {
+	forEachParallel(len(hera.evaluators), 16, func(worker, st int) {
+		ev := hera.evaluators[worker]
+		hera.rkCt[st] = ev.MulNew(hera.mkCt[st], hera.rcPt[st])
 		if reduce {
 			ev.Add(hera.stCt[st], hera.rkCt[st], hera.stCt[st])
 		} else {
 			ev.AddNoMod(hera.stCt[st], hera.rkCt[st], hera.stCt[st])
 		}
-	}
+	})
 }
 
 func (hera *mfvHera) linLayer() {
@@ -341,13 +363,13 @@ func (hera *mfvHera) linLayer() {
 }
 
 func (hera *mfvHera) cube() {
-	ev := hera.evaluator
-	for st := 0; st < 16; st++ {
+	forEachParallel(len(hera.evaluators), 16, func(worker, st int) {
+		ev := hera.evaluators[worker]
 		x2 := ev.MulNew(hera.stCt[st], hera.stCt[st])
 		y2 := ev.RelinearizeNew(x2)
 		x3 := ev.MulNew(y2, hera.stCt[st])
 		hera.stCt[st] = ev.RelinearizeNew(x3)
-	}
+	})
 }
 
 func (hera *mfvHera) EncKey(key []uint64) (res []*Ciphertext) {
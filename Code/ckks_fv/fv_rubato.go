@@ -3,70 +3,25 @@ package ckks_fv
 import (
 	"fmt"
 
+	"github.com/ldsec/lattigo/v2/plaincipher"
 	"github.com/ldsec/lattigo/v2/ring"
 	"golang.org/x/crypto/sha3"
 )
 
-type RubatoParam struct {
-	Blocksize    int
-	PlainModulus uint64
-	NumRound     int
-	Sigma        float64
-}
+// RubatoParam is a Rubato parameter set, see plaincipher.RubatoParam
+type RubatoParam = plaincipher.RubatoParam
 
 const (
-	RUBATO80S = iota
-	RUBATO80M
-	RUBATO80L
-	RUBATO128S
-	RUBATO128M
-	RUBATO128L
+	RUBATO80S  = plaincipher.RUBATO80S
+	RUBATO80M  = plaincipher.RUBATO80M
+	RUBATO80L  = plaincipher.RUBATO80L
+	RUBATO128S = plaincipher.RUBATO128S
+	RUBATO128M = plaincipher.RUBATO128M
+	RUBATO128L = plaincipher.RUBATO128L
 )
 
-var RubatoParams = []RubatoParam{
-	{
-		// RUBATO80S
-		Blocksize:    16,
-		PlainModulus: 0x3ee0001,
-		NumRound:     2,
-		Sigma:        4.4282593124559027251334012652716387400820308059307747000917767,
-	},
-	{
-		// RUBATO80M
-		Blocksize:    36,
-		PlainModulus: 0x1fc0001,
-		NumRound:     2,
-		Sigma:        1.0771441570838682304378543618228310448848183041453235756979997,
-	},
-	{
-		// RUBATO80L
-		Blocksize:    64,
-		PlainModulus: 0x1fc0001,
-		NumRound:     2,
-		Sigma:        0.63830764864229228470391369589501098956137380986389545226548133,
-	},
-	{
-		// RUBATO128S
-		Blocksize:    16,
-		PlainModulus: 0x3ee0001,
-		NumRound:     5,
-		Sigma:        4.1888939442150431183694336293110096189965156272318139054922212,
-	},
-	{
-		// RUBATO128M
-		Blocksize:    36,
-		PlainModulus: 0x1fc0001,
-		NumRound:     3,
-		Sigma:        1.6356633496458739795537788457309656607510203877762320964302959,
-	},
-	{
-		// RUBATO128L
-		Blocksize:    64,
-		PlainModulus: 0x1fc0001,
-		NumRound:     2,
-		Sigma:        1.6356633496458739795537788457309656607510203877762320964302959,
-	},
-}
+// RubatoParams are the Rubato parameter sets of plaincipher
+var RubatoParams = plaincipher.RubatoParams
 
 type MFVRubato interface {
 	Crypt(nonce [][]byte, counter []byte, kCt []*Ciphertext, rubatoModDown []int) []*Ciphertext
@@ -74,6 +29,7 @@ type MFVRubato interface {
 	CryptAutoModSwitch(nonce [][]byte, counter []byte, kCt []*Ciphertext, noiseEstimator MFVNoiseEstimator) (res []*Ciphertext, rubatoModDown []int)
 	Reset(nbInitModDown int)
 	EncKey(key []uint64) (res []*Ciphertext)
+	SetEvaluators(evaluators []MFVEvaluator)
 }
 
 type mfvRubato struct {
@@ -87,7 +43,10 @@ type mfvRubato struct {
 	encoder   MFVEncoder
 	encryptor MFVEncryptor
 	evaluator MFVEvaluator
+	// Evaluators of the goroutines evaluating the state words, evaluators[0] is evaluator
+	evaluators []MFVEvaluator
 
+	icCt []*Ciphertext // Initial states at the starting level, copied into stCt for each keystream
 	stCt []*Ciphertext
 	mkCt []*Ciphertext
 	rkCt []*Ciphertext   // Buffer for round key
@@ -109,7 +68,9 @@ func NewMFVRubato(rubatoParam int, params *Parameters, encoder MFVEncoder, encry
 	rubato.encoder = encoder
 	rubato.encryptor = encryptor
 	rubato.evaluator = evaluator
+	rubato.evaluators = []MFVEvaluator{evaluator}
 
+	rubato.icCt = make([]*Ciphertext, rubato.blocksize)
 	rubato.stCt = make([]*Ciphertext, rubato.blocksize)
 	rubato.mkCt = make([]*Ciphertext, rubato.blocksize)
 	rubato.rkCt = make([]*Ciphertext, rubato.blocksize)
@@ -134,9 +95,9 @@ func NewMFVRubato(rubatoParam int, params *Parameters, encoder MFVEncoder, encry
 		icPT := NewPlaintextFV(params)
 		encoder.EncodeUintSmall(state, icPT)
 		encryptor.EncryptNew(icPT)
-		rubato.stCt[i] = encryptor.EncryptNew(icPT)
+		rubato.icCt[i] = encryptor.EncryptNew(icPT)
 		if nbInitModDown > 0 {
-			evaluator.ModSwitchMany(rubato.stCt[i], rubato.stCt[i], nbInitModDown)
+			evaluator.ModSwitchMany(rubato.icCt[i], rubato.icCt[i], nbInitModDown)
 		}
 	}
 	return rubato
@@ -154,15 +115,35 @@ func (rubato *mfvRubato) Reset(nbInitModDown int) {
 		icPT := NewPlaintextFV(rubato.params)
 		rubato.encoder.EncodeUintSmall(state, icPT)
 		rubato.encryptor.EncryptNew(icPT)
-		rubato.stCt[i] = rubato.encryptor.EncryptNew(icPT)
+		rubato.icCt[i] = rubato.encryptor.EncryptNew(icPT)
 		if nbInitModDown > 0 {
-			rubato.evaluator.ModSwitchMany(rubato.stCt[i], rubato.stCt[i], nbInitModDown)
+			rubato.evaluator.ModSwitchMany(rubato.icCt[i], rubato.icCt[i], nbInitModDown)
 		}
 	}
 }
 
-// Compute Round Constants
+// SetEvaluators evaluates the state words on one goroutine per evaluator, which must be shallow copies of the evaluator
+// of the cipher. The keystream is the same as with a single evaluator.
+func (rubato *mfvRubato) SetEvaluators(evaluators []MFVEvaluator) {
+	if len(evaluators) == 0 {
+		evaluators = []MFVEvaluator{rubato.evaluator}
+	}
+	rubato.evaluator = evaluators[0]
+	rubato.evaluators = evaluators
+}
+
+// initState copies the initial states into a new state, so that the keystream of every call starts from them
+// and the states returned by earlier calls are left untouched
+func (rubato *mfvRubato) initState() {
+	rubato.stCt = make([]*Ciphertext, len(rubato.icCt))
+	for i := range rubato.icCt {
+		rubato.stCt[i] = rubato.icCt[i].CopyNew().Ciphertext()
+	}
+}
+
+// Compute Round Constants and start from the initial states
 func (rubato *mfvRubato) init(nonce [][]byte, counter []byte) {
+	rubato.initState()
 	slots := rubato.slots
 	for i := 0; i < slots; i++ {
 		rubato.xof[i] = sha3.NewShake256()
@@ -178,12 +159,12 @@ func (rubato *mfvRubato) init(nonce [][]byte, counter []byte) {
 		}
 	}
 
-	for i := 0; i < rubato.blocksize; i++ {
+	forEachParallel(len(rubato.evaluators), rubato.blocksize, func(worker, i int) {
 		nbSwitch := rubato.mkCt[i].Level() - rubato.stCt[i].Level()
 		if nbSwitch > 0 {
-			rubato.evaluator.ModSwitchMany(rubato.mkCt[i], rubato.mkCt[i], nbSwitch)
+			rubato.evaluators[worker].ModSwitchMany(rubato.mkCt[i], rubato.mkCt[i], nbSwitch)
 		}
-	}
+	})
 }
 
 func (rubato *mfvRubato) findBudgetInfo(noiseEstimator MFVNoiseEstimator) (maxInvBudget, minErrorBits int) {
@@ -250,10 +231,10 @@ func (rubato *mfvRubato) modSwitch(nbSwitch int) {
 	if nbSwitch <= 0 {
 		return
 	}
-	for i := 0; i < rubato.blocksize; i++ {
-		rubato.evaluator.ModSwitchMany(rubato.stCt[i], rubato.stCt[i], nbSwitch)
-		rubato.evaluator.ModSwitchMany(rubato.mkCt[i], rubato.mkCt[i], nbSwitch)
-	}
+	forEachParallel(len(rubato.evaluators), rubato.blocksize, func(worker, i int) {
+		rubato.evaluators[worker].ModSwitchMany(rubato.stCt[i], rubato.stCt[i], nbSwitch)
+		rubato.evaluators[worker].ModSwitchMany(rubato.mkCt[i], rubato.mkCt[i], nbSwitch)
+	})
 }
 
 // Compute ciphertexts without modulus switching
@@ -328,41 +309,33 @@ func (rubato *mfvRubato) Crypt(nonce [][]byte, counter []byte, kCt []*Ciphertext
 }
 
 func (rubato *mfvRubato) addRoundKey(round int, reduce bool) {
-	ev := rubato.evaluator
-
 	for i := 0; i < rubato.blocksize; i++ {
 		rubato.rcPt[i] = NewPlaintextMulLvl(rubato.params, rubato.stCt[i].Level())
 		rubato.encoder.EncodeUintMulSmall(rubato.rc[round][i], rubato.rcPt[i])
 	}
 
-	for i := 0; i < rubato.blocksize; i++ {
+	forEachParallel(len(rubato.evaluators), rubato.blocksize, func(worker, i int) {
+		ev := rubato.evaluators[worker]
 		rubato.rkCt[i] = ev.MulNew(rubato.mkCt[i], rubato.rcPt[i])
-	}
-
-	for i := 0; i < rubato.blocksize; i++ {
 		if reduce {
 			ev.Add(rubato.stCt[i], rubato.rkCt[i], rubato.stCt[i])
 		} else {
 			ev.AddNoMod(rubato.stCt[i], rubato.rkCt[i], rubato.stCt[i])
 		}
-	}
+	})
 }
 
 func (rubato *mfvRubato) finAddRoundKey(outputsize int) {
-	ev := rubato.evaluator
-
 	for i := 0; i < outputsize; i++ {
 		rubato.rcPt[i] = NewPlaintextMulLvl(rubato.params, rubato.stCt[i].Level())
 		rubato.encoder.EncodeUintMulSmall(rubato.rc[rubato.numRound][i], rubato.rcPt[i])
 	}
 
-	for i := 0; i < outputsize; i++ {
+	forEachParallel(len(rubato.evaluators), outputsize, func(worker, i int) {
+		ev := rubato.evaluators[worker]
 		rubato.rkCt[i] = ev.MulNew(rubato.mkCt[i], rubato.rcPt[i])
-	}
-
-	for i := 0; i < outputsize; i++ {
 		ev.Add(rubato.stCt[i], rubato.rkCt[i], rubato.stCt[i])
-	}
+	})
 }
 
 func (rubato *mfvRubato) linLayer() {
@@ -731,13 +704,17 @@ func (rubato *mfvRubato) finLinLayer() {
 	}
 }
 
+// feistel adds the square of each state word to the next one, all squares are taken of the words before the round
 func (rubato *mfvRubato) feistel() {
-	ev := rubato.evaluator
-	for i := rubato.blocksize - 1; i > 0; i-- {
-		tmp := ev.MulNew(rubato.stCt[i-1], rubato.stCt[i-1])
-		ev.Relinearize(tmp, tmp)
-		ev.Add(rubato.stCt[i], tmp, rubato.stCt[i])
-	}
+	squares := make([]*Ciphertext, rubato.blocksize)
+	forEachParallel(len(rubato.evaluators), rubato.blocksize-1, func(worker, i int) {
+		ev := rubato.evaluators[worker]
+		squares[i+1] = ev.MulNew(rubato.stCt[i], rubato.stCt[i])
+		ev.Relinearize(squares[i+1], squares[i+1])
+	})
+	forEachParallel(len(rubato.evaluators), rubato.blocksize-1, func(worker, i int) {
+		rubato.evaluators[worker].Add(rubato.stCt[i+1], squares[i+1], rubato.stCt[i+1])
+	})
 }
 
 func (rubato *mfvRubato) EncKey(key []uint64) (res []*Ciphertext) {
@@ -0,0 +1,120 @@
+package ckks_fv
+
+import (
+	"fmt"
+)
+
+// GalleryLayout describes how the references of a gallery are packed into the slots of CKKS ciphertexts.
+// Every reference occupies a block of Stride slots, the k-th reference of a ciphertext starts at slot -k*Stride.
+// The distances of the g-th gallery ciphertext are moved g slots to the left, so all distances fit into one ciphertext.
+type GalleryLayout struct {
+	SubjectIDs    []string
+	TemplateLen   int
+	Stride        int
+	PerCiphertext int
+	Slots         int
+}
+
+// NewGalleryLayout returns the layout for one reference per subject ID, each of length templateLen.
+// A template or gallery that does not fit into the slots returns an error matching ErrParameterMismatch.
+func NewGalleryLayout(subjectIDs []string, templateLen int, slots int) (*GalleryLayout, error) {
+	layout := new(GalleryLayout)
+	layout.SubjectIDs = subjectIDs
+	layout.TemplateLen = templateLen
+	layout.Slots = slots
+	layout.Stride = 1
+	for layout.Stride < templateLen {
+		layout.Stride <<= 1
+	}
+	if layout.Stride > slots {
+		return nil, fmt.Errorf("%w: template length %d does not fit into %d slots", ErrParameterMismatch, templateLen, slots)
+	}
+	layout.PerCiphertext = slots / layout.Stride
+	if layout.NumCiphertexts() > layout.Stride {
+		return nil, fmt.Errorf("%w: gallery of %d references does not fit into one ciphertext", ErrParameterMismatch, len(subjectIDs))
+	}
+	return layout, nil
+}
+
+// NumCiphertexts returns the number of ciphertexts needed to pack the gallery
+func (layout *GalleryLayout) NumCiphertexts() int {
+	return (len(layout.SubjectIDs) + layout.PerCiphertext - 1) / layout.PerCiphertext
+}
+
+// Offset returns the first slot of the k-th reference inside its gallery ciphertext
+func (layout *GalleryLayout) Offset(k int) int {
+	return (layout.Slots - k*layout.Stride) % layout.Slots
+}
+
+// Slot returns the slot holding the distance to the i-th reference of the gallery
+func (layout *GalleryLayout) Slot(i int) int {
+	g, k := i/layout.PerCiphertext, i%layout.PerCiphertext
+	return (layout.Offset(k) - g + layout.Slots) % layout.Slots
+}
+
+// References returns the indexes of the references packed into the g-th gallery ciphertext
+func (layout *GalleryLayout) References(g int) []int {
+	start := g * layout.PerCiphertext
+	end := start + layout.PerCiphertext
+	if end > len(layout.SubjectIDs) {
+		end = len(layout.SubjectIDs)
+	}
+	refs := make([]int, 0, end-start)
+	for i := start; i < end; i++ {
+		refs = append(refs, i)
+	}
+	return refs
+}
+
+// tournamentSteps returns the distances between the positions that are compared in each round of the tournament.
+// The positions of the references form a box of the number of gallery ciphertexts times the references per ciphertext,
+// both rounded up to powers of two.
+func (layout *GalleryLayout) tournamentSteps() []int {
+	steps := []int{}
+	for step := 1; step < layout.NumCiphertexts(); step <<= 1 {
+		steps = append(steps, step)
+	}
+	perCiphertext := layout.PerCiphertext
+	if len(layout.SubjectIDs) < perCiphertext {
+		perCiphertext = len(layout.SubjectIDs)
+	}
+	for step := layout.Stride; step < layout.Stride*perCiphertext; step <<= 1 {
+		steps = append(steps, step)
+	}
+	return steps
+}
+
+// tournamentSlots returns the slots of the positions still in the tournament after the given number of rounds
+func (layout *GalleryLayout) tournamentSlots(rounds int) []int {
+	steps := layout.tournamentSteps()
+	mask := 0
+	for _, step := range steps[:rounds] {
+		mask |= step
+	}
+	boxG, boxK := 1, 1
+	for boxG < layout.NumCiphertexts() {
+		boxG <<= 1
+	}
+	for boxK < len(layout.SubjectIDs) && boxK < layout.PerCiphertext {
+		boxK <<= 1
+	}
+	slots := []int{}
+	for k := 0; k < boxK; k++ {
+		for g := 0; g < boxG; g++ {
+			position := k*layout.Stride + g
+			if position&mask == 0 {
+				slots = append(slots, (layout.Slots-position)%layout.Slots)
+			}
+		}
+	}
+	return slots
+}
+
+// referenceSlots returns the slots of all references of the gallery
+func (layout *GalleryLayout) referenceSlots() []int {
+	slots := make([]int, len(layout.SubjectIDs))
+	for i := range layout.SubjectIDs {
+		slots[i] = layout.Slot(i)
+	}
+	return slots
+}
@@ -0,0 +1,425 @@
+package ckks_fv
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var (
+	ErrRecordNotFound = errors.New("gallery record not found")
+	ErrIntegrity      = errors.New("gallery record failed the integrity check")
+)
+
+const (
+	galleryCiphertextExt = ".enc"
+	galleryRecordExt     = ".meta"
+	galleryTmpExt        = ".tmp"
+)
+
+// GalleryRecord holds the metadata of a transciphered reference in a GalleryStore.
+// TemplateLengths are the message lengths of the modalities, masked templates count twice their length.
+// Checksum is the SHA-256 of the stored ciphertext file, it is checked on every read.
+type GalleryRecord struct {
+	SubjectID       string
+	TemplateID      string
+	Modalities      []string
+	TemplateLengths []int
+	ContextID       string
+	Level           int
+	Scale           float64
+	Checksum        string
+}
+
+// GalleryStore is an on-disk store of transciphered references, keyed by subject ID and template ID.
+// Every reference is kept as <root>/<subject ID>/<template ID>.enc next to its record <template ID>.meta.
+// Files are written to a temporary file and renamed, so readers never see a partial update.
+type GalleryStore interface {
+	Put(subjectID string, templateID string, modalities []string, templateLengths []int, ct *Ciphertext) (*GalleryRecord, error)
+	Get(subjectID string, templateID string) (*Ciphertext, *GalleryRecord, error)
+	Record(subjectID string, templateID string) (*GalleryRecord, error)
+	List() []*GalleryRecord
+	ListSubject(subjectID string) []*GalleryRecord
+	SubjectIDs() []string
+	Delete(subjectID string, templateID string) error
+	DeleteSubject(subjectID string) error
+	Verify() []error
+	Gallery(templateID string) ([]*Ciphertext, []string, error)
+	PackGallery(server ServerComp, templateID string) ([]*Ciphertext, *GalleryLayout, error)
+}
+
+type galleryStore struct {
+	root      string
+	contextID string
+	mutex     sync.RWMutex
+	index     map[string]map[string]*GalleryRecord
+}
+
+// OpenGalleryStore opens the store at root for references of the given context, creating the folder if needed.
+// The index is rebuilt from the records found on disk.
+func OpenGalleryStore(root string, contextID string) (GalleryStore, error) {
+	if err := os.MkdirAll(root, os.ModePerm); err != nil {
+		return nil, err
+	}
+	store := new(galleryStore)
+	store.root = root
+	store.contextID = contextID
+	store.index = make(map[string]map[string]*GalleryRecord)
+	subjects, err := ioutil.ReadDir(root)
+	if err != nil {
+		return nil, err
+	}
+	for _, subject := range subjects {
+		if !subject.IsDir() {
+			continue
+		}
+		files, err := ioutil.ReadDir(path.Join(root, subject.Name()))
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range files {
+			name := file.Name()
+			if strings.HasSuffix(name, galleryTmpExt) {
+				//left behind by an interrupted update
+				os.Remove(path.Join(root, subject.Name(), name))
+				continue
+			}
+			if !strings.HasSuffix(name, galleryRecordExt) {
+				continue
+			}
+			record := new(GalleryRecord)
+			if err := readGob(path.Join(root, subject.Name(), name), record); err != nil {
+				return nil, fmt.Errorf("%s/%s: %w", subject.Name(), name, err)
+			}
+			store.indexRecord(record)
+		}
+	}
+	return store, nil
+}
+
+// validateID rejects IDs that are empty or not a single path element
+func validateID(id string) error {
+	if id == "" || id == "." || id == ".." || strings.ContainsAny(id, "/\\") || strings.HasSuffix(id, galleryTmpExt) {
+		return fmt.Errorf("invalid gallery ID %q", id)
+	}
+	return nil
+}
+
+func (store *galleryStore) indexRecord(record *GalleryRecord) {
+	templates, ok := store.index[record.SubjectID]
+	if !ok {
+		templates = make(map[string]*GalleryRecord)
+		store.index[record.SubjectID] = templates
+	}
+	templates[record.TemplateID] = record
+}
+
+func (store *galleryStore) ciphertextPath(subjectID string, templateID string) string {
+	return path.Join(store.root, subjectID, templateID+galleryCiphertextExt)
+}
+
+func (store *galleryStore) recordPath(subjectID string, templateID string) string {
+	return path.Join(store.root, subjectID, templateID+galleryRecordExt)
+}
+
+// writeAtomic writes data to a temporary file next to name, syncs it and renames it to name
+func writeAtomic(name string, data []byte) error {
+	return writeAtomicMode(name, data, 0666)
+}
+
+// writeAtomicMode is writeAtomic for a file created with the permissions perm
+func writeAtomicMode(name string, data []byte, perm os.FileMode) error {
+	tmp := name + galleryTmpExt
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(data); err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, name)
+}
+
+func encodeGob(value interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(value); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func readGob(name string, value interface{}) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return gob.NewDecoder(f).Decode(value)
+}
+
+func checksum(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// Put stores ct as the reference templateID of the subject, replacing an existing one.
+// The ciphertext is renamed into place before its record, a record always describes a complete ciphertext.
+func (store *galleryStore) Put(subjectID string, templateID string, modalities []string, templateLengths []int, ct *Ciphertext) (*GalleryRecord, error) {
+	if err := validateID(subjectID); err != nil {
+		return nil, err
+	}
+	if err := validateID(templateID); err != nil {
+		return nil, err
+	}
+	if len(modalities) != len(templateLengths) {
+		return nil, fmt.Errorf("%d modalities but %d template lengths", len(modalities), len(templateLengths))
+	}
+	gob.Register(CT{})
+	data, err := encodeGob(NewSingleCiphertextSerialized(store.contextID, ct))
+	if err != nil {
+		return nil, err
+	}
+	record := &GalleryRecord{
+		SubjectID:       subjectID,
+		TemplateID:      templateID,
+		Modalities:      modalities,
+		TemplateLengths: templateLengths,
+		ContextID:       store.contextID,
+		Level:           ct.Level(),
+		Scale:           ct.Scale(),
+		Checksum:        checksum(data),
+	}
+	recordData, err := encodeGob(record)
+	if err != nil {
+		return nil, err
+	}
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	if err := os.MkdirAll(path.Join(store.root, subjectID), os.ModePerm); err != nil {
+		return nil, err
+	}
+	if err := writeAtomic(store.ciphertextPath(subjectID, templateID), data); err != nil {
+		return nil, err
+	}
+	if err := writeAtomic(store.recordPath(subjectID, templateID), recordData); err != nil {
+		return nil, err
+	}
+	store.indexRecord(record)
+	return record, nil
+}
+
+// Record returns the metadata of a reference without reading its ciphertext
+func (store *galleryStore) Record(subjectID string, templateID string) (*GalleryRecord, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+	record, ok := store.index[subjectID][templateID]
+	if !ok {
+		return nil, fmt.Errorf("%s/%s: %w", subjectID, templateID, ErrRecordNotFound)
+	}
+	return record, nil
+}
+
+// Get reads a reference and checks it against its record
+func (store *galleryStore) Get(subjectID string, templateID string) (*Ciphertext, *GalleryRecord, error) {
+	record, err := store.Record(subjectID, templateID)
+	if err != nil {
+		return nil, nil, err
+	}
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+	ct, err := store.readCiphertext(record)
+	if err != nil {
+		return nil, nil, err
+	}
+	return ct, record, nil
+}
+
+func (store *galleryStore) readCiphertext(record *GalleryRecord) (*Ciphertext, error) {
+	key := record.SubjectID + "/" + record.TemplateID
+	if record.ContextID != store.contextID {
+		return nil, fmt.Errorf("%s: context %s instead of %s: %w", key, record.ContextID, store.contextID, ErrContextMismatch)
+	}
+	data, err := ioutil.ReadFile(store.ciphertextPath(record.SubjectID, record.TemplateID))
+	if err != nil {
+		return nil, err
+	}
+	if checksum(data) != record.Checksum {
+		return nil, fmt.Errorf("%s: checksum mismatch: %w", key, ErrIntegrity)
+	}
+	gob.Register(CT{})
+	sct := new(CT)
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(sct); err != nil {
+		return nil, fmt.Errorf("%s: %v: %w", key, err, ErrIntegrity)
+	}
+	cts := sct.ConvertToRegularCiphertext()
+	if len(cts) != 1 {
+		return nil, fmt.Errorf("%s: %d ciphertexts instead of 1: %w", key, len(cts), ErrIntegrity)
+	}
+	if cts[0].Level() != record.Level || cts[0].Scale() != record.Scale {
+		return nil, fmt.Errorf("%s: level or scale differ from the record: %w", key, ErrIntegrity)
+	}
+	return cts[0], nil
+}
+
+// List returns the records of all references, sorted by subject ID and template ID
+func (store *galleryStore) List() []*GalleryRecord {
+	records := make([]*GalleryRecord, 0)
+	for _, subjectID := range store.SubjectIDs() {
+		records = append(records, store.ListSubject(subjectID)...)
+	}
+	return records
+}
+
+// ListSubject returns the records of the references of one subject, sorted by template ID
+func (store *galleryStore) ListSubject(subjectID string) []*GalleryRecord {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+	records := make([]*GalleryRecord, 0, len(store.index[subjectID]))
+	for _, record := range store.index[subjectID] {
+		records = append(records, record)
+	}
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].TemplateID < records[j].TemplateID
+	})
+	return records
+}
+
+// SubjectIDs returns the sorted IDs of all subjects with at least one reference
+func (store *galleryStore) SubjectIDs() []string {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+	subjectIDs := make([]string, 0, len(store.index))
+	for subjectID, templates := range store.index {
+		if len(templates) > 0 {
+			subjectIDs = append(subjectIDs, subjectID)
+		}
+	}
+	sort.Strings(subjectIDs)
+	return subjectIDs
+}
+
+// Delete removes a reference, the record is removed first so the reference disappears at once
+func (store *galleryStore) Delete(subjectID string, templateID string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	if _, ok := store.index[subjectID][templateID]; !ok {
+		return fmt.Errorf("%s/%s: %w", subjectID, templateID, ErrRecordNotFound)
+	}
+	if err := os.Remove(store.recordPath(subjectID, templateID)); err != nil {
+		return err
+	}
+	delete(store.index[subjectID], templateID)
+	if err := os.Remove(store.ciphertextPath(subjectID, templateID)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if len(store.index[subjectID]) == 0 {
+		delete(store.index, subjectID)
+		os.Remove(path.Join(store.root, subjectID))
+	}
+	return nil
+}
+
+// DeleteSubject removes all references of a subject
+func (store *galleryStore) DeleteSubject(subjectID string) error {
+	records := store.ListSubject(subjectID)
+	if len(records) == 0 {
+		return fmt.Errorf("%s: %w", subjectID, ErrRecordNotFound)
+	}
+	for _, record := range records {
+		if err := store.Delete(subjectID, record.TemplateID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Verify reads every reference and returns the errors of those failing the integrity checks
+func (store *galleryStore) Verify() []error {
+	errs := make([]error, 0)
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+	for _, templates := range store.index {
+		for _, record := range templates {
+			if _, err := store.readCiphertext(record); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	return errs
+}
+
+// galleryRecords returns one record per subject, the reference templateID of every subject that has it,
+// or the first reference if templateID is empty
+func (store *galleryStore) galleryRecords(templateID string) []*GalleryRecord {
+	records := make([]*GalleryRecord, 0)
+	for _, subjectID := range store.SubjectIDs() {
+		if templateID == "" {
+			if subject := store.ListSubject(subjectID); len(subject) > 0 {
+				records = append(records, subject[0])
+			}
+		} else if record, err := store.Record(subjectID, templateID); err == nil {
+			records = append(records, record)
+		}
+	}
+	return records
+}
+
+// Gallery returns one reference per subject for 1:N comparisons together with the subject IDs.
+// It picks the reference templateID of every subject that has it, or the first reference if templateID is empty.
+func (store *galleryStore) Gallery(templateID string) ([]*Ciphertext, []string, error) {
+	records := store.galleryRecords(templateID)
+	references := make([]*Ciphertext, len(records))
+	subjectIDs := make([]string, len(records))
+	for i, record := range records {
+		ct, _, err := store.Get(record.SubjectID, record.TemplateID)
+		if err != nil {
+			return nil, nil, err
+		}
+		references[i] = ct
+		subjectIDs[i] = record.SubjectID
+	}
+	return references, subjectIDs, nil
+}
+
+// PackGallery reads the gallery of templateID and packs it with the computation server for ProcessTemplateInstructionsGallery.
+// All references must have the same template lengths, the packed template length is their sum.
+func (store *galleryStore) PackGallery(server ServerComp, templateID string) ([]*Ciphertext, *GalleryLayout, error) {
+	records := store.galleryRecords(templateID)
+	if len(records) == 0 {
+		return nil, nil, fmt.Errorf("gallery %q: %w", templateID, ErrRecordNotFound)
+	}
+	templateLen := 0
+	for i, record := range records {
+		length := 0
+		for _, l := range record.TemplateLengths {
+			length += l
+		}
+		if i == 0 {
+			templateLen = length
+		} else if length != templateLen {
+			return nil, nil, fmt.Errorf("%s/%s: template length %d instead of %d", record.SubjectID, record.TemplateID, length, templateLen)
+		}
+	}
+	references, subjectIDs, err := store.Gallery(templateID)
+	if err != nil {
+		return nil, nil, err
+	}
+	return server.PackGallery(references, subjectIDs, templateLen)
+}
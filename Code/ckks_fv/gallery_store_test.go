@@ -0,0 +1,99 @@
+package ckks_fv
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+)
+
+// TestGalleryStore puts, reads, lists and deletes references, reopens the store and checks that a tampered
+// ciphertext fails Get and Verify
+func TestGalleryStore(t *testing.T) {
+	root, err := ioutil.TempDir("", "gallery")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	params := newTestCKKSParams(t)
+	_, pk := NewKeyGenerator(params).GenKeyPair()
+	encryptor := NewCKKSEncryptorFromPk(params, pk)
+	store, err := OpenGalleryStore(root, "context")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	references := map[[2]string]*Ciphertext{}
+	for _, key := range [][2]string{{"alice", "left"}, {"alice", "right"}, {"bob", "left"}} {
+		ct := encryptor.EncryptNew(NewPlaintextCKKS(params, params.MaxLevel(), params.Scale()))
+		if _, err := store.Put(key[0], key[1], []string{"face", "iris"}, []int{256, 512}, ct); err != nil {
+			t.Fatal(err)
+		}
+		references[key] = ct
+	}
+	if _, err := store.Put("../alice", "left", nil, nil, references[[2]string{"alice", "left"}]); err == nil {
+		t.Error("subject ID outside the store accepted")
+	}
+
+	store, err = OpenGalleryStore(root, "context")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if subjectIDs := store.SubjectIDs(); !reflect.DeepEqual(subjectIDs, []string{"alice", "bob"}) {
+		t.Errorf("subject IDs %v after reopening", subjectIDs)
+	}
+	if records := store.List(); len(records) != 3 || records[1].SubjectID != "alice" || records[1].TemplateID != "right" {
+		t.Errorf("%d records after reopening", len(records))
+	}
+	for key, want := range references {
+		ct, record, err := store.Get(key[0], key[1])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(record.TemplateLengths, []int{256, 512}) || record.Level != want.Level() || record.ContextID != "context" {
+			t.Errorf("%v: record %+v", key, record)
+		}
+		got, _ := ct.MarshalBinary()
+		expected, _ := want.MarshalBinary()
+		if !bytes.Equal(got, expected) {
+			t.Errorf("%v: ciphertext differs from the stored one", key)
+		}
+	}
+
+	if err := store.Delete("alice", "left"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := store.Get("alice", "left"); !errors.Is(err, ErrRecordNotFound) {
+		t.Errorf("get of a deleted reference: got %v, want ErrRecordNotFound", err)
+	}
+	if err := store.Delete("alice", "left"); !errors.Is(err, ErrRecordNotFound) {
+		t.Errorf("second delete: got %v, want ErrRecordNotFound", err)
+	}
+	if err := store.DeleteSubject("bob"); err != nil {
+		t.Fatal(err)
+	}
+	if subjectIDs := store.SubjectIDs(); !reflect.DeepEqual(subjectIDs, []string{"alice"}) {
+		t.Errorf("subject IDs %v after the deletes", subjectIDs)
+	}
+	if errs := store.Verify(); len(errs) != 0 {
+		t.Fatalf("untouched store: %v", errs)
+	}
+
+	p := store.(*galleryStore).ciphertextPath("alice", "right")
+	data, err := ioutil.ReadFile(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[len(data)-1] ^= 1
+	if err = ioutil.WriteFile(p, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if errs := store.Verify(); len(errs) != 1 || !errors.Is(errs[0], ErrIntegrity) {
+		t.Errorf("tampered ciphertext: got %v, want one ErrIntegrity", errs)
+	}
+	if _, _, err := store.Get("alice", "right"); !errors.Is(err, ErrIntegrity) {
+		t.Errorf("get of a tampered ciphertext: got %v, want ErrIntegrity", err)
+	}
+}
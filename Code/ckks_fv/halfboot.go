@@ -11,9 +11,11 @@ import (
 // If the input ciphertext is at level one or more, the input scale does not need to be an exact power of two as one level
 // can be used to do a scale matching.
 func (hbtp *HalfBootstrapper) HalfBoot(ct *Ciphertext, repack bool) (ct0, ct1 *Ciphertext) {
+	return hbtp.halfBoot(ct, repack, nil)
+}
 
-	//var t time.Time
-	// var ct0, ct1 *Ciphertext
+// halfBoot is HalfBoot logging the CoeffsToSlots and EvalSine stages to logger
+func (hbtp *HalfBootstrapper) halfBoot(ct *Ciphertext, repack bool, logger Logger) (ct0, ct1 *Ciphertext) {
 
 	// Drops the level to 1
 	for ct.Level() > 1 {
@@ -60,13 +62,13 @@ func (hbtp *HalfBootstrapper) HalfBoot(ct *Ciphertext, repack bool) (ct0, ct1 *C
 	//log.Println("After SubSum :", time.Now().Sub(t), ct.Level(), ct.Scale())
 	// Part 1 : Coeffs to slots
 
-	//t = time.Now()
+	timer := startStage(logger, StageCoeffsToSlots)
 	// ct0, ct1 = CoeffsToSlots(ct, hbtp.pDFTInv, hbtp.ckksEvaluator)
 	ct0, ct1 = CoeffsToSlotsWithoutRepack(ct, hbtp.pDFTInvWithoutRepack, hbtp.ckksEvaluator)
-	//log.Println("After CtS    :", time.Now().Sub(t), ct0.Level(), ct0.Scale())
+	timer.done(ct0)
 
 	// Part 2 : SineEval
-	//t = time.Now()
+	timer = startStage(logger, StageEvalSine)
 	if repack {
 		hbtp.ckksEvaluator.Rotate(ct1, hbtp.params.Slots()/2, ct1)
 		hbtp.ckksEvaluator.Add(ct0, ct1, ct0)
@@ -75,7 +77,7 @@ func (hbtp *HalfBootstrapper) HalfBoot(ct *Ciphertext, repack bool) (ct0, ct1 *C
 	} else {
 		ct0, ct1 = hbtp.evaluateSine(ct0, ct1)
 	}
-	//log.Println("After Sine   :", time.Now().Sub(t), ct0.Level(), ct0.Scale())
+	timer.done(ct0)
 
 	// Part 3 : Fix scale using diffScaleAfterEvalSine
 	hbtp.ckksEvaluator.MultByConst(ct0, hbtp.diffScaleAfterSineEval, ct0)
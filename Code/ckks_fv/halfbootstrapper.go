@@ -38,12 +38,22 @@ type HalfBootstrapper struct {
 
 // NewHalfBootstrapper creates a new HalfBootstrapper.
 func NewHalfBootstrapper(params *Parameters, hbtpParams *HalfBootParameters, btpKey BootstrappingKey) (hbtp *HalfBootstrapper, err error) {
+	return NewHalfBootstrapperFromMatrices(params, hbtpParams, btpKey, nil)
+}
+
+// NewHalfBootstrapperFromMatrices creates a new HalfBootstrapper with the CoeffsToSlots matrices returned by
+// CoeffsToSlotsMatrices of a HalfBootstrapper of the same parameters, which skips their generation.
+// The matrices are generated if pDFTInv is nil.
+func NewHalfBootstrapperFromMatrices(params *Parameters, hbtpParams *HalfBootParameters, btpKey BootstrappingKey, pDFTInv []*PtDiagMatrix) (hbtp *HalfBootstrapper, err error) {
 
 	if hbtpParams.SinType == SinType(Sin) && hbtpParams.SinRescal != 0 {
 		return nil, fmt.Errorf("cannot use double angle formul for SinType = Sin -> must use SinType = Cos")
 	}
+	if pDFTInv != nil && len(pDFTInv) != len(hbtpParams.CtSLevels()) {
+		return nil, fmt.Errorf("invalid CoeffsToSlots matrices: %d matrices for %d levels", len(pDFTInv), len(hbtpParams.CtSLevels()))
+	}
 
-	hbtp = newHalfBootstrapper(params, hbtpParams)
+	hbtp = newHalfBootstrapper(params, hbtpParams, pDFTInv)
 
 	hbtp.BootstrappingKey = &BootstrappingKey{btpKey.Rlk, btpKey.Rtks}
 	if err = hbtp.CheckKeys(); err != nil {
@@ -56,7 +66,7 @@ func NewHalfBootstrapper(params *Parameters, hbtpParams *HalfBootParameters, btp
 
 // newHalfBootstrapper is a constructor of "dummy" half-bootstrapper to enable the generation of bootstrapping-related constants
 // without providing a bootstrapping key. To be replaced by a propper factorization of the bootstrapping pre-computations.
-func newHalfBootstrapper(params *Parameters, hbtpParams *HalfBootParameters) (hbtp *HalfBootstrapper) {
+func newHalfBootstrapper(params *Parameters, hbtpParams *HalfBootParameters, pDFTInv []*PtDiagMatrix) (hbtp *HalfBootstrapper) {
 	hbtp = new(HalfBootstrapper)
 
 	hbtp.params = params.Copy()
@@ -77,13 +87,22 @@ func newHalfBootstrapper(params *Parameters, hbtpParams *HalfBootParameters) (hb
 	hbtp.ckksEvaluator = NewCKKSEvaluator(params, EvaluationKey{}).(*ckksEvaluator) // creates an evaluator without keys for genDFTMatrices
 
 	hbtp.genSinePoly()
-	hbtp.genDFTMatrices()
+	hbtp.genDFTMatrices(pDFTInv)
 
 	hbtp.ctxpool = NewCiphertextCKKS(params, 1, params.MaxLevel(), 0)
 
 	return hbtp
 }
 
+// ShallowCopy creates a shallow copy of this HalfBootstrapper in which the keys, polynomials and matrices are shared
+// with the receiver and the evaluator buffers are reallocated. The receiver and the copy can be used concurrently.
+func (hbtp *HalfBootstrapper) ShallowCopy() *HalfBootstrapper {
+	hbtpCopy := *hbtp
+	hbtpCopy.ckksEvaluator = hbtp.ckksEvaluator.ShallowCopy().(*ckksEvaluator)
+	hbtpCopy.ctxpool = NewCiphertextCKKS(hbtp.params, 1, hbtp.params.MaxLevel(), 0)
+	return &hbtpCopy
+}
+
 // CheckKeys checks if all the necessary keys are present
 func (hbtp *HalfBootstrapper) CheckKeys() (err error) {
 
@@ -104,13 +123,19 @@ func (hbtp *HalfBootstrapper) CheckKeys() (err error) {
 	}
 
 	if len(rotMissing) != 0 {
-		return fmt.Errorf("rotation key(s) missing: %d", rotMissing)
+		return &RotationKeyError{Rotations: rotMissing}
 	}
 
 	return nil
 }
 
-func (hbtp *HalfBootstrapper) genDFTMatrices() {
+// CoeffsToSlotsMatrices returns the precomputed CoeffsToSlots matrices, see NewHalfBootstrapperFromMatrices
+func (hbtp *HalfBootstrapper) CoeffsToSlotsMatrices() []*PtDiagMatrix {
+	return hbtp.pDFTInvWithoutRepack
+}
+
+// genDFTMatrices computes the scaling constants and the rotations of the matrices, the matrices are generated if pDFTInv is nil
+func (hbtp *HalfBootstrapper) genDFTMatrices(pDFTInv []*PtDiagMatrix) {
 
 	a := real(hbtp.sineEvalPoly.a)
 	b := real(hbtp.sineEvalPoly.b)
@@ -124,7 +149,10 @@ func (hbtp *HalfBootstrapper) genDFTMatrices() {
 	hbtp.diffScaleAfterSineEval = (qDiff * hbtp.params.scale) / hbtp.postscale
 
 	// CoeffsToSlotsWithoutRepack vectors
-	hbtp.pDFTInvWithoutRepack = hbtp.HalfBootParameters.GenCoeffsToSlotsMatrixWithoutRepack(hbtp.coeffsToSlotsDiffScale, hbtp.encoder)
+	hbtp.pDFTInvWithoutRepack = pDFTInv
+	if pDFTInv == nil {
+		hbtp.pDFTInvWithoutRepack = hbtp.HalfBootParameters.GenCoeffsToSlotsMatrixWithoutRepack(hbtp.coeffsToSlotsDiffScale, hbtp.encoder)
+	}
 
 	// List of the rotation key values to needed for the bootstrapp
 	hbtp.rotKeyIndex = []int{}
@@ -0,0 +1,395 @@
+package ckks_fv
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io/ioutil"
+)
+
+// Roles of the parties that load key material
+const (
+	RoleAuthServer = "auth"
+	RoleCompServer = "comp"
+	RoleClient     = "client"
+)
+
+// BundleParameters identify the parameters shared by all parties
+type BundleParameters struct {
+	ContextID  string
+	Cipher     int
+	NumRound   int
+	ParamIndex int
+	Radix      int
+	FullCoeffs bool
+}
+
+// AuthBundle is the private key material of the authentication server
+type AuthBundle struct {
+	BundleParameters
+	SK *SecretKey
+	PK *PublicKey
+}
+
+// EvaluationBundle is the key material of the computation server. The relinearization and rotation keys are seeded,
+// which halves their size, and are expanded by Shared. The bootstrapping key consists of the relinearization and
+// rotation keys. HeraModDown and StcModDown pin the mod down schedule the keys were made for.
+type EvaluationBundle struct {
+	BundleParameters
+	PK          *PublicKey
+	RelinKey    *SeededSwitchingKey
+	RotKeys     *SeededRotationKeySet
+	PDcds       [][]*PtDiagMatrixT
+	HeraModDown []int
+	StcModDown  []int
+}
+
+// ClientBundle is the key material of a client, which encrypts its symmetric key under PK
+type ClientBundle struct {
+	BundleParameters
+	PK *PublicKey
+}
+
+// keyBundleFile is the gob encoding of all bundles. Loading decodes the whole file,
+// so that a bundle with material the loading party must not hold is refused instead of silently dropped.
+type keyBundleFile struct {
+	Role string
+	BundleParameters
+	SK          *SecretKey
+	PK          *PublicKey
+	RelinKey    *SeededSwitchingKey
+	RotKeys     *SeededRotationKeySet
+	PDcds       [][]*PtDiagMatrixT
+	HeraModDown []int
+	StcModDown  []int
+}
+
+func bundleParameters(shared Shared, contextID string) BundleParameters {
+	return BundleParameters{
+		ContextID:  contextID,
+		Cipher:     shared.GetCipher(),
+		NumRound:   shared.GetNumRounds(),
+		ParamIndex: shared.GetParamIndex(),
+		Radix:      shared.GetRadix(),
+		FullCoeffs: shared.GetFullCoeffs(),
+	}
+}
+
+// shared initializes the parameters of the bundle, pDcds are generated if nil and generate is set
+func (params BundleParameters) shared(pDcds [][]*PtDiagMatrixT, generate bool) (*Ishared, error) {
+	s := new(Ishared)
+	s.radix = params.Radix
+	if err := s.setParameters(params.Cipher, params.NumRound, params.ParamIndex, params.Radix, params.FullCoeffs); err != nil {
+		return nil, fmt.Errorf("bundle of context %s: %w", params.ContextID, err)
+	}
+	s.FvEncoder = NewMFVEncoder(s.Params)
+	s.CkksEncoder = NewCKKSEncoder(s.Params)
+	s.PDcds = pDcds
+	if s.PDcds == nil && generate {
+		s.PDcds = s.FvEncoder.GenSlotToCoeffMatFV(params.Radix)
+	}
+	return s, nil
+}
+
+func equalInts(a []int, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Validate checks that the bundle holds the secret key
+func (bundle *AuthBundle) Validate() error {
+	if bundle.SK == nil || bundle.PK == nil {
+		return errors.New("auth bundle without key pair")
+	}
+	return nil
+}
+
+// Validate checks that the bundle holds all evaluation keys
+func (bundle *EvaluationBundle) Validate() error {
+	if bundle.PK == nil || bundle.RelinKey == nil || bundle.RotKeys == nil {
+		return errors.New("evaluation bundle without public, relinearization or rotation keys")
+	}
+	if len(bundle.PDcds) == 0 {
+		return errors.New("evaluation bundle without SlotsToCoeffs matrices")
+	}
+	return nil
+}
+
+// Validate checks that the bundle holds the public key, the nonces are derived per session by the clients
+func (bundle *ClientBundle) Validate() error {
+	if bundle.PK == nil {
+		return errors.New("client bundle without public key")
+	}
+	return nil
+}
+
+// Shared initializes the shared parameters of the authentication server
+func (bundle *AuthBundle) Shared() (Shared, error) {
+	if err := bundle.Validate(); err != nil {
+		return nil, err
+	}
+	return bundle.shared(nil, true)
+}
+
+// Shared initializes the shared parameters of the computation server and expands the evaluation keys
+func (bundle *EvaluationBundle) Shared() (Shared, error) {
+	if err := bundle.Validate(); err != nil {
+		return nil, err
+	}
+	s, err := bundle.shared(bundle.PDcds, false)
+	if err != nil {
+		return nil, err
+	}
+	if !equalInts(s.HeraModDown, bundle.HeraModDown) || !equalInts(s.stcModDown, bundle.StcModDown) {
+		return nil, fmt.Errorf("%w: mod down schedule of the evaluation bundle does not match its parameters", ErrParameterMismatch)
+	}
+	relinKey, rotKeys := bundle.RelinKey.RelinearizationKey(s.Params), bundle.RotKeys.RotationKeySet(s.Params)
+	s.SetPublicKeys(bundle.PK, rotKeys, relinKey, BootstrappingKey{Rlk: relinKey, Rtks: rotKeys})
+	return s, nil
+}
+
+// Shared initializes the shared parameters of a client, without evaluation keys
+func (bundle *ClientBundle) Shared() (Shared, error) {
+	if err := bundle.Validate(); err != nil {
+		return nil, err
+	}
+	s, err := bundle.shared(nil, false)
+	if err != nil {
+		return nil, err
+	}
+	s.SetPublicKeys(bundle.PK, nil, nil, BootstrappingKey{})
+	return s, nil
+}
+
+// NewServerAuthFromBundle initializes the authentication server with the evaluation keys of the evaluation bundle it
+// exported before. The evaluation bundle must be of the same context and public key. If it is nil, the evaluation
+// keys are generated and GetEvaluationBundle exports them.
+func NewServerAuthFromBundle(bundle *AuthBundle, evaluation *EvaluationBundle) (ServerAuth, Shared, error) {
+	if evaluation == nil {
+		shared, err := bundle.Shared()
+		if err != nil {
+			return nil, nil, err
+		}
+		server, err := newServerAuth(shared, bundle.SK, bundle.PK)
+		if err != nil {
+			return nil, nil, err
+		}
+		return server, shared, nil
+	}
+	if err := bundle.Validate(); err != nil {
+		return nil, nil, err
+	}
+	if evaluation.BundleParameters != bundle.BundleParameters {
+		return nil, nil, fmt.Errorf("%w: evaluation bundle of context %s does not match the auth bundle of context %s",
+			ErrParameterMismatch, evaluation.ContextID, bundle.ContextID)
+	}
+	if !equalPublicKeys(evaluation.PK, bundle.PK) {
+		return nil, nil, fmt.Errorf("%w: evaluation bundle of context %s was generated for another public key",
+			ErrParameterMismatch, evaluation.ContextID)
+	}
+	shared, err := evaluation.Shared()
+	if err != nil {
+		return nil, nil, err
+	}
+	server, err := restoreServerAuth(shared, bundle.SK, bundle.PK)
+	if err != nil {
+		return nil, nil, err
+	}
+	return server, shared, nil
+}
+
+// equalPublicKeys compares the encodings of the public keys
+func equalPublicKeys(a, b *PublicKey) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	encA, errA := a.MarshalBinary()
+	encB, errB := b.MarshalBinary()
+	return errA == nil && errB == nil && bytes.Equal(encA, encB)
+}
+
+// NewServerCompFromBundle initializes the computation server with the keys of the bundle
+func NewServerCompFromBundle(bundle *EvaluationBundle) (ServerComp, Shared, error) {
+	shared, err := bundle.Shared()
+	if err != nil {
+		return nil, nil, err
+	}
+	server, err := NewServerComp(shared)
+	if err != nil {
+		return nil, nil, err
+	}
+	return server, shared, nil
+}
+
+// NewClientFromBundle initializes a client with the public key and nonces of the bundle
+func NewClientFromBundle(bundle *ClientBundle) (Client, Shared, error) {
+	shared, err := bundle.Shared()
+	if err != nil {
+		return nil, nil, err
+	}
+	client, err := NewClient(shared)
+	if err != nil {
+		return nil, nil, err
+	}
+	return client, shared, nil
+}
+
+// GetAuthBundle returns the private key material of the authentication server
+func (server *serverAuth) GetAuthBundle(contextID string) *AuthBundle {
+	return &AuthBundle{
+		BundleParameters: bundleParameters(server.shared, contextID),
+		SK:               server.sk,
+		PK:               server.pk,
+	}
+}
+
+// GetEvaluationBundle returns the seeded evaluation keys to hand to the computation server. The seeded keys are
+// released afterwards, so the bundle of generated keys can be exported once.
+func (server *serverAuth) GetEvaluationBundle(contextID string) (*EvaluationBundle, error) {
+	if server.seededRelinKey == nil || server.seededRotationKeys == nil {
+		return nil, errors.New("no seeded evaluation keys, they are exported once after their generation")
+	}
+	bundle := &EvaluationBundle{
+		BundleParameters: bundleParameters(server.shared, contextID),
+		PK:               server.pk,
+		RelinKey:         server.seededRelinKey,
+		RotKeys:          server.seededRotationKeys,
+		PDcds:            server.shared.GetPDcds(),
+		HeraModDown:      server.shared.GetHeraModDown(),
+		StcModDown:       server.shared.GetStcModDown(),
+	}
+	server.seededRelinKey, server.seededRotationKeys = nil, nil
+	return bundle, nil
+}
+
+// GetClientBundle returns the key material to hand to the clients
+func (server *serverAuth) GetClientBundle(contextID string) *ClientBundle {
+	return &ClientBundle{
+		BundleParameters: bundleParameters(server.shared, contextID),
+		PK:               server.pk,
+	}
+}
+
+func (bundle *AuthBundle) file() *keyBundleFile {
+	return &keyBundleFile{Role: RoleAuthServer, BundleParameters: bundle.BundleParameters, SK: bundle.SK, PK: bundle.PK}
+}
+
+func (bundle *EvaluationBundle) file() *keyBundleFile {
+	return &keyBundleFile{
+		Role:             RoleCompServer,
+		BundleParameters: bundle.BundleParameters,
+		PK:               bundle.PK,
+		RelinKey:         bundle.RelinKey,
+		RotKeys:          bundle.RotKeys,
+		PDcds:            bundle.PDcds,
+		HeraModDown:      bundle.HeraModDown,
+		StcModDown:       bundle.StcModDown,
+	}
+}
+
+func (bundle *ClientBundle) file() *keyBundleFile {
+	return &keyBundleFile{
+		Role:             RoleClient,
+		BundleParameters: bundle.BundleParameters,
+		PK:               bundle.PK,
+	}
+}
+
+// KeyBundle is implemented by AuthBundle, EvaluationBundle and ClientBundle
+type KeyBundle interface {
+	Validate() error
+	file() *keyBundleFile
+}
+
+// SerializeKeyBundle writes the bundle with its role to path, readable by the owner only
+func SerializeKeyBundle(bundle KeyBundle, path string) error {
+	if err := bundle.Validate(); err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(bundle.file()); err != nil {
+		return err
+	}
+	// only the owner may read the bundle of the authentication server, which holds the secret key
+	return fileError("write", path, writeAtomicMode(path, buf.Bytes(), 0600))
+}
+
+// readKeyBundle reads a bundle and refuses it if it is not for role or holds material the role must not hold
+func readKeyBundle(path string, role string) (*keyBundleFile, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fileError("read", path, err)
+	}
+	file := new(keyBundleFile)
+	if err = gob.NewDecoder(bytes.NewReader(data)).Decode(file); err != nil {
+		return nil, err
+	}
+	if file.Role != role {
+		return nil, fmt.Errorf("%v holds a bundle for role %q, expected %q", path, file.Role, role)
+	}
+	if role != RoleAuthServer && file.SK != nil {
+		return nil, fmt.Errorf("%v holds a secret key, refused for role %q", path, role)
+	}
+	if role != RoleCompServer && (file.RelinKey != nil || file.RotKeys != nil) {
+		return nil, fmt.Errorf("%v holds evaluation keys, refused for role %q", path, role)
+	}
+	return file, nil
+}
+
+// LoadAuthBundle reads the bundle of the authentication server
+func LoadAuthBundle(path string) (*AuthBundle, error) {
+	file, err := readKeyBundle(path, RoleAuthServer)
+	if err != nil {
+		return nil, err
+	}
+	bundle := &AuthBundle{BundleParameters: file.BundleParameters, SK: file.SK, PK: file.PK}
+	if err = bundle.Validate(); err != nil {
+		return nil, err
+	}
+	return bundle, nil
+}
+
+// LoadEvaluationBundle reads the bundle of the computation server, refusing bundles with a secret key
+func LoadEvaluationBundle(path string) (*EvaluationBundle, error) {
+	file, err := readKeyBundle(path, RoleCompServer)
+	if err != nil {
+		return nil, err
+	}
+	bundle := &EvaluationBundle{
+		BundleParameters: file.BundleParameters,
+		PK:               file.PK,
+		RelinKey:         file.RelinKey,
+		RotKeys:          file.RotKeys,
+		PDcds:            file.PDcds,
+		HeraModDown:      file.HeraModDown,
+		StcModDown:       file.StcModDown,
+	}
+	if err = bundle.Validate(); err != nil {
+		return nil, err
+	}
+	return bundle, nil
+}
+
+// LoadClientBundle reads the bundle of a client, refusing bundles with a secret or evaluation keys
+func LoadClientBundle(path string) (*ClientBundle, error) {
+	file, err := readKeyBundle(path, RoleClient)
+	if err != nil {
+		return nil, err
+	}
+	bundle := &ClientBundle{
+		BundleParameters: file.BundleParameters,
+		PK:               file.PK,
+	}
+	if err = bundle.Validate(); err != nil {
+		return nil, err
+	}
+	return bundle, nil
+}
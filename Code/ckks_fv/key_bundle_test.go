@@ -0,0 +1,188 @@
+package ckks_fv
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+// newTestBundleKeys returns keys of the small test parameters, the bundles only carry them
+func newTestBundleKeys(t *testing.T) (*SecretKey, *PublicKey, *SeededSwitchingKey, *SeededRotationKeySet) {
+	kgen := NewKeyGenerator(newTestCKKSParams(t))
+	sk, pk := kgen.GenKeyPair()
+	return sk, pk, kgen.GenSeededRelinearizationKey(sk), kgen.GenSeededRotationKeysForRotations([]int{1}, false, sk)
+}
+
+func writeBundleFile(t *testing.T, p string, file *keyBundleFile) string {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(file); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(p, buf.Bytes(), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+// TestKeyBundleRoles checks that the auth bundle is written for the owner only and that a secret key or evaluation
+// keys in the bundle of another role are refused
+func TestKeyBundleRoles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bundle")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	sk, pk, rlk, rotKeys := newTestBundleKeys(t)
+	params := BundleParameters{ContextID: "test", Cipher: HERA, NumRound: 4, ParamIndex: 0, Radix: 2, FullCoeffs: true}
+
+	authPath := path.Join(dir, "auth.bundle")
+	if err = SerializeKeyBundle(&AuthBundle{BundleParameters: params, SK: sk, PK: pk}, authPath); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(authPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := info.Mode().Perm(); perm != 0600 {
+		t.Errorf("auth bundle written with permissions %v", perm)
+	}
+	if _, err = LoadAuthBundle(authPath); err != nil {
+		t.Errorf("auth bundle: %v", err)
+	}
+	if _, err = LoadEvaluationBundle(authPath); err == nil {
+		t.Error("auth bundle loaded as evaluation bundle")
+	}
+
+	for _, refused := range []struct {
+		name   string
+		reason string
+		load   func(string) error
+	}{
+		{"comp with secret key", "secret key", func(p string) error {
+			_, err := LoadEvaluationBundle(writeBundleFile(t, p, &keyBundleFile{Role: RoleCompServer, BundleParameters: params,
+				SK: sk, PK: pk, RelinKey: rlk, RotKeys: rotKeys}))
+			return err
+		}},
+		{"client with secret key", "secret key", func(p string) error {
+			_, err := LoadClientBundle(writeBundleFile(t, p, &keyBundleFile{Role: RoleClient, BundleParameters: params,
+				SK: sk, PK: pk}))
+			return err
+		}},
+		{"client with evaluation keys", "evaluation keys", func(p string) error {
+			_, err := LoadClientBundle(writeBundleFile(t, p, &keyBundleFile{Role: RoleClient, BundleParameters: params,
+				PK: pk, RelinKey: rlk}))
+			return err
+		}},
+	} {
+		if err := refused.load(path.Join(dir, "refused.bundle")); err == nil || !strings.Contains(err.Error(), refused.reason) {
+			t.Errorf("%s: got %v, want refusal for the %s", refused.name, err, refused.reason)
+		}
+	}
+}
+
+// TestEvaluationBundleModDown checks that an evaluation bundle whose mod down schedule differs from the one of its
+// parameters is refused
+func TestEvaluationBundleModDown(t *testing.T) {
+	_, pk, rlk, rotKeys := newTestBundleKeys(t)
+	modDown := HeraModDownParams80[0]
+	heraModDown := append([]int{}, modDown.CipherModDown...)
+	heraModDown[0]++
+	bundle := &EvaluationBundle{
+		BundleParameters: BundleParameters{ContextID: "test", Cipher: HERA, NumRound: 4, ParamIndex: 0, Radix: 2, FullCoeffs: true},
+		PK:               pk,
+		RelinKey:         rlk,
+		RotKeys:          rotKeys,
+		PDcds:            [][]*PtDiagMatrixT{{}},
+		HeraModDown:      heraModDown,
+		StcModDown:       modDown.StCModDown,
+	}
+	if _, err := bundle.Shared(); !errors.Is(err, ErrParameterMismatch) {
+		t.Errorf("HERA mod down %v of the schedule %v: got %v, want ErrParameterMismatch", heraModDown, modDown.CipherModDown, err)
+	}
+	bundle.HeraModDown = modDown.CipherModDown
+	bundle.StcModDown = append([]int{}, modDown.StCModDown...)
+	bundle.StcModDown[0]++
+	if _, err := bundle.Shared(); !errors.Is(err, ErrParameterMismatch) {
+		t.Errorf("SlotsToCoeffs mod down %v: got %v, want ErrParameterMismatch", bundle.StcModDown, err)
+	}
+}
+
+// TestEvaluationBundleSeeded checks that the evaluation bundle carries the seeded keys and that they expand to the
+// keys they were generated as after a round trip
+func TestEvaluationBundleSeeded(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bundle")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	params := newTestCKKSParams(t)
+	_, pk, rlk, rotKeys := newTestBundleKeys(t)
+	bundlePath := path.Join(dir, "evaluation.bundle")
+	bundle := &EvaluationBundle{
+		BundleParameters: BundleParameters{ContextID: "test", Cipher: HERA, NumRound: 4, ParamIndex: 0, Radix: 2, FullCoeffs: true},
+		PK:               pk,
+		RelinKey:         rlk,
+		RotKeys:          rotKeys,
+		PDcds:            [][]*PtDiagMatrixT{{}},
+	}
+	if err = SerializeKeyBundle(bundle, bundlePath); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadEvaluationBundle(bundlePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var expandedSize int
+	for _, keys := range []struct {
+		name             string
+		original, loaded WireObject
+	}{
+		{"relinearization key", rlk.RelinearizationKey(params), loaded.RelinKey.RelinearizationKey(params)},
+		{"rotation keys", rotKeys.RotationKeySet(params), loaded.RotKeys.RotationKeySet(params)},
+	} {
+		want, err := keys.original.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := keys.loaded.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("%s expanded from the bundle differ from the generated ones", keys.name)
+		}
+		expandedSize += len(want)
+	}
+	info, err := os.Stat(bundlePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() >= int64(expandedSize) {
+		t.Errorf("evaluation bundle of %d bytes, the expanded keys alone take %d bytes", info.Size(), expandedSize)
+	}
+}
+
+// TestServerAuthBundleMismatch checks that the authentication server is not restored with the evaluation bundle of
+// another context or key pair
+func TestServerAuthBundleMismatch(t *testing.T) {
+	sk, pk, rlk, rotKeys := newTestBundleKeys(t)
+	_, otherPK, _, _ := newTestBundleKeys(t)
+	params := BundleParameters{ContextID: "test", Cipher: HERA, NumRound: 4, ParamIndex: 0, Radix: 2, FullCoeffs: true}
+	bundle := &AuthBundle{BundleParameters: params, SK: sk, PK: pk}
+	otherContext := params
+	otherContext.ContextID = "other"
+	for _, evaluation := range []*EvaluationBundle{
+		{BundleParameters: otherContext, PK: pk, RelinKey: rlk, RotKeys: rotKeys, PDcds: [][]*PtDiagMatrixT{{}}},
+		{BundleParameters: params, PK: otherPK, RelinKey: rlk, RotKeys: rotKeys, PDcds: [][]*PtDiagMatrixT{{}}},
+	} {
+		if _, _, err := NewServerAuthFromBundle(bundle, evaluation); !errors.Is(err, ErrParameterMismatch) {
+			t.Errorf("evaluation bundle of context %s: got %v, want ErrParameterMismatch", evaluation.ContextID, err)
+		}
+	}
+}
@@ -0,0 +1,182 @@
+package ckks_fv
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ErrKeyNotFound is returned for symmetric keys missing in a KeyStore or on the computation server
+var ErrKeyNotFound = errors.New("symmetric key not found")
+
+// keyStoreVersion is the version of the files written by KeyStore.Save
+const keyStoreVersion = 1
+
+// ClientKey is a symmetric key of the client. Registered is set once the computation server holds its FV encryption,
+// the key is then used for all templates until it is rotated. The templates under the key use the nonces of SessionID,
+// Uses is the sequence number of the next template.
+type ClientKey struct {
+	ID         string
+	Key        []uint64
+	SessionID  []byte
+	Created    time.Time
+	Retired    time.Time
+	Registered bool
+	Uses       uint64
+}
+
+// Active reports whether the key has not been retired
+func (key *ClientKey) Active() bool {
+	return key.Retired.IsZero()
+}
+
+// KeyStore keeps the symmetric keys of a client. At most one key is current, rotating retires it and generates a new
+// one. Retired keys are kept until they are deleted, so that the client can remove them from the computation server.
+type KeyStore interface {
+	// Current returns the current key, nil if there is none
+	Current() *ClientKey
+	// Rotate retires the current key and returns a new current key
+	Rotate() *ClientKey
+	// Use returns the current key and counts its use, rotating first if there is no current key
+	Use() *ClientKey
+	Get(id string) (*ClientKey, error)
+	Keys() []*ClientKey
+	MarkRegistered(id string) error
+	Delete(id string) error
+	// Save writes the keys to path, readable by the owner only
+	Save(path string) error
+}
+
+type keyStore struct {
+	mutex   sync.Mutex
+	client  Client
+	keys    map[string]*ClientKey
+	current string
+}
+
+// keyStoreFile is the content of the file written by Save
+type keyStoreFile struct {
+	Version int
+	Current string
+	Keys    []*ClientKey
+}
+
+// NewKeyStore returns an empty KeyStore generating its keys with client
+func NewKeyStore(client Client) KeyStore {
+	return &keyStore{client: client, keys: make(map[string]*ClientKey)}
+}
+
+// LoadKeyStore reads a KeyStore saved at path, a missing file returns an error matching ErrMissingFile
+func LoadKeyStore(path string, client Client) (KeyStore, error) {
+	file := new(keyStoreFile)
+	if err := readGob(path, file); err != nil {
+		return nil, fileError("read", path, err)
+	}
+	if file.Version != keyStoreVersion {
+		return nil, fmt.Errorf("%w: key store version %d", ErrParameterMismatch, file.Version)
+	}
+	store := &keyStore{client: client, keys: make(map[string]*ClientKey), current: file.Current}
+	for _, key := range file.Keys {
+		store.keys[key.ID] = key
+	}
+	return store, nil
+}
+
+func (store *keyStore) Current() *ClientKey {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	return store.keys[store.current]
+}
+
+// rotate retires the current key and generates a new one, the caller holds the mutex
+func (store *keyStore) rotate() *ClientKey {
+	now := time.Now()
+	if current, ok := store.keys[store.current]; ok {
+		current.Retired = now
+	}
+	key := &ClientKey{ID: newRequestID(), Key: store.client.GenerateRandomKey(), SessionID: NewSessionID(), Created: now}
+	store.keys[key.ID] = key
+	store.current = key.ID
+	return key
+}
+
+func (store *keyStore) Rotate() *ClientKey {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	return store.rotate()
+}
+
+func (store *keyStore) Use() *ClientKey {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	key, ok := store.keys[store.current]
+	if !ok {
+		key = store.rotate()
+	}
+	key.Uses++
+	return key
+}
+
+func (store *keyStore) Get(id string) (*ClientKey, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	key, ok := store.keys[id]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrKeyNotFound, id)
+	}
+	return key, nil
+}
+
+// Keys returns all keys, oldest first
+func (store *keyStore) Keys() []*ClientKey {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	keys := make([]*ClientKey, 0, len(store.keys))
+	for _, key := range store.keys {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].Created.Before(keys[j].Created)
+	})
+	return keys
+}
+
+func (store *keyStore) MarkRegistered(id string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	key, ok := store.keys[id]
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrKeyNotFound, id)
+	}
+	key.Registered = true
+	return nil
+}
+
+func (store *keyStore) Delete(id string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	if _, ok := store.keys[id]; !ok {
+		return fmt.Errorf("%w: %s", ErrKeyNotFound, id)
+	}
+	delete(store.keys, id)
+	if store.current == id {
+		store.current = ""
+	}
+	return nil
+}
+
+func (store *keyStore) Save(path string) error {
+	store.mutex.Lock()
+	file := &keyStoreFile{Version: keyStoreVersion, Current: store.current}
+	for _, key := range store.keys {
+		file.Keys = append(file.Keys, key)
+	}
+	data, err := encodeGob(file)
+	store.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+	return fileError("write", path, writeAtomicMode(path, data, 0600))
+}
@@ -26,6 +26,9 @@ type KeyGenerator interface {
 
 	GenRotationKeysForRotations(ks []int, includeConjugate bool, sk *SecretKey) (rks *RotationKeySet)
 
+	GenSeededRelinearizationKey(sk *SecretKey) (rlk *SeededSwitchingKey)
+	GenSeededRotationKeysForRotations(ks []int, includeConjugate bool, sk *SecretKey) (rks *SeededRotationKeySet)
+
 	GenRotationIndexesForBootstrapping(logSlots int, btpParams *BootstrappingParameters) []int
 	GenRotationIndexesForHalfBoot(logSlots int, hbtpParams *HalfBootParameters) []int
 
@@ -296,6 +299,48 @@ func (keygen *keyGenerator) GenRotationKeysForRotations(ks []int, includeConjuga
 	return keygen.GenRotationKeys(galEls, sk)
 }
 
+// withSeed samples the uniform polynomials of the keys generated by gen from the seed
+func (keygen *keyGenerator) withSeed(seed []byte, gen func()) {
+	prng, err := utils.NewKeyedPRNG(seed)
+	if err != nil {
+		panic(err)
+	}
+	uniformSampler := keygen.uniformSampler
+	keygen.uniformSampler = ring.NewUniformSampler(prng, keygen.ringQP)
+	gen()
+	keygen.uniformSampler = uniformSampler
+}
+
+// GenSeededRelinearizationKey generates a relinearization key in seeded form, see SeededSwitchingKey.
+func (keygen *keyGenerator) GenSeededRelinearizationKey(sk *SecretKey) (rlk *SeededSwitchingKey) {
+	seed := NewSeed()
+	keygen.withSeed(seed, func() {
+		rlk = newSeededSwitchingKey(seed, keygen.GenRelinearizationKey(sk).Keys[0])
+	})
+	return
+}
+
+// GenSeededRotationKeysForRotations generates the keys of GenRotationKeysForRotations in seeded form, with one seed per key.
+func (keygen *keyGenerator) GenSeededRotationKeysForRotations(ks []int, includeConjugate bool, sk *SecretKey) (rks *SeededRotationKeySet) {
+	galEls := make([]uint64, len(ks), len(ks)+1)
+	for i, k := range ks {
+		galEls[i] = keygen.params.GaloisElementForColumnRotationBy(k)
+	}
+	if includeConjugate {
+		galEls = append(galEls, keygen.params.GaloisElementForRowRotation())
+	}
+	rks = &SeededRotationKeySet{Keys: make(map[uint64]*SeededSwitchingKey, len(galEls))}
+	for _, galEl := range galEls {
+		seed := NewSeed()
+		keygen.withSeed(seed, func() {
+			swk := NewSwitchingKey(keygen.params)
+			keygen.genrotKey(sk.Value, keygen.params.InverseGaloisElement(galEl), &swk.SwitchingKey)
+			rks.Keys[galEl] = newSeededSwitchingKey(seed, &swk.SwitchingKey)
+		})
+	}
+	return rks
+}
+
 // GenRotationIndexesForInnerSumNaive generates the rotation indexes for the
 // InnerSumNaive. To be then used with GenRotationKeysForRotations to generate
 // the RotationKeySet.
@@ -0,0 +1,78 @@
+package ckks_fv
+
+import (
+	"sync"
+)
+
+// Keystream is the FV keystream of the nonces of one symmetric ciphertext, evaluated by PrecomputeKeystream before
+// the ciphertext arrives. Its blocks are in the coefficients at level 0, ready to be removed from the ciphertext.
+type Keystream struct {
+	SessionID []byte
+	Sequence  uint64
+	Blocks    []*Ciphertext
+}
+
+// KeystreamCache keeps the keystreams precomputed for the registered keys until the ciphertext encrypted under
+// their nonces is transciphered. Each keystream is handed out once.
+type KeystreamCache interface {
+	// Put stores the keystream of the key, it returns false if the cache is full
+	Put(keyID string, keystream *Keystream) bool
+	// Take removes and returns the keystream of the key for the nonces, nil if none was precomputed
+	Take(keyID string, nonces *NonceSet) *Keystream
+	// Drop removes all keystreams of the key
+	Drop(keyID string)
+	Len() int
+}
+
+type keystreamEntry struct {
+	keyID     string
+	sessionID string
+	sequence  uint64
+}
+
+type keystreamCache struct {
+	mutex      sync.Mutex
+	capacity   int
+	keystreams map[keystreamEntry]*Keystream
+}
+
+// NewKeystreamCache returns a KeystreamCache holding at most capacity keystreams
+func NewKeystreamCache(capacity int) KeystreamCache {
+	return &keystreamCache{capacity: capacity, keystreams: make(map[keystreamEntry]*Keystream)}
+}
+
+func (cache *keystreamCache) Put(keyID string, keystream *Keystream) bool {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	entry := keystreamEntry{keyID, string(keystream.SessionID), keystream.Sequence}
+	if _, ok := cache.keystreams[entry]; !ok && len(cache.keystreams) >= cache.capacity {
+		return false
+	}
+	cache.keystreams[entry] = keystream
+	return true
+}
+
+func (cache *keystreamCache) Take(keyID string, nonces *NonceSet) *Keystream {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	entry := keystreamEntry{keyID, string(nonces.SessionID), nonces.Sequence}
+	keystream := cache.keystreams[entry]
+	delete(cache.keystreams, entry)
+	return keystream
+}
+
+func (cache *keystreamCache) Drop(keyID string) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	for entry := range cache.keystreams {
+		if entry.keyID == keyID {
+			delete(cache.keystreams, entry)
+		}
+	}
+}
+
+func (cache *keystreamCache) Len() int {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	return len(cache.keystreams)
+}
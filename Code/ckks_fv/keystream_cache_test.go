@@ -0,0 +1,29 @@
+package ckks_fv
+
+import (
+	"testing"
+)
+
+// TestKeystreamCache checks that precomputed keystreams are handed out once, per key and nonces, up to the capacity
+func TestKeystreamCache(t *testing.T) {
+	sessionID := NewSessionID()
+	cache := NewKeystreamCache(2)
+	first, second := DeriveNonces(sessionID, 0, 4), DeriveNonces(sessionID, 1, 4)
+	keystream := &Keystream{SessionID: first.SessionID, Sequence: first.Sequence}
+	if !cache.Put("a", keystream) || !cache.Put("b", &Keystream{SessionID: first.SessionID, Sequence: first.Sequence}) {
+		t.Fatal("cache refused a keystream below its capacity")
+	}
+	if cache.Put("a", &Keystream{SessionID: second.SessionID, Sequence: second.Sequence}) {
+		t.Error("cache accepted a keystream above its capacity")
+	}
+	if cache.Take("a", second) != nil {
+		t.Error("keystream of other nonces returned")
+	}
+	if cache.Take("a", first) != keystream || cache.Take("a", first) != nil {
+		t.Error("keystream not handed out exactly once")
+	}
+	cache.Drop("b")
+	if cache.Len() != 0 {
+		t.Errorf("%d keystreams left after dropping the key", cache.Len())
+	}
+}
@@ -0,0 +1,200 @@
+package ckks_fv
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LogLevel is the severity of a log event
+type LogLevel int
+
+// Levels of the log events, the pipeline stages are logged at LogDebug
+const (
+	LogDebug LogLevel = iota
+	LogInfo
+	LogWarn
+	LogError
+)
+
+func (level LogLevel) String() string {
+	switch level {
+	case LogDebug:
+		return "debug"
+	case LogInfo:
+		return "info"
+	case LogWarn:
+		return "warn"
+	case LogError:
+		return "error"
+	default:
+		return fmt.Sprintf("level(%d)", int(level))
+	}
+}
+
+// Pipeline stages of the parties. StageCoeffsToSlots and StageEvalSine are the sub-steps of StageHalfBoot and
+// StageRefresh, the half-boot that refreshes the slots of a comparison result.
+const (
+	StageSymEncrypt      = "sym_encrypt"
+	StageKeyEncrypt      = "key_encrypt"
+	StageKeystream       = "keystream"
+	StageSlotsToCoeffs   = "slots_to_coeffs"
+	StageModSwitch       = "mod_switch"
+	StageRemoveKeystream = "remove_keystream"
+	StageHalfBoot        = "half_boot"
+	StageRefresh         = "refresh"
+	StageCoeffsToSlots   = "coeffs_to_slots"
+	StageEvalSine        = "eval_sine"
+	StageDistance        = "distance"
+	StageDecrypt         = "decrypt"
+)
+
+// Field is a key-value pair of a log event
+type Field struct {
+	Key   string
+	Value interface{}
+}
+
+// Event is a log event. Events of a pipeline stage carry the stage, its start and duration,
+// so that a Logger can also forward them to a tracer.
+type Event struct {
+	Time     time.Time
+	Level    LogLevel
+	Stage    string
+	Message  string
+	Start    time.Time
+	Duration time.Duration
+	Fields   []Field
+}
+
+// Logger receives the log events of Shared and the parties. Events are passed through logEvent before,
+// which redacts every field that is not a bool, string, duration, []int or a number other than uint64, the type of
+// the symmetric key elements. So keys, plaintexts and ciphertexts never reach a Logger.
+type Logger interface {
+	Log(event *Event)
+}
+
+type nopLogger struct{}
+
+func (nopLogger) Log(*Event) {}
+
+// NewNopLogger returns a Logger that drops all events
+func NewNopLogger() Logger {
+	return nopLogger{}
+}
+
+type textLogger struct {
+	mu       sync.Mutex
+	w        io.Writer
+	minLevel LogLevel
+}
+
+// NewTextLogger returns a Logger that writes the events of at least minLevel to w, one line of key=value pairs per event
+func NewTextLogger(w io.Writer, minLevel LogLevel) Logger {
+	return &textLogger{w: w, minLevel: minLevel}
+}
+
+// defaultLogger is used while no Logger is set, it writes info and above to stdout as the prints did before
+var defaultLogger = NewTextLogger(os.Stdout, LogInfo)
+
+func (logger *textLogger) Log(event *Event) {
+	if event.Level < logger.minLevel {
+		return
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "time=%s level=%s", event.Time.Format(time.RFC3339Nano), event.Level)
+	if event.Stage != "" {
+		fmt.Fprintf(&b, " stage=%s", event.Stage)
+	}
+	if event.Message != "" {
+		fmt.Fprintf(&b, " msg=%q", event.Message)
+	}
+	if event.Duration != 0 {
+		fmt.Fprintf(&b, " duration=%s", event.Duration)
+	}
+	for _, f := range event.Fields {
+		fmt.Fprintf(&b, " %s=%v", f.Key, f.Value)
+	}
+	b.WriteByte('\n')
+	logger.mu.Lock()
+	defer logger.mu.Unlock()
+	io.WriteString(logger.w, b.String())
+}
+
+// redactedValue replaces the values of fields that could hold secret material
+const redactedValue = "[redacted]"
+
+func redact(value interface{}) interface{} {
+	switch value.(type) {
+	case bool, string, int, int8, int16, int32, int64, uint, uint8, uint16, uint32, float32, float64, time.Duration, []int:
+		return value
+	default:
+		return redactedValue
+	}
+}
+
+// logEvent redacts the fields of the event and passes it to logger, nil logs to the default logger
+func logEvent(logger Logger, event *Event) {
+	if logger == nil {
+		logger = defaultLogger
+	}
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	for i := range event.Fields {
+		event.Fields[i].Value = redact(event.Fields[i].Value)
+	}
+	logger.Log(event)
+}
+
+// logMessage logs a constant message, values go into the fields so that they are redacted
+func logMessage(logger Logger, level LogLevel, message string, fields ...Field) {
+	logEvent(logger, &Event{Level: level, Message: message, Fields: fields})
+}
+
+// stageTimer measures a pipeline stage
+type stageTimer struct {
+	logger Logger
+	stage  string
+	start  time.Time
+	fields []Field
+}
+
+func startStage(logger Logger, stage string, fields ...Field) *stageTimer {
+	return &stageTimer{logger: logger, stage: stage, start: time.Now(), fields: fields}
+}
+
+// done logs the stage with its duration and the level and scale of the resulting ciphertext, ct may be nil
+func (timer *stageTimer) done(ct *Ciphertext) {
+	fields := timer.fields
+	if ct != nil {
+		fields = append(fields, Field{"level", ct.Level()}, Field{"scale", ct.Scale()})
+	}
+	logEvent(timer.logger, &Event{
+		Level:    LogDebug,
+		Stage:    timer.stage,
+		Start:    timer.start,
+		Duration: time.Since(timer.start),
+		Fields:   fields,
+	})
+}
+
+// partyLogger is embedded into the parties, which log to the Logger of their Shared unless SetLogger overrides it
+type partyLogger struct {
+	logger Logger
+}
+
+// SetLogger sets the Logger of the party, nil logs to the Logger of Shared again
+func (p *partyLogger) SetLogger(logger Logger) {
+	p.logger = logger
+}
+
+func (p *partyLogger) log(shared Shared) Logger {
+	if p.logger != nil {
+		return p.logger
+	}
+	return shared.GetLogger()
+}
@@ -0,0 +1,54 @@
+package ckks_fv
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+type recordingLogger struct {
+	events []*Event
+}
+
+func (logger *recordingLogger) Log(event *Event) {
+	logger.events = append(logger.events, event)
+}
+
+// TestLoggerRedaction logs primitive fields next to key material, ciphertexts and other values and checks that only
+// the primitive fields reach the Logger and the text output
+func TestLoggerRedaction(t *testing.T) {
+	params := newTestCKKSParams(t)
+	ct := NewCiphertextCKKS(params, 1, params.MaxLevel(), params.Scale())
+	kept := []Field{{"ok", true}, {"name", "alice"}, {"count", 3}, {"ratio", 0.5}, {"elapsed", time.Second}, {"rotations", []int{1, 2}}}
+	redacted := []Field{{"key", []uint64{12345678, 87654321}}, {"element", uint64(12345678)}, {"nonce", []byte{0xde, 0xad}},
+		{"ciphertext", ct}, {"values", []float64{0.25}}, {"fields", map[string]int{"a": 1}}, {"field", Field{"a", 1}}}
+
+	logger := new(recordingLogger)
+	logMessage(logger, LogInfo, "fields", append(append([]Field{}, kept...), redacted...)...)
+	if len(logger.events) != 1 {
+		t.Fatalf("%d events logged", len(logger.events))
+	}
+	fields := logger.events[0].Fields
+	for i, f := range kept {
+		if got := fields[i]; got.Key != f.Key || !reflect.DeepEqual(got.Value, f.Value) {
+			t.Errorf("field %s is %v, expected %v", f.Key, got.Value, f.Value)
+		}
+	}
+	for i, f := range redacted {
+		if got := fields[len(kept)+i]; got.Value != redactedValue {
+			t.Errorf("field %s of type %T is %v, expected it redacted", f.Key, f.Value, got.Value)
+		}
+	}
+
+	var buf bytes.Buffer
+	text := NewTextLogger(&buf, LogInfo)
+	logMessage(text, LogDebug, "dropped", Field{"count", 1})
+	logMessage(text, LogWarn, "written", Field{"count", 2}, Field{"key", []uint64{12345678}})
+	startStage(text, StageDistance).done(ct)
+	line := buf.String()
+	if strings.Count(line, "\n") != 1 || !strings.Contains(line, `level=warn msg="written" count=2 key=[redacted]`) || strings.Contains(line, "12345678") {
+		t.Errorf("text output %q", line)
+	}
+}
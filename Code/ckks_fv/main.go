@@ -1,22 +1,8 @@
 package ckks_fv
 
-import (
-	"crypto/rand"
-	"fmt"
-	"math"
-	mrand "math/rand"
-	"sort"
-
-	//"github.com/ldsec/lattigo/v2/ckks"
-
-	"github.com/ldsec/lattigo/v2/utils"
-	"golang.org/x/crypto/sha3"
-)
-
-
+// Test runs the evaluation on the paths below, cmd/mtpro eval takes them as flags
 func Test() {
-	testdatabase := true
-	//add paths here 
+	//add paths here
 	ptPath := ""
 	encPath := ""
 	contextPath := ""
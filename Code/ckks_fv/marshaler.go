@@ -0,0 +1,675 @@
+package ckks_fv
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+
+	"github.com/ldsec/lattigo/v2/ring"
+)
+
+// WireVersion is the version of the wire format written by WireCodec
+const WireVersion = 1
+
+// Types of the objects in the wire format
+const (
+	WireCiphertext = iota + 1
+	WirePlaintextRingT
+	WirePublicKey
+	WireRelinearizationKey
+	WireRotationKeySet
+	WireEncryptedKey
+	WireSeededCiphertext
+	WireSeededSwitchingKey
+	WireSeededRotationKeySet
+)
+
+// WireHeaderLen is the length in bytes of the header written by WireCodec
+const WireHeaderLen = 13
+
+var wireMagic = [2]byte{'R', 'F'}
+
+// WireHeader precedes every object in the wire format:
+// 2 byte : magic "RF"
+// 1 byte : format version
+// 1 byte : object type
+// 1 byte : level, the maximum level of the parameters for keys
+// 8 byte : first 8 bytes of the SHA-256 of the marshaled parameters
+type WireHeader struct {
+	Version    uint8
+	Type       uint8
+	Level      uint8
+	ParamsHash [8]byte
+}
+
+// WireObject is an object that can be sent in the wire format
+type WireObject interface {
+	MarshalBinary() ([]byte, error)
+	UnmarshalBinary(data []byte) error
+	wireType() uint8
+}
+
+// WireCodec marshals objects together with a WireHeader for its parameters and
+// rejects data of other versions, types, parameters or levels when unmarshaling.
+type WireCodec struct {
+	params     *Parameters
+	paramsHash [8]byte
+}
+
+// ParametersHash returns the first 8 bytes of the SHA-256 of the marshaled parameters
+func ParametersHash(params *Parameters) [8]byte {
+	data, err := params.MarshalBinary()
+	if err != nil {
+		panic(err)
+	}
+	sum := sha256.Sum256(data)
+	var hash [8]byte
+	copy(hash[:], sum[:8])
+	return hash
+}
+
+// NewWireCodec returns a WireCodec for the given parameters
+func NewWireCodec(params *Parameters) *WireCodec {
+	return &WireCodec{params: params, paramsHash: ParametersHash(params)}
+}
+
+// wireLevel returns the level written to the header of the object
+func (codec *WireCodec) wireLevel(v WireObject) int {
+	if leveled, ok := v.(interface{ Level() int }); ok {
+		return leveled.Level()
+	}
+	return codec.params.MaxLevel()
+}
+
+// Marshal returns the header followed by the binary encoding of v
+func (codec *WireCodec) Marshal(v WireObject) ([]byte, error) {
+	body, err := v.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	data := make([]byte, WireHeaderLen, WireHeaderLen+len(body))
+	copy(data[0:2], wireMagic[:])
+	data[2] = WireVersion
+	data[3] = v.wireType()
+	data[4] = uint8(codec.wireLevel(v))
+	copy(data[5:13], codec.paramsHash[:])
+	return append(data, body...), nil
+}
+
+// ReadWireHeader decodes the header at the beginning of data
+func ReadWireHeader(data []byte) (*WireHeader, error) {
+	if len(data) < WireHeaderLen || data[0] != wireMagic[0] || data[1] != wireMagic[1] {
+		return nil, errors.New("not in the wire format")
+	}
+	header := &WireHeader{Version: data[2], Type: data[3], Level: data[4]}
+	copy(header.ParamsHash[:], data[5:13])
+	return header, nil
+}
+
+// Unmarshal checks the header of data and decodes the rest on v
+func (codec *WireCodec) Unmarshal(data []byte, v WireObject) error {
+	header, err := ReadWireHeader(data)
+	if err != nil {
+		return err
+	}
+	if header.Version != WireVersion {
+		return fmt.Errorf("unsupported wire format version %d", header.Version)
+	}
+	if header.Type != v.wireType() {
+		return fmt.Errorf("wire object of type %d instead of %d", header.Type, v.wireType())
+	}
+	if header.ParamsHash != codec.paramsHash {
+		return errors.New("wire object was created with other parameters")
+	}
+	if int(header.Level) > codec.params.MaxLevel() {
+		return fmt.Errorf("level %d exceeds the maximum level %d of the parameters", header.Level, codec.params.MaxLevel())
+	}
+	if err = v.UnmarshalBinary(data[WireHeaderLen:]); err != nil {
+		return err
+	}
+	if level := codec.wireLevel(v); level != int(header.Level) {
+		return fmt.Errorf("level %d does not match the header level %d", level, header.Level)
+	}
+	if el, ok := v.(interface{ ringDegree() int }); ok {
+		if degree := el.ringDegree(); degree != codec.params.N() {
+			return fmt.Errorf("ring degree %d instead of %d", degree, codec.params.N())
+		}
+	}
+	return nil
+}
+
+func (el *Element) ringDegree() int {
+	return el.value[0].Degree()
+}
+
+// getDataLen returns the length in bytes of the encoded Element
+func (el *Element) getDataLen() (dataLen int) {
+	// MetaData is :
+	// 1 byte : Degree + 1
+	// 8 byte : Scale
+	// 1 byte : isNTT
+	dataLen = 10
+	for _, pol := range el.value {
+		dataLen += pol.GetDataLen(true)
+	}
+	return dataLen
+}
+
+// marshalBinary encodes the Element as the Ciphertext of the ckks package
+func (el *Element) marshalBinary() (data []byte, err error) {
+	data = make([]byte, el.getDataLen())
+	data[0] = uint8(len(el.value))
+	binary.LittleEndian.PutUint64(data[1:9], math.Float64bits(el.scale))
+	if el.isNTT {
+		data[9] = 1
+	}
+	var pointer, inc int
+	pointer = 10
+	for _, pol := range el.value {
+		if inc, err = pol.WriteTo(data[pointer:]); err != nil {
+			return nil, err
+		}
+		pointer += inc
+	}
+	return data, nil
+}
+
+// decodePoly decodes a polynomial written by ring.Poly.WriteTo and returns the number of bytes read
+func decodePoly(data []byte) (*ring.Poly, int, error) {
+	if len(data) < 2 {
+		return nil, 0, errors.New("too small bytearray")
+	}
+	//2 byte metadata : logN and number of moduli, then 8 byte per coefficient
+	if data[0] > MaxLogN || len(data) < 2+(int(data[1])<<(data[0]+3)) {
+		return nil, 0, errors.New("invalid polynomial encoding")
+	}
+	pol := new(ring.Poly)
+	pointer, err := pol.DecodePolyNew(data)
+	return pol, pointer, err
+}
+
+// unmarshalBinary decodes an Element encoded by marshalBinary
+func (el *Element) unmarshalBinary(data []byte) (err error) {
+	if len(data) < 10 {
+		return errors.New("too small bytearray")
+	}
+	el.value = make([]*ring.Poly, data[0])
+	if len(el.value) == 0 {
+		return errors.New("element without polynomials")
+	}
+	el.scale = math.Float64frombits(binary.LittleEndian.Uint64(data[1:9]))
+	el.isNTT = data[9] == 1
+	var pointer, inc int
+	pointer = 10
+	for i := range el.value {
+		if el.value[i], inc, err = decodePoly(data[pointer:]); err != nil {
+			return err
+		}
+		if el.value[i].Degree() != el.value[0].Degree() || el.value[i].LenModuli() != el.value[0].LenModuli() {
+			return errors.New("polynomials of different rings")
+		}
+		pointer += inc
+	}
+	if pointer != len(data) {
+		return errors.New("remaining unparsed data")
+	}
+	return nil
+}
+
+// MarshalBinary encodes the Ciphertext as in the ckks package:
+// 1 byte degree + 1, 8 byte scale, 1 byte isNTT, followed by the polynomials.
+func (ciphertext *Ciphertext) MarshalBinary() ([]byte, error) {
+	return ciphertext.Element.marshalBinary()
+}
+
+// UnmarshalBinary decodes a Ciphertext encoded by MarshalBinary
+func (ciphertext *Ciphertext) UnmarshalBinary(data []byte) error {
+	ciphertext.Element = new(Element)
+	return ciphertext.Element.unmarshalBinary(data)
+}
+
+func (ciphertext *Ciphertext) wireType() uint8 {
+	return WireCiphertext
+}
+
+// MarshalBinary encodes the PlaintextRingT like a Ciphertext of degree 0
+func (pt *PlaintextRingT) MarshalBinary() ([]byte, error) {
+	return pt.Element.marshalBinary()
+}
+
+// UnmarshalBinary decodes a PlaintextRingT encoded by MarshalBinary
+func (pt *PlaintextRingT) UnmarshalBinary(data []byte) error {
+	pt.Element = new(Element)
+	if err := pt.Element.unmarshalBinary(data); err != nil {
+		return err
+	}
+	if len(pt.Element.value) != 1 {
+		return errors.New("plaintext with more than one polynomial")
+	}
+	pt.value = pt.Element.value[0]
+	return nil
+}
+
+func (pt *PlaintextRingT) wireType() uint8 {
+	return WirePlaintextRingT
+}
+
+// unmarshalKey decodes a key with the decoder of the rlwe package, which does not check the length of data
+// and may panic on truncated data, and checks that all of data was used
+func unmarshalKey(data []byte, unmarshal func([]byte) error, dataLen func() int) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("invalid key encoding: %v", r)
+		}
+	}()
+	if err = unmarshal(data); err != nil {
+		return err
+	}
+	if dataLen() != len(data) {
+		return errors.New("invalid key encoding")
+	}
+	return nil
+}
+
+// MarshalBinary encodes the PublicKey as in the rlwe package
+func (pk *PublicKey) MarshalBinary() ([]byte, error) {
+	return pk.PublicKey.MarshalBinary()
+}
+
+// UnmarshalBinary decodes a PublicKey encoded by MarshalBinary
+func (pk *PublicKey) UnmarshalBinary(data []byte) error {
+	return unmarshalKey(data, pk.PublicKey.UnmarshalBinary, func() int { return pk.PublicKey.GetDataLen(true) })
+}
+
+func (pk *PublicKey) wireType() uint8 {
+	return WirePublicKey
+}
+
+// MarshalBinary encodes the RelinearizationKey as in the rlwe package
+func (rlk *RelinearizationKey) MarshalBinary() ([]byte, error) {
+	return rlk.RelinearizationKey.MarshalBinary()
+}
+
+// UnmarshalBinary decodes a RelinearizationKey encoded by MarshalBinary
+func (rlk *RelinearizationKey) UnmarshalBinary(data []byte) error {
+	return unmarshalKey(data, rlk.RelinearizationKey.UnmarshalBinary, func() int { return rlk.RelinearizationKey.GetDataLen(true) })
+}
+
+func (rlk *RelinearizationKey) wireType() uint8 {
+	return WireRelinearizationKey
+}
+
+// MarshalBinary encodes the RotationKeySet as in the rlwe package
+func (rtks *RotationKeySet) MarshalBinary() ([]byte, error) {
+	return rtks.RotationKeySet.MarshalBinary()
+}
+
+// UnmarshalBinary decodes a RotationKeySet encoded by MarshalBinary
+func (rtks *RotationKeySet) UnmarshalBinary(data []byte) error {
+	return unmarshalKey(data, rtks.RotationKeySet.UnmarshalBinary, func() int { return rtks.RotationKeySet.GetDataLen(true) })
+}
+
+func (rtks *RotationKeySet) wireType() uint8 {
+	return WireRotationKeySet
+}
+
+// EncryptedKey is the symmetric key of the client encrypted under the FV scheme, one ciphertext per key element,
+// as returned next to the symmetric ciphertexts by the client and consumed by the transciphering of ServerComp.
+type EncryptedKey struct {
+	Cipher      int
+	Ciphertexts []*Ciphertext
+}
+
+// NewEncryptedKey returns the EncryptedKey of the key ciphertexts for the given cipher
+func NewEncryptedKey(cipher int, kCt []*Ciphertext) *EncryptedKey {
+	return &EncryptedKey{Cipher: cipher, Ciphertexts: kCt}
+}
+
+// Level returns the level of the key ciphertexts
+func (key *EncryptedKey) Level() int {
+	return key.Ciphertexts[0].Level()
+}
+
+// MarshalBinary encodes the EncryptedKey:
+// 1 byte cipher, 4 byte number of ciphertexts, then for each ciphertext its length (8 byte) and encoding.
+func (key *EncryptedKey) MarshalBinary() ([]byte, error) {
+	if len(key.Ciphertexts) == 0 {
+		return nil, errors.New("encrypted key without ciphertexts")
+	}
+	data := make([]byte, 5)
+	data[0] = uint8(key.Cipher)
+	binary.LittleEndian.PutUint32(data[1:5], uint32(len(key.Ciphertexts)))
+	for _, ct := range key.Ciphertexts {
+		ctData, err := ct.MarshalBinary()
+		if err != nil {
+			return nil, err
+		}
+		data = appendChunk(data, ctData)
+	}
+	return data, nil
+}
+
+// UnmarshalBinary decodes an EncryptedKey encoded by MarshalBinary
+func (key *EncryptedKey) UnmarshalBinary(data []byte) error {
+	if len(data) < 5 {
+		return errors.New("too small bytearray")
+	}
+	key.Cipher = int(data[0])
+	if key.Cipher != HERA && key.Cipher != RUBATO {
+		return fmt.Errorf("unknown cipher %d", key.Cipher)
+	}
+	count := int(binary.LittleEndian.Uint32(data[1:5]))
+	if count == 0 || count > len(data) {
+		return errors.New("invalid number of key ciphertexts")
+	}
+	key.Ciphertexts = make([]*Ciphertext, count)
+	pointer := 5
+	for i := range key.Ciphertexts {
+		chunk, inc, err := readChunk(data[pointer:])
+		if err != nil {
+			return err
+		}
+		key.Ciphertexts[i] = new(Ciphertext)
+		if err = key.Ciphertexts[i].UnmarshalBinary(chunk); err != nil {
+			return err
+		}
+		if key.Ciphertexts[i].Level() != key.Ciphertexts[0].Level() {
+			return errors.New("key ciphertexts at different levels")
+		}
+		pointer += inc
+	}
+	if pointer != len(data) {
+		return errors.New("remaining unparsed data")
+	}
+	return nil
+}
+
+func (key *EncryptedKey) wireType() uint8 {
+	return WireEncryptedKey
+}
+
+func (key *EncryptedKey) ringDegree() int {
+	return key.Ciphertexts[0].ringDegree()
+}
+
+// marshalSeed writes the length of the seed in one byte followed by the seed
+func marshalSeed(data []byte, seed []byte) []byte {
+	data = append(data, uint8(len(seed)))
+	return append(data, seed...)
+}
+
+func unmarshalSeed(data []byte) ([]byte, int, error) {
+	if len(data) < 1 || len(data) < 1+int(data[0]) {
+		return nil, 0, errors.New("too small bytearray")
+	}
+	seed := make([]byte, data[0])
+	copy(seed, data[1:])
+	return seed, 1 + len(seed), nil
+}
+
+// appendChunk writes the length of chunk in 8 byte followed by chunk
+func appendChunk(data []byte, chunk []byte) []byte {
+	var length [8]byte
+	binary.LittleEndian.PutUint64(length[:], uint64(len(chunk)))
+	data = append(data, length[:]...)
+	return append(data, chunk...)
+}
+
+// readChunk returns the chunk written by appendChunk at the beginning of data and the number of bytes read
+func readChunk(data []byte) ([]byte, int, error) {
+	if len(data) < 8 {
+		return nil, 0, errors.New("too small bytearray")
+	}
+	length := binary.LittleEndian.Uint64(data[:8])
+	if uint64(len(data)-8) < length {
+		return nil, 0, errors.New("too small bytearray")
+	}
+	return data[8 : 8+length], 8 + int(length), nil
+}
+
+// MarshalBinary encodes the SeededCiphertext: seed, 8 byte scale, 1 byte isNTT, then the first polynomial
+func (ct *SeededCiphertext) MarshalBinary() ([]byte, error) {
+	data := marshalSeed(make([]byte, 0, 2+len(ct.Seed)+9+ct.Value.GetDataLen(true)), ct.Seed)
+	var scale [8]byte
+	binary.LittleEndian.PutUint64(scale[:], math.Float64bits(ct.Scale))
+	data = append(data, scale[:]...)
+	data = append(data, boolByte(ct.IsNTT))
+	pol, err := ct.Value.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	return append(data, pol...), nil
+}
+
+// UnmarshalBinary decodes a SeededCiphertext encoded by MarshalBinary
+func (ct *SeededCiphertext) UnmarshalBinary(data []byte) (err error) {
+	var pointer, inc int
+	if ct.Seed, pointer, err = unmarshalSeed(data); err != nil {
+		return err
+	}
+	if len(data)-pointer < 9 {
+		return errors.New("too small bytearray")
+	}
+	ct.Scale = math.Float64frombits(binary.LittleEndian.Uint64(data[pointer : pointer+8]))
+	ct.IsNTT = data[pointer+8] == 1
+	pointer += 9
+	if ct.Value, inc, err = decodePoly(data[pointer:]); err != nil {
+		return err
+	}
+	if pointer+inc != len(data) {
+		return errors.New("remaining unparsed data")
+	}
+	return nil
+}
+
+func (ct *SeededCiphertext) wireType() uint8 {
+	return WireSeededCiphertext
+}
+
+// MarshalBinary encodes the SeededSwitchingKey: seed, 1 byte number of polynomials, then the polynomials
+func (swk *SeededSwitchingKey) MarshalBinary() ([]byte, error) {
+	data := marshalSeed(make([]byte, 0), swk.Seed)
+	data = append(data, uint8(len(swk.Value)))
+	for _, pol := range swk.Value {
+		polData, err := pol.MarshalBinary()
+		if err != nil {
+			return nil, err
+		}
+		data = append(data, polData...)
+	}
+	return data, nil
+}
+
+// UnmarshalBinary decodes a SeededSwitchingKey encoded by MarshalBinary
+func (swk *SeededSwitchingKey) UnmarshalBinary(data []byte) (err error) {
+	var pointer, inc int
+	if swk.Seed, pointer, err = unmarshalSeed(data); err != nil {
+		return err
+	}
+	if len(data) <= pointer || data[pointer] == 0 {
+		return errors.New("invalid key encoding")
+	}
+	swk.Value = make([]*ring.Poly, data[pointer])
+	pointer++
+	for i := range swk.Value {
+		if swk.Value[i], inc, err = decodePoly(data[pointer:]); err != nil {
+			return err
+		}
+		pointer += inc
+	}
+	if pointer != len(data) {
+		return errors.New("remaining unparsed data")
+	}
+	return nil
+}
+
+func (swk *SeededSwitchingKey) wireType() uint8 {
+	return WireSeededSwitchingKey
+}
+
+// MarshalBinary encodes the SeededRotationKeySet: 4 byte number of keys, then for each key
+// its galois element (8 byte), its length (8 byte) and its encoding
+func (rtks *SeededRotationKeySet) MarshalBinary() ([]byte, error) {
+	data := make([]byte, 4)
+	binary.LittleEndian.PutUint32(data, uint32(len(rtks.Keys)))
+	for galEl, swk := range rtks.Keys {
+		swkData, err := swk.MarshalBinary()
+		if err != nil {
+			return nil, err
+		}
+		var galElData [8]byte
+		binary.LittleEndian.PutUint64(galElData[:], galEl)
+		data = append(data, galElData[:]...)
+		data = appendChunk(data, swkData)
+	}
+	return data, nil
+}
+
+// UnmarshalBinary decodes a SeededRotationKeySet encoded by MarshalBinary
+func (rtks *SeededRotationKeySet) UnmarshalBinary(data []byte) error {
+	if len(data) < 4 {
+		return errors.New("too small bytearray")
+	}
+	count := int(binary.LittleEndian.Uint32(data[:4]))
+	if count > len(data) {
+		return errors.New("invalid number of keys")
+	}
+	rtks.Keys = make(map[uint64]*SeededSwitchingKey, count)
+	pointer := 4
+	for i := 0; i < count; i++ {
+		if len(data)-pointer < 8 {
+			return errors.New("too small bytearray")
+		}
+		galEl := binary.LittleEndian.Uint64(data[pointer : pointer+8])
+		pointer += 8
+		chunk, inc, err := readChunk(data[pointer:])
+		if err != nil {
+			return err
+		}
+		swk := new(SeededSwitchingKey)
+		if err = swk.UnmarshalBinary(chunk); err != nil {
+			return err
+		}
+		rtks.Keys[galEl] = swk
+		pointer += inc
+	}
+	if pointer != len(data) {
+		return errors.New("remaining unparsed data")
+	}
+	return nil
+}
+
+func (rtks *SeededRotationKeySet) wireType() uint8 {
+	return WireSeededRotationKeySet
+}
+
+// marshalDiagonals encodes the diagonals of a plaintext matrix: 4 byte number of diagonals, then for each
+// diagonal its 8 byte index and its two polynomials
+func marshalDiagonals(data []byte, vec map[int][2]*ring.Poly) ([]byte, error) {
+	var buf [8]byte
+	binary.LittleEndian.PutUint32(buf[:4], uint32(len(vec)))
+	data = append(data, buf[:4]...)
+	for idx, diag := range vec {
+		binary.LittleEndian.PutUint64(buf[:], uint64(int64(idx)))
+		data = append(data, buf[:]...)
+		for _, pol := range diag {
+			polData, err := pol.MarshalBinary()
+			if err != nil {
+				return nil, err
+			}
+			data = append(data, polData...)
+		}
+	}
+	return data, nil
+}
+
+func unmarshalDiagonals(data []byte) (map[int][2]*ring.Poly, error) {
+	if len(data) < 4 {
+		return nil, errors.New("too small bytearray")
+	}
+	count := int(binary.LittleEndian.Uint32(data[:4]))
+	if count > len(data) {
+		return nil, errors.New("invalid number of diagonals")
+	}
+	vec := make(map[int][2]*ring.Poly, count)
+	pointer := 4
+	for i := 0; i < count; i++ {
+		if len(data)-pointer < 8 {
+			return nil, errors.New("too small bytearray")
+		}
+		idx := int(int64(binary.LittleEndian.Uint64(data[pointer : pointer+8])))
+		pointer += 8
+		var diag [2]*ring.Poly
+		for j := range diag {
+			pol, inc, err := decodePoly(data[pointer:])
+			if err != nil {
+				return nil, err
+			}
+			diag[j] = pol
+			pointer += inc
+		}
+		vec[idx] = diag
+	}
+	if pointer != len(data) {
+		return nil, errors.New("remaining unparsed data")
+	}
+	return vec, nil
+}
+
+func boolByte(b bool) uint8 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// MarshalBinary encodes the PtDiagMatrix: 1 byte logSlots, 4 byte N1, 1 byte level, 8 byte scale,
+// 1 byte naive, 1 byte isGaussian, then the diagonals
+func (matrix *PtDiagMatrix) MarshalBinary() ([]byte, error) {
+	data := make([]byte, 16)
+	data[0] = uint8(matrix.LogSlots)
+	binary.LittleEndian.PutUint32(data[1:5], uint32(matrix.N1))
+	data[5] = uint8(matrix.Level)
+	binary.LittleEndian.PutUint64(data[6:14], math.Float64bits(matrix.Scale))
+	data[14] = boolByte(matrix.naive)
+	data[15] = boolByte(matrix.isGaussian)
+	return marshalDiagonals(data, matrix.Vec)
+}
+
+// UnmarshalBinary decodes a PtDiagMatrix encoded by MarshalBinary
+func (matrix *PtDiagMatrix) UnmarshalBinary(data []byte) (err error) {
+	if len(data) < 16 {
+		return errors.New("too small bytearray")
+	}
+	matrix.LogSlots = int(data[0])
+	matrix.N1 = int(binary.LittleEndian.Uint32(data[1:5]))
+	matrix.Level = int(data[5])
+	matrix.Scale = math.Float64frombits(binary.LittleEndian.Uint64(data[6:14]))
+	matrix.naive = data[14] == 1
+	matrix.isGaussian = data[15] == 1
+	matrix.Vec, err = unmarshalDiagonals(data[16:])
+	return err
+}
+
+// MarshalBinary encodes the PtDiagMatrixT: 1 byte logFVSlots, 4 byte N1, 1 byte naive, then the diagonals
+func (matrix *PtDiagMatrixT) MarshalBinary() ([]byte, error) {
+	data := make([]byte, 6)
+	data[0] = uint8(matrix.LogFVSlots)
+	binary.LittleEndian.PutUint32(data[1:5], uint32(matrix.N1))
+	data[5] = boolByte(matrix.naive)
+	return marshalDiagonals(data, matrix.Vec)
+}
+
+// UnmarshalBinary decodes a PtDiagMatrixT encoded by MarshalBinary
+func (matrix *PtDiagMatrixT) UnmarshalBinary(data []byte) (err error) {
+	if len(data) < 6 {
+		return errors.New("too small bytearray")
+	}
+	matrix.LogFVSlots = int(data[0])
+	matrix.N1 = int(binary.LittleEndian.Uint32(data[1:5]))
+	matrix.naive = data[5] == 1
+	matrix.Vec, err = unmarshalDiagonals(data[6:])
+	return err
+}
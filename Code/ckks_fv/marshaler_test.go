@@ -0,0 +1,62 @@
+package ckks_fv
+
+import (
+	"strings"
+	"testing"
+)
+
+// TestWireCodec sends a ciphertext through the wire format and checks that headers of another format version, object
+// type or parameters are rejected
+func TestWireCodec(t *testing.T) {
+	params := newTestCKKSParams(t)
+	sk, pk := NewKeyGenerator(params).GenKeyPair()
+	values := make([]complex128, params.Slots())
+	for i := range values {
+		values[i] = complex(float64(i%11)/11, 0)
+	}
+	ct := NewCKKSEncryptorFromPk(params, pk).EncryptNew(NewCKKSEncoder(params).EncodeComplexNTTNew(values, params.LogSlots()))
+	codec := NewWireCodec(params)
+	data, err := codec.Marshal(ct)
+	if err != nil {
+		t.Fatal(err)
+	}
+	header, err := ReadWireHeader(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header.Version != WireVersion || header.Type != WireCiphertext || int(header.Level) != ct.Level() || header.ParamsHash != ParametersHash(params) {
+		t.Errorf("header %+v", header)
+	}
+	res := new(Ciphertext)
+	if err = codec.Unmarshal(data, res); err != nil {
+		t.Fatal(err)
+	}
+	checkCKKSValues(t, "wire ciphertext", params, sk, res, values)
+
+	otherParams, err := NewParametersFromLogModuli(10, &LogModuli{LogQi: []int{55, 40, 40}, LogPi: []int{55}}, 40961)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherParams.SetScale(1 << 40)
+	otherParams.SetLogSlots(9)
+	unmodified := func(data []byte) []byte { return data }
+	for _, rejected := range []struct {
+		name   string
+		reason string
+		modify func([]byte) []byte
+		codec  *WireCodec
+		v      WireObject
+	}{
+		{"wrong magic", "not in the wire format", func(data []byte) []byte { data[0] = 'X'; return data }, codec, new(Ciphertext)},
+		{"other version", "version", func(data []byte) []byte { data[2] = WireVersion + 1; return data }, codec, new(Ciphertext)},
+		{"other type", "type", unmodified, codec, new(PublicKey)},
+		{"other parameters", "other parameters", unmodified, NewWireCodec(otherParams), new(Ciphertext)},
+		{"flipped parameters hash", "other parameters", func(data []byte) []byte { data[5] ^= 1; return data }, codec, new(Ciphertext)},
+		{"truncated header", "not in the wire format", func(data []byte) []byte { return data[:WireHeaderLen-1] }, codec, new(Ciphertext)},
+	} {
+		modified := rejected.modify(append([]byte{}, data...))
+		if err := rejected.codec.Unmarshal(modified, rejected.v); err == nil || !strings.Contains(err.Error(), rejected.reason) {
+			t.Errorf("%s: got %v, want a rejection for %q", rejected.name, err, rejected.reason)
+		}
+	}
+}
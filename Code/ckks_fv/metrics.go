@@ -0,0 +1,131 @@
+package ckks_fv
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// DefaultDurationBuckets are the upper bounds in seconds of the stage duration histograms
+var DefaultDurationBuckets = []float64{0.001, 0.01, 0.1, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300}
+
+// StageStats are the accumulated durations of a pipeline stage
+type StageStats struct {
+	Count   uint64
+	Sum     time.Duration
+	Buckets []uint64 // Buckets[i] counts the durations up to DefaultDurationBuckets[i], not cumulative
+}
+
+// Metrics collects the durations of the pipeline stages from the stage events of the parties.
+// It is a Logger, set it to Shared or to a party, combined with another Logger by NewTeeLogger.
+type Metrics struct {
+	mu      sync.Mutex
+	buckets []float64
+	stages  map[string]*StageStats
+}
+
+// NewMetrics returns empty Metrics with the DefaultDurationBuckets
+func NewMetrics() *Metrics {
+	return &Metrics{buckets: DefaultDurationBuckets, stages: make(map[string]*StageStats)}
+}
+
+// Log records the duration of stage events, all other events are ignored
+func (metrics *Metrics) Log(event *Event) {
+	if event.Stage == "" {
+		return
+	}
+	metrics.Observe(event.Stage, event.Duration)
+}
+
+// Observe records a duration of the stage
+func (metrics *Metrics) Observe(stage string, duration time.Duration) {
+	metrics.mu.Lock()
+	defer metrics.mu.Unlock()
+	stats, ok := metrics.stages[stage]
+	if !ok {
+		stats = &StageStats{Buckets: make([]uint64, len(metrics.buckets))}
+		metrics.stages[stage] = stats
+	}
+	stats.Count++
+	stats.Sum += duration
+	for i, bound := range metrics.buckets {
+		if duration.Seconds() <= bound {
+			stats.Buckets[i]++
+			break
+		}
+	}
+}
+
+// Stage returns a copy of the statistics of the stage, zero if it was not observed
+func (metrics *Metrics) Stage(stage string) StageStats {
+	metrics.mu.Lock()
+	defer metrics.mu.Unlock()
+	stats, ok := metrics.stages[stage]
+	if !ok {
+		return StageStats{Buckets: make([]uint64, len(metrics.buckets))}
+	}
+	res := *stats
+	res.Buckets = append([]uint64(nil), stats.Buckets...)
+	return res
+}
+
+// Stages returns the observed stages in lexical order
+func (metrics *Metrics) Stages() []string {
+	metrics.mu.Lock()
+	defer metrics.mu.Unlock()
+	stages := make([]string, 0, len(metrics.stages))
+	for stage := range metrics.stages {
+		stages = append(stages, stage)
+	}
+	sort.Strings(stages)
+	return stages
+}
+
+// Reset drops all observations
+func (metrics *Metrics) Reset() {
+	metrics.mu.Lock()
+	defer metrics.mu.Unlock()
+	metrics.stages = make(map[string]*StageStats)
+}
+
+// WritePrometheus writes the stage histograms in the Prometheus text exposition format
+func (metrics *Metrics) WritePrometheus(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintln(bw, "# HELP mtpro_stage_duration_seconds Duration of the transciphering and comparison pipeline stages.")
+	fmt.Fprintln(bw, "# TYPE mtpro_stage_duration_seconds histogram")
+	for _, stage := range metrics.Stages() {
+		stats := metrics.Stage(stage)
+		var cumulative uint64
+		for i, bound := range metrics.buckets {
+			cumulative += stats.Buckets[i]
+			fmt.Fprintf(bw, "mtpro_stage_duration_seconds_bucket{stage=%q,le=\"%g\"} %d\n", stage, bound, cumulative)
+		}
+		fmt.Fprintf(bw, "mtpro_stage_duration_seconds_bucket{stage=%q,le=\"+Inf\"} %d\n", stage, stats.Count)
+		fmt.Fprintf(bw, "mtpro_stage_duration_seconds_sum{stage=%q} %g\n", stage, stats.Sum.Seconds())
+		fmt.Fprintf(bw, "mtpro_stage_duration_seconds_count{stage=%q} %d\n", stage, stats.Count)
+	}
+	return bw.Flush()
+}
+
+// ServeHTTP serves the metrics in the Prometheus text format
+func (metrics *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	metrics.WritePrometheus(w)
+}
+
+type teeLogger []Logger
+
+func (loggers teeLogger) Log(event *Event) {
+	for _, logger := range loggers {
+		logger.Log(event)
+	}
+}
+
+// NewTeeLogger returns a Logger that passes every event to all loggers, e.g. to log and collect Metrics
+func NewTeeLogger(loggers ...Logger) Logger {
+	return teeLogger(loggers)
+}
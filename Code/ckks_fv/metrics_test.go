@@ -0,0 +1,60 @@
+package ckks_fv
+
+import (
+	"bytes"
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestWritePrometheus observes stage durations through the Logger interface and checks the cumulative buckets,
+// sum and count of the exposition format
+func TestWritePrometheus(t *testing.T) {
+	metrics := NewMetrics()
+	for _, d := range []time.Duration{5 * time.Millisecond, 700 * time.Millisecond, 400 * time.Second} {
+		metrics.Log(&Event{Stage: StageDistance, Duration: d})
+	}
+	metrics.Log(&Event{Stage: StageDecrypt, Duration: 50 * time.Millisecond})
+	metrics.Log(&Event{Message: "not a stage", Duration: time.Second})
+
+	var want strings.Builder
+	want.WriteString("# HELP mtpro_stage_duration_seconds Duration of the transciphering and comparison pipeline stages.\n")
+	want.WriteString("# TYPE mtpro_stage_duration_seconds histogram\n")
+	for _, stage := range []struct {
+		name       string
+		cumulative []int
+		sum        string
+		count      int
+	}{
+		{StageDecrypt, []int{0, 0, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1}, "0.05", 1},
+		{StageDistance, []int{0, 1, 1, 1, 2, 2, 2, 2, 2, 2, 2, 2}, "400.705", 3},
+	} {
+		for i, le := range []string{"0.001", "0.01", "0.1", "0.5", "1", "2.5", "5", "10", "30", "60", "120", "300"} {
+			fmt.Fprintf(&want, "mtpro_stage_duration_seconds_bucket{stage=%q,le=%q} %d\n", stage.name, le, stage.cumulative[i])
+		}
+		fmt.Fprintf(&want, "mtpro_stage_duration_seconds_bucket{stage=%q,le=\"+Inf\"} %d\n", stage.name, stage.count)
+		fmt.Fprintf(&want, "mtpro_stage_duration_seconds_sum{stage=%q} %s\n", stage.name, stage.sum)
+		fmt.Fprintf(&want, "mtpro_stage_duration_seconds_count{stage=%q} %d\n", stage.name, stage.count)
+	}
+
+	var buf bytes.Buffer
+	if err := metrics.WritePrometheus(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != want.String() {
+		t.Errorf("exposition\n%s\nexpected\n%s", buf.String(), want.String())
+	}
+
+	rec := httptest.NewRecorder()
+	metrics.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if contentType := rec.Header().Get("Content-Type"); contentType != "text/plain; version=0.0.4" || rec.Body.String() != want.String() {
+		t.Errorf("served with content type %q:\n%s", contentType, rec.Body.String())
+	}
+
+	metrics.Reset()
+	if stages := metrics.Stages(); len(stages) != 0 {
+		t.Errorf("stages %v after reset", stages)
+	}
+}
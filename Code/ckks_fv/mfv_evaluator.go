@@ -248,13 +248,25 @@ func (eval *mfvEvaluator) ShallowCopy() MFVEvaluator {
 	for i := range baseconverterQ1Q2s {
 		baseconverterQ1Q2s[i] = eval.baseconverterQ1Q2s[i].ShallowCopy()
 	}
+	var baseconverterQ1P *ring.FastBasisExtender
+	if eval.baseconverterQ1P != nil {
+		baseconverterQ1P = eval.baseconverterQ1P.ShallowCopy()
+	}
+	// the rings hold a polynomial pool, so they are copied as well
+	base := *eval.mfvEvaluatorBase
+	base.ringQ, base.ringP, base.ringQMul = eval.ringQ.ShallowCopy(), eval.ringP.ShallowCopy(), eval.ringQMul.ShallowCopy()
+	base.ringQs = make([]*ring.Ring, len(eval.ringQs))
+	for i := range base.ringQs {
+		base.ringQs[i] = eval.ringQs[i].ShallowCopy()
+	}
 	return &mfvEvaluator{
-		mfvEvaluatorBase:    eval.mfvEvaluatorBase,
-		mfvEvaluatorBuffers: newMFVEvaluatorBuffer(eval.mfvEvaluatorBase),
+		mfvEvaluatorBase:    &base,
+		mfvEvaluatorBuffers: newMFVEvaluatorBuffer(&base),
 		baseconverterQ1Q2s:  baseconverterQ1Q2s,
-		baseconverterQ1P:    eval.baseconverterQ1P.ShallowCopy(),
+		baseconverterQ1P:    baseconverterQ1P,
 		rlk:                 eval.rlk,
 		rtks:                eval.rtks,
+		permuteNTTIndex:     eval.permuteNTTIndex,
 		pDcds:               eval.pDcds,
 	}
 }
@@ -39,15 +39,12 @@ func NewMultiTemplate(templates []Template, instructions []*TemplateInstruction,
 	return nmt
 }
 
+// Distance returns the fused score of the instructions, as computed by ServerComp followed by FuseDistances
 func (nmt *MTmpl) Distance(other MultiTemplate) float64 {
 	sum := 0.0
 	for i, t := range nmt.data {
-		if i == 1 {
-			sum += 2 * t.SquaredEuclideanDistance(other.GetTemplates()[i])
-		} else {
-			sum += t.SquaredEuclideanDistance(other.GetTemplates()[i])
-		}
-
+		ins := nmt.instructions[i]
+		sum += ins.Fuse(ins.Score(t, other.GetTemplates()[i]))
 	}
 	return sum
 }
@@ -0,0 +1,119 @@
+package ckks_fv
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"sync"
+
+	"golang.org/x/crypto/sha3"
+)
+
+// NonceSize is the length of the nonce of one keystream block
+const NonceSize = 64
+
+// SessionIDSize is the length of the session IDs generated by NewSessionID
+const SessionIDSize = 16
+
+// nonceDomain separates the nonce derivation from other uses of SHAKE256 on the same inputs
+var nonceDomain = []byte("MT-Pro nonces v1")
+
+// NonceSet holds the nonces of the keystream blocks of one symmetric ciphertext and the counter of the Rubato keystream.
+// They are derived from the session ID and the sequence number of the ciphertext within the session, so that no two
+// ciphertexts of a session share a keystream.
+type NonceSet struct {
+	SessionID []byte
+	Sequence  uint64
+	Nonces    [][]byte
+	Counter   []byte
+}
+
+// NewSessionID returns a random session ID
+func NewSessionID() []byte {
+	sessionID := make([]byte, SessionIDSize)
+	if _, err := rand.Read(sessionID); err != nil {
+		panic(err)
+	}
+	return sessionID
+}
+
+// DeriveNonces returns the n nonces and the counter of the ciphertext with the given sequence number in the session.
+// The nonces are read from SHAKE256 of the session ID and the sequence number, the counter is the sequence number.
+func DeriveNonces(sessionID []byte, sequence uint64, n int) *NonceSet {
+	counter := make([]byte, 8)
+	binary.BigEndian.PutUint64(counter, sequence)
+	xof := sha3.NewShake256()
+	xof.Write(nonceDomain)
+	xof.Write([]byte{byte(len(sessionID))})
+	xof.Write(sessionID)
+	xof.Write(counter)
+	nonces := make([][]byte, n)
+	for i := range nonces {
+		nonces[i] = make([]byte, NonceSize)
+		xof.Read(nonces[i])
+	}
+	return &NonceSet{
+		SessionID: append([]byte(nil), sessionID...),
+		Sequence:  sequence,
+		Nonces:    nonces,
+		Counter:   counter,
+	}
+}
+
+// Verify checks that the set holds n nonces derived from its session ID and sequence number,
+// other sets return an error matching ErrParameterMismatch
+func (nonces *NonceSet) Verify(n int) error {
+	if nonces == nil || len(nonces.SessionID) == 0 {
+		return fmt.Errorf("%w: nonces without session", ErrParameterMismatch)
+	}
+	if len(nonces.Nonces) != n {
+		return fmt.Errorf("%w: %d nonces given for messages of size %d", ErrParameterMismatch, len(nonces.Nonces), n)
+	}
+	expected := DeriveNonces(nonces.SessionID, nonces.Sequence, n)
+	if !bytes.Equal(nonces.Counter, expected.Counter) {
+		return fmt.Errorf("%w: counter does not match the sequence number", ErrParameterMismatch)
+	}
+	for i := range expected.Nonces {
+		if !bytes.Equal(nonces.Nonces[i], expected.Nonces[i]) {
+			return fmt.Errorf("%w: nonce %d is not derived from the session", ErrParameterMismatch, i)
+		}
+	}
+	return nil
+}
+
+// NonceManager hands out the nonces of the symmetric ciphertexts of one session, each set only once
+type NonceManager interface {
+	SessionID() []byte
+	// Next returns the nonces of the next ciphertext and advances the sequence number
+	Next() *NonceSet
+}
+
+type nonceManager struct {
+	mutex     sync.Mutex
+	sessionID []byte
+	sequence  uint64
+	size      int
+}
+
+// NewNonceManager returns a NonceManager for the session that derives size nonces per ciphertext, starting at
+// sequence number start. A session resumed with the same ID must start after the last sequence number used.
+func NewNonceManager(sessionID []byte, start uint64, size int) NonceManager {
+	return &nonceManager{
+		sessionID: append([]byte(nil), sessionID...),
+		sequence:  start,
+		size:      size,
+	}
+}
+
+func (manager *nonceManager) SessionID() []byte {
+	return manager.sessionID
+}
+
+func (manager *nonceManager) Next() *NonceSet {
+	manager.mutex.Lock()
+	sequence := manager.sequence
+	manager.sequence++
+	manager.mutex.Unlock()
+	return DeriveNonces(manager.sessionID, sequence, manager.size)
+}
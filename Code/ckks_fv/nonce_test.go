@@ -0,0 +1,47 @@
+package ckks_fv
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+// TestNonceManager checks that the nonces of a session are reproducible, differ between ciphertexts and are verified
+func TestNonceManager(t *testing.T) {
+	sessionID := NewSessionID()
+	manager := NewNonceManager(sessionID, 0, 8)
+	first, second := manager.Next(), manager.Next()
+	if first.Sequence != 0 || second.Sequence != 1 {
+		t.Fatalf("sequence numbers %d and %d", first.Sequence, second.Sequence)
+	}
+	seen := make(map[string]bool)
+	for _, set := range []*NonceSet{first, second} {
+		if err := set.Verify(8); err != nil {
+			t.Fatal(err)
+		}
+		for _, nonce := range set.Nonces {
+			if len(nonce) != NonceSize || seen[string(nonce)] {
+				t.Fatal("nonce reused or of wrong size")
+			}
+			seen[string(nonce)] = true
+		}
+	}
+	if resumed := NewNonceManager(sessionID, 1, 8).Next(); !bytes.Equal(resumed.Nonces[3], second.Nonces[3]) {
+		t.Error("resumed session derives other nonces")
+	}
+	if other := DeriveNonces(NewSessionID(), 0, 8); bytes.Equal(other.Nonces[0], first.Nonces[0]) {
+		t.Error("sessions share nonces")
+	}
+
+	first.Nonces[2][0] ^= 1
+	if err := first.Verify(8); !errors.Is(err, ErrParameterMismatch) {
+		t.Errorf("tampered nonce: got %v", err)
+	}
+	second.Counter = first.Counter
+	if err := second.Verify(8); !errors.Is(err, ErrParameterMismatch) {
+		t.Errorf("tampered counter: got %v", err)
+	}
+	if err := DeriveNonces(sessionID, 0, 4).Verify(8); !errors.Is(err, ErrParameterMismatch) {
+		t.Errorf("short nonce set: got %v", err)
+	}
+}
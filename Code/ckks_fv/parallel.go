@@ -0,0 +1,43 @@
+package ckks_fv
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// forEachParallel calls f(worker, i) for i = 0, ..., n-1 on at most workers goroutines, worker is the index of the
+// goroutine calling f. With a single worker, f is called in order on the calling goroutine. A panic in f is raised
+// again on the calling goroutine once all goroutines have stopped.
+func forEachParallel(workers int, n int, f func(worker int, i int)) {
+	if workers > n {
+		workers = n
+	}
+	if workers <= 1 {
+		for i := 0; i < n; i++ {
+			f(0, i)
+		}
+		return
+	}
+	var wg sync.WaitGroup
+	var once sync.Once
+	var recovered interface{}
+	next := int64(-1)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			defer func() {
+				if r := recover(); r != nil {
+					once.Do(func() { recovered = r })
+				}
+			}()
+			for i := int(atomic.AddInt64(&next, 1)); i < n; i = int(atomic.AddInt64(&next, 1)) {
+				f(worker, i)
+			}
+		}(w)
+	}
+	wg.Wait()
+	if recovered != nil {
+		panic(recovered)
+	}
+}
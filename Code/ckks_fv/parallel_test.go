@@ -0,0 +1,96 @@
+package ckks_fv
+
+import (
+	"flag"
+	"reflect"
+	"sync/atomic"
+	"testing"
+)
+
+var testParallel = flag.Bool("test-parallel", false, "compare the parallel and the sequential transciphering on the parameters of InitWithCipher (memory intensive)")
+
+// TestForEachParallel checks that every index is visited once within the worker limit and that panics reach the caller
+func TestForEachParallel(t *testing.T) {
+	for _, workers := range []int{1, 3, 16} {
+		visits := make([]int32, 10)
+		forEachParallel(workers, len(visits), func(worker, i int) {
+			if worker < 0 || worker >= workers {
+				t.Errorf("worker %d of %d", worker, workers)
+			}
+			atomic.AddInt32(&visits[i], 1)
+		})
+		for i, n := range visits {
+			if n != 1 {
+				t.Errorf("%d workers: index %d visited %d times", workers, i, n)
+			}
+		}
+	}
+
+	defer func() {
+		if r := recover(); r != "failed" {
+			t.Errorf("recovered %v", r)
+		}
+	}()
+	forEachParallel(4, 8, func(worker, i int) {
+		if i == 5 {
+			panic("failed")
+		}
+	})
+	t.Error("panic not raised again")
+}
+
+// TestParallelTranscipher checks that the parallel transciphering returns the same ciphertexts as the sequential one,
+// on the test parties and, with -test-parallel, on the parameters of InitWithCipher
+func TestParallelTranscipher(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipped in short mode")
+	}
+	for _, fullCoeffs := range []bool{false, true} {
+		parties := newTestParties(t, fullCoeffs)
+		checkParallelTranscipher(t, parties.shared, parties.comp, parties.client)
+	}
+
+	if !*testParallel {
+		t.Skip("parameters of InitWithCipher skipped, run with -test-parallel")
+	}
+	shared, err := InitWithCipher(HERA, 4, 0, 2, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	shared.SetLogger(NewNopLogger())
+	serverComp, err := NewServerComp(shared)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := NewClient(shared)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkParallelTranscipher(t, shared, serverComp, client)
+}
+
+// checkParallelTranscipher transciphers two templates sequentially and on four goroutines and compares the ciphertexts
+func checkParallelTranscipher(t *testing.T, shared Shared, serverComp ServerComp, client Client) {
+	symCiphertexts := make([][]*PlaintextRingT, 2)
+	kCts := make([][]*Ciphertext, 2)
+	nonces := make([]*NonceSet, 2)
+	for i := range symCiphertexts {
+		symCiphertexts[i], kCts[i], nonces[i] = client.EncryptMultipleTemplatesWithNonces([]Template{NewMockTemplate(16)}, client.GenerateRandomKey(), 1, shared.GetMessagesSize())
+	}
+
+	sequential, err := serverComp.TranscipherFirstMessagesWithNonces(symCiphertexts, kCts, nonces)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverComp.SetConcurrency(4)
+	defer serverComp.SetConcurrency(1)
+	parallel, err := serverComp.TranscipherFirstMessagesWithNonces(symCiphertexts, kCts, nonces)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range sequential {
+		if sequential[i].Scale() != parallel[i].Scale() || !reflect.DeepEqual(sequential[i].Value(), parallel[i].Value()) {
+			t.Errorf("full coefficients %v, template %d: parallel ciphertext differs", shared.GetFullCoeffs(), i)
+		}
+	}
+}
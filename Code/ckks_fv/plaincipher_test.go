@@ -0,0 +1,89 @@
+package ckks_fv
+
+import (
+	"crypto/rand"
+	"testing"
+
+	"github.com/ldsec/lattigo/v2/plaincipher"
+)
+
+// TestFVKeyStream checks that the FV evaluations of HERA and Rubato decrypt to the keystreams of plaincipher
+func TestFVKeyStream(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipped in short mode")
+	}
+
+	t.Run("HERA", func(t *testing.T) {
+		params := newTestFVParams(t, 268042241)
+		encoder, encryptor, decryptor, evaluator := newTestFVContext(params)
+		plain := plaincipher.NewHera(plaincipher.HeraParam{NumRound: 4, PlainModulus: params.PlainModulus()})
+		key := plaincipher.GenerateKey(rand.Reader, plain.BlockSize(), plain.PlainModulus())
+		nonces := newTestNonces(params.FVSlots(), NonceSize)
+
+		hera := NewMFVHera(4, params, encoder, encryptor, evaluator, 0)
+		checkFVKeyStream(t, hera.CryptNoModSwitch(nonces, hera.EncKey(key)), encoder, decryptor, func(slot int) []uint64 {
+			return plain.KeyStream(nonces[slot], nil, key)
+		})
+	})
+
+	t.Run("Rubato", func(t *testing.T) {
+		params := newTestFVParams(t, RubatoParams[RUBATO80S].PlainModulus)
+		encoder, encryptor, decryptor, evaluator := newTestFVContext(params)
+		plain := plaincipher.NewRubato(RubatoParams[RUBATO80S])
+		key := plaincipher.GenerateKey(rand.Reader, plain.BlockSize(), plain.PlainModulus())
+		nonces := newTestNonces(params.FVSlots(), 8)
+		counter := newTestNonces(1, 8)[0]
+
+		rubato := NewMFVRubato(RUBATO80S, params, encoder, encryptor, evaluator, 0)
+		checkFVKeyStream(t, rubato.CryptNoModSwitch(nonces, counter, rubato.EncKey(key)), encoder, decryptor, func(slot int) []uint64 {
+			return plain.NoiselessKeyStream(nonces[slot], counter, key)
+		})
+	})
+}
+
+// newTestFVParams returns insecure parameters of ring degree 2^14 and 16 FV slots, deep enough for HERA without
+// modulus switching
+func newTestFVParams(t *testing.T, plainModulus uint64) *Parameters {
+	logQi := make([]int, 10)
+	for i := range logQi {
+		logQi[i] = 60
+	}
+	params, err := NewParametersFromLogModuli(14, &LogModuli{LogQi: logQi, LogPi: []int{61, 61}}, plainModulus)
+	if err != nil {
+		t.Fatal(err)
+	}
+	params.SetLogFVSlots(4)
+	return params
+}
+
+func newTestFVContext(params *Parameters) (MFVEncoder, MFVEncryptor, MFVDecryptor, MFVEvaluator) {
+	kgen := NewKeyGenerator(params)
+	sk, pk := kgen.GenKeyPair()
+	rlk := kgen.GenRelinearizationKey(sk)
+	return NewMFVEncoder(params), NewMFVEncryptorFromPk(params, pk), NewMFVDecryptor(params, sk), NewMFVEvaluator(params, EvaluationKey{Rlk: rlk}, nil)
+}
+
+func newTestNonces(n int, size int) [][]byte {
+	nonces := make([][]byte, n)
+	for i := range nonces {
+		nonces[i] = make([]byte, size)
+		rand.Read(nonces[i])
+	}
+	return nonces
+}
+
+// checkFVKeyStream compares the decrypted word ciphertexts, one slot per nonce, with the plaintext keystream of each slot
+func checkFVKeyStream(t *testing.T, words []*Ciphertext, encoder MFVEncoder, decryptor MFVDecryptor, keystream func(slot int) []uint64) {
+	decoded := make([][]uint64, len(words))
+	for st := range words {
+		decoded[st] = encoder.DecodeUintSmallNew(decryptor.DecryptNew(words[st]))
+	}
+	for slot := range decoded[0] {
+		want := keystream(slot)
+		for st := range want {
+			if decoded[st][slot] != want[st] {
+				t.Fatalf("slot %d word %d: FV keystream %d, expected %d", slot, st, decoded[st][slot], want[st])
+			}
+		}
+	}
+}
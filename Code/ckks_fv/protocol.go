@@ -0,0 +1,277 @@
+package ckks_fv
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// Routes of the MT-Pro services. The computation server serves enrolment, verification and identification,
+// the authentication server receives the encrypted results and serves the decisions. The computation server
+// registers every comparison at RouteRequests before it posts the result to RouteResults, both routes require
+// the token shared by the servers. The routes of the computation server require the token of the clients.
+// Both commands serve the stage Metrics of their server at RouteMetrics.
+const (
+	RouteEnrol    = "/v1/enrol"
+	RouteVerify   = "/v1/verify"
+	RouteIdentify = "/v1/identify"
+	RouteRequests = "/v1/requests/"
+	RouteResults  = "/v1/results"
+	RouteDecision = "/v1/decisions/"
+	RouteKeys     = "/v1/keys/"
+	RouteMetrics  = "/metrics"
+)
+
+// Kinds of the results sent to the authentication server
+const (
+	ResultVerification   = "verification"
+	ResultIdentification = "identification"
+)
+
+// maxRequestSize bounds the bodies read by the services, an encrypted HERA key alone takes a few hundred MB
+const maxRequestSize = 1 << 30
+
+// EncryptedTemplate is the input of the transciphering: the symmetric ciphertexts and the FV encryption of
+// the symmetric key in the wire format, with the nonces and counter of the keystream.
+// The nonces are derived from SessionID and Sequence, templates without SessionID are refused.
+// All bodies are JSON, binary fields are base64 encoded.
+//
+// Instead of EncryptedKey, KeyID may refer to a key registered at RouteKeys.
+type EncryptedTemplate struct {
+	SymCiphertexts [][]byte
+	EncryptedKey   []byte `json:",omitempty"`
+	KeyID          string `json:",omitempty"`
+	SessionID      []byte `json:",omitempty"`
+	Sequence       uint64 `json:",omitempty"`
+	Nonces         [][]byte
+	Counter        []byte
+}
+
+// nonceSet returns the nonces of a template with session, nil for a template without session
+func (template *EncryptedTemplate) nonceSet() *NonceSet {
+	if len(template.SessionID) == 0 {
+		return nil
+	}
+	return &NonceSet{SessionID: template.SessionID, Sequence: template.Sequence, Nonces: template.Nonces, Counter: template.Counter}
+}
+
+// RegisterKeyRequest stores the FV encryption of a symmetric key of the client under KeyID, templates encrypted
+// under the key then only send KeyID. The key is removed with a DELETE request at RouteKeys followed by KeyID.
+// With Precompute, the server evaluates the keystreams of the next Precompute ciphertexts of the session ahead,
+// starting at Sequence, so that transciphering them only removes the keystream and half-bootstraps.
+type RegisterKeyRequest struct {
+	KeyID        string
+	EncryptedKey []byte
+	SessionID    []byte `json:",omitempty"`
+	Sequence     uint64 `json:",omitempty"`
+	Precompute   int    `json:",omitempty"`
+}
+
+// RegisterKeyResponse confirms the registered key and the number of keystreams that are precomputed
+type RegisterKeyResponse struct {
+	KeyID      string
+	Level      int
+	Precompute int `json:",omitempty"`
+}
+
+// EnrolRequest stores the transciphered template as reference of the subject
+type EnrolRequest struct {
+	SubjectID       string
+	TemplateID      string
+	Modalities      []string
+	TemplateLengths []int
+	Template        *EncryptedTemplate
+}
+
+// EnrolResponse returns the stored record
+type EnrolResponse struct {
+	Record *GalleryRecord
+}
+
+// VerifyRequest compares the probe against the reference TemplateID of the subject
+type VerifyRequest struct {
+	SubjectID  string
+	TemplateID string
+	Probe      *EncryptedTemplate
+}
+
+// IdentifyRequest searches the best match of the probe in the gallery of TemplateID, an empty TemplateID takes the
+// first reference of every subject
+type IdentifyRequest struct {
+	TemplateID string
+	Probe      *EncryptedTemplate
+}
+
+// ComparisonResponse returns the ID under which the authentication server holds the decision
+type ComparisonResponse struct {
+	RequestID string
+}
+
+// PendingRequest registers the request ID of a comparison, the authentication server only accepts one result of
+// the given kind for it. The request is withdrawn with a DELETE request at RouteRequests followed by RequestID.
+type PendingRequest struct {
+	RequestID string
+	Kind      string
+}
+
+// ResultRequest hands an encrypted result of the computation server to the authentication server.
+// Decision is the CKKS ciphertext of the threshold comparison, BestMatch the one-hot ciphertext of the
+// identification, both in the wire format.
+type ResultRequest struct {
+	RequestID string
+	Kind      string
+	Decision  []byte
+	BestMatch []byte
+	Layout    *GalleryLayout
+}
+
+// DecisionResponse is the decrypted result. SubjectID is the best match of an identification,
+// Accepted is false if the result has no decision.
+type DecisionResponse struct {
+	RequestID string
+	Kind      string
+	Accepted  bool
+	SubjectID string
+}
+
+// ErrorResponse is the body of all responses with an error status
+type ErrorResponse struct {
+	Error string
+}
+
+// newRequestID returns a random ID of 16 bytes in hex
+func newRequestID() string {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(id)
+}
+
+// NewServiceToken returns a random token of 32 bytes in hex, to be shared by the computation server and the
+// authentication server or its clients
+func NewServiceToken() string {
+	token := make([]byte, 32)
+	if _, err := rand.Read(token); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(token)
+}
+
+// LoadServiceToken reads the token file at path, a missing file is written with a new token for the owner only
+func LoadServiceToken(path string) (string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err == nil {
+		return strings.TrimSpace(string(data)), nil
+	}
+	if !os.IsNotExist(err) {
+		return "", fileError("read", path, err)
+	}
+	token := NewServiceToken()
+	return token, fileError("write", path, ioutil.WriteFile(path, []byte(token+"\n"), 0600))
+}
+
+// authorized checks in constant time that the request carries token as bearer token
+func authorized(r *http.Request, token string) bool {
+	return subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+token)) == 1
+}
+
+// statusOf maps the errors of the MT-Pro layer to HTTP status codes
+func statusOf(err error) int {
+	switch {
+	case errors.Is(err, ErrRecordNotFound), errors.Is(err, ErrKeyNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, ErrParameterMismatch), errors.Is(err, ErrContextMismatch):
+		return http.StatusBadRequest
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(value)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, &ErrorResponse{Error: err.Error()})
+}
+
+// readJSON decodes the body of a POST request, on failure it writes the error and returns false
+func readJSON(w http.ResponseWriter, r *http.Request, value interface{}) bool {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("%s not allowed", r.Method))
+		return false
+	}
+	if err := json.NewDecoder(io.LimitReader(r.Body, maxRequestSize)).Decode(value); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return false
+	}
+	return true
+}
+
+// ServiceError is returned by the service clients for responses with an error status
+type ServiceError struct {
+	Status  int
+	Message string
+}
+
+func (e *ServiceError) Error() string {
+	return fmt.Sprintf("%d %s: %s", e.Status, http.StatusText(e.Status), e.Message)
+}
+
+// Is matches ErrRecordNotFound and ErrKeyNotFound for 404 responses, which the services return for unknown
+// references, keys and decisions
+func (e *ServiceError) Is(target error) bool {
+	return (target == ErrRecordNotFound || target == ErrKeyNotFound) && e.Status == http.StatusNotFound
+}
+
+// doJSON sends the request, with value as JSON body if not nil, and decodes the response into res
+func doJSON(httpClient *http.Client, method string, url string, value interface{}, res interface{}) error {
+	return doJSONWithToken(httpClient, "", method, url, value, res)
+}
+
+// doJSONWithToken sends the request like doJSON, with token as bearer token unless it is empty
+func doJSONWithToken(httpClient *http.Client, token string, method string, url string, value interface{}, res interface{}) error {
+	var body io.Reader
+	if value != nil {
+		data, err := json.Marshal(value)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		return err
+	}
+	if value != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		errResp := new(ErrorResponse)
+		if err = json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(errResp); err != nil {
+			errResp.Error = err.Error()
+		}
+		return &ServiceError{Status: resp.StatusCode, Message: errResp.Error}
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, maxRequestSize)).Decode(res)
+}
@@ -0,0 +1,191 @@
+package ckks_fv
+
+import (
+	"crypto/rand"
+
+	"github.com/ldsec/lattigo/v2/ring"
+	"github.com/ldsec/lattigo/v2/rlwe"
+	"github.com/ldsec/lattigo/v2/utils"
+)
+
+// SeedSize is the size in bytes of the seeds of the uniform polynomials
+const SeedSize = 32
+
+// SeededCiphertext is a fresh secret-key encryption [-a*s + m + e, a] that stores the seed of the uniform
+// polynomial a instead of a itself, which halves its size. Only fresh encryptions can be seeded:
+// modulus switching or any other evaluation, as in transciphering, makes a depend on the secret.
+// The symmetric keys of the clients are not seeded: the clients encrypt them under the public key, whose
+// encryptions have no seeded form, and the authentication server must never see them in the clear.
+type SeededCiphertext struct {
+	Seed  []byte
+	Value *ring.Poly
+	Scale float64
+	IsNTT bool
+}
+
+// SeededEncryptor encrypts plaintexts under the secret key into SeededCiphertexts
+type SeededEncryptor interface {
+	EncryptNew(plaintext *Plaintext) *SeededCiphertext
+}
+
+type seededEncryptor struct {
+	params *Parameters
+	ringQ  *ring.Ring
+	fv     MFVEncryptor
+	ckks   CKKSEncryptor
+}
+
+// NewSeededMFVEncryptor returns a SeededEncryptor for FV plaintexts
+func NewSeededMFVEncryptor(params *Parameters, sk *SecretKey) SeededEncryptor {
+	encryptor := newSeededEncryptor(params)
+	encryptor.fv = NewMFVEncryptorFromSk(params, sk)
+	return encryptor
+}
+
+// NewSeededCKKSEncryptor returns a SeededEncryptor for CKKS plaintexts
+func NewSeededCKKSEncryptor(params *Parameters, sk *SecretKey) SeededEncryptor {
+	encryptor := newSeededEncryptor(params)
+	encryptor.ckks = NewCKKSEncryptorFromSk(params, sk)
+	return encryptor
+}
+
+func newSeededEncryptor(params *Parameters) *seededEncryptor {
+	ringQ, err := ring.NewRing(params.N(), params.qi)
+	if err != nil {
+		panic(err)
+	}
+	return &seededEncryptor{params: params, ringQ: ringQ}
+}
+
+// NewSeed returns a random seed for a uniform polynomial
+func NewSeed() []byte {
+	seed := make([]byte, SeedSize)
+	if _, err := rand.Read(seed); err != nil {
+		panic(err)
+	}
+	return seed
+}
+
+// seededCRP returns the uniform polynomial of the seed in the NTT domain, allocated over all moduli of Q
+// as the EncryptFromCRP methods expect, with only the first level+1 moduli sampled
+func seededCRP(ringQ *ring.Ring, seed []byte, level int) *ring.Poly {
+	prng, err := utils.NewKeyedPRNG(seed)
+	if err != nil {
+		panic(err)
+	}
+	crp := ringQ.NewPoly()
+	ring.NewUniformSampler(prng, ringQ).Readlvl(level, crp)
+	return crp
+}
+
+func (encryptor *seededEncryptor) EncryptNew(plaintext *Plaintext) *SeededCiphertext {
+	seed := NewSeed()
+	crp := seededCRP(encryptor.ringQ, seed, plaintext.Level())
+	var ciphertext *Ciphertext
+	if encryptor.fv != nil {
+		ciphertext = encryptor.fv.EncryptFromCRPNew(plaintext, crp)
+	} else {
+		ciphertext = NewCiphertextCKKS(encryptor.params, 1, encryptor.params.MaxLevel(), plaintext.Scale())
+		encryptor.ckks.EncryptFromCRP(plaintext, ciphertext, crp)
+	}
+	return &SeededCiphertext{
+		Seed:  seed,
+		Value: ciphertext.value[0],
+		Scale: ciphertext.scale,
+		IsNTT: ciphertext.isNTT,
+	}
+}
+
+// Level returns the level of the ciphertext
+func (ct *SeededCiphertext) Level() int {
+	return len(ct.Value.Coeffs) - 1
+}
+
+func (ct *SeededCiphertext) ringDegree() int {
+	return ct.Value.Degree()
+}
+
+// Expand regenerates the uniform polynomial and returns the full ciphertext
+func (ct *SeededCiphertext) Expand(params *Parameters) *Ciphertext {
+	ringQ, err := ring.NewRing(params.N(), params.qi)
+	if err != nil {
+		panic(err)
+	}
+	level := ct.Level()
+	crp := seededCRP(ringQ, ct.Seed, level)
+	ciphertext := &Ciphertext{&Element{}}
+	ciphertext.value = []*ring.Poly{ct.Value.CopyNew(), ringQ.NewPolyLvl(level)}
+	if ct.IsNTT {
+		ringQ.CopyLvl(level, crp, ciphertext.value[1])
+	} else {
+		ringQ.InvNTTLvl(level, crp, ciphertext.value[1])
+	}
+	ciphertext.scale = ct.Scale
+	ciphertext.isNTT = ct.IsNTT
+	return ciphertext
+}
+
+// SeededSwitchingKey is a switching key that stores the seed of its uniform polynomials instead of the polynomials,
+// which halves its size. Value holds the first polynomial of every decomposition element.
+type SeededSwitchingKey struct {
+	Seed  []byte
+	Value []*ring.Poly
+}
+
+// SeededRotationKeySet holds a SeededSwitchingKey per galois element
+type SeededRotationKeySet struct {
+	Keys map[uint64]*SeededSwitchingKey
+}
+
+// newSeededSwitchingKey keeps the seed and the first polynomials of swk
+func newSeededSwitchingKey(seed []byte, swk *rlwe.SwitchingKey) *SeededSwitchingKey {
+	seeded := &SeededSwitchingKey{Seed: seed, Value: make([]*ring.Poly, len(swk.Value))}
+	for i := range swk.Value {
+		seeded.Value[i] = swk.Value[i][0]
+	}
+	return seeded
+}
+
+// expand regenerates the uniform polynomials in the order the key generator sampled them
+func (swk *SeededSwitchingKey) expand(params *Parameters) *rlwe.SwitchingKey {
+	ringQP, err := ring.NewRing(params.N(), append(params.qi, params.pi...))
+	if err != nil {
+		panic(err)
+	}
+	prng, err := utils.NewKeyedPRNG(swk.Seed)
+	if err != nil {
+		panic(err)
+	}
+	uniformSampler := ring.NewUniformSampler(prng, ringQP)
+	key := &rlwe.SwitchingKey{Value: make([][2]*ring.Poly, len(swk.Value))}
+	for i := range swk.Value {
+		key.Value[i][0] = swk.Value[i].CopyNew()
+		key.Value[i][1] = ringQP.NewPoly()
+		uniformSampler.Read(key.Value[i][1])
+	}
+	return key
+}
+
+func (swk *SeededSwitchingKey) ringDegree() int {
+	return swk.Value[0].Degree()
+}
+
+// RelinearizationKey expands a seeded relinearization key
+func (swk *SeededSwitchingKey) RelinearizationKey(params *Parameters) *RelinearizationKey {
+	rlk := NewRelinearizationKey(params)
+	rlk.Keys[0] = swk.expand(params)
+	return rlk
+}
+
+// RotationKeySet expands the seeded rotation keys
+func (rtks *SeededRotationKeySet) RotationKeySet(params *Parameters) *RotationKeySet {
+	galEls := make([]uint64, 0, len(rtks.Keys))
+	for galEl := range rtks.Keys {
+		galEls = append(galEls, galEl)
+	}
+	res := NewRotationKeySet(params, galEls)
+	for galEl, swk := range rtks.Keys {
+		res.Keys[galEl] = swk.expand(params)
+	}
+	return res
+}
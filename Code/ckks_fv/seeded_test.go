@@ -0,0 +1,81 @@
+package ckks_fv
+
+import (
+	"math"
+	"testing"
+)
+
+// newTestCKKSParams returns insecure CKKS parameters of ring degree 2^10 with two levels
+func newTestCKKSParams(t *testing.T) *Parameters {
+	params, err := NewParametersFromLogModuli(10, &LogModuli{LogQi: []int{55, 40, 40}, LogPi: []int{55}}, 65537)
+	if err != nil {
+		t.Fatal(err)
+	}
+	params.SetScale(1 << 40)
+	params.SetLogSlots(9)
+	return params
+}
+
+// wireRoundTrip marshals v with the codec of params and unmarshals it into res
+func wireRoundTrip(t *testing.T, params *Parameters, v WireObject, res WireObject) {
+	codec := NewWireCodec(params)
+	data, err := codec.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = codec.Unmarshal(data, res); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// checkCKKSValues decrypts ct and compares its slots with want
+func checkCKKSValues(t *testing.T, name string, params *Parameters, sk *SecretKey, ct *Ciphertext, want []complex128) {
+	t.Helper()
+	values := NewCKKSEncoder(params).DecodeComplex(NewCKKSDecryptor(params, sk).DecryptNew(ct), params.LogSlots())
+	for i := range want {
+		if math.Abs(real(values[i])-real(want[i])) > 1e-5 {
+			t.Fatalf("%s: slot %d is %v, expected %v", name, i, values[i], want[i])
+		}
+	}
+}
+
+// TestSeededRoundTrip sends the seeded ciphertexts and keys through the wire format, expands them and uses them
+func TestSeededRoundTrip(t *testing.T) {
+	params := newTestCKKSParams(t)
+	kgen := NewKeyGenerator(params)
+	sk := kgen.GenSecretKey()
+	encoder := NewCKKSEncoder(params)
+	values := make([]complex128, params.Slots())
+	for i := range values {
+		values[i] = complex(float64(i%17)/17-0.5, 0)
+	}
+	pt := encoder.EncodeComplexNTTNew(values, params.LogSlots())
+
+	seededCt := new(SeededCiphertext)
+	wireRoundTrip(t, params, NewSeededCKKSEncryptor(params, sk).EncryptNew(pt), seededCt)
+	ct := seededCt.Expand(params)
+	checkCKKSValues(t, "seeded ciphertext", params, sk, ct, values)
+
+	seededRlk := new(SeededSwitchingKey)
+	wireRoundTrip(t, params, kgen.GenSeededRelinearizationKey(sk), seededRlk)
+	seededRotKeys := new(SeededRotationKeySet)
+	wireRoundTrip(t, params, kgen.GenSeededRotationKeysForRotations([]int{1}, false, sk), seededRotKeys)
+	eval := NewCKKSEvaluator(params, EvaluationKey{Rlk: seededRlk.RelinearizationKey(params), Rtks: seededRotKeys.RotationKeySet(params)})
+
+	square := eval.MulNew(ct, ct)
+	eval.Relinearize(square, square)
+	if err := eval.Rescale(square, params.Scale(), square); err != nil {
+		t.Fatal(err)
+	}
+	want := make([]complex128, len(values))
+	for i := range values {
+		want[i] = values[i] * values[i]
+	}
+	checkCKKSValues(t, "relinearization", params, sk, square, want)
+
+	rotated := eval.RotateNew(ct, 1)
+	for i := range values {
+		want[i] = values[(i+1)%len(values)]
+	}
+	checkCKKSValues(t, "rotation", params, sk, rotated, want)
+}
@@ -2,236 +2,140 @@ package ckks_fv
 
 import (
 	"encoding/gob"
-	"fmt"
+	"io/ioutil"
 	"os"
 )
 
-func SerializeShared(shared Shared) {
-	fmt.Println("=====Serialize Shared=====")
-	gob.Register(Ishared{})
-	f, err := os.Create("./shared.gob")
+// serializeGob streams the gob encoding of value into a temporary file that replaces path when complete
+func serializeGob(path string, value interface{}) error {
+	tmp := path + galleryTmpExt
+	// contexts hold the secret key, only the owner may read them
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
 	if err != nil {
-		fmt.Println(err)
+		return fileError("create", tmp, err)
+	}
+	if err = gob.NewEncoder(f).Encode(value); err == nil {
+		err = f.Sync()
 	}
-	defer f.Close()
-	enc := gob.NewEncoder(f)
-	if enc.Encode(shared); err != nil {
-		fmt.Println(err)
-	} else {
-		println("Done")
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
 	}
-	/*err := writeGob("./shared.gob", shared)
 	if err != nil {
-		fmt.Println(err)
-	} else {
-		fmt.Println("Done")
-	}*/
+		os.Remove(tmp)
+		return fileError("write", path, err)
+	}
+	return fileError("rename", path, os.Rename(tmp, path))
 }
 
-func DeserializeShared() Shared {
-	fmt.Println("=====Deserialize Shared=====")
-	shared := new(Shared)
-	f, err := os.Open("./shared.gob")
-	if err != nil {
-		fmt.Println(err)
-	}
-	gob.Register(Ishared{})
-	dec := gob.NewDecoder(f)
-	if dec.Decode(&shared); err != nil {
-		fmt.Println(err)
-	} else {
-		println("Done")
+// deserializeGob decodes the gob encoding in the file at path into value
+func deserializeGob(path string, value interface{}) error {
+	if err := readGob(path, value); err != nil {
+		return fileError("read", path, err)
 	}
+	return nil
+}
 
-	//err := readGob(, &shared)
+func SerializeShared(shared Shared) error {
+	gob.Register(Ishared{})
+	return serializeGob("./shared.gob", shared)
+}
 
-	return *shared
+func DeserializeShared() (Shared, error) {
+	shared := new(Ishared)
+	gob.Register(Ishared{})
+	if err := deserializeGob("./shared.gob", shared); err != nil {
+		return nil, err
+	}
+	return shared, nil
 }
 
-func SerializeContext(context SaveFile, path string) {
-	fmt.Println("=====Serialize Context=====")
-	//gob.Register(BootstrappingKey{})
+func SerializeContext(context SaveFile, path string) error {
 	gob.Register(Context{})
-	f, err := os.Create(path)
-	if err != nil {
-		fmt.Println(err)
-	}
-	defer f.Close()
-	enc := gob.NewEncoder(f)
-	if enc.Encode(context); err != nil {
-		fmt.Println(err)
-	} else {
-		println("Done")
-	}
+	return serializeGob(path, context)
 }
 
-func DeserializeContext(path string) SaveFile {
-	fmt.Println("=====Deserialize Context=====")
+func DeserializeContext(path string) (SaveFile, error) {
 	context := new(Context)
-	f, err := os.Open(path)
-	if err != nil {
-		fmt.Println(err)
-	}
 	gob.Register(Context{})
-	//gob.Register(BootstrappingKey{})
-	dec := gob.NewDecoder(f)
-	if dec.Decode(&context); err != nil {
-		fmt.Println(err)
-	} else {
-		println("Done")
+	if err := deserializeGob(path, context); err != nil {
+		return nil, err
 	}
-
-	return context
+	return context, nil
 }
 
-func SerializeContextFC(context SaveFileFC, path string) {
-	fmt.Println("=====Serialize Context=====")
-	//gob.Register(BootstrappingKey{})
+func SerializeContextFC(context SaveFileFC, path string) error {
 	gob.Register(ContextFC{})
-	f, err := os.Create(path)
-	if err != nil {
-		fmt.Println(err)
-	}
-	defer f.Close()
-	enc := gob.NewEncoder(f)
-	if enc.Encode(context); err != nil {
-		fmt.Println(err)
-	} else {
-		println("Done")
-	}
+	return serializeGob(path, context)
 }
 
-func DeserializeContextFC(path string) SaveFileFC {
-	fmt.Println("=====Deserialize Context=====")
+func DeserializeContextFC(path string) (SaveFileFC, error) {
 	context := new(ContextFC)
-	f, err := os.Open(path)
-	if err != nil {
-		fmt.Println(err)
-	}
 	gob.Register(ContextFC{})
-	//gob.Register(BootstrappingKey{})
-	dec := gob.NewDecoder(f)
-	if dec.Decode(&context); err != nil {
-		fmt.Println(err)
-	} else {
-		println("Done")
+	if err := deserializeGob(path, context); err != nil {
+		return nil, err
 	}
-
-	return context
+	return context, nil
 }
-func SerializeRotationKeys(rtks *RotationKeySet, path string) {
-	fmt.Println("=====Serialize RotKeys=====")
+
+func SerializeRotationKeys(rtks *RotationKeySet, path string) error {
 	gob.Register(RotationKeySet{})
-	f, err := os.Create(path)
-	if err != nil {
-		fmt.Println(err)
-	}
-	defer f.Close()
-	enc := gob.NewEncoder(f)
-	if enc.Encode(rtks); err != nil {
-		fmt.Println(err)
-	} else {
-		println("Done")
-	}
+	return serializeGob(path, rtks)
 }
 
-func DeserializeRotationKeys(path string) *RotationKeySet {
-	fmt.Println("=====Deserialize RotKeys=====")
-	ct := new(RotationKeySet)
-	f, err := os.Open(path)
-	if err != nil {
-		fmt.Println(err)
-	}
+func DeserializeRotationKeys(path string) (*RotationKeySet, error) {
+	rtks := new(RotationKeySet)
 	gob.Register(RotationKeySet{})
-	dec := gob.NewDecoder(f)
-	if dec.Decode(&ct); err != nil {
-		fmt.Println(err)
-	} else {
-		println("Done")
+	if err := deserializeGob(path, rtks); err != nil {
+		return nil, err
 	}
-
-	return ct
+	return rtks, nil
 }
 
-func SerializeBootstrapKeys(rtks BootstrappingKey, path string) {
-	fmt.Println("=====Serialize BootstrappingKey=====")
+func SerializeBootstrapKeys(rtks BootstrappingKey, path string) error {
 	gob.Register(BootstrappingKey{})
-	f, err := os.Create(path)
-	if err != nil {
-		fmt.Println(err)
-	}
-	defer f.Close()
-	enc := gob.NewEncoder(f)
-	if enc.Encode(rtks); err != nil {
-		fmt.Println(err)
-	} else {
-		println("Done")
-	}
+	return serializeGob(path, rtks)
 }
 
-func DeserializeBootstrappingKeys(path string) BootstrappingKey {
-	fmt.Println("=====Deserialize BootstrappingKey=====")
-	var ct BootstrappingKey
-	f, err := os.Open(path)
-	if err != nil {
-		fmt.Println(err)
-	}
+func DeserializeBootstrappingKeys(path string) (BootstrappingKey, error) {
+	var btpKey BootstrappingKey
 	gob.Register(BootstrappingKey{})
-	dec := gob.NewDecoder(f)
-	if dec.Decode(&ct); err != nil {
-		fmt.Println(err)
-	} else {
-		println("Done")
-	}
-
-	return ct
+	err := deserializeGob(path, &btpKey)
+	return btpKey, err
 }
 
-func SerializeSymCT(pt SymCiphertext_Serialized, path string) {
-	fmt.Println("=====Serialize SymCT=====")
+func SerializeSymCT(pt SymCiphertext_Serialized, path string) error {
 	gob.Register(SCT{})
-	f, err := os.Create(path)
-	if err != nil {
-		fmt.Println(err)
-	}
-	defer f.Close()
-	enc := gob.NewEncoder(f)
-	if enc.Encode(pt); err != nil {
-		fmt.Println(err)
-	} else {
-		println("Done")
-	}
+	return serializeGob(path, pt)
 }
 
-func SerializeCiphertext(cts Ciphertext_Serialized, path string) {
-	fmt.Println("=====Serialize Ciphertext=====")
+func SerializeCiphertext(cts Ciphertext_Serialized, path string) error {
 	gob.Register(CT{})
-	f, err := os.Create(path)
-	if err != nil {
-		fmt.Println(err)
-	}
-	defer f.Close()
-	enc := gob.NewEncoder(f)
-	if enc.Encode(cts); err != nil {
-		fmt.Println(err)
-	} else {
-		println("Done")
-	}
+	return serializeGob(path, cts)
 }
-func DeserializeCiphertext(path string) Ciphertext_Serialized {
-	fmt.Println("=====Deserialize Ciphertext=====")
+
+func DeserializeCiphertext(path string) (Ciphertext_Serialized, error) {
 	ct := new(CT)
-	f, err := os.Open(path)
-	if err != nil {
-		fmt.Println(err)
-	}
 	gob.Register(CT{})
-	dec := gob.NewDecoder(f)
-	if dec.Decode(&ct); err != nil {
-		fmt.Println(err)
-	} else {
-		println("Done")
+	if err := deserializeGob(path, ct); err != nil {
+		return nil, err
 	}
+	return ct, nil
+}
 
-	return ct
+// SerializeWire writes v in the versioned wire format of codec, unlike gob it can be read by other implementations
+func SerializeWire(codec *WireCodec, v WireObject, path string) error {
+	data, err := codec.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return fileError("write", path, writeAtomicMode(path, data, 0600))
+}
+
+// DeserializeWire reads v from a file in the wire format of codec, rejecting data of other parameters
+func DeserializeWire(codec *WireCodec, path string, v WireObject) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fileError("read", path, err)
+	}
+	return codec.Unmarshal(data, v)
 }
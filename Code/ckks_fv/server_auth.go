@@ -2,15 +2,25 @@ package ckks_fv
 
 import (
 	"fmt"
+	"math"
+
+	"github.com/ldsec/lattigo/v2/utils"
 )
 
 type ServerAuth interface {
 	DecryptMessage(ciphertext *Ciphertext) []complex128
 	DecryptFullMessage(ciphertext []*Ciphertext) [][]complex128
 	DecryptNMessages(ciphertext []*Ciphertext, n int) [][]complex128
+	DecryptGalleryDistances(ciphertext *Ciphertext, layout *GalleryLayout) map[string]float64
+	DecryptDecision(ciphertext *Ciphertext) bool
+	DecryptBestMatch(ciphertext *Ciphertext, layout *GalleryLayout) string
 	GetSaveContext() SaveFile
 	GetSaveContextFC() SaveFileFC
+	GetAuthBundle(contextID string) *AuthBundle
+	GetEvaluationBundle(contextID string) (*EvaluationBundle, error)
+	GetClientBundle(contextID string) *ClientBundle
 	TestMask()
+	SetLogger(logger Logger)
 }
 
 type serverAuth struct {
@@ -20,6 +30,12 @@ type serverAuth struct {
 	ckksEncoder   CKKSEncoder
 	shared        Shared
 	context       SaveFile
+
+	// seeded form of the generated evaluation keys until GetEvaluationBundle exports them
+	seededRelinKey     *SeededSwitchingKey
+	seededRotationKeys *SeededRotationKeySet
+
+	partyLogger
 }
 
 func (server *serverAuth) containsKey(rotations []int, r int) bool {
@@ -31,7 +47,88 @@ func (server *serverAuth) containsKey(rotations []int, r int) bool {
 	return false
 }
 
-func NewServerAuthFromContext(context SaveFile, shared Shared, Rotkeys *RotationKeySet, bootKey BootstrappingKey) ServerAuth {
+// templateSumRotations returns the rotations needed by InnerSum to sum templates of the given lengths
+func templateSumRotations(kgen KeyGenerator, templateLengths []int) []int {
+	rotations := []int{}
+	for _, templateLen := range templateLengths {
+		for _, r := range kgen.GenRotationIndexesForInnerSum(1, templateLen) {
+			if !utils.IsInSliceInt(r, rotations) {
+				rotations = append(rotations, r)
+			}
+		}
+	}
+	return rotations
+}
+
+func (server *serverAuth) appendTemplateSumRotations(kgen KeyGenerator, rotations []int) []int {
+	for _, r := range templateSumRotations(kgen, server.shared.GetTemplateLengths()) {
+		if !server.containsKey(rotations, r) {
+			rotations = append(rotations, r)
+		}
+	}
+	return rotations
+}
+
+// galleryRotations returns the power of two rotations in both directions used to pack, compare and search a gallery
+func galleryRotations(slots int) []int {
+	rotations := []int{}
+	for r := 1; r < slots; r <<= 1 {
+		rotations = append(rotations, r)
+		if !utils.IsInSliceInt(slots-r, rotations) {
+			rotations = append(rotations, slots-r)
+		}
+	}
+	return rotations
+}
+
+func (server *serverAuth) appendGalleryRotations(rotations []int) []int {
+	for _, r := range galleryRotations(server.shared.GetParams().Slots()) {
+		if !server.containsKey(rotations, r) {
+			rotations = append(rotations, r)
+		}
+	}
+	return rotations
+}
+
+// checkContext returns an error matching ErrContextMismatch if the context was saved with other parameters than shared
+func checkContext(shared Shared, contextID string, cipher int, numRound int, paramIndex int, radix int, fullCoeffs bool) error {
+	if cipher != shared.GetCipher() || numRound != shared.GetNumRounds() || paramIndex != shared.GetParamIndex() ||
+		radix != shared.GetRadix() || fullCoeffs != shared.GetFullCoeffs() {
+		return fmt.Errorf("%w: context %s was saved with other parameters", ErrContextMismatch, contextID)
+	}
+	return nil
+}
+
+// checkRotationKeys returns a RotationKeyError for the rotations without a key in rotKeys
+func checkRotationKeys(params *Parameters, rotKeys *RotationKeySet, rotations []int) error {
+	missing := []int{}
+	for _, r := range rotations {
+		if rotKeys == nil {
+			missing = append(missing, r)
+		} else if _, ok := rotKeys.Keys[params.GaloisElementForColumnRotationBy(r)]; !ok {
+			missing = append(missing, r)
+		}
+	}
+	if len(missing) != 0 {
+		return &RotationKeyError{Rotations: missing}
+	}
+	return nil
+}
+
+// checkSavedContext checks the key pair and the parameters of the context
+func checkSavedContext(shared Shared, context SaveFile) error {
+	sk, pk := context.GetClientParameters()
+	if sk == nil || pk == nil {
+		return fmt.Errorf("context %s has no key pair", context.GetContextID())
+	}
+	numRound, paramIndex, radix, fullCoeffs, _ := context.GetSharedParameters()
+	return checkContext(shared, context.GetContextID(), context.GetCipher(), numRound, paramIndex, radix, fullCoeffs)
+}
+
+func NewServerAuthFromContext(context SaveFile, shared Shared, Rotkeys *RotationKeySet, bootKey BootstrappingKey) (ServerAuth, error) {
+	if err := checkSavedContext(shared, context); err != nil {
+		return nil, err
+	}
 	server := new(serverAuth)
 	server.shared = shared
 	sk, pk := context.GetClientParameters()
@@ -40,37 +137,78 @@ func NewServerAuthFromContext(context SaveFile, shared Shared, Rotkeys *Rotation
 	server.pk = pk
 	server.ckksDecryptor = NewCKKSDecryptor(server.shared.GetParams(), server.sk)
 	server.ckksEncoder = NewCKKSEncoder(server.shared.GetParams())
-	kgen := NewKeyGenerator(shared.GetParams())
-	rotationsHalfBoot := kgen.GenRotationIndexesForHalfBoot(shared.GetParams().LogSlots(), shared.GetHbtpParams())
-	rotationsStC := kgen.GenRotationIndexesForSlotsToCoeffsMat(shared.GetPDcds())
-	rotations := append(rotationsHalfBoot, rotationsStC...)
+	rotations := server.rotations(NewKeyGenerator(shared.GetParams()))
+	logMessage(server.log(shared), LogDebug, "checking rotation keys", Field{"rotations", rotations})
+	if err := checkRotationKeys(shared.GetParams(), Rotkeys, rotations); err != nil {
+		return nil, err
+	}
+	//rel, boot := context.GetRelinAndBootstrappingKeys()
+	shared.SetPublicKeys(pk, Rotkeys, context.GetRelinKey(), bootKey)
+	return server, nil
+}
 
-	if !shared.GetFullCoeffs() {
-		rotations = append(rotations, shared.GetParams().Slots()/2)
+// NewServerAuthFromSavedContext restores the authentication server with the evaluation keys that Init_From_Context
+// set to shared, so no keys are generated. For a context saved without evaluation keys they are generated.
+func NewServerAuthFromSavedContext(shared Shared, context SaveFile) (ServerAuth, error) {
+	if err := checkSavedContext(shared, context); err != nil {
+		return nil, err
 	}
-	for i := 1; i < 16; i++ {
-		if !server.containsKey(rotations, i) {
-			rotations = append(rotations, i)
+	sk, pk := context.GetClientParameters()
+	_, rotKeys, relinKey, _ := shared.GetAllPublicKeys()
+	if rotKeys == nil || relinKey == nil {
+		logMessage(shared.GetLogger(), LogInfo, "context without evaluation keys, generating them", Field{"context", context.GetContextID()})
+		server, err := newServerAuth(shared, sk, pk)
+		if err != nil {
+			return nil, err
 		}
+		server.context = context
+		return server, nil
 	}
-	fmt.Printf("\nRotations: %v\n", rotations)
-	//dauert ewig?
-	//rotationKeys := kgen.GenRotationKeysForRotations(rotations, true, server.sk)
-	//rel, boot := context.GetRelinAndBootstrappingKeys()
-	shared.SetPublicKeys(pk, Rotkeys, context.GetRelinKey(), bootKey)
-	return server
+	server, err := restoreServerAuth(shared, sk, pk)
+	if err != nil {
+		return nil, err
+	}
+	server.context = context
+	return server, nil
 }
 
-func NewServerAuthFromContextFC(shared Shared, context SaveFileFC) ServerAuth {
+// restoreServerAuth returns the authentication server of the key pair with the evaluation keys set to shared,
+// a missing rotation returns a RotationKeyError
+func restoreServerAuth(shared Shared, sk *SecretKey, pk *PublicKey) (*serverAuth, error) {
 	server := new(serverAuth)
-
 	server.shared = shared
-	kgen := NewKeyGenerator(shared.GetParams())
-	sk, pk := context.GetAuthServerParameters()
-	fmt.Printf("\nSK: %v. Pk: %v", sk, pk)
 	server.sk = sk
 	server.pk = pk
+	_, rotKeys, _, _ := shared.GetAllPublicKeys()
+	if err := checkRotationKeys(shared.GetParams(), rotKeys, server.rotations(NewKeyGenerator(shared.GetParams()))); err != nil {
+		return nil, err
+	}
+	server.ckksDecryptor = NewCKKSDecryptor(shared.GetParams(), sk)
+	server.ckksEncoder = NewCKKSEncoder(shared.GetParams())
+	return server, nil
+}
 
+func NewServerAuthFromContextFC(shared Shared, context SaveFileFC) (ServerAuth, error) {
+	sk, pk := context.GetAuthServerParameters()
+	if sk == nil || pk == nil {
+		return nil, fmt.Errorf("context %s has no key pair", context.GetContextID())
+	}
+	numRound, paramIndex, radix, fullCoeffs := context.GetSharedParameters()
+	if err := checkContext(shared, context.GetContextID(), context.GetCipher(), numRound, paramIndex, radix, fullCoeffs); err != nil {
+		return nil, err
+	}
+	return newServerAuth(shared, sk, pk)
+}
+
+func NewServerAuth(shared Shared) (ServerAuth, error) {
+	kgen := NewKeyGenerator(shared.GetParams())
+	sk, pk := kgen.GenKeyPairSparse(shared.GetHammingWeight())
+	return newServerAuth(shared, sk, pk)
+}
+
+// rotations returns the rotations of the evaluation keys: HalfBoot, SlotsToCoeffs, template sums and galleries
+func (server *serverAuth) rotations(kgen KeyGenerator) []int {
+	shared := server.shared
 	rotationsHalfBoot := kgen.GenRotationIndexesForHalfBoot(shared.GetParams().LogSlots(), shared.GetHbtpParams())
 
 	rotationsStC := kgen.GenRotationIndexesForSlotsToCoeffsMat(shared.GetPDcds())
@@ -84,91 +222,65 @@ func NewServerAuthFromContextFC(shared Shared, context SaveFileFC) ServerAuth {
 		// 	}
 		// }
 	} else {
-		// for i := 1; i < 250; i++ {
+		// for i := 1; i < 128; i++ {
 		// 	if !server.containsKey(rotations, i) {
 		// 		rotations = append(rotations, i)
 		// 	}
 		// }
 	}
 
-	//fmt.Println("Rotations: ", rotations, "HalfBootRot: ", rotationsHalfBoot, "rotationsStC: ", rotationsStC)
-	fmt.Printf("\nRotations: %v\n", rotations)
-	//dauert ewig?
-	rotationKeys := kgen.GenRotationKeysForRotations(rotations, true, server.sk)
-	//rotationKeys := kgen.GenRotationKeysForRotations(rotations, false, server.sk)
-	fmt.Println("Rotation Keys added")
-	relinKey := kgen.GenRelinearizationKey(server.sk)
-	fmt.Println("Relin Keys added")
-	hbtpKey := BootstrappingKey{Rlk: relinKey, Rtks: rotationKeys}
-	bootstrappingKey := hbtpKey
-	fmt.Println("Bootstrapping Keys added")
-
-	shared.SetPublicKeys(pk, rotationKeys, relinKey, bootstrappingKey)
-	fmt.Println("Public Keys Keys set to shared")
-	server.ckksDecryptor = NewCKKSDecryptor(server.shared.GetParams(), server.sk)
-	server.ckksEncoder = NewCKKSEncoder(server.shared.GetParams())
-	return server
+	rotations = server.appendTemplateSumRotations(kgen, rotations)
+	return server.appendGalleryRotations(rotations)
 }
 
-func NewServerAuth(shared Shared) ServerAuth {
-
+// newServerAuth generates the evaluation keys of the key pair and sets them to shared
+func newServerAuth(shared Shared, sk *SecretKey, pk *PublicKey) (*serverAuth, error) {
+	if len(shared.GetPDcds()) == 0 {
+		return nil, fmt.Errorf("%w: shared without SlotsToCoeffs matrices", ErrParameterMismatch)
+	}
 	server := new(serverAuth)
 
 	server.shared = shared
 	kgen := NewKeyGenerator(shared.GetParams())
-	sk, pk := kgen.GenKeyPairSparse(shared.GetHammingWeight())
-	fmt.Printf("\nSK: %v. Pk: %v", sk, pk)
 	server.sk = sk
 	server.pk = pk
-	rotationsHalfBoot := kgen.GenRotationIndexesForHalfBoot(shared.GetParams().LogSlots(), shared.GetHbtpParams())
-
-	rotationsStC := kgen.GenRotationIndexesForSlotsToCoeffsMat(shared.GetPDcds())
-	rotations := append(rotationsHalfBoot, rotationsStC...)
+	rotations := server.rotations(kgen)
 
-	if !shared.GetFullCoeffs() {
-		rotations = append(rotations, shared.GetParams().Slots()/2)
-		// for i := 1; i < 16; i++ {
-		// 	if !server.containsKey(rotations, i) {
-		// 		rotations = append(rotations, i)
-		// 	}
-		// }
-	} else {
-		// for i := 1; i < 128; i++ {
-		// 	if !server.containsKey(rotations, i) {
-		// 		rotations = append(rotations, i)
-		// 	}
-		// }
-	}
-
-	//fmt.Println("Rotations: ", rotations, "HalfBootRot: ", rotationsHalfBoot, "rotationsStC: ", rotationsStC)
-	fmt.Printf("\nRotations: %v\n", rotations)
+	log := server.log(shared)
+	logMessage(log, LogInfo, "generating evaluation keys", Field{"rotations", len(rotations)})
+	logMessage(log, LogDebug, "rotations of the evaluation keys", Field{"rotations", rotations})
 	//dauert ewig?
-	rotationKeys := kgen.GenRotationKeysForRotations(rotations, true, server.sk)
+	server.seededRotationKeys = kgen.GenSeededRotationKeysForRotations(rotations, true, server.sk)
+	rotationKeys := server.seededRotationKeys.RotationKeySet(shared.GetParams())
 	//rotationKeys := kgen.GenRotationKeysForRotations(rotations, false, server.sk)
-	fmt.Println("Rotation Keys added")
-	relinKey := kgen.GenRelinearizationKey(server.sk)
-	fmt.Println("Relin Keys added")
+	server.seededRelinKey = kgen.GenSeededRelinearizationKey(server.sk)
+	relinKey := server.seededRelinKey.RelinearizationKey(shared.GetParams())
 	hbtpKey := BootstrappingKey{Rlk: relinKey, Rtks: rotationKeys}
 	bootstrappingKey := hbtpKey
-	fmt.Println("Bootstrapping Keys added")
 
 	shared.SetPublicKeys(pk, rotationKeys, relinKey, bootstrappingKey)
-	fmt.Println("Public Keys Keys set to shared")
+	logMessage(log, LogInfo, "evaluation keys set to shared")
 	server.ckksDecryptor = NewCKKSDecryptor(server.shared.GetParams(), server.sk)
 	server.ckksEncoder = NewCKKSEncoder(server.shared.GetParams())
-	return server
+	return server, nil
+}
+
+// decrypt decrypts and decodes a CKKS ciphertext
+func (server *serverAuth) decrypt(ciphertext *Ciphertext) []complex128 {
+	timer := startStage(server.log(server.shared), StageDecrypt, Field{"level", ciphertext.Level()})
+	defer timer.done(nil)
+	return server.ckksEncoder.DecodeComplex(server.ckksDecryptor.DecryptNew(ciphertext), server.shared.GetParams().LogSlots())
 }
-func (server *serverAuth) DecryptMessage(ciphertext *Ciphertext) []complex128 {
 
-	valuesTest := server.ckksEncoder.DecodeComplex(server.ckksDecryptor.DecryptNew(ciphertext), server.shared.GetParams().LogSlots())
-	return valuesTest
+func (server *serverAuth) DecryptMessage(ciphertext *Ciphertext) []complex128 {
+	return server.decrypt(ciphertext)
 }
 
 func (server *serverAuth) DecryptFullMessage(ciphertext []*Ciphertext) [][]complex128 {
 
 	var result [][]complex128
-	for i := 0; i < 16; i++ {
-		valuesTest := server.ckksEncoder.DecodeComplex(server.ckksDecryptor.DecryptNew(ciphertext[i]), server.shared.GetParams().LogSlots())
+	for i := 0; i < len(ciphertext); i++ {
+		valuesTest := server.decrypt(ciphertext[i])
 		result = append(result, valuesTest)
 	}
 	return result
@@ -177,12 +289,40 @@ func (server *serverAuth) DecryptFullMessage(ciphertext []*Ciphertext) [][]compl
 func (server *serverAuth) DecryptNMessages(ciphertext []*Ciphertext, n int) [][]complex128 {
 	var result [][]complex128
 	for i := 0; i < n; i++ {
-		valuesTest := server.ckksEncoder.DecodeComplex(server.ckksDecryptor.DecryptNew(ciphertext[i]), server.shared.GetParams().LogSlots())
+		valuesTest := server.decrypt(ciphertext[i])
 		result = append(result, valuesTest)
 	}
 	return result
 }
 
+// DecryptGalleryDistances decrypts the result of ProcessTemplateInstructionsGallery and maps each distance to its subject ID
+func (server *serverAuth) DecryptGalleryDistances(ciphertext *Ciphertext, layout *GalleryLayout) map[string]float64 {
+	values := server.DecryptMessage(ciphertext)
+	distances := make(map[string]float64, len(layout.SubjectIDs))
+	for i, subjectID := range layout.SubjectIDs {
+		distances[subjectID] = real(values[layout.Slot(i)])
+	}
+	return distances
+}
+
+// DecryptDecision decrypts the result of EvaluateThreshold and returns true if the comparison is accepted
+func (server *serverAuth) DecryptDecision(ciphertext *Ciphertext) bool {
+	values := server.DecryptMessage(ciphertext)
+	return real(values[0]) > 0.5
+}
+
+// DecryptBestMatch decrypts the one-hot result of FindBestMatch and returns the subject ID of the best match
+func (server *serverAuth) DecryptBestMatch(ciphertext *Ciphertext, layout *GalleryLayout) string {
+	values := server.DecryptMessage(ciphertext)
+	best := 0
+	for i := range layout.SubjectIDs {
+		if real(values[layout.Slot(i)]) > real(values[layout.Slot(best)]) {
+			best = i
+		}
+	}
+	return layout.SubjectIDs[best]
+}
+
 func (server *serverAuth) generateSaveContext() SaveFile {
 	context := CreateNewContext(server.shared, server.pk, server.sk)
 	return context
@@ -216,16 +356,15 @@ func (server *serverAuth) TestMask() {
 		cmplx[i] = complex(message[i], 0.0)
 	}
 
-	fmt.Println(logSlots, len(message), server.shared.GetParams().logSlots)
 	pt := server.ckksEncoder.EncodeComplexNew(cmplx, logSlots)
 	ckksEncryptor := NewCKKSEncryptorFromPk(server.shared.GetParams(), server.pk)
 	enc := ckksEncryptor.EncryptNew(pt)
 	res := server.DecryptMessage(enc)
-	//fmt.Println(res)
-	for _, c := range res {
-		fmt.Printf("%6.3f,", real(c))
+	var maxErr float64
+	for i := range message {
+		maxErr = math.Max(maxErr, math.Abs(real(res[i])-message[i]))
 	}
-	fmt.Println("")
+	logMessage(server.log(server.shared), LogInfo, "mask decrypted", Field{"log_slots", logSlots}, Field{"size", len(message)}, Field{"max_error", maxErr})
 	//ckksEncoder := NewCKKSEncoder(server.shared.GetParams())
 
 }
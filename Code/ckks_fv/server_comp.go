@@ -3,47 +3,78 @@ package ckks_fv
 import (
 	"fmt"
 	"math"
-	"time"
+
+	"github.com/ldsec/lattigo/v2/ring"
 )
 
 type ServerComp interface {
-	TranscipherFirstMessage(symCiphertext []*PlaintextRingT, kCt []*Ciphertext) *Ciphertext
-	TranscipherFullMessage(symCiphertext []*PlaintextRingT, kCt []*Ciphertext) []*Ciphertext
-	TranscipherFirstNMessages(symCiphertext []*PlaintextRingT, kCt []*Ciphertext, n int) []*Ciphertext
-	TranscipherFirstMessageTimings(symCiphertext []*PlaintextRingT, kCt []*Ciphertext) (*Ciphertext, float64, float64)
-	ComputeEuclideanDistanceSingle(probe *Ciphertext, reference *Ciphertext, tmplateLen int) *Ciphertext
-	ComputeEuclideanDistanceFull(probe []*Ciphertext, reference []*Ciphertext, templateLen int) *Ciphertext
-	ComputeHammingDistanceSingle(probe *Ciphertext, reference *Ciphertext, templateLen int) *Ciphertext
+	TranscipherFirstMessageWithNonces(symCiphertext []*PlaintextRingT, kCt []*Ciphertext, nonces *NonceSet) (*Ciphertext, error)
+	TranscipherFirstMessagesWithNonces(symCiphertexts [][]*PlaintextRingT, kCts [][]*Ciphertext, nonces []*NonceSet) ([]*Ciphertext, error)
+	TranscipherFullMessage(symCiphertext []*PlaintextRingT, kCt []*Ciphertext, nonces *NonceSet) ([]*Ciphertext, error)
+	TranscipherFirstNMessages(symCiphertext []*PlaintextRingT, kCt []*Ciphertext, nonces *NonceSet, n int) ([]*Ciphertext, error)
+	// PrepareKey returns a copy of the encrypted key at the level of the initial states of the cipher
+	PrepareKey(kCt []*Ciphertext) []*Ciphertext
+	// PrecomputeKeystream evaluates the first n keystream blocks of the nonces ahead of the message (offline phase)
+	PrecomputeKeystream(kCt []*Ciphertext, nonces *NonceSet, n int) (*Keystream, error)
+	// TranscipherWithKeystream removes a precomputed keystream and half-bootstraps its blocks (online phase)
+	TranscipherWithKeystream(symCiphertext []*PlaintextRingT, keystream *Keystream) ([]*Ciphertext, error)
+	ComputeEuclideanDistanceSingle(probe *Ciphertext, reference *Ciphertext, tmplateLen int) (*Ciphertext, error)
+	ComputeEuclideanDistanceFull(probe []*Ciphertext, reference []*Ciphertext, templateLen int) (*Ciphertext, error)
+	ComputeHammingDistanceSingle(probe *Ciphertext, reference *Ciphertext, templateLen int) (*Ciphertext, error)
 	AccumulateDistances(left *Ciphertext, right *Ciphertext) *Ciphertext
 	Mask(probe *Ciphertext, i int) *Ciphertext
-	ProcessTemplateInstructionsSingleCT(instructions []*TemplateInstruction, probe *Ciphertext, reference *Ciphertext) *Ciphertext
+	ProcessTemplateInstructionsSingleCT(instructions []*TemplateInstruction, probe *Ciphertext, reference *Ciphertext) (*Ciphertext, error)
 	EncryptProbeDirectlySingleCiphertext(data []float64) *Ciphertext
+	PackGallery(references []*Ciphertext, subjectIDs []string, templateLen int) ([]*Ciphertext, *GalleryLayout, error)
+	ProcessTemplateInstructionsGallery(instructions []*TemplateInstruction, probe *Ciphertext, gallery []*Ciphertext, layout *GalleryLayout) (*Ciphertext, error)
+	FuseDistances(instructions []*TemplateInstruction, ct *Ciphertext) (*Ciphertext, error)
+	EvaluateThreshold(distance *Ciphertext, thresholdParams *ThresholdParameters) (*Ciphertext, error)
+	FindBestMatch(distances *Ciphertext, layout *GalleryLayout, argminParams *ArgminParameters) (*Ciphertext, *Ciphertext, error)
+	MaskedHammingDistance(probe *Ciphertext, reference *Ciphertext, ins *TemplateInstruction) (*Ciphertext, *Ciphertext, error)
+	SetLogger(logger Logger)
+	// SetConcurrency evaluates the keystream words, SlotsToCoeffs and the half-bootstraps on up to n goroutines
+	SetConcurrency(n int)
 }
 
 type serverComp struct {
-	shared    Shared
-	hera      MFVHera
-	hbtp      *HalfBootstrapper
-	needReset bool
+	shared Shared
+	cipher TranscipherCipher
+	hbtp   *HalfBootstrapper
+	// Evaluators and half-bootstrappers of the goroutines, the first ones are those of shared and hbtp
+	evaluators []MFVEvaluator
+	hbtps      []*HalfBootstrapper
+
+	partyLogger
 }
 
-func NewServerComp(shared Shared) ServerComp {
+// NewServerComp creates the computation server with the evaluation keys of shared,
+// missing keys return an error matching ErrMissingRotationKey
+func NewServerComp(shared Shared) (ServerComp, error) {
 
 	server := new(serverComp)
-	server.needReset = false
 	server.shared = shared
-	server.hera = NewMFVHera(shared.GetNumRounds(), shared.GetParams(), shared.GetFvEncoder(), shared.GetFvEncryptor(), shared.GetFvEvaluator(), shared.GetHeraModDown()[0])
 	_, rotkeys, rlk, _ := shared.GetAllPublicKeys()
+	if rlk == nil || rotkeys == nil {
+		return nil, fmt.Errorf("%w: shared without relinearization or rotation keys", ErrMissingRotationKey)
+	}
+	server.cipher = NewTranscipherCipher(shared)
 	hbtpKey := BootstrappingKey{Rlk: rlk, Rtks: rotkeys}
-	server.hbtp, _ = NewHalfBootstrapper(server.shared.GetParams(), server.shared.GetHbtpParams(), hbtpKey)
+	hbtp, err := NewHalfBootstrapperFromMatrices(server.shared.GetParams(), server.shared.GetHbtpParams(), hbtpKey, shared.GetHalfBootMatrices())
+	if err != nil {
+		return nil, err
+	}
+	server.hbtp = hbtp
+	server.evaluators = []MFVEvaluator{shared.GetFvEvaluator()}
+	server.hbtps = []*HalfBootstrapper{hbtp}
+	shared.SetHalfBootMatrices(hbtp.CoeffsToSlotsMatrices())
 
-	return server
+	return server, nil
 }
 func (server *serverComp) generateScaledPlaintext(plainCKKSRingTs []*PlaintextRingT) *Ciphertext {
 	//var plaintexts []*Plaintext
-	plaintexts := make([]*Plaintext, 16)
+	plaintexts := make([]*Plaintext, len(plainCKKSRingTs))
 
-	for s := 0; s < 16; s++ {
+	for s := 0; s < len(plainCKKSRingTs); s++ {
 		plaintexts[s] = NewPlaintextFVLvl(server.shared.GetParams(), 0)
 		// ring -> in - plaintext -> out
 		server.shared.GetFvEncoder().FVScaleUp(plainCKKSRingTs[s], plaintexts[s])
@@ -55,16 +86,16 @@ func (server *serverComp) generateScaledPlaintext(plainCKKSRingTs []*PlaintextRi
 }
 func (server *serverComp) generateScaledFullPlaintext(plainCKKSRingTs []*PlaintextRingT) []*Ciphertext {
 	//var plaintexts []*Plaintext
-	plaintexts := make([]*Plaintext, 16)
+	plaintexts := make([]*Plaintext, len(plainCKKSRingTs))
 
-	for s := 0; s < 16; s++ {
+	for s := 0; s < len(plainCKKSRingTs); s++ {
 		plaintexts[s] = NewPlaintextFVLvl(server.shared.GetParams(), 0)
 		// ring -> in - plaintext -> out
 		server.shared.GetFvEncoder().FVScaleUp(plainCKKSRingTs[s], plaintexts[s])
 	}
 	var ciphertexts []*Ciphertext
 
-	for i := 0; i < 16; i++ {
+	for i := 0; i < len(plaintexts); i++ {
 		ciphertext := NewCiphertextFVLvl(server.shared.GetParams(), 1, 0)
 		ciphertext.Value()[0] = plaintexts[i].Value()[0].CopyNew()
 		ciphertexts = append(ciphertexts, ciphertext)
@@ -73,212 +104,216 @@ func (server *serverComp) generateScaledFullPlaintext(plainCKKSRingTs []*Plainte
 	return ciphertexts
 	//return plaintexts
 }
-func (server *serverComp) reset() {
-	if server.needReset {
-		fmt.Println("Reset Hera")
-		server.hera.Reset(server.shared.GetHeraModDown()[0])
-	} else {
-		server.needReset = true
-	}
-}
-
-func (server *serverComp) TranscipherFullMessage(symCiphertext []*PlaintextRingT, kCt []*Ciphertext) []*Ciphertext {
-	var ctBoot *Ciphertext
-	var result []*Ciphertext
-	//var ciphertext *Ciphertext
-	server.reset()
-	ciphertexts := server.generateScaledFullPlaintext(symCiphertext)
-
-	fvKeystreams := server.hera.Crypt(server.shared.GetNonces(), kCt, server.shared.GetHeraModDown())
-	fmt.Println("HERA Offline")
-	for i := 0; i < 1; i++ {
-		//stcModDown is empty?? -> added check for length
-		fvKeystreams[i] = server.shared.GetFvEvaluator().SlotsToCoeffs(fvKeystreams[i], server.shared.GetStcModDown())
-		server.shared.GetFvEvaluator().ModSwitchMany(fvKeystreams[i], fvKeystreams[i], fvKeystreams[i].Level())
-	}
-
-	for i := 1; i < 16; i++ {
-		fvKeystreams[i] = server.shared.GetFvEvaluator().SlotsToCoeffs(fvKeystreams[i], server.shared.GetStcModDown())
-		server.shared.GetFvEvaluator().ModSwitchMany(fvKeystreams[i], fvKeystreams[i], fvKeystreams[i].Level())
-	}
-	for i := 0; i < 16; i++ {
-		fmt.Printf("Round %v \n", i)
-		fmt.Println("Sub")
-		server.shared.GetFvEvaluator().Sub(ciphertexts[i], fvKeystreams[i], ciphertexts[i])
-		fmt.Println("NTT")
-		server.shared.GetFvEvaluator().TransformToNTT(ciphertexts[i], ciphertexts[i])
-		fmt.Println("Scale")
-		ciphertexts[i].SetScale(math.Exp2(math.Round(math.Log2(float64(server.shared.GetParams().Qi()[0]) / float64(server.shared.GetParams().PlainModulus()) * server.shared.GetMessageScaling()))))
-		fmt.Println("HalfBoot")
-		if server.shared.GetFullCoeffs() {
-			ctBoot, _ = server.hbtp.HalfBoot(ciphertexts[i], false)
-		} else {
-			ctBoot, _ = server.hbtp.HalfBoot(ciphertexts[i], true)
-		}
-		result = append(result, ctBoot)
 
-	}
+// crypt evaluates the keystream of the selected cipher under FV
+func (server *serverComp) crypt(kCt []*Ciphertext, nonces [][]byte, counter []byte) []*Ciphertext {
+	return server.cipher.Crypt(nonces, counter, kCt, server.shared.GetHeraModDown())
+}
+
+// evaluateKeystreamWithNonces evaluates the keystream of the nonces and moves its first n blocks to the
+// coefficients at level 0
+func (server *serverComp) evaluateKeystreamWithNonces(kCt []*Ciphertext, n int, nonces [][]byte, counter []byte) []*Ciphertext {
+	timer := startStage(server.log(server.shared), StageKeystream)
+	fvKeystreams := server.crypt(kCt, nonces, counter)
+	timer.done(fvKeystreams[0])
+	server.slotsToCoeffs(fvKeystreams[:n], "block")
+	return fvKeystreams
+}
+
+// slotsToCoeffs moves the keystream blocks to the coefficients at level 0 in place, field names the index of a
+// block in the log
+func (server *serverComp) slotsToCoeffs(keystreams []*Ciphertext, field string) {
+	log := server.log(server.shared)
+	forEachParallel(len(server.evaluators), len(keystreams), func(worker, i int) {
+		eval := server.evaluators[worker]
+		timer := startStage(log, StageSlotsToCoeffs, Field{field, i})
+		keystreams[i] = eval.SlotsToCoeffs(keystreams[i], server.shared.GetStcModDown())
+		timer.done(keystreams[i])
+		timer = startStage(log, StageModSwitch, Field{field, i})
+		eval.ModSwitchMany(keystreams[i], keystreams[i], keystreams[i].Level())
+		timer.done(keystreams[i])
+	})
+}
+
+// transcipherBlock subtracts the keystream from the scaled symmetric ciphertext and half-bootstraps it to CKKS
+// with the evaluator and half-bootstrapper of the worker
+func (server *serverComp) transcipherBlock(worker int, ciphertext *Ciphertext, keystream *Ciphertext, index Field) *Ciphertext {
+	log := server.log(server.shared)
+	timer := startStage(log, StageRemoveKeystream, index)
+	server.evaluators[worker].Sub(ciphertext, keystream, ciphertext)
+	server.evaluators[worker].TransformToNTT(ciphertext, ciphertext)
+	ciphertext.SetScale(math.Exp2(math.Round(math.Log2(float64(server.shared.GetParams().Qi()[0]) / float64(server.shared.GetParams().PlainModulus()) * server.shared.GetMessageScaling()))))
+	timer.done(ciphertext)
+
+	timer = startStage(log, StageHalfBoot, index)
+	ctBoot, _ := server.hbtps[worker].halfBoot(ciphertext, !server.shared.GetFullCoeffs(), log)
+	timer.done(ctBoot)
+	return ctBoot
+}
 
+// transcipherBlocks transciphers the ciphertexts with their keystreams, field names the index of a block in the log
+func (server *serverComp) transcipherBlocks(ciphertexts []*Ciphertext, keystreams []*Ciphertext, field string) []*Ciphertext {
+	result := make([]*Ciphertext, len(keystreams))
+	forEachParallel(len(server.hbtps), len(keystreams), func(worker, i int) {
+		result[i] = server.transcipherBlock(worker, ciphertexts[i], keystreams[i], Field{field, i})
+	})
 	return result
 }
 
-func (server *serverComp) TranscipherFirstNMessages(symCiphertext []*PlaintextRingT, kCt []*Ciphertext, n int) []*Ciphertext {
-	var ctBoot *Ciphertext
-	var result []*Ciphertext
-	server.reset()
-	//var ciphertext *Ciphertext
-	ciphertexts := server.generateScaledFullPlaintext(symCiphertext)
-	// if we want to transcipher another message kCt doesn't have enough levels??? aka the encrypted key
-
-	fvKeystreams := server.hera.Crypt(server.shared.GetNonces(), kCt, server.shared.GetHeraModDown())
-	fmt.Println("HERA Offline")
-	for i := 0; i < 1; i++ {
-		//stcModDown is empty?? -> added check for length
-		fvKeystreams[i] = server.shared.GetFvEvaluator().SlotsToCoeffs(fvKeystreams[i], server.shared.GetStcModDown())
-		server.shared.GetFvEvaluator().ModSwitchMany(fvKeystreams[i], fvKeystreams[i], fvKeystreams[i].Level())
-	}
-
-	for i := 1; i < 16; i++ {
-		fvKeystreams[i] = server.shared.GetFvEvaluator().SlotsToCoeffs(fvKeystreams[i], server.shared.GetStcModDown())
-		server.shared.GetFvEvaluator().ModSwitchMany(fvKeystreams[i], fvKeystreams[i], fvKeystreams[i].Level())
-	}
-	for i := 0; i < n; i++ {
-		fmt.Printf("Round %v \n", i)
-		fmt.Println("Sub")
-		server.shared.GetFvEvaluator().Sub(ciphertexts[i], fvKeystreams[i], ciphertexts[i])
-		fmt.Println("NTT")
-		server.shared.GetFvEvaluator().TransformToNTT(ciphertexts[i], ciphertexts[i])
-		fmt.Println("Scale")
-		ciphertexts[i].SetScale(math.Exp2(math.Round(math.Log2(float64(server.shared.GetParams().Qi()[0]) / float64(server.shared.GetParams().PlainModulus()) * server.shared.GetMessageScaling()))))
-		fmt.Println("HalfBoot")
-		if server.shared.GetFullCoeffs() {
-			ctBoot, _ = server.hbtp.HalfBoot(ciphertexts[i], false)
-		} else {
-			ctBoot, _ = server.hbtp.HalfBoot(ciphertexts[i], true)
-		}
-		result = append(result, ctBoot)
+// TranscipherFullMessage transciphers all blocks of a message, the keystream is evaluated on the nonces sent with it
+func (server *serverComp) TranscipherFullMessage(symCiphertext []*PlaintextRingT, kCt []*Ciphertext, nonces *NonceSet) ([]*Ciphertext, error) {
+	return server.TranscipherFirstNMessages(symCiphertext, kCt, nonces, server.cipher.OutputSize())
+}
 
+// TranscipherFirstNMessages transciphers the first n blocks of a message, the keystream is evaluated on the nonces
+// sent with it. Nonces not derived from their session return an error matching ErrParameterMismatch.
+func (server *serverComp) TranscipherFirstNMessages(symCiphertext []*PlaintextRingT, kCt []*Ciphertext, nonces *NonceSet, n int) ([]*Ciphertext, error) {
+	keystream, err := server.PrecomputeKeystream(kCt, nonces, n)
+	if err != nil {
+		return nil, err
 	}
+	return server.TranscipherWithKeystream(symCiphertext, keystream)
+}
 
-	return result
+// SetConcurrency shares the work on up to n goroutines, each with a shallow copy of the FV evaluator and the
+// half-bootstrapper. The state words of the keystream are spread over the goroutines, SlotsToCoeffs and the
+// half-bootstraps over the blocks and templates. The results do not depend on n.
+func (server *serverComp) SetConcurrency(n int) {
+	if n < 1 {
+		n = 1
+	}
+	for len(server.evaluators) < n {
+		server.evaluators = append(server.evaluators, server.evaluators[0].ShallowCopy())
+		server.hbtps = append(server.hbtps, server.hbtp.ShallowCopy())
+	}
+	server.evaluators = server.evaluators[:n]
+	server.hbtps = server.hbtps[:n]
+	server.cipher.SetEvaluators(server.evaluators)
 }
 
-func (server *serverComp) TranscipherFirstMessage(symCiphertext []*PlaintextRingT, kCt []*Ciphertext) *Ciphertext {
-	var ctBoot *Ciphertext
-	var ciphertext *Ciphertext
-	server.reset()
-	//Measure this time
-	ciphertext = server.generateScaledPlaintext(symCiphertext)
-	//to this
-	fvKeystreams := server.hera.Crypt(server.shared.GetNonces(), kCt, server.shared.GetHeraModDown())
-	fmt.Println("HERA Offline")
-	for i := 0; i < 1; i++ {
-		//stcModDown is empty?? -> added check for length
-		//fvKeystreams[i] = server.shared.GetFvEvaluator().SlotsToCoeffs(fvKeystreams[i], server.shared.GetStcModDown())
-		//server.shared.GetFvEvaluator().ModSwitchMany(fvKeystreams[i], fvKeystreams[i], fvKeystreams[i].Level())
-		fmt.Printf("round %v\n", i)
-		fvKeystreams[i] = server.shared.GetFvEvaluator().SlotsToCoeffs(fvKeystreams[i], server.shared.GetStcModDown())
-		server.shared.GetFvEvaluator().ModSwitchMany(fvKeystreams[i], fvKeystreams[i], fvKeystreams[i].Level())
-	}
-
-	fmt.Println("Sub")
-	server.shared.GetFvEvaluator().Sub(ciphertext, fvKeystreams[0], ciphertext)
-	fmt.Println("NTT")
-	server.shared.GetFvEvaluator().TransformToNTT(ciphertext, ciphertext)
-	fmt.Println("Scale")
-	ciphertext.SetScale(math.Exp2(math.Round(math.Log2(float64(server.shared.GetParams().Qi()[0]) / float64(server.shared.GetParams().PlainModulus()) * server.shared.GetMessageScaling()))))
-	fmt.Println("HalfBoot")
+// TranscipherFirstMessageWithNonces transciphers a message encrypted with EncryptMultipleTemplatesWithNonces,
+// the keystream is evaluated on the nonces sent with it. Nonces not derived from their session return an error
+// matching ErrParameterMismatch.
+func (server *serverComp) TranscipherFirstMessageWithNonces(symCiphertext []*PlaintextRingT, kCt []*Ciphertext, nonces *NonceSet) (*Ciphertext, error) {
+	keystream, err := server.PrecomputeKeystream(kCt, nonces, 1)
+	if err != nil {
+		return nil, err
+	}
+	result, err := server.TranscipherWithKeystream(symCiphertext, keystream)
+	if err != nil {
+		return nil, err
+	}
+	return result[0], nil
+}
 
-	if server.shared.GetFullCoeffs() {
-		ctBoot, _ = server.hbtp.HalfBoot(ciphertext, false)
-	} else {
-		ctBoot, _ = server.hbtp.HalfBoot(ciphertext, true)
+// PrepareKey switches a copy of the encrypted key down to the level of the initial states, keystreams evaluated on
+// the prepared key start without switching the key again
+func (server *serverComp) PrepareKey(kCt []*Ciphertext) []*Ciphertext {
+	level := server.shared.GetParams().MaxLevel() - server.shared.GetHeraModDown()[0]
+	prepared := make([]*Ciphertext, len(kCt))
+	for i, ct := range kCt {
+		prepared[i] = ct.CopyNew().Ciphertext()
+		if nbSwitch := prepared[i].Level() - level; nbSwitch > 0 {
+			server.shared.GetFvEvaluator().ModSwitchMany(prepared[i], prepared[i], nbSwitch)
+		}
 	}
-	return ctBoot
+	return prepared
 }
-func (server *serverComp) TranscipherFirstMessageTimings(symCiphertext []*PlaintextRingT, kCt []*Ciphertext) (*Ciphertext, float64, float64) {
-	var ctBoot *Ciphertext
-	var ciphertext *Ciphertext
-	server.reset()
-	//Measure this time
-	start := time.Now()
-	ciphertext = server.generateScaledPlaintext(symCiphertext)
-	timingCT := time.Since(start).Seconds()
-	//to this
-	start = time.Now()
-	fvKeystreams := server.hera.Crypt(server.shared.GetNonces(), kCt, server.shared.GetHeraModDown())
-	fmt.Println("HERA Offline")
-	for i := 0; i < 1; i++ {
-		//stcModDown is empty?? -> added check for length
-		//fvKeystreams[i] = server.shared.GetFvEvaluator().SlotsToCoeffs(fvKeystreams[i], server.shared.GetStcModDown())
-		//server.shared.GetFvEvaluator().ModSwitchMany(fvKeystreams[i], fvKeystreams[i], fvKeystreams[i].Level())
-		fmt.Printf("round %v\n", i)
-		fvKeystreams[i] = server.shared.GetFvEvaluator().SlotsToCoeffs(fvKeystreams[i], server.shared.GetStcModDown())
-		server.shared.GetFvEvaluator().ModSwitchMany(fvKeystreams[i], fvKeystreams[i], fvKeystreams[i].Level())
-	}
-
-	fmt.Println("Sub")
-	server.shared.GetFvEvaluator().Sub(ciphertext, fvKeystreams[0], ciphertext)
-	fmt.Println("NTT")
-	server.shared.GetFvEvaluator().TransformToNTT(ciphertext, ciphertext)
-	fmt.Println("Scale")
-	ciphertext.SetScale(math.Exp2(math.Round(math.Log2(float64(server.shared.GetParams().Qi()[0]) / float64(server.shared.GetParams().PlainModulus()) * server.shared.GetMessageScaling()))))
-	fmt.Println("HalfBoot")
 
-	if server.shared.GetFullCoeffs() {
-		ctBoot, _ = server.hbtp.HalfBoot(ciphertext, false)
-	} else {
-		ctBoot, _ = server.hbtp.HalfBoot(ciphertext, true)
+// PrecomputeKeystream evaluates the first n keystream blocks of the nonces under kCt and moves them to the
+// coefficients at level 0. Nonces not derived from their session return an error matching ErrParameterMismatch.
+func (server *serverComp) PrecomputeKeystream(kCt []*Ciphertext, nonces *NonceSet, n int) (*Keystream, error) {
+	if err := nonces.Verify(server.shared.GetMessagesSize()); err != nil {
+		return nil, err
+	}
+	if n < 1 || n > server.cipher.OutputSize() {
+		return nil, fmt.Errorf("%w: %d keystream blocks requested, the cipher outputs %d", ErrParameterMismatch, n, server.cipher.OutputSize())
 	}
-	timingTransciphering := time.Since(start).Seconds()
-	return ctBoot, timingCT, timingTransciphering
+	fvKeystreams := server.evaluateKeystreamWithNonces(kCt, n, nonces.Nonces, nonces.Counter)
+	return &Keystream{SessionID: nonces.SessionID, Sequence: nonces.Sequence, Blocks: fvKeystreams[:n]}, nil
 }
-func (server *serverComp) ComputeEuclideanDistanceSingle(probe *Ciphertext, reference *Ciphertext, templateLen int) *Ciphertext {
-	temp := server.shared.GetCKKSEvaluator().SubNew(reference, probe)
-	tempSquared := server.shared.GetCKKSEvaluator().MulNew(temp, temp)
-	server.shared.GetCKKSEvaluator().Relinearize(tempSquared, tempSquared)
 
-	rt := server.shared.GetCKKSEvaluator().RotateNew(tempSquared, 1)
-	//rt := server.shared.CKKSEvaluator().RotateNew(reference, 1)
-	server.shared.GetCKKSEvaluator().Add(tempSquared, rt, tempSquared)
+// TranscipherWithKeystream transciphers the first blocks of a message with a keystream of PrecomputeKeystream,
+// one block per keystream block. The keystream must belong to the nonces the message was encrypted with.
+func (server *serverComp) TranscipherWithKeystream(symCiphertext []*PlaintextRingT, keystream *Keystream) ([]*Ciphertext, error) {
+	if keystream == nil || len(keystream.Blocks) == 0 || len(keystream.Blocks) > len(symCiphertext) {
+		return nil, fmt.Errorf("%w: keystream does not fit the symmetric ciphertext", ErrParameterMismatch)
+	}
+	ciphertexts := server.generateScaledFullPlaintext(symCiphertext[:len(keystream.Blocks)])
+	return server.transcipherBlocks(ciphertexts, keystream.Blocks, "block"), nil
+}
 
-	for i := 0; i < templateLen-2; i++ {
-		rt = server.shared.GetCKKSEvaluator().RotateNew(rt, 1)
-		server.shared.GetCKKSEvaluator().Add(tempSquared, rt, tempSquared)
+// TranscipherFirstMessagesWithNonces transciphers the first message of several templates, each encrypted under its
+// key and nonces. The keystreams are evaluated one after the other, SlotsToCoeffs and the half-bootstraps of all
+// templates are shared between the goroutines set by SetConcurrency.
+func (server *serverComp) TranscipherFirstMessagesWithNonces(symCiphertexts [][]*PlaintextRingT, kCts [][]*Ciphertext, nonces []*NonceSet) ([]*Ciphertext, error) {
+	if len(kCts) != len(symCiphertexts) || len(nonces) != len(symCiphertexts) {
+		return nil, fmt.Errorf("%w: %d templates with %d keys and %d nonce sets", ErrParameterMismatch, len(symCiphertexts), len(kCts), len(nonces))
+	}
+	for i := range nonces {
+		if err := nonces[i].Verify(server.shared.GetMessagesSize()); err != nil {
+			return nil, fmt.Errorf("template %d: %w", i, err)
+		}
 	}
+	log := server.log(server.shared)
+	keystreams := make([]*Ciphertext, len(symCiphertexts))
+	ciphertexts := make([]*Ciphertext, len(symCiphertexts))
+	for i := range symCiphertexts {
+		timer := startStage(log, StageKeystream, Field{"template", i})
+		keystreams[i] = server.crypt(kCts[i], nonces[i].Nonces, nonces[i].Counter)[0]
+		timer.done(keystreams[i])
+		ciphertexts[i] = server.generateScaledPlaintext(symCiphertexts[i])
+	}
+	server.slotsToCoeffs(keystreams, "template")
+	return server.transcipherBlocks(ciphertexts, keystreams, "template"), nil
+}
+
+// ComputeEuclideanDistanceSingle returns the squared Euclidean distance of the templates in the first slot
+func (server *serverComp) ComputeEuclideanDistanceSingle(probe *Ciphertext, reference *Ciphertext, templateLen int) (*Ciphertext, error) {
+	return server.distanceSingle(EUCLIDEAN, "euclidean", probe, reference, templateLen)
+}
+
+// distanceSingle sums the comparator term of the templates of length templateLen into the first slot
+func (server *serverComp) distanceSingle(comparator int, name string, probe *Ciphertext, reference *Ciphertext, templateLen int) (res *Ciphertext, err error) {
+	timer := startStage(server.log(server.shared), StageDistance, Field{"comparator", name})
+	defer func() { timer.done(res) }()
+	term, err := server.comparatorTerm(comparator, probe, reference)
+	if err != nil {
+		return nil, err
+	}
+	return server.sumSlots(term, templateLen), nil
+}
 
-	return tempSquared
+// sumSlots returns a ciphertext whose slot j holds the sum of the slots j, ..., j+n-1 of ct.
+// It uses InnerSum, so only about 2*log2(n) rotations are needed instead of n-1.
+func (server *serverComp) sumSlots(ct *Ciphertext, n int) *Ciphertext {
+	res := NewCiphertextCKKS(server.shared.GetParams(), 1, ct.Level(), ct.Scale())
+	server.shared.GetCKKSEvaluator().InnerSum(ct, 1, n, res)
+	return res
 }
 
-func (server *serverComp) ComputeEuclideanDistanceFull(probe []*Ciphertext, reference []*Ciphertext, templateLen int) *Ciphertext {
-	accumulated := server.ComputeEuclideanDistanceSingle(probe[0], reference[0], templateLen)
+func (server *serverComp) ComputeEuclideanDistanceFull(probe []*Ciphertext, reference []*Ciphertext, templateLen int) (*Ciphertext, error) {
+	accumulated, err := server.ComputeEuclideanDistanceSingle(probe[0], reference[0], templateLen)
+	if err != nil {
+		return nil, err
+	}
 	for i := 1; i < len(probe); i++ {
-		tempSquared := server.ComputeEuclideanDistanceSingle(probe[i], reference[i], templateLen)
+		tempSquared, err := server.ComputeEuclideanDistanceSingle(probe[i], reference[i], templateLen)
+		if err != nil {
+			return nil, err
+		}
 		server.shared.GetCKKSEvaluator().Add(accumulated, tempSquared, accumulated)
 	}
-	return accumulated
+	return accumulated, nil
 }
 
 func (server *serverComp) AccumulateDistances(left *Ciphertext, right *Ciphertext) *Ciphertext {
 	return server.shared.GetCKKSEvaluator().AddNew(left, right)
 }
 
-func (server *serverComp) ComputeHammingDistanceSingle(probe *Ciphertext, reference *Ciphertext, templateLen int) *Ciphertext {
-	//Sum(Ai+Bi - 2*AiBi)
-	AiBiAdd := server.shared.GetCKKSEvaluator().AddNew(probe, reference)
-	AiBiMul := server.shared.GetCKKSEvaluator().MulNew(probe, reference)
-	server.shared.GetCKKSEvaluator().Relinearize(AiBiMul, AiBiMul)
-	AiBiMulTwo := server.shared.GetCKKSEvaluator().MultByConstNew(AiBiMul, 2.0)
-	//server.shared.GetCKKSEvaluator().Relinearize(AiBiMulTwo, AiBiMulTwo)
-	temp := server.shared.GetCKKSEvaluator().SubNew(AiBiAdd, AiBiMulTwo)
-	//Sum up temp into first slot
-	rt := server.shared.GetCKKSEvaluator().RotateNew(temp, 1)
-	server.shared.GetCKKSEvaluator().Add(temp, rt, temp)
-	for i := 0; i < templateLen-2; i++ {
-		rt = server.shared.GetCKKSEvaluator().RotateNew(rt, 1)
-		server.shared.GetCKKSEvaluator().Add(temp, rt, temp)
-	}
-	return temp
+// ComputeHammingDistanceSingle returns the Hamming distance of the binary templates in the first slot
+func (server *serverComp) ComputeHammingDistanceSingle(probe *Ciphertext, reference *Ciphertext, templateLen int) (*Ciphertext, error) {
+	return server.distanceSingle(HAMMING, "hamming", probe, reference, templateLen)
 }
 func (server *serverComp) Mask(text *Ciphertext, i int) *Ciphertext {
 	mask := server.GetEncryptedMaskSingle(i)
@@ -291,7 +326,6 @@ func (server *serverComp) GetEncryptedMask(templateInstruction *TemplateInstruct
 	//coeffs := server.generateCoeffsFromData(message)
 	//plainCKKSRingTs := server.encCoeffsKeystreamToCkksPtRing(coeffs)
 	cmplx := make([]complex128, server.shared.GetMessagesSize())
-	fmt.Println(message)
 	for i, _ := range message {
 		cmplx[i] = complex(message[i], 0.0)
 	}
@@ -349,141 +383,786 @@ func (server *serverComp) MaxTemplateLen(instructionsDic map[int][]*TemplateInst
 	return max
 }
 
-func (server *serverComp) EuclideanDistanceTemplateInstructions(instructionsDic map[int][]*TemplateInstruction, probe *Ciphertext, reference *Ciphertext) {
-	maxLen := server.MaxTemplateLen(instructionsDic)
+// comparatorTerm returns the slot-wise term whose sum over a template gives the score of the comparator.
+// COSINE uses the inner product, which is normalized after the sum. An unknown comparator returns an error matching
+// ErrParameterMismatch.
+func (server *serverComp) comparatorTerm(comparator int, probe *Ciphertext, reference *Ciphertext) (*Ciphertext, error) {
+	eval := server.shared.GetCKKSEvaluator()
+	switch comparator {
+	case EUCLIDEAN:
+		temp := eval.SubNew(reference, probe)
+		tempSquared := eval.MulNew(temp, temp)
+		eval.Relinearize(tempSquared, tempSquared)
+		return tempSquared, nil
+	case HAMMING:
+		//Ai+Bi - 2*AiBi
+		AiBiAdd := eval.AddNew(probe, reference)
+		AiBiMul := eval.MulNew(probe, reference)
+		eval.Relinearize(AiBiMul, AiBiMul)
+		AiBiMulTwo := eval.MultByConstNew(AiBiMul, 2.0)
+		return eval.SubNew(AiBiAdd, AiBiMulTwo), nil
+	case INNER_PRODUCT, COSINE:
+		AiBiMul := eval.MulNew(probe, reference)
+		eval.Relinearize(AiBiMul, AiBiMul)
+		return AiBiMul, nil
+	default:
+		return nil, fmt.Errorf("%w: unknown comparator %d", ErrParameterMismatch, comparator)
+	}
+}
 
-	temp := server.shared.GetCKKSEvaluator().SubNew(reference, probe)
-	tempSquared := server.shared.GetCKKSEvaluator().MulNew(temp, temp)
-	server.shared.GetCKKSEvaluator().Relinearize(tempSquared, tempSquared)
+// inverseSqrt approximates 1/sqrt(x) slot-wise
+func (server *serverComp) inverseSqrt(x *Ciphertext, approx *InverseSqrtApproximation) (*Ciphertext, error) {
+	eval := server.shared.GetCKKSEvaluator()
 
-	rt := server.shared.GetCKKSEvaluator().RotateNew(tempSquared, 1)
-	//rt := server.shared.CKKSEvaluator().RotateNew(reference, 1)
-	server.shared.GetCKKSEvaluator().Add(tempSquared, rt, tempSquared)
+	//u = (2x - Min - Max)/(Max - Min)
+	u := eval.MultByConstNew(x, 2/(approx.Max-approx.Min))
+	eval.AddConst(u, -(approx.Min+approx.Max)/(approx.Max-approx.Min), u)
+	if err := server.rescale("inverse sqrt", u); err != nil {
+		return nil, err
+	}
+	y, err := server.evaluateCheby("inverse sqrt", u, approx.chebyshev())
+	if err != nil {
+		return nil, err
+	}
+	for i := 0; i < approx.Iterations; i++ {
+		//y = y*(3 - x*y^2)/2
+		squared, err := server.mulRescale(y, y)
+		if err != nil {
+			return nil, err
+		}
+		t, err := server.mulRescale(x, squared)
+		if err != nil {
+			return nil, err
+		}
+		eval.MultByConst(t, -0.5, t)
+		eval.AddConst(t, 1.5, t)
+		if y, err = server.mulRescale(y, t); err != nil {
+			return nil, err
+		}
+	}
+	return y, nil
+}
 
-	for i := 1; i < maxLen-1; i++ {
-		//for a templen of 512, 511 rotations are needed thats why we look at i+1 in the dic
-		val, exists := instructionsDic[(i + 1)]
-		if exists {
-			for _, ins := range val {
+// normalizeCosine divides the summed inner product by the norms of both templates, if the instruction
+// approximates the inverse square root under encryption. Otherwise the client normalized the templates.
+// Outside the slots of the scores the product of the norms is set into [Min, Max], as the approximation
+// diverges outside of it.
+func (server *serverComp) normalizeCosine(ins *TemplateInstruction, innerProduct *Ciphertext, probe *Ciphertext, reference *Ciphertext, slots []int) (*Ciphertext, error) {
+	if ins.InverseSqrt == nil {
+		return innerProduct, nil
+	}
+	eval := server.shared.GetCKKSEvaluator()
+	probeNorm := eval.MulNew(probe, probe)
+	eval.Relinearize(probeNorm, probeNorm)
+	referenceNorm := eval.MulNew(reference, reference)
+	eval.Relinearize(referenceNorm, referenceNorm)
+	norms, err := server.mulRescale(server.sumSlots(probeNorm, ins.TemplateLength), server.sumSlots(referenceNorm, ins.TemplateLength))
+	if err != nil {
+		return nil, err
+	}
 
-				fmt.Println("index: ", ins.Index)
-				fmt.Println("ct: ", tempSquared)
-				mask := server.Mask(tempSquared, ins.Index)
-				server.shared.GetCKKSEvaluator().Relinearize(mask, mask)
-				ins.Mask = mask
-			}
+	if norms, err = server.fillOutside(norms, slots, (ins.InverseSqrt.Min+ins.InverseSqrt.Max)/2); err != nil {
+		return nil, err
+	}
+	inverse, err := server.inverseSqrt(norms, ins.InverseSqrt)
+	if err != nil {
+		return nil, err
+	}
+	return server.mulRescale(innerProduct, inverse)
+}
+
+// fillOutside keeps ct at the given slots and sets all other slots to value
+func (server *serverComp) fillOutside(ct *Ciphertext, slots []int, value float64) (*Ciphertext, error) {
+	eval := server.shared.GetCKKSEvaluator()
+	//(ct - value)*mask + value
+	res := eval.AddConstNew(ct, -value)
+	res = eval.MulNew(res, server.slotsPlaintext(slots, 1, res.Level()))
+	if err := server.rescale("fill", res); err != nil {
+		return nil, err
+	}
+	eval.AddConst(res, value, res)
+	return res, nil
+}
+
+// inverse approximates 1/x at the given slots, x must be in [Min, Max] there. If fewer levels are left than the
+// approximation and one more product take, the normalized x is refreshed and x is computed again from it.
+func (server *serverComp) inverse(x *Ciphertext, slots []int, approx *InverseApproximation) (*Ciphertext, error) {
+	eval := server.shared.GetCKKSEvaluator()
+
+	//u = (2x - Min - Max)/(Max - Min)
+	u := eval.MultByConstNew(x, 2/(approx.Max-approx.Min))
+	eval.AddConst(u, -(approx.Min+approx.Max)/(approx.Max-approx.Min), u)
+	if err := server.rescale("inverse", u); err != nil {
+		return nil, err
+	}
+	if levels := polyLevels(approx.ChebyDegree) + 2*approx.Iterations + 1; u.Level() < levels {
+		var err error
+		if u, err = server.ensureLevels(u, slots, levels); err != nil {
+			return nil, err
 		}
-		rt = server.shared.GetCKKSEvaluator().RotateNew(rt, 1)
-		server.shared.GetCKKSEvaluator().Add(tempSquared, rt, tempSquared)
+		//x = (u*(Max - Min) + Min + Max)/2
+		x = eval.MultByConstNew(u, (approx.Max-approx.Min)/2)
+		eval.AddConst(x, (approx.Min+approx.Max)/2, x)
+		if err := server.rescale("inverse", x); err != nil {
+			return nil, err
+		}
+	}
+	y, err := server.evaluateCheby("inverse", u, approx.chebyshev())
+	if err != nil {
+		return nil, err
 	}
-	val, exists := instructionsDic[maxLen]
-	if exists {
-		for _, ins := range val {
-			mask := server.Mask(tempSquared, ins.Index)
-			ins.Mask = mask
+	for i := 0; i < approx.Iterations; i++ {
+		//y = y*(2 - x*y)
+		t, err := server.mulRescale(x, y)
+		if err != nil {
+			return nil, err
+		}
+		eval.MultByConst(t, -1, t)
+		eval.AddConst(t, 2, t)
+		if y, err = server.mulRescale(y, t); err != nil {
+			return nil, err
 		}
 	}
+	return y, nil
+}
 
+// barrelShift rotates the regions of length n starting at the given slots cyclically to the left by shift,
+// slot start+i of the result holds slot start+((i+shift) mod n). All other slots are set to zero.
+func (server *serverComp) barrelShift(ct *Ciphertext, starts []int, n int, shift int) (*Ciphertext, error) {
+	params := server.shared.GetParams()
+	eval := server.shared.GetCKKSEvaluator()
+	shift = ((shift % n) + n) % n
+	head, tail := []int{}, []int{}
+	for _, start := range starts {
+		for i := 0; i < n; i++ {
+			if i < n-shift {
+				head = append(head, (start+i)%params.Slots())
+			} else {
+				tail = append(tail, (start+i)%params.Slots())
+			}
+		}
+	}
+	rotated, err := server.rotateByPowersOfTwo(ct, shift)
+	if err != nil {
+		return nil, err
+	}
+	res := eval.MulNew(rotated, server.slotsPlaintext(head, 1, ct.Level()))
+	if shift != 0 {
+		if rotated, err = server.rotateByPowersOfTwo(ct, shift-n); err != nil {
+			return nil, err
+		}
+		eval.Add(res, eval.MulNew(rotated, server.slotsPlaintext(tail, 1, ct.Level())), res)
+	}
+	if err := server.rescale("barrel shift", res); err != nil {
+		return nil, err
+	}
+	return res, nil
 }
 
-func (server *serverComp) HammingDistanceTemplateInstructions(instructionsDic map[int][]*TemplateInstruction, probe *Ciphertext, reference *Ciphertext) {
-	maxLen := server.MaxTemplateLen(instructionsDic)
+// MaskedHammingDistance returns the number of bits that differ and are valid in both templates and the number of
+// bits valid in both templates, at the slot of the instruction's index. The templates are followed by their masks.
+func (server *serverComp) MaskedHammingDistance(probe *Ciphertext, reference *Ciphertext, ins *TemplateInstruction) (*Ciphertext, *Ciphertext, error) {
+	n := ins.TemplateLength
+	//MA*MB moved onto the bits
+	probeMask, err := server.rotateByPowersOfTwo(probe, n)
+	if err != nil {
+		return nil, nil, err
+	}
+	referenceMask, err := server.rotateByPowersOfTwo(reference, n)
+	if err != nil {
+		return nil, nil, err
+	}
+	valid, err := server.mulRescale(probeMask, referenceMask)
+	if err != nil {
+		return nil, nil, err
+	}
+	//(Ai+Bi - 2*AiBi)*MAi*MBi
+	xor, err := server.comparatorTerm(HAMMING, probe, reference)
+	if err != nil {
+		return nil, nil, err
+	}
+	masked, err := server.mulRescale(xor, valid)
+	if err != nil {
+		return nil, nil, err
+	}
+	return server.sumSlots(masked, n), server.sumSlots(valid, n), nil
+}
 
-	AiBiAdd := server.shared.GetCKKSEvaluator().AddNew(probe, reference)
-	AiBiMul := server.shared.GetCKKSEvaluator().MulNew(probe, reference)
-	server.shared.GetCKKSEvaluator().Relinearize(AiBiMul, AiBiMul)
-	AiBiMulTwo := server.shared.GetCKKSEvaluator().MultByConstNew(AiBiMul, 2.0)
-	//server.shared.GetCKKSEvaluator().Relinearize(AiBiMulTwo, AiBiMulTwo)
-	temp := server.shared.GetCKKSEvaluator().SubNew(AiBiAdd, AiBiMulTwo)
-	//Sum up temp into first slot
-	rt := server.shared.GetCKKSEvaluator().RotateNew(temp, 1)
-	server.shared.GetCKKSEvaluator().Add(temp, rt, temp)
+// maskedHammingScores returns the fractional Hamming distance of the instruction at the slot of its index after
+// each of the offsets, the minimum over the barrel shifts of the probe. Without inverse approximation it returns
+// the number of disagreeing valid bits.
+func (server *serverComp) maskedHammingScores(ins *TemplateInstruction, probe *Ciphertext, reference *Ciphertext, offsets []int) (*Ciphertext, error) {
+	options := ins.MaskedHamming
+	if options == nil || options.Inverse == nil {
+		distance, _, err := server.MaskedHammingDistance(probe, reference, ins)
+		return distance, err
+	}
+	eval := server.shared.GetCKKSEvaluator()
+	slots := make([]int, len(offsets))
+	starts := make([]int, 0, 2*len(offsets))
+	for i, offset := range offsets {
+		slots[i] = (offset + ins.Index) % server.shared.GetParams().Slots()
+		starts = append(starts, slots[i], slots[i]+ins.TemplateLength)
+	}
+	var best *Ciphertext
+	for _, shift := range options.shifts() {
+		shifted := probe
+		if shift != 0 {
+			var err error
+			if shifted, err = server.barrelShift(probe, starts, ins.TemplateLength, shift); err != nil {
+				return nil, err
+			}
+		}
+		distance, valid, err := server.MaskedHammingDistance(shifted, reference, ins)
+		if err != nil {
+			return nil, err
+		}
+		//both are restricted to the score slots, so the fraction is in [0, 1] everywhere
+		if distance, err = server.fillOutside(distance, slots, 0); err != nil {
+			return nil, err
+		}
+		if valid, err = server.fillOutside(valid, slots, (options.Inverse.Min+options.Inverse.Max)/2); err != nil {
+			return nil, err
+		}
+		inverse, err := server.inverse(valid, slots, options.Inverse)
+		if err != nil {
+			return nil, err
+		}
+		fraction, err := server.mulRescale(distance, inverse)
+		if err != nil {
+			return nil, err
+		}
+		if best == nil {
+			best = fraction
+			continue
+		}
+		//min(best, fraction) = fraction + [best < fraction]*(best - fraction)
+		if best, err = server.ensureLevels(best, slots, 3); err != nil {
+			return nil, err
+		}
+		if fraction, err = server.ensureLevels(fraction, slots, 3); err != nil {
+			return nil, err
+		}
+		diff := eval.SubNew(best, fraction)
+		c, err := server.approximateStep(diff, slots, 0, options.Comparison, 3)
+		if err != nil {
+			return nil, err
+		}
+		if c, err = server.mulRescale(c, diff); err != nil {
+			return nil, err
+		}
+		best = eval.AddNew(fraction, c)
+	}
+	return best, nil
+}
 
-	for i := 1; i < maxLen-1; i++ {
-		//for a templen of 512, 511 rotations are needed thats why we look at i+1 in the dic
-		val, exists := instructionsDic[(i + 1)]
-		if exists {
-			for _, ins := range val {
+// fuse applies the normalization and weight of the instruction to the distances in ct
+func (server *serverComp) fuse(ins *TemplateInstruction, ct *Ciphertext) *Ciphertext {
+	if ins.Offset == 0 && ins.Weight*ins.Scale == 1 {
+		return ct
+	}
+	res := ct.CopyNew().Ciphertext()
+	if ins.Offset != 0 {
+		server.shared.GetCKKSEvaluator().AddConst(res, -ins.Offset, res)
+	}
+	if ins.Weight*ins.Scale != 1 {
+		server.shared.GetCKKSEvaluator().MultByConst(res, ins.Weight*ins.Scale, res)
+	}
+	return res
+}
 
-				fmt.Println("index: ", ins.Index)
-				fmt.Println("ct: ", temp)
-				mask := server.Mask(temp, ins.Index)
-				server.shared.GetCKKSEvaluator().Relinearize(mask, mask)
-				ins.Mask = mask
+// templateScores returns for each instruction a ciphertext holding its fused score at the slot of the template's index
+// after each of the offsets. The slot-wise terms and their sums are shared by instructions with the same comparator
+// and template length.
+func (server *serverComp) templateScores(instructions []*TemplateInstruction, probe *Ciphertext, reference *Ciphertext, offsets []int) (map[*TemplateInstruction]*Ciphertext, error) {
+	terms := make(map[int]*Ciphertext)
+	sums := make(map[[2]int]*Ciphertext)
+	scores := make(map[*TemplateInstruction]*Ciphertext)
+	for _, ins := range instructions {
+		if ins.Comparator == MASKED_HAMMING {
+			score, err := server.maskedHammingScores(ins, probe, reference, offsets)
+			if err != nil {
+				return nil, err
 			}
+			scores[ins] = server.fuse(ins, score)
+			continue
 		}
-		rt = server.shared.GetCKKSEvaluator().RotateNew(rt, 1)
-		server.shared.GetCKKSEvaluator().Add(temp, rt, temp)
-	}
-	val, exists := instructionsDic[maxLen]
-	if exists {
-		for _, ins := range val {
-			mask := server.Mask(temp, ins.Index)
-			ins.Mask = mask
+		termKey := ins.Comparator
+		if termKey == COSINE {
+			termKey = INNER_PRODUCT
+		}
+		term, ok := terms[termKey]
+		if !ok {
+			var err error
+			if term, err = server.comparatorTerm(termKey, probe, reference); err != nil {
+				return nil, err
+			}
+			terms[termKey] = term
 		}
+		sumKey := [2]int{termKey, ins.TemplateLength}
+		sum, ok := sums[sumKey]
+		if !ok {
+			sum = server.sumSlots(term, ins.TemplateLength)
+			sums[sumKey] = sum
+		}
+		if ins.Comparator == COSINE {
+			slots := make([]int, len(offsets))
+			for i, offset := range offsets {
+				slots[i] = (offset + ins.Index) % server.shared.GetParams().Slots()
+			}
+			var err error
+			if sum, err = server.normalizeCosine(ins, sum, probe, reference, slots); err != nil {
+				return nil, err
+			}
+		}
+		scores[ins] = server.fuse(ins, sum)
 	}
+	return scores, nil
 }
 
-func (server *serverComp) ProcessTemplateInstructionsSingleCT(instructions []*TemplateInstruction, probe *Ciphertext, reference *Ciphertext) *Ciphertext {
-	bin_dic := make(map[int][]*TemplateInstruction)
-	float_dic := make(map[int][]*TemplateInstruction)
-	for _, instruction := range instructions {
-		if instruction.Binary {
-			_, ok := bin_dic[instruction.TemplateLength]
-			if !ok {
-				bin_dic[instruction.TemplateLength] = make([]*TemplateInstruction, 0)
-			}
-			bin_dic[instruction.TemplateLength] = append(bin_dic[instruction.TemplateLength], instruction)
+func (server *serverComp) ProcessTemplateInstructionsSingleCT(instructions []*TemplateInstruction, probe *Ciphertext, reference *Ciphertext) (final_ct *Ciphertext, err error) {
+	timer := startStage(server.log(server.shared), StageDistance, Field{"templates", len(instructions)})
+	defer func() { timer.done(final_ct) }()
+	scores, err := server.templateScores(instructions, probe, reference, []int{0})
+	if err != nil {
+		return nil, err
+	}
+	//mask the scores and add them together for final result
+	for _, ins := range instructions {
+		mask := server.Mask(scores[ins], ins.Index)
+		server.shared.GetCKKSEvaluator().Relinearize(mask, mask)
+		if err = server.rescaleScore(mask); err != nil {
+			return nil, err
+		}
+		if final_ct == nil {
+			final_ct = mask
 		} else {
-			_, ok := float_dic[instruction.TemplateLength]
-			if !ok {
-				float_dic[instruction.TemplateLength] = make([]*TemplateInstruction, 0)
+			server.shared.GetCKKSEvaluator().Add(final_ct, mask, final_ct)
+		}
+	}
+	return final_ct, nil
+}
+
+// rescaleScore rescales a score to the default scale, the scores of comparators of different depths
+// are only added once their scales match
+func (server *serverComp) rescaleScore(ct *Ciphertext) error {
+	if ct.Level() == 0 {
+		return nil
+	}
+	return server.rescale("score", ct)
+}
+
+// rescale rescales ct in place to the default scale, a ciphertext at level 0 returns a LevelError for op
+func (server *serverComp) rescale(op string, ct *Ciphertext) error {
+	if ct.Level() == 0 {
+		return &LevelError{Op: op, Needed: 1, Available: 0}
+	}
+	return server.shared.GetCKKSEvaluator().Rescale(ct, server.shared.GetParams().Scale(), ct)
+}
+
+// evaluateCheby evaluates the interpolation on ct at the default scale, too few levels return a LevelError for op
+func (server *serverComp) evaluateCheby(op string, ct *Ciphertext, cheby *ChebyshevInterpolation) (*Ciphertext, error) {
+	if levels := polyLevels(cheby.Degree()); ct.Level() < levels {
+		return nil, &LevelError{Op: op, Needed: levels, Available: ct.Level()}
+	}
+	return server.shared.GetCKKSEvaluator().EvaluateCheby(ct, cheby, server.shared.GetParams().Scale())
+}
+
+// evaluatePoly evaluates pol on ct at the default scale, too few levels return a LevelError for op
+func (server *serverComp) evaluatePoly(op string, ct *Ciphertext, pol *Poly) (*Ciphertext, error) {
+	if levels := polyLevels(pol.Degree()); ct.Level() < levels {
+		return nil, &LevelError{Op: op, Needed: levels, Available: ct.Level()}
+	}
+	return server.shared.GetCKKSEvaluator().EvaluatePoly(ct, pol, server.shared.GetParams().Scale())
+}
+
+// rotateByPowersOfTwo rotates ct to the left by k using only power of two rotations
+func (server *serverComp) rotateByPowersOfTwo(ct *Ciphertext, k int) (*Ciphertext, error) {
+	slots := server.shared.GetParams().Slots()
+	k = ((k % slots) + slots) % slots
+	res := ct.CopyNew().Ciphertext()
+	for step := 1; k > 0; step <<= 1 {
+		if k&1 == 1 {
+			if err := server.checkRotation(step); err != nil {
+				return nil, err
 			}
-			float_dic[instruction.TemplateLength] = append(float_dic[instruction.TemplateLength], instruction)
+			server.shared.GetCKKSEvaluator().Rotate(res, step, res)
 		}
+		k >>= 1
 	}
+	return res, nil
+}
 
-	server.EuclideanDistanceTemplateInstructions(float_dic, probe, reference)
-	server.HammingDistanceTemplateInstructions(bin_dic, probe, reference)
-	//add masks together for final result
-	var final_ct *Ciphertext
-	firstAdded := false
-	for _, v := range float_dic {
-		for _, ti := range v {
-			if !firstAdded {
-				rel := ti.Mask
-				if ti.Mask.Degree() == 2 {
-					rel = server.shared.GetCKKSEvaluator().RelinearizeNew(ti.Mask)
-				}
-				final_ct = rel
-				firstAdded = true
-			} else {
-				rel := ti.Mask
-				if ti.Mask.Degree() == 2 {
-					rel = server.shared.GetCKKSEvaluator().RelinearizeNew(ti.Mask)
+// PackGallery packs the references (one ciphertext per subject, templates starting at slot 0)
+// into as few ciphertexts as possible, following the GalleryLayout for the subject IDs.
+func (server *serverComp) PackGallery(references []*Ciphertext, subjectIDs []string, templateLen int) ([]*Ciphertext, *GalleryLayout, error) {
+	if len(references) != len(subjectIDs) {
+		return nil, nil, fmt.Errorf("%w: %d references but %d subject IDs", ErrParameterMismatch, len(references), len(subjectIDs))
+	}
+	eval := server.shared.GetCKKSEvaluator()
+	layout, err := NewGalleryLayout(subjectIDs, templateLen, server.shared.GetParams().Slots())
+	if err != nil {
+		return nil, nil, err
+	}
+	gallery := make([]*Ciphertext, layout.NumCiphertexts())
+	for g := range gallery {
+		refs := layout.References(g)
+		packed := make([]*Ciphertext, len(refs))
+		for i, ref := range refs {
+			packed[i] = references[ref].CopyNew().Ciphertext()
+		}
+		//reference k ends up at slot -k*Stride, one rotation per level of the tree
+		for step := layout.Stride; len(packed) > 1; step <<= 1 {
+			next := make([]*Ciphertext, (len(packed)+1)/2)
+			for i := range next {
+				next[i] = packed[2*i]
+				if 2*i+1 < len(packed) {
+					rotated, err := server.rotateNew(packed[2*i+1], step)
+					if err != nil {
+						return nil, nil, err
+					}
+					eval.Add(next[i], rotated, next[i])
 				}
-				server.shared.GetCKKSEvaluator().Add(final_ct, rel, final_ct)
 			}
+			packed = next
 		}
+		gallery[g] = packed[0]
 	}
-	for _, v := range bin_dic {
-		for _, ti := range v {
-			if !firstAdded {
-				rel := ti.Mask
-				if ti.Mask.Degree() == 2 {
-					rel = server.shared.GetCKKSEvaluator().RelinearizeNew(ti.Mask)
-				}
-				final_ct = rel
-				firstAdded = true
+	return gallery, layout, nil
+}
+
+// replicateProbe copies the probe into every reference block of the layout
+func (server *serverComp) replicateProbe(probe *Ciphertext, layout *GalleryLayout) (*Ciphertext, error) {
+	eval := server.shared.GetCKKSEvaluator()
+	rep := probe.CopyNew().Ciphertext()
+	for step := layout.Stride; step < layout.Stride*layout.PerCiphertext; step <<= 1 {
+		rotated, err := server.rotateNew(rep, step)
+		if err != nil {
+			return nil, err
+		}
+		eval.Add(rep, rotated, rep)
+	}
+	return rep, nil
+}
+
+// galleryMask returns a plaintext with ones at the first slot of the first n reference blocks
+func (server *serverComp) galleryMask(layout *GalleryLayout, n int, level int) *Plaintext {
+	cmplx := make([]complex128, layout.Slots)
+	for k := 0; k < n; k++ {
+		cmplx[layout.Offset(k)] = complex(1.0, 0.0)
+	}
+	return server.shared.GetCKKSEncoder().EncodeComplexNTTAtLvlNew(level, cmplx, server.shared.GetParams().LogSlots())
+}
+
+// ProcessTemplateInstructionsGallery compares the probe against every reference of the packed gallery.
+// The distance to the i-th reference is found at slot layout.Slot(i) of the returned ciphertext.
+func (server *serverComp) ProcessTemplateInstructionsGallery(instructions []*TemplateInstruction, probe *Ciphertext, gallery []*Ciphertext, layout *GalleryLayout) (final_ct *Ciphertext, err error) {
+	timer := startStage(server.log(server.shared), StageDistance, Field{"templates", len(instructions)}, Field{"references", len(layout.SubjectIDs)})
+	defer func() { timer.done(final_ct) }()
+	eval := server.shared.GetCKKSEvaluator()
+	rep, err := server.replicateProbe(probe, layout)
+	if err != nil {
+		return nil, err
+	}
+	for g, packed := range gallery {
+		offsets := make([]int, len(layout.References(g)))
+		for k := range offsets {
+			offsets[k] = layout.Offset(k)
+		}
+		scores, err := server.templateScores(instructions, rep, packed, offsets)
+		if err != nil {
+			return nil, err
+		}
+		var distances *Ciphertext
+		for _, ins := range instructions {
+			sum, err := server.rotateByPowersOfTwo(scores[ins], ins.Index)
+			if err != nil {
+				return nil, err
+			}
+			if err = server.rescaleScore(sum); err != nil {
+				return nil, err
+			}
+			if distances == nil {
+				distances = sum
 			} else {
-				rel := ti.Mask
-				if ti.Mask.Degree() == 2 {
-					rel = server.shared.GetCKKSEvaluator().RelinearizeNew(ti.Mask)
-				}
-				server.shared.GetCKKSEvaluator().Add(final_ct, rel, final_ct)
+				eval.Add(distances, sum, distances)
+			}
+		}
+		masked := eval.MulNew(distances, server.galleryMask(layout, len(layout.References(g)), distances.Level()))
+		if masked, err = server.rotateByPowersOfTwo(masked, g); err != nil {
+			return nil, err
+		}
+		if final_ct == nil {
+			final_ct = masked
+		} else {
+			eval.Add(final_ct, masked, final_ct)
+		}
+	}
+	return final_ct, nil
+}
+
+// FuseDistances sums the fused distances of all template instructions into slot 0
+func (server *serverComp) FuseDistances(instructions []*TemplateInstruction, ct *Ciphertext) (*Ciphertext, error) {
+	var fused *Ciphertext
+	for _, ins := range instructions {
+		rotated, err := server.rotateByPowersOfTwo(ct, ins.Index)
+		if err != nil {
+			return nil, err
+		}
+		if fused == nil {
+			fused = rotated
+		} else {
+			server.shared.GetCKKSEvaluator().Add(fused, rotated, fused)
+		}
+	}
+	return fused, nil
+}
+
+// slotsPlaintext returns a plaintext holding value at the given slots and zero everywhere else
+func (server *serverComp) slotsPlaintext(slots []int, value float64, level int) *Plaintext {
+	return server.slotsPlaintextAtScale(slots, value, level, server.shared.GetParams().Scale())
+}
+
+// slotsPlaintextAtScale is slotsPlaintext encoded at the given scale
+func (server *serverComp) slotsPlaintextAtScale(slots []int, value float64, level int, scale float64) *Plaintext {
+	params := server.shared.GetParams()
+	cmplx := make([]complex128, params.Slots())
+	for _, s := range slots {
+		cmplx[s] = complex(value, 0.0)
+	}
+	pt := NewPlaintextCKKS(params, level, scale)
+	server.shared.GetCKKSEncoder().EncodeComplexNTT(pt, cmplx, params.LogSlots())
+	return pt
+}
+
+// monomialPlaintext returns X^deg as a plaintext of scale 1
+func (server *serverComp) monomialPlaintext(deg int, level int) (*Plaintext, error) {
+	params := server.shared.GetParams()
+	ringQ, err := ring.NewRing(params.N(), params.Qi()[:level+1])
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrParameterMismatch, err)
+	}
+	pt := NewPlaintextCKKS(params, level, 1)
+	for i := 0; i < level+1; i++ {
+		pt.Value()[0].Coeffs[i][deg] = 1
+	}
+	ringQ.NTTLvl(level, pt.Value()[0], pt.Value()[0])
+	return pt, nil
+}
+
+// refreshSlots re-encrypts the values at the given slots at a higher level with the half-bootstrapper.
+// Every value is spread over all slots, which gives a constant polynomial, and moved to the coefficient
+// the client encodes its slot at, so the coefficients to slots step of HalfBoot brings it back to its slot.
+// The values must be in [-1, 1] and the ciphertext needs two levels, all other slots are set to zero.
+// The masks are encoded at the scale that brings the values to exactly the default scale, HalfBoot matches
+// the scale with an integer constant only.
+func (server *serverComp) refreshSlots(ct *Ciphertext, slots []int) (*Ciphertext, error) {
+	params := server.shared.GetParams()
+	eval := server.shared.GetCKKSEvaluator()
+	if ct.Level() < 2 {
+		return nil, &LevelError{Op: "refresh", Needed: 2, Available: ct.Level()}
+	}
+	if ct.Scale() >= 2*params.Scale() {
+		ct = ct.CopyNew().Ciphertext()
+		if err := server.rescale("refresh", ct); err != nil {
+			return nil, err
+		}
+	}
+	maskScale := params.Scale() * float64(params.Qi()[ct.Level()]) / ct.Scale()
+	var packed *Ciphertext
+	for _, s := range slots {
+		value := eval.MulNew(ct, server.slotsPlaintextAtScale([]int{s}, 1, ct.Level(), maskScale))
+		if err := server.rescale("refresh", value); err != nil {
+			return nil, err
+		}
+		value.SetScale(params.Scale())
+		for step := 1; step < params.Slots(); step <<= 1 {
+			rotated, err := server.rotateNew(value, step)
+			if err != nil {
+				return nil, err
+			}
+			eval.Add(value, rotated, value)
+		}
+		if deg := messageCoefficient(params.LogN(), server.shared.GetMessagesSize(), s); deg != 0 {
+			monomial, err := server.monomialPlaintext(deg, value.Level())
+			if err != nil {
+				return nil, err
 			}
+			value = eval.MulNew(value, monomial)
 		}
+		if packed == nil {
+			packed = value
+		} else {
+			eval.Add(packed, value, packed)
+		}
+	}
+	log := server.log(server.shared)
+	timer := startStage(log, StageRefresh, Field{"slots", len(slots)})
+	refreshed, _ := server.hbtp.halfBoot(packed, !server.shared.GetFullCoeffs(), log)
+	timer.done(refreshed)
+	return refreshed, nil
+}
+
+// checkRotation returns a RotationKeyError if there is no key for the rotation by k
+func (server *serverComp) checkRotation(k int) error {
+	return checkRotationKeys(server.shared.GetParams(), server.shared.GetRotationKeys(), []int{k})
+}
+
+// rotateNew rotates ct by k, a missing key returns a RotationKeyError
+func (server *serverComp) rotateNew(ct *Ciphertext, k int) (*Ciphertext, error) {
+	if err := server.checkRotation(k); err != nil {
+		return nil, err
 	}
-	return final_ct
+	return server.shared.GetCKKSEvaluator().RotateNew(ct, k), nil
+}
+
+// ensureLevels refreshes ct if less than levels levels are left, a LevelError is returned if the refresh does not
+// give enough levels either
+func (server *serverComp) ensureLevels(ct *Ciphertext, slots []int, levels int) (*Ciphertext, error) {
+	if ct.Level() >= levels {
+		return ct, nil
+	}
+	ct, err := server.refreshSlots(ct, slots)
+	if err != nil {
+		return nil, err
+	}
+	if ct.Level() < levels {
+		return nil, &LevelError{Op: "refresh", Needed: levels, Available: ct.Level()}
+	}
+	return ct, nil
+}
+
+// EvaluateThreshold compares the fused distance in slot 0 against the threshold under encryption.
+// Slot 0 of the result is close to 1 if the distance is below the threshold and close to 0 otherwise.
+func (server *serverComp) EvaluateThreshold(distance *Ciphertext, thresholdParams *ThresholdParameters) (*Ciphertext, error) {
+	return server.evaluateThresholdAtSlots(distance, []int{0}, thresholdParams)
+}
 
+func (server *serverComp) evaluateThresholdAtSlots(distance *Ciphertext, slots []int, thresholdParams *ThresholdParameters) (*Ciphertext, error) {
+	eval := server.shared.GetCKKSEvaluator()
+
+	if distance.Level() < 1 {
+		return nil, &LevelError{Op: "threshold", Needed: 1, Available: distance.Level()}
+	}
+	//u = 2*d/MaxDistance - 1 at the given slots and -1 everywhere else
+	u := eval.MulNew(distance, server.slotsPlaintext(slots, 2/thresholdParams.MaxDistance, distance.Level()))
+	if err := server.rescale("threshold", u); err != nil {
+		return nil, err
+	}
+	eval.AddConst(u, -1, u)
+
+	return server.approximateStep(u, slots, thresholdParams.normalizedThreshold(), thresholdParams.SignApproximation, 0)
+}
+
+// approximateStep evaluates [u < t] at the given slots, u must be in [-1, 1] in all slots.
+// The result keeps at least reserve levels, refreshing it if needed.
+func (server *serverComp) approximateStep(u *Ciphertext, slots []int, t float64, approx SignApproximation, reserve int) (*Ciphertext, error) {
+	//keep two levels for a refresh as long as more work follows
+	keep := 0
+	if approx.Iterations > 0 || reserve > 0 {
+		keep = 2
+	}
+	u, err := server.ensureLevels(u, slots, polyLevels(approx.ChebyDegree)+keep)
+	if err != nil {
+		return nil, err
+	}
+	res, err := server.evaluateCheby("step", u, approx.chebyshev(t))
+	if err != nil {
+		return nil, err
+	}
+	for i := 0; i < approx.Iterations; i++ {
+		last := i == approx.Iterations-1
+		if last && reserve == 0 {
+			keep = 0
+		}
+		if res, err = server.ensureLevels(res, slots, polyLevels(3)+keep); err != nil {
+			return nil, err
+		}
+		if res, err = server.evaluatePoly("step", res, approx.sharpening(last)); err != nil {
+			return nil, err
+		}
+	}
+	return server.ensureLevels(res, slots, reserve)
+}
+
+// mulRescale multiplies two ciphertexts and rescales the product to the default scale
+func (server *serverComp) mulRescale(left *Ciphertext, right *Ciphertext) (*Ciphertext, error) {
+	eval := server.shared.GetCKKSEvaluator()
+	res := eval.MulNew(left, right)
+	eval.Relinearize(res, res)
+	if err := server.rescale("product", res); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// FindBestMatch searches the smallest distance in the result of ProcessTemplateInstructionsGallery with a tournament
+// of encrypted comparisons. It returns a one-hot ciphertext in the slots of the gallery layout, which is close to 1
+// at the best match only, and, if a threshold is set, the decision for the smallest distance in slot 0.
+func (server *serverComp) FindBestMatch(distances *Ciphertext, layout *GalleryLayout, argminParams *ArgminParameters) (*Ciphertext, *Ciphertext, error) {
+	params := server.shared.GetParams()
+	eval := server.shared.GetCKKSEvaluator()
+	//three levels before every multiplication: one for the product and two for a refresh of it
+	const reserve = 3
+
+	if distances.Level() < 1 {
+		return nil, nil, &LevelError{Op: "argmin", Needed: 1, Available: distances.Level()}
+	}
+	//d/MaxDistance at the references and 1 everywhere else, so the padding never wins
+	cur := eval.AddConstNew(distances, -argminParams.MaxDistance)
+	cur = eval.MulNew(cur, server.slotsPlaintext(layout.referenceSlots(), 1/argminParams.MaxDistance, cur.Level()))
+	if err := server.rescale("argmin", cur); err != nil {
+		return nil, nil, err
+	}
+	eval.AddConst(cur, 1, cur)
+
+	//forward: the position p keeps the smaller of p and p+step
+	steps := layout.tournamentSteps()
+	comparisons := make([]*Ciphertext, len(steps))
+	var err error
+	for r, step := range steps {
+		if cur, err = server.ensureLevels(cur, layout.tournamentSlots(r), reserve); err != nil {
+			return nil, nil, err
+		}
+		other, err := server.rotateNew(cur, params.Slots()-step)
+		if err != nil {
+			return nil, nil, err
+		}
+		diff := eval.SubNew(cur, other)
+		if comparisons[r], err = server.approximateStep(diff, layout.tournamentSlots(r+1), 0, argminParams.Comparison, reserve); err != nil {
+			return nil, nil, err
+		}
+		if diff, err = server.mulRescale(comparisons[r], diff); err != nil {
+			return nil, nil, err
+		}
+		cur = eval.AddNew(other, diff)
+	}
+
+	//backward: spread the weight of every winner over the two positions it was chosen from
+	res := server.shared.GetCKKSEncryptor().EncryptNew(server.slotsPlaintext([]int{0}, 1, params.MaxLevel()))
+	for r := len(steps) - 1; r >= 0; r-- {
+		if res, err = server.ensureLevels(res, layout.tournamentSlots(r+1), reserve); err != nil {
+			return nil, nil, err
+		}
+		kept, err := server.mulRescale(res, comparisons[r])
+		if err != nil {
+			return nil, nil, err
+		}
+		lost, err := server.rotateNew(eval.SubNew(res, kept), steps[r])
+		if err != nil {
+			return nil, nil, err
+		}
+		res = eval.AddNew(kept, lost)
+	}
+
+	var decision *Ciphertext
+	if argminParams.Threshold != nil {
+		if cur, err = server.ensureLevels(cur, []int{0}, reserve); err != nil {
+			return nil, nil, err
+		}
+		if decision, err = server.evaluateThresholdAtSlots(cur, []int{0}, argminParams.normalizedThreshold()); err != nil {
+			return nil, nil, err
+		}
+	}
+	return res, decision, nil
 }
@@ -0,0 +1,506 @@
+package ckks_fv
+
+import (
+	"errors"
+	"math"
+	"sort"
+	"testing"
+)
+
+// testParties are the parties of insecure parameters of ring degree 2^11, small enough to evaluate and half-bootstrap
+// in every test run. They are set up once per slot mode.
+type testParties struct {
+	shared *Ishared
+	auth   ServerAuth
+	comp   *serverComp
+	client Client
+	// level of the half-bootstrapped ciphertexts, the levels above it rescale by the moduli of the half-bootstrapping
+	level int
+}
+
+var testPartiesCache = map[bool]*testParties{}
+
+// testLogN is the ring degree of the test parties, the moduli of the RtF parameters are NTT friendly for it
+const testLogN = 11
+
+// newTestParties returns the HERA parties with the moduli of the RtF parameters 0 (fullCoeffs) or 1 (slots) on a ring
+// of degree 2^testLogN
+func newTestParties(t *testing.T, fullCoeffs bool) *testParties {
+	if parties, ok := testPartiesCache[fullCoeffs]; ok {
+		return parties
+	}
+	paramIndex := 1
+	if fullCoeffs {
+		paramIndex = 0
+	}
+	s := new(Ishared)
+	s.radix = 2
+	if err := s.setParameters(HERA, 4, paramIndex, 2, fullCoeffs); err != nil {
+		t.Fatal(err)
+	}
+	hbtpParams := s.HbtpParams.Copy()
+	hbtpParams.LogN = testLogN
+	if fullCoeffs {
+		hbtpParams.LogSlots = testLogN - 1
+	}
+	if err := s.setHalfBootParameters(hbtpParams, s.Params.PlainModulus(), fullCoeffs); err != nil {
+		t.Fatal(err)
+	}
+	s.FvEncoder = NewMFVEncoder(s.Params)
+	s.CkksEncoder = NewCKKSEncoder(s.Params)
+	s.PDcds = s.FvEncoder.GenSlotToCoeffMatFV(2)
+	s.SetLogger(NewNopLogger())
+
+	parties := &testParties{shared: s, level: len(hbtpParams.ResidualModuli) - 1}
+	var err error
+	if parties.auth, err = NewServerAuth(s); err != nil {
+		t.Fatal(err)
+	}
+	comp, err := NewServerComp(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parties.comp = comp.(*serverComp)
+	if parties.client, err = NewClient(s); err != nil {
+		t.Fatal(err)
+	}
+	testPartiesCache[fullCoeffs] = parties
+	return parties
+}
+
+// encrypt encrypts the values into the first slots at the level of the half-bootstrapped ciphertexts
+func (parties *testParties) encrypt(values []float64) *Ciphertext {
+	return parties.encryptAtLevel(values, parties.level)
+}
+
+// encryptAtLevel encrypts the values and drops the ciphertext to the given level
+func (parties *testParties) encryptAtLevel(values []float64, level int) *Ciphertext {
+	params := parties.shared.GetParams()
+	slots := make([]complex128, params.Slots())
+	for i, v := range values {
+		slots[i] = complex(v, 0)
+	}
+	pt := parties.shared.GetCKKSEncoder().EncodeComplexNTTAtLvlNew(params.MaxLevel(), slots, params.LogSlots())
+	ct := parties.shared.GetCKKSEncryptor().EncryptNew(pt)
+	return parties.shared.GetCKKSEvaluator().DropLevelNew(ct, ct.Level()-level)
+}
+
+// decrypt returns the real parts of the slots
+func (parties *testParties) decrypt(ct *Ciphertext) []float64 {
+	values := parties.auth.DecryptMessage(ct)
+	res := make([]float64, len(values))
+	for i, v := range values {
+		res[i] = real(v)
+	}
+	return res
+}
+
+// checkSlots compares the decrypted slots with want, a missing slot of want is expected to be zero
+func checkSlots(t *testing.T, name string, got []float64, want map[int]float64, tolerance float64) {
+	t.Helper()
+	for i, v := range got {
+		if math.Abs(v-want[i]) > tolerance {
+			t.Errorf("%s: slot %d is %v, expected %v", name, i, v, want[i])
+		}
+	}
+}
+
+func randomValues(n int, min float64, max float64) []float64 {
+	values := make([]float64, n)
+	for i := range values {
+		values[i] = min + (max-min)*float64(i*7919%n)/float64(n)
+	}
+	return values
+}
+
+// TestRefreshSlots half-bootstraps values at various slots, of the default scale and of the scale of a product,
+// and checks that each comes back to its slot and that the refreshes are recorded under StageRefresh
+func TestRefreshSlots(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipped in short mode")
+	}
+	for _, fullCoeffs := range []bool{false, true} {
+		parties := newTestParties(t, fullCoeffs)
+		slots := parties.shared.GetParams().Slots()
+		values := randomValues(slots, -0.9, 0.9)
+		refreshed := []int{0, 1, 3, slots/2 - 1, slots / 2, slots - 1}
+		ones := make([]float64, slots)
+		for i := range ones {
+			ones[i] = 1
+		}
+		ct := parties.encrypt(values)
+		metrics := NewMetrics()
+		parties.comp.SetLogger(metrics)
+		defer parties.comp.SetLogger(nil)
+		//the product is rescaled by a modulus of the chain, its scale is not a power of two
+		product, err := parties.comp.mulRescale(ct, parties.encrypt(ones))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, input := range []*Ciphertext{ct, product} {
+			res, err := parties.comp.refreshSlots(input, refreshed)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res.Level() <= 2 {
+				t.Errorf("full coefficients %v: refreshed at level %d", fullCoeffs, res.Level())
+			}
+			want := map[int]float64{}
+			for _, s := range refreshed {
+				want[s] = values[s]
+			}
+			checkSlots(t, "refresh", parties.decrypt(res), want, 1e-3)
+		}
+		if refreshes, halfBoots := metrics.Stage(StageRefresh).Count, metrics.Stage(StageHalfBoot).Count; refreshes != 2 || halfBoots != 0 {
+			t.Errorf("full coefficients %v: %d refreshes and %d half-boots recorded, want 2 refreshes", fullCoeffs, refreshes, halfBoots)
+		}
+	}
+}
+
+// TestEvaluationErrors checks that galleries which do not fit, unknown comparators and ciphertexts without enough
+// levels return errors
+func TestEvaluationErrors(t *testing.T) {
+	if _, err := NewGalleryLayout([]string{"a"}, 33, 32); !errors.Is(err, ErrParameterMismatch) {
+		t.Errorf("template longer than the slots: got %v, want ErrParameterMismatch", err)
+	}
+	if _, err := NewGalleryLayout(make([]string, 17), 4, 16); !errors.Is(err, ErrParameterMismatch) {
+		t.Errorf("gallery larger than one ciphertext of distances: got %v, want ErrParameterMismatch", err)
+	}
+
+	parties := newTestParties(t, false)
+	ct := parties.encrypt([]float64{0.5})
+	if _, _, err := parties.comp.PackGallery([]*Ciphertext{ct, ct}, []string{"a"}, 4); !errors.Is(err, ErrParameterMismatch) {
+		t.Errorf("two references of one subject ID: got %v, want ErrParameterMismatch", err)
+	}
+	threshold := NewThresholdParameters(0.5, 1)
+	var levelErr *LevelError
+	for _, level := range []int{0, 1} {
+		_, err := parties.comp.EvaluateThreshold(parties.encryptAtLevel([]float64{0.5}, level), threshold)
+		if !errors.Is(err, ErrInsufficientLevels) || !errors.As(err, &levelErr) {
+			t.Errorf("threshold at level %d: got %v, want a LevelError", level, err)
+		}
+	}
+
+	probe := parties.encryptAtLevel([]float64{0.5, 0.25}, 2)
+	unknown := []*TemplateInstruction{NewTemplateInstruction(0, 4, false).SetComparator(MASKED_HAMMING+1, nil)}
+	if _, err := parties.comp.ProcessTemplateInstructionsSingleCT(unknown, probe, probe); !errors.Is(err, ErrParameterMismatch) {
+		t.Errorf("unknown comparator: got %v, want ErrParameterMismatch", err)
+	}
+	//the normalization of the cosine similarity runs out of levels at the inverse square root
+	cosine := []*TemplateInstruction{NewTemplateInstruction(0, 4, false).SetComparator(COSINE, NewInverseSqrtApproximation(0.1, 1))}
+	if _, err := parties.comp.ProcessTemplateInstructionsSingleCT(cosine, probe, probe); !errors.As(err, &levelErr) {
+		t.Errorf("cosine similarity at level 2: got %v, want a LevelError", err)
+	}
+}
+
+// TestTranscipherSessionNonces transciphers a message encrypted with the nonces of the client's session and checks
+// that other nonces are refused
+func TestTranscipherSessionNonces(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipped in short mode")
+	}
+	parties := newTestParties(t, false)
+	const n = 2
+	message := make([][]float64, parties.shared.GetOutputSize())
+	for s := range message {
+		message[s] = randomValues(parties.shared.GetMessagesSize(), -1, 1)
+		message[s][0] = float64(s) / 4
+	}
+	key := parties.client.GenerateRandomKey()
+	symCiphertexts, kCt, nonces := parties.client.EncryptMessage(message, key)
+	blocks, err := parties.comp.TranscipherFirstNMessages(symCiphertexts, kCt, nonces, n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(blocks) != n {
+		t.Fatalf("%d blocks transciphered, expected %d", len(blocks), n)
+	}
+	for s, block := range blocks {
+		want := map[int]float64{}
+		for i, v := range message[s] {
+			want[i] = v
+		}
+		checkSlots(t, "block", parties.decrypt(block), want, 1e-3)
+	}
+
+	other := *nonces
+	other.Sequence++
+	if _, err = parties.comp.TranscipherFirstNMessages(symCiphertexts, kCt, &other, n); !errors.Is(err, ErrParameterMismatch) {
+		t.Errorf("nonces of another sequence number: got %v, want ErrParameterMismatch", err)
+	}
+}
+
+// binaryValues returns n deterministic bits, different seeds give different bits
+func binaryValues(n int, seed int) []float64 {
+	values := make([]float64, n)
+	for i := range values {
+		values[i] = float64((i*7919 + seed) % 3 % 2)
+	}
+	return values
+}
+
+// TestSumSlots checks that every slot of the InnerSum holds the sum of the template starting at it and that the
+// distances of a template match the plaintext ones, with the rotation keys generated for the template lengths
+func TestSumSlots(t *testing.T) {
+	parties := newTestParties(t, true)
+	slots := parties.shared.GetParams().Slots()
+	values := randomValues(slots, -1, 1)
+	ct := parties.encrypt(values)
+	for _, n := range parties.shared.GetTemplateLengths() {
+		if n > slots {
+			continue
+		}
+		want := map[int]float64{}
+		for j := 0; j < slots; j++ {
+			for i := 0; i < n; i++ {
+				want[j] += values[(j+i)%slots]
+			}
+		}
+		checkSlots(t, "sum", parties.decrypt(parties.comp.sumSlots(ct, n)), want, 1e-3)
+	}
+
+	const n = 256
+	probe, reference := &Tmpl{data: randomValues(n, -1, 1)}, &Tmpl{data: randomValues(n, -0.5, 0.7)}
+	distance, err := parties.comp.ComputeEuclideanDistanceSingle(parties.encrypt(probe.data), parties.encrypt(reference.data), n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkSlots(t, "euclidean", parties.decrypt(distance)[:1], map[int]float64{0: probe.SquaredEuclideanDistance(reference)}, 1e-3)
+	probe, reference = &Tmpl{data: binaryValues(n, 0)}, &Tmpl{data: binaryValues(n, 1)}
+	if distance, err = parties.comp.ComputeHammingDistanceSingle(parties.encrypt(probe.data), parties.encrypt(reference.data), n); err != nil {
+		t.Fatal(err)
+	}
+	checkSlots(t, "hamming", parties.decrypt(distance)[:1], map[int]float64{0: probe.HammingDistance(reference)}, 1e-3)
+}
+
+// TestGallery packs references into two ciphertexts and checks the slots of the packed templates and of the distances
+func TestGallery(t *testing.T) {
+	parties := newTestParties(t, true)
+	params := parties.shared.GetParams()
+	const n = 256
+	subjectIDs := []string{"a", "b", "c", "d", "e"}
+	templates := make([]*Tmpl, len(subjectIDs))
+	references := make([]*Ciphertext, len(subjectIDs))
+	for i := range templates {
+		templates[i] = &Tmpl{data: randomValues(n, -1+0.1*float64(i), 1)}
+		references[i] = parties.encrypt(templates[i].data)
+	}
+	gallery, layout, err := parties.comp.PackGallery(references, subjectIDs, n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(gallery) != 2 || layout.NumCiphertexts() != 2 || layout.PerCiphertext != params.Slots()/n {
+		t.Fatalf("%d gallery ciphertexts with %d references each", len(gallery), layout.PerCiphertext)
+	}
+	for g, packed := range gallery {
+		want := map[int]float64{}
+		for k, ref := range layout.References(g) {
+			for j, v := range templates[ref].data {
+				want[(layout.Offset(k)+j)%params.Slots()] = v
+			}
+		}
+		checkSlots(t, "packed", parties.decrypt(packed), want, 1e-3)
+	}
+
+	probe := &Tmpl{data: randomValues(n, -0.8, 0.9)}
+	instructions := []*TemplateInstruction{NewTemplateInstruction(0, n, false)}
+	distances, err := parties.comp.ProcessTemplateInstructionsGallery(instructions, parties.encrypt(probe.data), gallery, layout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[int]float64{}
+	for i, template := range templates {
+		want[layout.Slot(i)] = probe.SquaredEuclideanDistance(template)
+	}
+	checkSlots(t, "distances", parties.decrypt(distances), want, 1e-2)
+	for subjectID, distance := range parties.auth.DecryptGalleryDistances(distances, layout) {
+		i := sort.SearchStrings(subjectIDs, subjectID)
+		if math.Abs(distance-want[layout.Slot(i)]) > 1e-2 {
+			t.Errorf("distance of %s is %v, expected %v", subjectID, distance, want[layout.Slot(i)])
+		}
+	}
+}
+
+// TestThreshold compares distances on both sides of the threshold and checks the sign approximation against the step
+func TestThreshold(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipped in short mode")
+	}
+	parties := newTestParties(t, false)
+	threshold := NewThresholdParameters(50, 100)
+	distances := []float64{10, 40, 60, 95}
+	slots := []int{0, 1, 2, 3}
+	res, err := parties.comp.evaluateThresholdAtSlots(parties.encrypt(distances), slots, threshold)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[int]float64{}
+	for i, d := range distances {
+		want[i] = threshold.EvaluatePlain(d)
+	}
+	checkSlots(t, "threshold", parties.decrypt(res)[:len(slots)], want, 0.05)
+	if decision, err := parties.comp.EvaluateThreshold(parties.encrypt(distances[2:]), threshold); err != nil {
+		t.Fatal(err)
+	} else if parties.auth.DecryptDecision(decision) {
+		t.Errorf("distance %v accepted with threshold %v", distances[2], threshold.Threshold)
+	}
+
+	u := []float64{-0.9, 0.05, 0.35, 0.8}
+	const step = 0.2
+	for _, approx := range []SignApproximation{NewSignApproximation(), {Steepness: 16, ChebyDegree: 31}} {
+		res, err := parties.comp.approximateStep(parties.encrypt(u), slots, step, approx, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := map[int]float64{}
+		for _, s := range slots {
+			if u[s] < step {
+				want[s] = 1
+			}
+		}
+		checkSlots(t, "step", parties.decrypt(res)[:len(slots)], want, 0.05)
+	}
+}
+
+// TestFindBestMatch searches the smallest of distances spread over two gallery ciphertexts and compares it
+// against thresholds on both sides of it
+func TestFindBestMatch(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipped in short mode")
+	}
+	parties := newTestParties(t, false)
+	subjectIDs := []string{"a", "b", "c", "d", "e", "f", "g", "h", "i", "j"}
+	layout, err := NewGalleryLayout(subjectIDs, 2, parties.shared.GetParams().Slots())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if layout.NumCiphertexts() != 2 {
+		t.Fatalf("gallery of %d ciphertexts", layout.NumCiphertexts())
+	}
+	distances := []float64{70, 55, 90, 62, 80, 35, 75, 58, 95, 66}
+	const best = 5
+	values := make([]float64, layout.Slots)
+	for i, d := range distances {
+		values[layout.Slot(i)] = d
+	}
+	for _, threshold := range []float64{45, 25} {
+		argminParams := NewArgminParameters(100)
+		argminParams.Threshold = NewThresholdParameters(threshold, 100)
+		oneHot, decision, err := parties.comp.FindBestMatch(parties.encrypt(values), layout, argminParams)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := map[int]float64{layout.Slot(best): 1}
+		got := parties.decrypt(oneHot)
+		for i := range subjectIDs {
+			if math.Abs(got[layout.Slot(i)]-want[layout.Slot(i)]) > 0.05 {
+				t.Errorf("best match weight of %s is %v, expected %v", subjectIDs[i], got[layout.Slot(i)], want[layout.Slot(i)])
+			}
+		}
+		if match := parties.auth.DecryptBestMatch(oneHot, layout); match != subjectIDs[best] {
+			t.Errorf("best match %s, expected %s", match, subjectIDs[best])
+		}
+		checkSlots(t, "decision", parties.decrypt(decision)[:1], map[int]float64{0: argminParams.Threshold.EvaluatePlain(distances[best])}, 0.05)
+	}
+}
+
+// TestFusion fuses a weighted Euclidean and a normalized Hamming distance under encryption and compares the result
+// with the plaintext fusion of the multi template
+func TestFusion(t *testing.T) {
+	parties := newTestParties(t, true)
+	const n = 256
+	instructions := []*TemplateInstruction{
+		NewTemplateInstruction(0, n, false).SetWeight(2),
+		NewTemplateInstruction(n, n, true).SetWeight(0.5).SetNormalization(10, 0.25),
+	}
+	probe := &MTmpl{data: []Template{&Tmpl{data: randomValues(n, -1, 1)}, &Tmpl{data: binaryValues(n, 0)}}, instructions: instructions}
+	reference := &MTmpl{data: []Template{&Tmpl{data: randomValues(n, -0.6, 0.9)}, &Tmpl{data: binaryValues(n, 2)}}, instructions: instructions}
+	scores, err := parties.comp.ProcessTemplateInstructionsSingleCT(instructions, parties.encrypt(probe.ToMessage()), parties.encrypt(reference.ToMessage()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[int]float64{}
+	for i, ins := range instructions {
+		want[ins.Index] = ins.Fuse(ins.Score(probe.GetTemplates()[i], reference.GetTemplates()[i]))
+	}
+	checkSlots(t, "scores", parties.decrypt(scores), want, 1e-2)
+	fused, err := parties.comp.FuseDistances(instructions, scores)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkSlots(t, "fused", parties.decrypt(fused)[:1], map[int]float64{0: probe.Distance(reference)}, 1e-2)
+}
+
+// TestComparators compares templates by inner product, by the cosine of templates normalized by the client and by the
+// cosine normalized under encryption, and checks the scores against the plaintext comparators
+func TestComparators(t *testing.T) {
+	parties := newTestParties(t, true)
+	const n = 256
+	probe, reference := &Tmpl{data: randomValues(n, -1, 1)}, &Tmpl{data: randomValues(n, -0.2, 1)}
+	normalizedProbe, normalizedReference := probe.Normalized(), reference.Normalized()
+	norms := probe.InnerProduct(probe) * reference.InnerProduct(reference)
+	instructions := []*TemplateInstruction{
+		NewTemplateInstruction(0, n, false).SetComparator(INNER_PRODUCT, nil),
+		NewTemplateInstruction(n, n, false).SetComparator(COSINE, nil),
+		NewTemplateInstruction(2*n, n, false).SetComparator(COSINE, NewInverseSqrtApproximation(norms/2, 2*norms)),
+	}
+	probes := []Template{probe, normalizedProbe, probe}
+	references := []Template{reference, normalizedReference, reference}
+	scores, err := parties.comp.ProcessTemplateInstructionsSingleCT(instructions,
+		parties.encrypt(ConnectTemplates(probes)), parties.encrypt(ConnectTemplates(references)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[int]float64{}
+	for i, ins := range instructions {
+		want[ins.Index] = ins.Score(probes[i], references[i])
+	}
+	if math.Abs(want[n]-probe.CosineSimilarity(reference)) > 1e-9 {
+		t.Fatalf("cosine of the normalized templates %v, expected %v", want[n], probe.CosineSimilarity(reference))
+	}
+	checkSlots(t, "scores", parties.decrypt(scores), want, 1e-2)
+}
+
+// TestMaskedHamming compares iris codes with occlusion masks by the number of disagreeing valid bits and by the
+// fractional distance over barrel shifts, the probe matches the reference best after one of the shifts
+func TestMaskedHamming(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipped in short mode")
+	}
+	parties := newTestParties(t, true)
+	const n = 256
+	reference := &Tmpl{data: make([]float64, n), mask: make([]float64, n)}
+	for i, v := range randomValues(n, -1, 1) {
+		if v > 0 {
+			reference.data[i] = 1
+		}
+		if v > -0.5 || i%2 == 0 {
+			reference.mask[i] = 1
+		}
+	}
+	probe := reference.shifted(-3)
+	for i := 0; i < n; i += 16 {
+		probe.data[i] = 1 - probe.data[i]
+	}
+	probeCt, referenceCt := parties.encrypt(probe.GetMessage()), parties.encrypt(reference.GetMessage())
+
+	ins := NewTemplateInstruction(0, n, true).SetMaskedHamming(nil)
+	distance, valid, err := parties.comp.MaskedHammingDistance(probeCt, referenceCt, ins)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkSlots(t, "masked distance", parties.decrypt(distance)[:1], map[int]float64{0: probe.MaskedHammingDistance(reference)}, 1e-2)
+	checkSlots(t, "valid bits", parties.decrypt(valid)[:1], map[int]float64{0: probe.ValidBits(reference)}, 1e-2)
+
+	shifts := []int{-2, 0, 3}
+	ins = NewTemplateInstruction(0, n, true).SetMaskedHamming(NewMaskedHammingOptions(n, n/4, shifts))
+	scores, err := parties.comp.ProcessTemplateInstructionsSingleCT([]*TemplateInstruction{ins}, probeCt, referenceCt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := ins.Score(probe, reference)
+	if want != probe.shifted(3).MaskedHammingDistance(reference)/probe.shifted(3).ValidBits(reference) {
+		t.Fatalf("fractional distance %v is not the one of the matching shift", want)
+	}
+	checkSlots(t, "fractional distance", parties.decrypt(scores), map[int]float64{0: want}, 1e-2)
+}
@@ -0,0 +1,523 @@
+package ckks_fv
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// CompServiceConfig configures the comparisons of the computation service. Identification is refused if
+// Argmin is nil. The encrypted results are sent to the authentication service at AuthURL, authenticated with
+// Token. The requests of the clients must carry ClientToken as bearer token. At most Keystreams keystreams are
+// precomputed for the registered keys, zero disables the precomputation.
+type CompServiceConfig struct {
+	Instructions []*TemplateInstruction
+	Threshold    *ThresholdParameters
+	Argmin       *ArgminParameters
+	AuthURL      string
+	Token        string
+	ClientToken  string
+	HTTPClient   *http.Client
+	Keystreams   int
+}
+
+type compService struct {
+	mutex      sync.Mutex // the evaluators of the ServerComp are not safe for concurrent use
+	shared     Shared
+	server     ServerComp
+	gallery    GalleryStore
+	codec      *WireCodec
+	config     *CompServiceConfig
+	keysMutex  sync.RWMutex
+	keys       map[string]*EncryptedKey
+	keystreams KeystreamCache
+}
+
+// NewCompService returns the HTTP handler of the computation server for RouteKeys, RouteEnrol, RouteVerify and
+// RouteIdentify, all routes require the client token. The registered keys and their precomputed keystreams are kept
+// in memory.
+func NewCompService(shared Shared, server ServerComp, gallery GalleryStore, config *CompServiceConfig) (http.Handler, error) {
+	if len(config.Instructions) == 0 || config.Threshold == nil {
+		return nil, errors.New("computation service without template instructions or threshold")
+	}
+	if config.AuthURL == "" || config.Token == "" {
+		return nil, errors.New("computation service without URL or token of the authentication service")
+	}
+	if config.ClientToken == "" {
+		return nil, errors.New("computation service without client token")
+	}
+	cfg := *config
+	if cfg.HTTPClient == nil {
+		cfg.HTTPClient = http.DefaultClient
+	}
+	service := &compService{
+		shared:  shared,
+		server:  server,
+		gallery: gallery,
+		codec:   NewWireCodec(shared.GetParams()),
+		config:  &cfg,
+		keys:    make(map[string]*EncryptedKey),
+	}
+	service.keystreams = NewKeystreamCache(cfg.Keystreams)
+	mux := http.NewServeMux()
+	mux.HandleFunc(RouteKeys, service.key)
+	mux.HandleFunc(RouteEnrol, service.enrol)
+	mux.HandleFunc(RouteVerify, service.verify)
+	mux.HandleFunc(RouteIdentify, service.identify)
+	return mux, nil
+}
+
+// authorizeClient answers requests without the client token with StatusUnauthorized
+func (service *compService) authorizeClient(w http.ResponseWriter, r *http.Request) bool {
+	if !authorized(r, service.config.ClientToken) {
+		writeError(w, http.StatusUnauthorized, errors.New("missing or wrong token"))
+		return false
+	}
+	return true
+}
+
+// decodeTemplate checks the nonces and decodes the symmetric ciphertexts and the encrypted key, templates without
+// session are refused
+func (service *compService) decodeTemplate(template *EncryptedTemplate) ([]*PlaintextRingT, *EncryptedKey, *NonceSet, error) {
+	if template == nil || len(template.SymCiphertexts) == 0 || template.EncryptedKey == nil && template.KeyID == "" {
+		return nil, nil, nil, fmt.Errorf("%w: request without encrypted template", ErrParameterMismatch)
+	}
+	nonceSet := template.nonceSet()
+	if nonceSet == nil {
+		return nil, nil, nil, fmt.Errorf("%w: template without session", ErrParameterMismatch)
+	}
+	if err := nonceSet.Verify(service.shared.GetMessagesSize()); err != nil {
+		return nil, nil, nil, err
+	}
+	symCiphertexts := make([]*PlaintextRingT, len(template.SymCiphertexts))
+	for i, data := range template.SymCiphertexts {
+		symCiphertexts[i] = new(PlaintextRingT)
+		if err := service.codec.Unmarshal(data, symCiphertexts[i]); err != nil {
+			return nil, nil, nil, fmt.Errorf("%w: symmetric ciphertext %d: %v", ErrParameterMismatch, i, err)
+		}
+	}
+	if template.EncryptedKey == nil {
+		service.keysMutex.RLock()
+		key, ok := service.keys[template.KeyID]
+		service.keysMutex.RUnlock()
+		if !ok {
+			return nil, nil, nil, fmt.Errorf("%w: %s", ErrKeyNotFound, template.KeyID)
+		}
+		return symCiphertexts, key, nonceSet, nil
+	}
+	key, err := service.decodeKey(template.EncryptedKey)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return symCiphertexts, key, nonceSet, nil
+}
+
+// decodeKey decodes an encrypted key and checks that it belongs to the cipher of the context
+func (service *compService) decodeKey(data []byte) (*EncryptedKey, error) {
+	key := new(EncryptedKey)
+	if err := service.codec.Unmarshal(data, key); err != nil {
+		return nil, fmt.Errorf("%w: encrypted key: %v", ErrParameterMismatch, err)
+	}
+	if key.Cipher != service.shared.GetCipher() || len(key.Ciphertexts) != service.shared.GetBlockSize() {
+		return nil, fmt.Errorf("%w: encrypted key of another cipher", ErrParameterMismatch)
+	}
+	return key, nil
+}
+
+// key registers an encrypted key with POST and removes it with DELETE followed by the key ID
+func (service *compService) key(w http.ResponseWriter, r *http.Request) {
+	if !service.authorizeClient(w, r) {
+		return
+	}
+	if r.Method == http.MethodDelete {
+		id := strings.TrimPrefix(r.URL.Path, RouteKeys)
+		service.keysMutex.Lock()
+		_, ok := service.keys[id]
+		delete(service.keys, id)
+		service.keystreams.Drop(id)
+		service.keysMutex.Unlock()
+		if !ok {
+			writeError(w, http.StatusNotFound, fmt.Errorf("%w: %s", ErrKeyNotFound, id))
+			return
+		}
+		writeJSON(w, http.StatusOK, &RegisterKeyResponse{KeyID: id})
+		return
+	}
+	req := new(RegisterKeyRequest)
+	if !readJSON(w, r, req) {
+		return
+	}
+	if err := validateID(req.KeyID); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	key, err := service.decodeKey(req.EncryptedKey)
+	if err != nil {
+		writeError(w, statusOf(err), err)
+		return
+	}
+	service.mutex.Lock()
+	key.Ciphertexts = service.server.PrepareKey(key.Ciphertexts)
+	service.mutex.Unlock()
+	service.keysMutex.Lock()
+	_, exists := service.keys[req.KeyID]
+	if !exists {
+		service.keys[req.KeyID] = key
+	}
+	service.keysMutex.Unlock()
+	if exists {
+		writeError(w, http.StatusConflict, fmt.Errorf("key %s is already registered", req.KeyID))
+		return
+	}
+	precompute := 0
+	if len(req.SessionID) > 0 && req.Precompute > 0 {
+		precompute = req.Precompute
+		if free := service.config.Keystreams - service.keystreams.Len(); precompute > free {
+			precompute = free
+		}
+	}
+	if precompute > 0 {
+		go service.precompute(req.KeyID, key, req.SessionID, req.Sequence, precompute)
+	}
+	writeJSON(w, http.StatusOK, &RegisterKeyResponse{KeyID: req.KeyID, Level: key.Level(), Precompute: precompute})
+}
+
+// precompute evaluates the keystreams of count ciphertexts of the session under the registered key, starting at
+// sequence. It stops when the key is removed or the cache is full.
+func (service *compService) precompute(keyID string, key *EncryptedKey, sessionID []byte, sequence uint64, count int) {
+	for i := 0; i < count; i++ {
+		nonces := DeriveNonces(sessionID, sequence+uint64(i), service.shared.GetMessagesSize())
+		service.mutex.Lock()
+		keystream, err := service.server.PrecomputeKeystream(key.Ciphertexts, nonces, 1)
+		service.mutex.Unlock()
+		if err != nil {
+			return
+		}
+		service.keysMutex.RLock()
+		stored := service.keys[keyID] == key && service.keystreams.Put(keyID, keystream)
+		service.keysMutex.RUnlock()
+		if !stored {
+			return
+		}
+	}
+}
+
+// transcipher decodes the template and transciphers its first message, the caller holds the mutex
+func (service *compService) transcipher(template *EncryptedTemplate) (ct *Ciphertext, err error) {
+	symCiphertexts, key, nonces, err := service.decodeTemplate(template)
+	if err != nil {
+		return nil, err
+	}
+	if template.EncryptedKey == nil {
+		if keystream := service.keystreams.Take(template.KeyID, nonces); keystream != nil {
+			result, err := service.server.TranscipherWithKeystream(symCiphertexts, keystream)
+			if err != nil {
+				return nil, err
+			}
+			return result[0], nil
+		}
+	}
+	return service.server.TranscipherFirstMessageWithNonces(symCiphertexts, key.Ciphertexts, nonces)
+}
+
+func (service *compService) enrol(w http.ResponseWriter, r *http.Request) {
+	if !service.authorizeClient(w, r) {
+		return
+	}
+	req := new(EnrolRequest)
+	if !readJSON(w, r, req) {
+		return
+	}
+	service.mutex.Lock()
+	ct, err := service.transcipher(req.Template)
+	service.mutex.Unlock()
+	if err != nil {
+		writeError(w, statusOf(err), err)
+		return
+	}
+	record, err := service.gallery.Put(req.SubjectID, req.TemplateID, req.Modalities, req.TemplateLengths, ct)
+	if err != nil {
+		writeError(w, statusOf(err), err)
+		return
+	}
+	writeJSON(w, http.StatusOK, &EnrolResponse{Record: record})
+}
+
+// compareReference returns the encrypted threshold decision of the probe against the reference
+func (service *compService) compareReference(req *VerifyRequest) (decision *Ciphertext, err error) {
+	reference, _, err := service.gallery.Get(req.SubjectID, req.TemplateID)
+	if err != nil {
+		return nil, err
+	}
+	service.mutex.Lock()
+	defer service.mutex.Unlock()
+	probe, err := service.transcipher(req.Probe)
+	if err != nil {
+		return nil, err
+	}
+	instructions := service.config.Instructions
+	scores, err := service.server.ProcessTemplateInstructionsSingleCT(instructions, probe, reference)
+	if err != nil {
+		return nil, err
+	}
+	distance, err := service.server.FuseDistances(instructions, scores)
+	if err != nil {
+		return nil, err
+	}
+	return service.server.EvaluateThreshold(distance, service.config.Threshold)
+}
+
+func (service *compService) verify(w http.ResponseWriter, r *http.Request) {
+	if !service.authorizeClient(w, r) {
+		return
+	}
+	req := new(VerifyRequest)
+	if !readJSON(w, r, req) {
+		return
+	}
+	requestID, err := service.registerRequest(ResultVerification)
+	if err != nil {
+		writeError(w, http.StatusBadGateway, err)
+		return
+	}
+	decision, err := service.compareReference(req)
+	if err != nil {
+		service.cancelRequest(requestID)
+		writeError(w, statusOf(err), err)
+		return
+	}
+	service.sendResult(w, &ResultRequest{RequestID: requestID, Kind: ResultVerification}, decision, nil)
+}
+
+// searchGallery returns the encrypted best match of the probe in the gallery and the decision if a threshold is set
+func (service *compService) searchGallery(req *IdentifyRequest) (bestMatch *Ciphertext, decision *Ciphertext, layout *GalleryLayout, err error) {
+	service.mutex.Lock()
+	defer service.mutex.Unlock()
+	probe, err := service.transcipher(req.Probe)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	gallery, layout, err := service.gallery.PackGallery(service.server, req.TemplateID)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	distances, err := service.server.ProcessTemplateInstructionsGallery(service.config.Instructions, probe, gallery, layout)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if bestMatch, decision, err = service.server.FindBestMatch(distances, layout, service.config.Argmin); err != nil {
+		return nil, nil, nil, err
+	}
+	return bestMatch, decision, layout, nil
+}
+
+func (service *compService) identify(w http.ResponseWriter, r *http.Request) {
+	if !service.authorizeClient(w, r) {
+		return
+	}
+	if service.config.Argmin == nil {
+		writeError(w, http.StatusNotImplemented, errors.New("identification is not configured"))
+		return
+	}
+	req := new(IdentifyRequest)
+	if !readJSON(w, r, req) {
+		return
+	}
+	requestID, err := service.registerRequest(ResultIdentification)
+	if err != nil {
+		writeError(w, http.StatusBadGateway, err)
+		return
+	}
+	bestMatch, decision, layout, err := service.searchGallery(req)
+	if err != nil {
+		service.cancelRequest(requestID)
+		writeError(w, statusOf(err), err)
+		return
+	}
+	service.sendResult(w, &ResultRequest{RequestID: requestID, Kind: ResultIdentification, Layout: layout}, decision, bestMatch)
+}
+
+// registerRequest registers a new request ID of the given kind at the authentication service
+func (service *compService) registerRequest(kind string) (string, error) {
+	req := &PendingRequest{RequestID: newRequestID(), Kind: kind}
+	if err := doJSONWithToken(service.config.HTTPClient, service.config.Token, http.MethodPost, service.config.AuthURL+RouteRequests, req, new(ComparisonResponse)); err != nil {
+		return "", fmt.Errorf("authentication service: %w", err)
+	}
+	return req.RequestID, nil
+}
+
+// cancelRequest withdraws a registered request without result, a failure only leaves the request pending
+func (service *compService) cancelRequest(requestID string) {
+	doJSONWithToken(service.config.HTTPClient, service.config.Token, http.MethodDelete, service.config.AuthURL+RouteRequests+url.PathEscape(requestID), nil, new(ComparisonResponse))
+}
+
+// sendResult hands the encrypted result of the registered request to the authentication service and responds with
+// its request ID
+func (service *compService) sendResult(w http.ResponseWriter, req *ResultRequest, decision *Ciphertext, bestMatch *Ciphertext) {
+	var err error
+	if decision != nil {
+		req.Decision, err = service.codec.Marshal(decision)
+	}
+	if err == nil && bestMatch != nil {
+		req.BestMatch, err = service.codec.Marshal(bestMatch)
+	}
+	if err != nil {
+		service.cancelRequest(req.RequestID)
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	res := new(ComparisonResponse)
+	if err = doJSONWithToken(service.config.HTTPClient, service.config.Token, http.MethodPost, service.config.AuthURL+RouteResults, req, res); err != nil {
+		service.cancelRequest(req.RequestID)
+		writeError(w, http.StatusBadGateway, fmt.Errorf("authentication service: %w", err))
+		return
+	}
+	writeJSON(w, http.StatusOK, res)
+}
+
+type authService struct {
+	mutex     sync.Mutex
+	server    ServerAuth
+	codec     *WireCodec
+	token     string
+	pending   map[string]string
+	decisions map[string]*DecisionResponse
+}
+
+// NewAuthService returns the HTTP handler of the authentication server. It decrypts the results posted to RouteResults
+// and serves each decision once at RouteDecision followed by the request ID. Only results of requests registered at
+// RouteRequests are decrypted, both routes require token as bearer token.
+func NewAuthService(shared Shared, server ServerAuth, token string) (http.Handler, error) {
+	if token == "" {
+		return nil, errors.New("authentication service without token")
+	}
+	service := &authService{
+		server:    server,
+		codec:     NewWireCodec(shared.GetParams()),
+		token:     token,
+		pending:   make(map[string]string),
+		decisions: make(map[string]*DecisionResponse),
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc(RouteRequests, service.requests)
+	mux.HandleFunc(RouteResults, service.results)
+	mux.HandleFunc(RouteDecision, service.decision)
+	return mux, nil
+}
+
+// requests registers a request ID of the computation server with POST and withdraws it with DELETE followed by the
+// request ID
+func (service *authService) requests(w http.ResponseWriter, r *http.Request) {
+	if !authorized(r, service.token) {
+		writeError(w, http.StatusUnauthorized, errors.New("missing or wrong token"))
+		return
+	}
+	if r.Method == http.MethodDelete {
+		id := strings.TrimPrefix(r.URL.Path, RouteRequests)
+		service.mutex.Lock()
+		_, ok := service.pending[id]
+		delete(service.pending, id)
+		service.mutex.Unlock()
+		if !ok {
+			writeError(w, http.StatusNotFound, fmt.Errorf("no pending request %q", id))
+			return
+		}
+		writeJSON(w, http.StatusOK, &ComparisonResponse{RequestID: id})
+		return
+	}
+	req := new(PendingRequest)
+	if !readJSON(w, r, req) {
+		return
+	}
+	if req.RequestID == "" || req.Kind != ResultVerification && req.Kind != ResultIdentification {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("request %q of kind %q", req.RequestID, req.Kind))
+		return
+	}
+	service.mutex.Lock()
+	_, exists := service.pending[req.RequestID]
+	if !exists {
+		service.pending[req.RequestID] = req.Kind
+	}
+	service.mutex.Unlock()
+	if exists {
+		writeError(w, http.StatusConflict, fmt.Errorf("request %s is already registered", req.RequestID))
+		return
+	}
+	writeJSON(w, http.StatusOK, &ComparisonResponse{RequestID: req.RequestID})
+}
+
+// decrypt decrypts the result, the caller holds the mutex
+func (service *authService) decrypt(req *ResultRequest) (*DecisionResponse, error) {
+	res := &DecisionResponse{RequestID: req.RequestID, Kind: req.Kind}
+	if req.Decision != nil {
+		ct := new(Ciphertext)
+		if err := service.codec.Unmarshal(req.Decision, ct); err != nil {
+			return nil, fmt.Errorf("%w: decision: %v", ErrParameterMismatch, err)
+		}
+		res.Accepted = service.server.DecryptDecision(ct)
+	}
+	switch req.Kind {
+	case ResultVerification:
+		if req.Decision == nil {
+			return nil, fmt.Errorf("%w: verification without decision", ErrParameterMismatch)
+		}
+	case ResultIdentification:
+		if req.BestMatch == nil || req.Layout == nil {
+			return nil, fmt.Errorf("%w: identification without best match", ErrParameterMismatch)
+		}
+		ct := new(Ciphertext)
+		if err := service.codec.Unmarshal(req.BestMatch, ct); err != nil {
+			return nil, fmt.Errorf("%w: best match: %v", ErrParameterMismatch, err)
+		}
+		res.SubjectID = service.server.DecryptBestMatch(ct, req.Layout)
+	default:
+		return nil, fmt.Errorf("%w: unknown result kind %q", ErrParameterMismatch, req.Kind)
+	}
+	return res, nil
+}
+
+// results decrypts the result of a pending request, which is no longer pending afterwards
+func (service *authService) results(w http.ResponseWriter, r *http.Request) {
+	if !authorized(r, service.token) {
+		writeError(w, http.StatusUnauthorized, errors.New("missing or wrong token"))
+		return
+	}
+	req := new(ResultRequest)
+	if !readJSON(w, r, req) {
+		return
+	}
+	service.mutex.Lock()
+	defer service.mutex.Unlock()
+	if kind, ok := service.pending[req.RequestID]; !ok || kind != req.Kind {
+		writeError(w, http.StatusForbidden, fmt.Errorf("no pending %s request %q", req.Kind, req.RequestID))
+		return
+	}
+	res, err := service.decrypt(req)
+	if err != nil {
+		writeError(w, statusOf(err), err)
+		return
+	}
+	delete(service.pending, req.RequestID)
+	service.decisions[req.RequestID] = res
+	writeJSON(w, http.StatusOK, &ComparisonResponse{RequestID: req.RequestID})
+}
+
+func (service *authService) decision(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("%s not allowed", r.Method))
+		return
+	}
+	id := strings.TrimPrefix(r.URL.Path, RouteDecision)
+	service.mutex.Lock()
+	res, ok := service.decisions[id]
+	delete(service.decisions, id)
+	service.mutex.Unlock()
+	if !ok {
+		writeError(w, http.StatusNotFound, fmt.Errorf("no decision for request %q", id))
+		return
+	}
+	writeJSON(w, http.StatusOK, res)
+}
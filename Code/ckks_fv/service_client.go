@@ -0,0 +1,190 @@
+package ckks_fv
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+)
+
+// ServiceClient encrypts templates with a Client and sends them to the computation service.
+// Verify and Identify return the request ID under which the authentication service holds the decision.
+type ServiceClient interface {
+	Enrol(subjectID string, templateID string, modalities []string, templates []Template) (*GalleryRecord, error)
+	Verify(subjectID string, templateID string, templates []Template) (string, error)
+	Identify(templateID string, templates []Template) (string, error)
+	Decision(requestID string) (*DecisionResponse, error)
+	// SetKeyStore encrypts all templates under the current key of store, which is registered once at the computation
+	// service, instead of a fresh key per template
+	SetKeyStore(store KeyStore)
+	// RotateKey registers a new current key and removes the previous one from the computation service
+	RotateKey() (*ClientKey, error)
+	// SetPrecompute asks the computation service to precompute the keystreams of the next n templates whenever a key
+	// is registered
+	SetPrecompute(n int)
+	// SetToken sends token as bearer token with the requests to the computation service
+	SetToken(token string)
+}
+
+type serviceClient struct {
+	shared     Shared
+	client     Client
+	codec      *WireCodec
+	compURL    string
+	authURL    string
+	httpClient *http.Client
+	keys       KeyStore
+	precompute int
+	token      string
+}
+
+// NewServiceClient returns a ServiceClient for the services at compURL and authURL, a nil httpClient uses http.DefaultClient
+func NewServiceClient(shared Shared, client Client, compURL string, authURL string, httpClient *http.Client) ServiceClient {
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	return &serviceClient{
+		shared:     shared,
+		client:     client,
+		codec:      NewWireCodec(shared.GetParams()),
+		compURL:    compURL,
+		authURL:    authURL,
+		httpClient: httpClient,
+	}
+}
+
+func (sc *serviceClient) SetKeyStore(store KeyStore) {
+	sc.keys = store
+}
+
+func (sc *serviceClient) SetPrecompute(n int) {
+	sc.precompute = n
+}
+
+func (sc *serviceClient) SetToken(token string) {
+	sc.token = token
+}
+
+// registerKey sends the FV encryption of the key to the computation service, keystreams are precomputed from the
+// template with the given sequence number on
+func (sc *serviceClient) registerKey(key *ClientKey, sequence uint64) error {
+	encKey, err := sc.codec.Marshal(NewEncryptedKey(sc.shared.GetCipher(), sc.client.EncryptKey(key.Key)))
+	if err != nil {
+		return err
+	}
+	req := &RegisterKeyRequest{KeyID: key.ID, EncryptedKey: encKey}
+	if len(key.SessionID) > 0 {
+		req.SessionID, req.Sequence, req.Precompute = key.SessionID, sequence, sc.precompute
+	}
+	if err = doJSONWithToken(sc.httpClient, sc.token, http.MethodPost, sc.compURL+RouteKeys, req, new(RegisterKeyResponse)); err != nil {
+		return err
+	}
+	return sc.keys.MarkRegistered(key.ID)
+}
+
+func (sc *serviceClient) RotateKey() (*ClientKey, error) {
+	if sc.keys == nil {
+		return nil, errors.New("service client without key store")
+	}
+	previous := sc.keys.Current()
+	key := sc.keys.Rotate()
+	if err := sc.registerKey(key, key.Uses); err != nil {
+		return nil, err
+	}
+	if previous != nil && previous.Registered {
+		err := doJSONWithToken(sc.httpClient, sc.token, http.MethodDelete, sc.compURL+RouteKeys+url.PathEscape(previous.ID), nil, new(RegisterKeyResponse))
+		if err != nil && !errors.Is(err, ErrKeyNotFound) {
+			return key, err
+		}
+	}
+	if previous != nil {
+		if err := sc.keys.Delete(previous.ID); err != nil {
+			return key, err
+		}
+	}
+	return key, nil
+}
+
+// encryptTemplates encrypts the connected templates under the next nonces of the session, with the current key of
+// the key store and its session if set and under a fresh symmetric key otherwise
+func (sc *serviceClient) encryptTemplates(templates []Template) (*EncryptedTemplate, error) {
+	var symCiphertexts []*PlaintextRingT
+	var nonces *NonceSet
+	template := new(EncryptedTemplate)
+	var err error
+	if sc.keys != nil {
+		key := sc.keys.Use()
+		sequence := key.Uses - 1
+		if !key.Registered {
+			if err = sc.registerKey(key, sequence); err != nil {
+				return nil, err
+			}
+		}
+		if len(key.SessionID) > 0 {
+			sc.client.SetNonceManager(NewNonceManager(key.SessionID, sequence, sc.shared.GetMessagesSize()))
+		}
+		symCiphertexts, nonces = sc.client.EncryptMultipleTemplatesSymmetric(templates, key.Key, 1, sc.shared.GetMessagesSize())
+		template.KeyID = key.ID
+	} else {
+		var encKey []*Ciphertext
+		symCiphertexts, encKey, nonces = sc.client.EncryptMultipleTemplatesWithNonces(templates, sc.client.GenerateRandomKey(), 1, sc.shared.GetMessagesSize())
+		if template.EncryptedKey, err = sc.codec.Marshal(NewEncryptedKey(sc.shared.GetCipher(), encKey)); err != nil {
+			return nil, err
+		}
+	}
+	template.SymCiphertexts = make([][]byte, len(symCiphertexts))
+	template.SessionID = nonces.SessionID
+	template.Sequence = nonces.Sequence
+	template.Nonces = nonces.Nonces
+	template.Counter = nonces.Counter
+	for i, pt := range symCiphertexts {
+		if template.SymCiphertexts[i], err = sc.codec.Marshal(pt); err != nil {
+			return nil, err
+		}
+	}
+	return template, nil
+}
+
+func (sc *serviceClient) Enrol(subjectID string, templateID string, modalities []string, templates []Template) (*GalleryRecord, error) {
+	template, err := sc.encryptTemplates(templates)
+	if err != nil {
+		return nil, err
+	}
+	lengths := make([]int, len(templates))
+	for i, t := range templates {
+		lengths[i] = len(t.GetMessage())
+	}
+	req := &EnrolRequest{SubjectID: subjectID, TemplateID: templateID, Modalities: modalities, TemplateLengths: lengths, Template: template}
+	res := new(EnrolResponse)
+	if err = doJSONWithToken(sc.httpClient, sc.token, http.MethodPost, sc.compURL+RouteEnrol, req, res); err != nil {
+		return nil, err
+	}
+	return res.Record, nil
+}
+
+func (sc *serviceClient) Verify(subjectID string, templateID string, templates []Template) (string, error) {
+	probe, err := sc.encryptTemplates(templates)
+	if err != nil {
+		return "", err
+	}
+	res := new(ComparisonResponse)
+	err = doJSONWithToken(sc.httpClient, sc.token, http.MethodPost, sc.compURL+RouteVerify, &VerifyRequest{SubjectID: subjectID, TemplateID: templateID, Probe: probe}, res)
+	return res.RequestID, err
+}
+
+func (sc *serviceClient) Identify(templateID string, templates []Template) (string, error) {
+	probe, err := sc.encryptTemplates(templates)
+	if err != nil {
+		return "", err
+	}
+	res := new(ComparisonResponse)
+	err = doJSONWithToken(sc.httpClient, sc.token, http.MethodPost, sc.compURL+RouteIdentify, &IdentifyRequest{TemplateID: templateID, Probe: probe}, res)
+	return res.RequestID, err
+}
+
+func (sc *serviceClient) Decision(requestID string) (*DecisionResponse, error) {
+	res := new(DecisionResponse)
+	if err := doJSON(sc.httpClient, http.MethodGet, sc.authURL+RouteDecision+url.PathEscape(requestID), nil, res); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
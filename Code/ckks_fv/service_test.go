@@ -0,0 +1,200 @@
+package ckks_fv
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+// TestServicesLoopback runs the three parties behind in-process HTTP servers and enrols, verifies and identifies
+func TestServicesLoopback(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipped in short mode")
+	}
+	parties := newTestParties(t, true)
+	shared, serverAuth, serverComp, client := parties.shared, parties.auth, parties.comp, parties.client
+	galleryDir, err := ioutil.TempDir("", "gallery")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(galleryDir)
+	gallery, err := OpenGalleryStore(galleryDir, "0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token, clientToken := NewServiceToken(), NewServiceToken()
+	authService, err := NewAuthService(shared, serverAuth, token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth := httptest.NewServer(authService)
+	defer auth.Close()
+	threshold := NewThresholdParameters(10, 1024)
+	argmin := NewArgminParameters(1024)
+	argmin.Threshold = threshold
+	compService, err := NewCompService(shared, serverComp, gallery, &CompServiceConfig{
+		Instructions: []*TemplateInstruction{NewFingerShortTemplateInstruction(0)},
+		Threshold:    threshold,
+		Argmin:       argmin,
+		AuthURL:      auth.URL,
+		Token:        token,
+		ClientToken:  clientToken,
+		Keystreams:   1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	comp := httptest.NewServer(compService)
+	defer comp.Close()
+
+	service := NewServiceClient(shared, client, comp.URL, auth.URL, nil)
+	service.SetToken(clientToken)
+	templates := map[string]Template{"alice": NewMockTemplate(256), "bob": NewMockTemplate(256)}
+	for subjectID, template := range templates {
+		if _, err = service.Enrol(subjectID, "finger", []string{"finger"}, []Template{template}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	t.Run("Verify", func(t *testing.T) {
+		for _, probe := range []string{"alice", "bob"} {
+			requestID, err := service.Verify("alice", "finger", []Template{templates[probe]})
+			if err != nil {
+				t.Fatal(err)
+			}
+			decision, err := service.Decision(requestID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if decision.Accepted != (probe == "alice") {
+				t.Errorf("probe of %s against alice: accepted %v", probe, decision.Accepted)
+			}
+			if _, err = service.Decision(requestID); !errors.Is(err, ErrRecordNotFound) {
+				t.Errorf("decision served twice: %v", err)
+			}
+		}
+	})
+
+	t.Run("Identify", func(t *testing.T) {
+		requestID, err := service.Identify("finger", []Template{templates["bob"]})
+		if err != nil {
+			t.Fatal(err)
+		}
+		decision, err := service.Decision(requestID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if decision.SubjectID != "bob" || !decision.Accepted {
+			t.Errorf("best match %s, accepted %v", decision.SubjectID, decision.Accepted)
+		}
+	})
+
+	t.Run("RegisteredKey", func(t *testing.T) {
+		keyed := NewServiceClient(shared, client, comp.URL, auth.URL, nil)
+		keyed.SetToken(clientToken)
+		keyed.SetKeyStore(NewKeyStore(client))
+		// the keystream of the first probe is precomputed, the second is evaluated online
+		keyed.SetPrecompute(1)
+		first, err := keyed.RotateKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 2; i++ {
+			requestID, err := keyed.Verify("alice", "finger", []Template{templates["alice"]})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if decision, err := keyed.Decision(requestID); err != nil || !decision.Accepted {
+				t.Errorf("probe %d under registered key: %v %v", i, decision, err)
+			}
+		}
+		if _, err = keyed.RotateKey(); err != nil {
+			t.Fatal(err)
+		}
+		symCiphertexts, nonces := client.EncryptMultipleTemplatesSymmetric([]Template{templates["alice"]}, first.Key, 1, shared.GetMessagesSize())
+		symCiphertext, err := NewWireCodec(shared.GetParams()).Marshal(symCiphertexts[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		probe := &EncryptedTemplate{SymCiphertexts: [][]byte{symCiphertext}, KeyID: first.ID, SessionID: nonces.SessionID,
+			Sequence: nonces.Sequence, Nonces: nonces.Nonces, Counter: nonces.Counter}
+		err = doJSONWithToken(http.DefaultClient, clientToken, http.MethodPost, comp.URL+RouteVerify, &VerifyRequest{SubjectID: "alice", TemplateID: "finger", Probe: probe}, new(ComparisonResponse))
+		if !errors.Is(err, ErrKeyNotFound) {
+			t.Errorf("probe under the rotated key: %v", err)
+		}
+	})
+
+	t.Run("WithoutSession", func(t *testing.T) {
+		// nonces without a session are never accepted, the template is refused before it is decoded
+		nonces := DeriveNonces(NewSessionID(), 0, shared.GetMessagesSize())
+		probe := &EncryptedTemplate{SymCiphertexts: [][]byte{{0}}, EncryptedKey: []byte{0}, Nonces: nonces.Nonces, Counter: nonces.Counter}
+		err := doJSONWithToken(http.DefaultClient, clientToken, http.MethodPost, comp.URL+RouteVerify, &VerifyRequest{SubjectID: "alice", TemplateID: "finger", Probe: probe}, new(ComparisonResponse))
+		var serviceErr *ServiceError
+		if !errors.As(err, &serviceErr) || serviceErr.Status != http.StatusBadRequest {
+			t.Errorf("probe without session: %v", err)
+		}
+	})
+
+	t.Run("ClientToken", func(t *testing.T) {
+		for _, route := range []string{RouteKeys, RouteEnrol, RouteVerify, RouteIdentify} {
+			for _, wrong := range []string{"", token} {
+				err := doJSONWithToken(http.DefaultClient, wrong, http.MethodPost, comp.URL+route, &VerifyRequest{SubjectID: "alice", TemplateID: "finger"}, new(ComparisonResponse))
+				var serviceErr *ServiceError
+				if !errors.As(err, &serviceErr) || serviceErr.Status != http.StatusUnauthorized {
+					t.Errorf("%s with token %q: got %v, want StatusUnauthorized", route, wrong, err)
+				}
+			}
+		}
+	})
+
+	t.Run("Results", func(t *testing.T) {
+		codec := NewWireCodec(shared.GetParams())
+		decision, err := codec.Marshal(parties.encrypt([]float64{1}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		result := &ResultRequest{RequestID: newRequestID(), Kind: ResultVerification, Decision: decision}
+		post := func(token string, value interface{}, route string) int {
+			err := doJSONWithToken(http.DefaultClient, token, http.MethodPost, auth.URL+route, value, new(ComparisonResponse))
+			var serviceErr *ServiceError
+			if errors.As(err, &serviceErr) {
+				return serviceErr.Status
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			return http.StatusOK
+		}
+		pending := &PendingRequest{RequestID: result.RequestID, Kind: ResultIdentification}
+		for _, refused := range []struct {
+			name   string
+			token  string
+			value  interface{}
+			route  string
+			status int
+		}{
+			{"registration without token", "", pending, RouteRequests, http.StatusUnauthorized},
+			{"result without token", "", result, RouteResults, http.StatusUnauthorized},
+			{"result with another token", NewServiceToken(), result, RouteResults, http.StatusUnauthorized},
+			{"result of an unregistered request", token, result, RouteResults, http.StatusForbidden},
+			{"registration", token, pending, RouteRequests, http.StatusOK},
+			{"result of another kind", token, result, RouteResults, http.StatusForbidden},
+		} {
+			if status := post(refused.token, refused.value, refused.route); status != refused.status {
+				t.Errorf("%s: status %d, want %d", refused.name, status, refused.status)
+			}
+		}
+		if _, err = service.Decision(result.RequestID); !errors.Is(err, ErrRecordNotFound) {
+			t.Errorf("decision of a refused result: %v", err)
+		}
+	})
+
+	t.Run("UnknownSubject", func(t *testing.T) {
+		if _, err := service.Verify("carol", "finger", []Template{templates["alice"]}); !errors.Is(err, ErrRecordNotFound) {
+			t.Errorf("verification against an unknown subject: %v", err)
+		}
+	})
+}
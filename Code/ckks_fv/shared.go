@@ -1,14 +1,20 @@
 package ckks_fv
 
 import (
-	"crypto/rand"
 	"fmt"
 
 	"github.com/ldsec/lattigo/v2/utils"
 )
 
+// Symmetric ciphers available for transciphering
+const (
+	HERA = iota
+	RUBATO
+)
+
 type Shared interface {
 	GetParams() *Parameters
+	GetCipher() int
 	GetParamIndex() int
 	GetRadix() int
 	GetHammingWeight() int
@@ -16,11 +22,13 @@ type Shared interface {
 	GetMessagesSize() int
 	GetNumRounds() int
 	GetMessageScaling() float64
-	GetNonces() [][]byte
+	GetBlockSize() int
+	GetOutputSize() int
 	GetHeraModDown() []int
 	GetStcModDown() []int
 	GetPDcds() [][]*PtDiagMatrixT
 	GetHbtpParams() *HalfBootParameters
+	GetHalfBootMatrices() []*PtDiagMatrix
 	GetFvEncryptor() MFVEncryptor
 	GetFvEvaluator() MFVEvaluator
 	GetCKKSEvaluator() CKKSEvaluator
@@ -39,12 +47,19 @@ type Shared interface {
 
 	SetPublicKeys(pk *PublicKey, rotKeys *RotationKeySet, relinKey *RelinearizationKey, bootstrappingKey BootstrappingKey)
 	SetRotationKeyset(rotKeys *RotationKeySet)
-	SetNonces(nonce [][]byte)
+	SetHalfBootMatrices(matrices []*PtDiagMatrix)
+	// GetTemplateLengths returns the lengths summed by the comparisons, TemplateLengths unless set
+	GetTemplateLengths() []int
+	// SetTemplateLengths sets the lengths for which the authentication server generates the InnerSum rotation keys
+	SetTemplateLengths(lengths []int)
+	GetLogger() Logger
+	SetLogger(logger Logger)
 }
 
 // bootstrappingKey BootstrappingKey
 type Ishared struct {
 	Params     *Parameters
+	Cipher     int
 	ParamIndex int
 	radix      int
 	HbtpParams *HalfBootParameters
@@ -57,7 +72,8 @@ type Ishared struct {
 	CkksEncryptor CKKSEncryptor
 	CkksEncoder   CKKSEncoder
 
-	Nonces         [][]byte
+	BlockSize      int
+	OutputSize     int
 	MessageSize    int
 	MessageScaling float64
 	PDcds          [][]*PtDiagMatrixT
@@ -69,71 +85,133 @@ type Ishared struct {
 	RotKeys          *RotationKeySet
 	RelinKey         *RelinearizationKey
 	BootstrappingKey BootstrappingKey
+	// HalfBootMatrices are the CoeffsToSlots matrices of the half bootstrapper, generated by the first NewServerComp
+	HalfBootMatrices []*PtDiagMatrix
 
 	HeraModDown []int
 	stcModDown  []int
+
+	templateLengths []int
+
+	logger Logger
 }
 
-func Init_From_Context(context SaveFile) Shared {
-	numRound, paramIndex, radix, fullCoeffs, pDcds, nonces := context.GetSharedParameters()
-	//pk, ror, rel, boot := context.GetPublicAndComputationKeys()
+// Init_From_Context restores the shared parameters, evaluation keys and precomputed matrices of the context
+// without generating keys. Matrices missing in the context are generated.
+func Init_From_Context(context SaveFile) (Shared, error) {
+	numRound, paramIndex, radix, fullCoeffs, pDcds := context.GetSharedParameters()
 	var s Ishared
-	s.Nonces = nonces
-	s.NumRound = numRound
 	s.radix = radix
-	hbtpParams := RtFHeraParams[paramIndex]
-	s.HbtpParams = hbtpParams
-	s.ParamIndex = paramIndex
-	params, err := hbtpParams.Params()
-	if err != nil {
-		panic(err)
+	if err := s.setParameters(context.GetCipher(), numRound, paramIndex, radix, fullCoeffs); err != nil {
+		return nil, fmt.Errorf("context %s: %w", context.GetContextID(), err)
 	}
-	//server.paramIndex = paramIndex
 
-	if numRound == 4 {
-		s.HeraModDown = HeraModDownParams80[paramIndex].CipherModDown
-		s.stcModDown = HeraModDownParams80[paramIndex].StCModDown
-	} else {
-		s.HeraModDown = HeraModDownParams128[paramIndex].CipherModDown
-		s.stcModDown = HeraModDownParams128[paramIndex].StCModDown
+	//is this really needed?
+	s.FvEncoder = NewMFVEncoder(s.Params)
+	s.CkksEncoder = NewCKKSEncoder(s.Params)
+
+	s.PDcds = pDcds
+	if len(s.PDcds) == 0 {
+		s.PDcds = s.FvEncoder.GenSlotToCoeffMatFV(radix)
 	}
-	if fullCoeffs {
-		s.MessageSize = params.N()
-		params.SetLogFVSlots(params.LogN())
-	} else {
-		s.MessageSize = params.Slots()
-		params.SetLogFVSlots(params.LogSlots())
+	s.HalfBootMatrices = context.GetHalfBootMatrices()
+
+	pk, rotKeys, relinKey, bootstrappingKey := context.GetEvaluationKeys()
+	if pk != nil && rotKeys != nil && relinKey != nil {
+		s.SetPublicKeys(pk, rotKeys, relinKey, bootstrappingKey)
 	}
+	return &s, nil
+}
 
-	s.Params = params
-	s.HammingWeight = hbtpParams.H
-	s.MessageScaling = (float64(params.PlainModulus()) / (hbtpParams.MessageRatio * 2))
-	s.MessageScaling = (float64(params.PlainModulus()) / hbtpParams.MessageRatio)
+// Init sets up the shared parameters for transciphering with HERA
+func Init(numRound int, paramIndex int, radix int, fullCoeffs bool) (Shared, error) {
+	return InitWithCipher(HERA, numRound, paramIndex, radix, fullCoeffs)
+}
 
-	//is this really needed?
-	s.FvEncoder = NewMFVEncoder(params)
-	s.CkksEncoder = NewCKKSEncoder(params)
+// InitWithCipher sets up the shared parameters for transciphering with the given cipher.
+// For HERA paramIndex selects the RtF parameter set, for RUBATO it selects the Rubato
+// parameter (RUBATO80S, ..., RUBATO128L) and numRound is taken from the Rubato parameter.
+// Invalid combinations return an error matching ErrParameterMismatch.
+func InitWithCipher(cipher int, numRound int, paramIndex int, radix int, fullCoeffs bool) (Shared, error) {
+	var s Ishared
+	s.radix = radix
+	if err := s.setParameters(cipher, numRound, paramIndex, radix, fullCoeffs); err != nil {
+		return nil, err
+	}
 
-	s.FullCoeffs = fullCoeffs
+	//is this really needed?
+	s.FvEncoder = NewMFVEncoder(s.Params)
+	s.CkksEncoder = NewCKKSEncoder(s.Params)
 
-	s.PDcds = pDcds
+	s.PDcds = s.FvEncoder.GenSlotToCoeffMatFV(radix)
 
-	//s.SetPublicKeys(pk, ror, rel, boot)
-	return &s
+	return &s, nil
 }
-func Init(numRound int, paramIndex int, radix int, fullCoeffs bool) Shared {
-	var s Ishared
-	s.NumRound = numRound
-	s.radix = radix
-	hbtpParams := RtFHeraParams[paramIndex]
-	s.HbtpParams = hbtpParams
+
+func (s *Ishared) setParameters(cipher int, numRound int, paramIndex int, radix int, fullCoeffs bool) error {
+	var hbtpParams *HalfBootParameters
+	var modDown ModDownParams
+	s.Cipher = cipher
 	s.ParamIndex = paramIndex
+	switch cipher {
+	case HERA:
+		if paramIndex < 0 || paramIndex >= len(RtFHeraParams) {
+			return fmt.Errorf("%w: no HERA parameter %d", ErrParameterMismatch, paramIndex)
+		}
+		if numRound != 4 && numRound != 5 {
+			return fmt.Errorf("%w: HERA has 4 or 5 rounds, not %d", ErrParameterMismatch, numRound)
+		}
+		hbtpParams = RtFHeraParams[paramIndex]
+		s.BlockSize = 16
+		s.OutputSize = 16
+		if numRound == 4 {
+			modDown = HeraModDownParams80[paramIndex]
+		} else {
+			modDown = HeraModDownParams128[paramIndex]
+		}
+	case RUBATO:
+		if !fullCoeffs {
+			return fmt.Errorf("%w: Rubato is only available with full coefficients", ErrParameterMismatch)
+		}
+		if paramIndex < 0 || paramIndex >= len(RubatoParams) {
+			return fmt.Errorf("%w: no Rubato parameter %d", ErrParameterMismatch, paramIndex)
+		}
+		rubatoParam := RubatoParams[paramIndex]
+		hbtpParams = RtFRubatoParams[0]
+		numRound = rubatoParam.NumRound
+		s.BlockSize = rubatoParam.Blocksize
+		s.OutputSize = rubatoParam.Blocksize - 4
+		var err error
+		if modDown, err = rubatoModDownParams(paramIndex, radix); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("%w: unknown cipher %d", ErrParameterMismatch, cipher)
+	}
+	s.NumRound = numRound
+	s.HeraModDown = modDown.CipherModDown
+	s.stcModDown = modDown.StCModDown
+
+	plainModulus := hbtpParams.PlainModulus
+	if cipher == RUBATO {
+		plainModulus = RubatoParams[paramIndex].PlainModulus
+	}
+	if err := s.setHalfBootParameters(hbtpParams, plainModulus, fullCoeffs); err != nil {
+		return err
+	}
+	return nil
+}
+
+// setHalfBootParameters sets the CKKS and FV parameters of the half-boot parameters with the plaintext modulus of
+// the cipher and the message size of the slot mode
+func (s *Ishared) setHalfBootParameters(hbtpParams *HalfBootParameters, plainModulus uint64, fullCoeffs bool) error {
 	params, err := hbtpParams.Params()
 	if err != nil {
-		panic(err)
+		return err
 	}
-	//server.paramIndex = paramIndex
+	params.SetPlainModulus(plainModulus)
 
+	s.HbtpParams = hbtpParams
 	s.HammingWeight = hbtpParams.H
 	if fullCoeffs {
 		s.MessageSize = params.N()
@@ -145,25 +223,26 @@ func Init(numRound int, paramIndex int, radix int, fullCoeffs bool) Shared {
 	//s.MessageScaling = (float64(params.PlainModulus()) / (hbtpParams.MessageRatio * 2))
 	s.MessageScaling = (float64(params.PlainModulus()) / hbtpParams.MessageRatio)
 	s.Params = params
-
-	//is this really needed?
-	s.FvEncoder = NewMFVEncoder(params)
-	s.CkksEncoder = NewCKKSEncoder(params)
-
 	s.FullCoeffs = fullCoeffs
-
-	s.PDcds = s.FvEncoder.GenSlotToCoeffMatFV(radix)
-
-	if numRound == 4 {
-		s.HeraModDown = HeraModDownParams80[paramIndex].CipherModDown
-		s.stcModDown = HeraModDownParams80[paramIndex].StCModDown
-	} else {
-		s.HeraModDown = HeraModDownParams128[paramIndex].CipherModDown
-		s.stcModDown = HeraModDownParams128[paramIndex].StCModDown
+	return nil
+}
+
+// rubatoModDownParams returns the mod down indices of the Rubato parameter with RtF param 128af and the given radix
+func rubatoModDownParams(rubatoParam int, radix int) (ModDownParams, error) {
+	tables := [][]ModDownParams{
+		RubatoModDownParams80S,
+		RubatoModDownParams80M,
+		RubatoModDownParams80L,
+		RubatoModDownParams128S,
+		RubatoModDownParams128M,
+		RubatoModDownParams128L,
 	}
-
-	return &s
+	if radix != 1 && radix != 2 {
+		return ModDownParams{}, fmt.Errorf("%w: no Rubato mod down parameters for radix %d", ErrParameterMismatch, radix)
+	}
+	return tables[rubatoParam][radix-1], nil
 }
+
 func (shared *Ishared) GetParamIndex() int {
 	return shared.ParamIndex
 }
@@ -201,18 +280,19 @@ func (s *Ishared) GetHeraModDown() []int {
 func (s *Ishared) GetStcModDown() []int {
 	return s.stcModDown
 }
-func (s *Ishared) GetNonces() [][]byte {
-	//var nonces [][]byte
-	if len(s.Nonces) > 0 {
-		return s.Nonces
-	}
-	nonces := make([][]byte, s.MessageSize)
-	for i := 0; i < s.MessageSize; i++ {
-		nonces[i] = make([]byte, 64)
-		rand.Read(nonces[i])
-	}
-	s.Nonces = nonces
-	return nonces
+
+func (s *Ishared) GetCipher() int {
+	return s.Cipher
+}
+
+// GetBlockSize returns the state size of the cipher, which is also the length of the symmetric key
+func (s *Ishared) GetBlockSize() int {
+	return s.BlockSize
+}
+
+// GetOutputSize returns the number of keystream words per block, i.e. the number of symmetric ciphertexts per message
+func (s *Ishared) GetOutputSize() int {
+	return s.OutputSize
 }
 
 func (s *Ishared) GetParams() *Parameters {
@@ -232,12 +312,20 @@ func (s *Ishared) GetHbtpParams() *HalfBootParameters {
 	return s.HbtpParams
 }
 
+// GetHalfBootMatrices returns the CoeffsToSlots matrices of the half bootstrapper, nil if not generated yet
+func (s *Ishared) GetHalfBootMatrices() []*PtDiagMatrix {
+	return s.HalfBootMatrices
+}
+func (s *Ishared) SetHalfBootMatrices(matrices []*PtDiagMatrix) {
+	s.HalfBootMatrices = matrices
+}
+
 // if fullCoeffs size = params.N
 // else size = params.slots
 func (shared *Ishared) CreateRandomData() [][]float64 {
-	fmt.Println("Message Size: 16x", shared.MessageSize)
-	data := make([][]float64, 16)
-	for s := 0; s < 16; s++ {
+	logMessage(shared.GetLogger(), LogDebug, "random data", Field{"outputs", shared.OutputSize}, Field{"size", shared.MessageSize})
+	data := make([][]float64, shared.OutputSize)
+	for s := 0; s < shared.OutputSize; s++ {
 		data[s] = make([]float64, shared.MessageSize)
 
 		for i := 0; i < shared.MessageSize; i++ {
@@ -247,11 +335,11 @@ func (shared *Ishared) CreateRandomData() [][]float64 {
 	return data
 }
 
-//Fill all rows with range from 0-16 but [1][0] will be 1 to test euclidean distance
+// Fill all rows with range from 0-16 but [1][0] will be 1 to test euclidean distance
 func (shared *Ishared) CreateSpecificData() [][]float64 {
-	data := make([][]float64, 16)
+	data := make([][]float64, shared.OutputSize)
 
-	for s := 0; s < 16; s++ {
+	for s := 0; s < shared.OutputSize; s++ {
 		data[s] = make([]float64, shared.MessageSize)
 		for i := 0; i < shared.MessageSize; i++ {
 			data[s][i] = float64(s*16 + i)
@@ -260,9 +348,9 @@ func (shared *Ishared) CreateSpecificData() [][]float64 {
 	return data
 }
 func (shared *Ishared) CreateMask(index int) [][]float64 {
-	data := make([][]float64, 16)
+	data := make([][]float64, shared.OutputSize)
 
-	for s := 0; s < 16; s++ {
+	for s := 0; s < shared.OutputSize; s++ {
 		data[s] = make([]float64, shared.MessageSize)
 		for i := 0; i < shared.MessageSize; i++ {
 			if i == index {
@@ -346,6 +434,26 @@ func (shared *Ishared) GetCKKSEncryptor() CKKSEncryptor {
 	return shared.CkksEncryptor
 }
 
-func (shared *Ishared) SetNonces(nonce [][]byte) {
-	shared.Nonces = nonce
+func (shared *Ishared) GetTemplateLengths() []int {
+	if len(shared.templateLengths) == 0 {
+		return TemplateLengths
+	}
+	return shared.templateLengths
+}
+
+func (shared *Ishared) SetTemplateLengths(lengths []int) {
+	shared.templateLengths = lengths
+}
+
+// GetLogger returns the Logger of the parties, the default logger writes info and above to stdout
+func (shared *Ishared) GetLogger() Logger {
+	if shared.logger == nil {
+		return defaultLogger
+	}
+	return shared.logger
+}
+
+// SetLogger sets the Logger of the parties, it is not serialized
+func (shared *Ishared) SetLogger(logger Logger) {
+	shared.logger = logger
 }
@@ -2,7 +2,6 @@ package ckks_fv
 
 import (
 	"bufio"
-	"errors"
 	"fmt"
 	"math"
 	"math/rand"
@@ -18,6 +17,7 @@ import (
 
 type Tmpl struct {
 	data []float64
+	mask []float64
 	name string
 }
 
@@ -25,6 +25,16 @@ type Template interface {
 	PrintTemplate()
 	SquaredEuclideanDistance(other Template) float64
 	HammingDistance(other Template) float64
+	InnerProduct(other Template) float64
+	CosineSimilarity(other Template) float64
+	Compare(other Template, comparator int) float64
+	Normalized() Template
+	MaskedHammingDistance(other Template) float64
+	ValidBits(other Template) float64
+	FractionalHammingDistance(other Template, shifts []int) float64
+	GetMask() []float64
+	SetMask(mask []float64)
+	GetMessage() []float64
 	DecryptedDeviationDistance(decrypted [][]complex128) float64
 	DecryptedDeviationDistanceFullCoeffs(decrypted []complex128) float64
 	GetData() []float64
@@ -45,6 +55,19 @@ func NewBinaryMockTemplate(size int) Template {
 	return nTemplate
 }
 
+// NewMaskedBinaryMockTemplate returns a random binary template whose mask marks about validRatio of the bits as valid
+func NewMaskedBinaryMockTemplate(size int, validRatio float64) Template {
+	nTemplate := NewBinaryMockTemplate(size)
+	mask := make([]float64, size)
+	for i := 0; i < size; i++ {
+		if rand.Float64() < validRatio {
+			mask[i] = 1.0
+		}
+	}
+	nTemplate.SetMask(mask)
+	return nTemplate
+}
+
 func NewMockTemplate(size int) Template {
 	nTemplate := new(Tmpl)
 	nTemplate.data = make([]float64, size)
@@ -54,19 +77,16 @@ func NewMockTemplate(size int) Template {
 	}
 	return nTemplate
 }
-func NewTemplate(pathToFile string, half ...bool) Template {
-	nTemplate := new(Tmpl)
-	if _, err := os.Stat(pathToFile); err == nil {
 
-	} else if errors.Is(err, os.ErrNotExist) {
-		fmt.Println("File does not exist")
-	}
+// NewTemplate reads a template from an .af file with one value per line or from a float32 .npy file.
+// A missing file returns an error matching ErrMissingFile.
+func NewTemplate(pathToFile string, half ...bool) (Template, error) {
+	nTemplate := new(Tmpl)
 	file, err := os.Open(pathToFile)
-
 	if err != nil {
-		println(err)
-		return nil
+		return nil, fileError("open", pathToFile, err)
 	}
+	defer file.Close()
 	_, fileName := path.Split(pathToFile)
 	name := strings.TrimSuffix(fileName, ".af")
 	nTemplate.name = strings.TrimSuffix(name, ".npy")
@@ -75,14 +95,23 @@ func NewTemplate(pathToFile string, half ...bool) Template {
 		scanner.Split(bufio.ScanLines)
 		for scanner.Scan() {
 			//fmt.Println(scanner.Text())
-			parsed, _ := strconv.ParseFloat(scanner.Text(), 64)
+			parsed, err := strconv.ParseFloat(scanner.Text(), 64)
+			if err != nil {
+				return nil, fileError("parse", pathToFile, err)
+			}
 			nTemplate.data = append(nTemplate.data, parsed)
 		}
+		if err := scanner.Err(); err != nil {
+			return nil, fileError("read", pathToFile, err)
+		}
 	} else {
-		r, x := gonpy.NewFileReader(pathToFile)
-		data, e := r.GetFloat32()
-		if e != nil || x != nil {
-			fmt.Print(e, x)
+		r, err := gonpy.NewFileReader(pathToFile)
+		if err != nil {
+			return nil, fileError("read", pathToFile, err)
+		}
+		data, err := r.GetFloat32()
+		if err != nil {
+			return nil, fileError("parse", pathToFile, err)
 		}
 		for i, _ := range data {
 			if len(half) > 0 && i == len(data)/2 {
@@ -92,9 +121,8 @@ func NewTemplate(pathToFile string, half ...bool) Template {
 		}
 	}
 
-	file.Close()
 	fmt.Println("Sucessfully converted to Template: ", nTemplate.name)
-	return nTemplate
+	return nTemplate, nil
 }
 
 func (template *Tmpl) PrintTemplate() {
@@ -133,6 +161,120 @@ func (template *Tmpl) HammingDistance(other Template) float64 {
 
 }
 
+func (template *Tmpl) InnerProduct(other Template) float64 {
+	otherData := other.GetData()
+	if len(template.data) != len(otherData) {
+		panic("templates need to have same length")
+	}
+	accum := 0.0
+	for i, _ := range template.data {
+		accum += template.data[i] * otherData[i]
+	}
+	return accum
+}
+
+func (template *Tmpl) CosineSimilarity(other Template) float64 {
+	return template.InnerProduct(other) / math.Sqrt(template.InnerProduct(template)*other.InnerProduct(other))
+}
+
+// Compare returns the score of the comparator as computed by ServerComp
+func (template *Tmpl) Compare(other Template, comparator int) float64 {
+	switch comparator {
+	case EUCLIDEAN:
+		return template.SquaredEuclideanDistance(other)
+	case HAMMING:
+		return template.HammingDistance(other)
+	case INNER_PRODUCT:
+		return template.InnerProduct(other)
+	case COSINE:
+		return template.CosineSimilarity(other)
+	case MASKED_HAMMING:
+		return template.MaskedHammingDistance(other)
+	default:
+		panic(fmt.Sprintf("unknown comparator %d", comparator))
+	}
+}
+
+// Normalized returns a copy of the template with unit length, so that the inner product of
+// normalized templates is their cosine similarity
+func (template *Tmpl) Normalized() Template {
+	nTemplate := new(Tmpl)
+	nTemplate.name = template.name
+	nTemplate.data = make([]float64, len(template.data))
+	norm := math.Sqrt(template.InnerProduct(template))
+	for i, _ := range template.data {
+		nTemplate.data[i] = template.data[i] / norm
+	}
+	return nTemplate
+}
+
+// maskAt returns the bit i of mask, templates without mask are valid everywhere
+func maskAt(mask []float64, i int) float64 {
+	if mask == nil {
+		return 1.0
+	}
+	return mask[i]
+}
+
+// MaskedHammingDistance returns the number of bits that differ and are valid in both templates
+func (template *Tmpl) MaskedHammingDistance(other Template) float64 {
+	otherData := other.GetData()
+	if len(template.data) != len(otherData) {
+		panic("templates need to have same length")
+	}
+	otherMask := other.GetMask()
+	accum := 0.0
+	for i, _ := range template.data {
+		if template.data[i] != otherData[i] {
+			accum += maskAt(template.mask, i) * maskAt(otherMask, i)
+		}
+	}
+	return accum
+}
+
+// ValidBits returns the number of bits that are valid in both templates
+func (template *Tmpl) ValidBits(other Template) float64 {
+	otherMask := other.GetMask()
+	accum := 0.0
+	for i, _ := range template.data {
+		accum += maskAt(template.mask, i) * maskAt(otherMask, i)
+	}
+	return accum
+}
+
+// shifted returns the template with data and mask rotated cyclically by shift, bit i of the result is bit i+shift
+func (template *Tmpl) shifted(shift int) *Tmpl {
+	n := len(template.data)
+	nTemplate := new(Tmpl)
+	nTemplate.name = template.name
+	nTemplate.data = make([]float64, n)
+	if template.mask != nil {
+		nTemplate.mask = make([]float64, n)
+	}
+	for i := 0; i < n; i++ {
+		j := ((i+shift)%n + n) % n
+		nTemplate.data[i] = template.data[j]
+		if template.mask != nil {
+			nTemplate.mask[i] = template.mask[j]
+		}
+	}
+	return nTemplate
+}
+
+// FractionalHammingDistance returns the smallest masked Hamming distance divided by the number of valid bits
+// over the barrel shifts of the template
+func (template *Tmpl) FractionalHammingDistance(other Template, shifts []int) float64 {
+	best := math.Inf(1)
+	for _, shift := range shifts {
+		shifted := template.shifted(shift)
+		fraction := shifted.MaskedHammingDistance(other) / shifted.ValidBits(other)
+		if fraction < best {
+			best = fraction
+		}
+	}
+	return best
+}
+
 func (template *Tmpl) DecryptedDeviationDistance(decrypted [][]complex128) float64 {
 
 	deviation := 0.0
@@ -166,6 +308,27 @@ func (Template *Tmpl) GetData() []float64 {
 	return Template.data
 }
 
+func (Template *Tmpl) GetMask() []float64 {
+	return Template.mask
+}
+
+func (Template *Tmpl) SetMask(mask []float64) {
+	if len(mask) != len(Template.data) {
+		panic("mask needs to have the length of the template")
+	}
+	Template.mask = mask
+}
+
+// GetMessage returns the data followed by the mask if the template has one, as it is encrypted by the client
+func (Template *Tmpl) GetMessage() []float64 {
+	if Template.mask == nil {
+		return Template.data
+	}
+	message := make([]float64, 0, 2*len(Template.data))
+	message = append(message, Template.data...)
+	return append(message, Template.mask...)
+}
+
 func (Template *Tmpl) GetName() string {
 	return Template.name
 }
@@ -1,64 +1,133 @@
 package ckks_fv
 
+// TemplateLengths lists the template lengths of the predefined template instructions,
+// rotation keys for summing templates of these lengths are generated by the authentication server unless
+// the shared parameters set the lengths of a configuration
+var TemplateLengths = []int{256, 512, 640, 5120}
+
+// Comparators of templates, EUCLIDEAN and HAMMING are distances, INNER_PRODUCT and COSINE are similarities.
+// MASKED_HAMMING compares binary templates followed by their occlusion masks.
+const (
+	EUCLIDEAN = iota
+	HAMMING
+	INNER_PRODUCT
+	COSINE
+	MASKED_HAMMING
+)
+
+// TemplateInstruction describes where a template is found in the message, how it is compared and how its score is fused.
+// The fused score of the template is Weight * Scale * (score - Offset), similarities can be turned into distances
+// with a negative scale, e.g. Offset 1 and Scale -1 give the cosine distance.
+// For COSINE, InverseSqrt approximates the normalization under encryption, if it is nil the client normalizes the templates.
+// For MASKED_HAMMING, the mask follows the code in the message and MaskedHamming configures the fractional distance.
 type TemplateInstruction struct {
 	Index          int
 	TemplateLength int
 	Binary         bool
-	Mask           *Ciphertext
+	Comparator     int
+	InverseSqrt    *InverseSqrtApproximation
+	MaskedHamming  *MaskedHammingOptions
+	Weight         float64
+	Offset         float64
+	Scale          float64
 }
 
-func NewFingerShortTemplateInstruction(index int) *TemplateInstruction {
+// NewTemplateInstruction returns a TemplateInstruction with weight 1 and without normalization,
+// binary templates are compared with HAMMING and all others with EUCLIDEAN
+func NewTemplateInstruction(index int, templateLength int, binary bool) *TemplateInstruction {
 	ti := new(TemplateInstruction)
 	ti.Index = index
-	ti.TemplateLength = 256
-	ti.Binary = false
+	ti.TemplateLength = templateLength
+	ti.Binary = binary
+	ti.Comparator = EUCLIDEAN
+	if binary {
+		ti.Comparator = HAMMING
+	}
+	ti.Weight = 1
+	ti.Offset = 0
+	ti.Scale = 1
 	return ti
 }
 
-func NewIrisTemplateInstruction(index int) *TemplateInstruction {
-	ti := new(TemplateInstruction)
-	ti.Index = index
-	ti.TemplateLength = 5120
-	ti.Binary = true
+// SetComparator sets the comparator of the template, inverseSqrt is only used by COSINE
+func (ti *TemplateInstruction) SetComparator(comparator int, inverseSqrt *InverseSqrtApproximation) *TemplateInstruction {
+	ti.Comparator = comparator
+	ti.InverseSqrt = inverseSqrt
 	return ti
 }
-func NewIrisShortTemplateInstruction(index int) *TemplateInstruction {
-	ti := new(TemplateInstruction)
-	ti.Index = index
-	ti.TemplateLength = 512
-	ti.Binary = true
+
+// SetMaskedHamming compares the template with MASKED_HAMMING, options may be nil to get the number of disagreeing valid bits
+func (ti *TemplateInstruction) SetMaskedHamming(options *MaskedHammingOptions) *TemplateInstruction {
+	ti.Comparator = MASKED_HAMMING
+	ti.MaskedHamming = options
 	return ti
 }
 
+// MessageLength returns the number of message elements taken by the template, including its mask
+func (ti *TemplateInstruction) MessageLength() int {
+	if ti.Comparator == MASKED_HAMMING {
+		return 2 * ti.TemplateLength
+	}
+	return ti.TemplateLength
+}
+
+// SetWeight sets the fusion weight of the template
+func (ti *TemplateInstruction) SetWeight(weight float64) *TemplateInstruction {
+	ti.Weight = weight
+	return ti
+}
+
+// SetNormalization sets the offset and scale applied to the distance before weighting
+func (ti *TemplateInstruction) SetNormalization(offset float64, scale float64) *TemplateInstruction {
+	ti.Offset = offset
+	ti.Scale = scale
+	return ti
+}
+
+// Fuse returns the contribution of a distance of this template to the fused score
+func (ti *TemplateInstruction) Fuse(distance float64) float64 {
+	return ti.Weight * ti.Scale * (distance - ti.Offset)
+}
+
+// Score returns the plaintext score of the comparator before fusion, as approximated by ServerComp
+func (ti *TemplateInstruction) Score(probe Template, reference Template) float64 {
+	if ti.Comparator == MASKED_HAMMING && ti.MaskedHamming != nil && ti.MaskedHamming.Inverse != nil {
+		return probe.FractionalHammingDistance(reference, ti.MaskedHamming.shifts())
+	}
+	return probe.Compare(reference, ti.Comparator)
+}
+
+func NewFingerShortTemplateInstruction(index int) *TemplateInstruction {
+	return NewTemplateInstruction(index, 256, false)
+}
+
+func NewIrisTemplateInstruction(index int) *TemplateInstruction {
+	return NewTemplateInstruction(index, 5120, true)
+}
+
+// NewMaskedIrisTemplateInstruction returns the instruction for an iris code followed by its occlusion mask,
+// compared with the fractional Hamming distance over the given barrel shifts
+func NewMaskedIrisTemplateInstruction(index int, minValidBits float64, shifts []int) *TemplateInstruction {
+	return NewTemplateInstruction(index, 5120, true).SetMaskedHamming(NewMaskedHammingOptions(5120, minValidBits, shifts))
+}
+
+func NewIrisShortTemplateInstruction(index int) *TemplateInstruction {
+	return NewTemplateInstruction(index, 512, true)
+}
+
 func NewFaceTemplateInstruction(index int) *TemplateInstruction {
-	ti := new(TemplateInstruction)
-	ti.Index = index
-	ti.TemplateLength = 512
-	ti.Binary = false
 	//log.Println("Added FaceTemplate Instruction")
-	return ti
+	return NewTemplateInstruction(index, 512, false)
 }
 func NewFingerValentinaTemplateInstruction(index int) *TemplateInstruction {
-	ti := new(TemplateInstruction)
-	ti.Index = index
-	ti.TemplateLength = 256
-	ti.Binary = false
 	//log.Println("Added FaceTemplate Instruction")
-	return ti
+	return NewTemplateInstruction(index, 256, false)
 }
 func NewIrisValentinaTemplateInstruction(index int) *TemplateInstruction {
-	ti := new(TemplateInstruction)
-	ti.Index = index
-	ti.TemplateLength = 512
-	ti.Binary = false
 	//log.Println("Added Iris(Valentina) Instruction")
-	return ti
+	return NewTemplateInstruction(index, 512, false)
 }
 
 func NewFingerLongTemplateInstruction(index int) *TemplateInstruction {
-	ti := new(TemplateInstruction)
-	ti.Index = index
-	ti.TemplateLength = 640
-	ti.Binary = false
-	return ti
+	return NewTemplateInstruction(index, 640, false)
 }
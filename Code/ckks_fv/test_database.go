@@ -1,6 +1,7 @@
 package ckks_fv
 
 import (
+	"errors"
 	"fmt"
 	"log"
 	"os"
@@ -9,6 +10,11 @@ import (
 
 type DTesting interface {
 	Init_Parties()
+	SetCipher(cipher int, paramIndex int)
+	SetParameters(cipher int, numRound int, paramIndex int, radix int, fullCoeffs bool)
+	SetConfig(config *Config)
+	MapTemplates(start int)
+	TranscipherMap()
 	Run()
 }
 
@@ -19,7 +25,15 @@ type d_testing struct {
 	client               Client
 	serverAuth           ServerAuth
 	serverComp           ServerComp
+	gallery              GalleryStore
+	metrics              *Metrics
 	contextPath          string
+	cipher               int
+	numRound             int
+	paramIndex           int
+	radix                int
+	fullCoeffs           bool
+	config               *Config
 	subjectMap           map[string][]MultiTemplate
 }
 
@@ -39,9 +53,8 @@ func NewDatabaseTest(encryptedTemplateDir string, plainTemplateDir string, conte
 	}
 	if etc {
 		fmt.Println("Encrypted Template Dir does not exist and will be created if necessary")
-	} else {
-		test.EncryptedTemplateDir = encryptedTemplateDir
 	}
+	test.EncryptedTemplateDir = encryptedTemplateDir
 	if pte {
 		fmt.Println("Plain Template Dir does not exist")
 	} else {
@@ -54,88 +67,158 @@ func NewDatabaseTest(encryptedTemplateDir string, plainTemplateDir string, conte
 		log.SetFlags(log.LstdFlags | log.Lshortfile | log.Lmicroseconds)
 	}
 	test.subjectMap = make(map[string][]MultiTemplate)
+	test.metrics = NewMetrics()
+	test.SetConfig(DefaultConfig())
 	return test
 }
+
+// SetCipher selects the cipher and its parameter index used when no context file exists yet
+func (test *d_testing) SetCipher(cipher int, paramIndex int) {
+	test.cipher = cipher
+	test.paramIndex = paramIndex
+}
+
+// SetParameters selects all parameters used when no context file exists yet
+func (test *d_testing) SetParameters(cipher int, numRound int, paramIndex int, radix int, fullCoeffs bool) {
+	test.cipher = cipher
+	test.numRound = numRound
+	test.paramIndex = paramIndex
+	test.radix = radix
+	test.fullCoeffs = fullCoeffs
+}
+
+// SetConfig selects the parameters and modalities of the configuration, the plain template folder holds one folder
+// per modality and subject
+func (test *d_testing) SetConfig(config *Config) {
+	test.config = config
+	test.SetParameters(config.SharedParameters())
+}
 func (test *d_testing) Init_Parties() {
 	if !FileOrFolderExists(test.contextPath) {
-		test.Init_Parties_Fresh(4, 0, 2)
+		test.Init_Parties_Fresh(test.cipher, test.numRound, test.paramIndex, test.radix)
 	} else {
 		test.Init_Parties_from_File()
 	}
+	test.shared.SetLogger(NewTeeLogger(test.shared.GetLogger(), test.metrics))
+	gallery, err := OpenGalleryStore(test.EncryptedTemplateDir, "0")
+	if err != nil {
+		panic(err)
+	}
+	test.gallery = gallery
 
 }
-func (test *d_testing) Init_Parties_Fresh(numRound int, paramIndex int, radix int) {
+func (test *d_testing) Init_Parties_Fresh(cipher int, numRound int, paramIndex int, radix int) {
+	var err error
 	fmt.Println("Init Parties and save to file: ")
 	fmt.Println("\nInit shared With Params")
-	test.shared = Init(numRound, paramIndex, radix, true)
+	if test.shared, err = InitWithCipher(cipher, numRound, paramIndex, radix, test.fullCoeffs); err != nil {
+		panic(err)
+	}
 	fmt.Println("\nInit Authentication Server")
-	test.serverAuth = NewServerAuth(test.shared)
+	if test.serverAuth, err = NewServerAuth(test.shared); err != nil {
+		panic(err)
+	}
 	fmt.Println("\nInit Computation Server")
-	test.serverComp = NewServerComp(test.shared)
+	if test.serverComp, err = NewServerComp(test.shared); err != nil {
+		panic(err)
+	}
 	fmt.Println("\nInit Client")
-	test.client = NewClient(test.shared)
+	if test.client, err = NewClient(test.shared); err != nil {
+		panic(err)
+	}
 	Print_context(test.shared)
-	SaveContext(test.contextPath, test.shared, test.serverAuth)
+	if err = SaveContext(test.contextPath, test.shared, test.serverAuth); err != nil {
+		panic(err)
+	}
 
 }
 func (test *d_testing) Init_Parties_from_File() {
-	context := DeserializeContextFC(test.contextPath)
+	context, err := DeserializeContext(test.contextPath)
+	if err != nil {
+		panic(err)
+	}
 	context.PrintContext()
-	numRound, paramIndex, radix, fullCoeffs, nonces := context.GetSharedParameters()
-	fmt.Println("\nInit shared")
-	test.shared = Init(numRound, paramIndex, radix, fullCoeffs)
-
-	test.shared.SetNonces(nonces)
-	fmt.Println("\nInit Authentication Server")
-	test.serverAuth = NewServerAuthFromContextFC(test.shared, context)
-	fmt.Println("\nInit Computation Server")
-	test.serverComp = NewServerComp(test.shared)
-	fmt.Println("\nInit Client")
-	test.client = NewClient(test.shared)
+	test.shared, test.serverAuth, test.serverComp, test.client, err = LoadPartiesFromContext(context)
+	if err != nil {
+		panic(err)
+	}
 	Print_context(test.shared)
 }
 func (test *d_testing) GetInstructions() []*TemplateInstruction {
+	return test.config.Instructions()
+}
 
-	irisInstruction := NewIrisValentinaTemplateInstruction(0)
-	fingerInstruction := NewFingerValentinaTemplateInstruction(irisInstruction.TemplateLength)
-	instructions := []*TemplateInstruction{irisInstruction, fingerInstruction}
-	return instructions
+// galleryMetadata returns the modalities and their message lengths stored with every reference
+func (test *d_testing) galleryMetadata() ([]string, []int) {
+	modalities := test.config.ModalityNames()
+	lengths := make([]int, 0, len(modalities))
+	for _, ins := range test.GetInstructions() {
+		lengths = append(lengths, ins.MessageLength())
+	}
+	return modalities, lengths
 }
 func (test *d_testing) TranscipherMap() {
+	modalities, lengths := test.galleryMetadata()
 	for k, v := range test.subjectMap {
-		AddSubjectFolder(test.EncryptedTemplateDir, k)
 		for i, m := range v {
-			t := ProbePath(test.EncryptedTemplateDir, k, m.GetName())
-			if FileOrFolderExists(t) {
+			if _, err := test.gallery.Record(k, m.GetName()); err == nil {
 				continue
 			}
 
 			sym_key := test.client.GenerateRandomKey()
-			sym_ct, he_key := test.client.EncryptMultipleTemplates(m.GetTemplates(), sym_key, 1, test.shared.GetMessagesSize())
-			transciphered, sym_time, he_time := test.serverComp.TranscipherFirstMessageTimings(sym_ct, he_key)
-			log.Printf("%v; %v;  %v", m.GetName(), sym_time, he_time)
-			sct := NewSingleCiphertextSerialized("0", transciphered)
-			SerializeCiphertext(sct, t)
+			sym_ct, he_key, nonces := test.client.EncryptMultipleTemplatesWithNonces(m.GetTemplates(), sym_key, 1, test.shared.GetMessagesSize())
+			start := time.Now()
+			transciphered, err := test.serverComp.TranscipherFirstMessageWithNonces(sym_ct, he_key, nonces)
+			if err != nil {
+				log.Printf("%v - not transciphered: %v", m.GetName(), err)
+				continue
+			}
+			log.Printf("%v; %v", m.GetName(), time.Since(start).Seconds())
+			if _, err := test.gallery.Put(k, m.GetName(), modalities, lengths, transciphered); err != nil {
+				log.Printf("%v - not saved: %v", m.GetName(), err)
+				continue
+			}
 			log.Printf("%v - saved: %v", m.GetName(), i)
 
 		}
 	}
 }
 func (test *d_testing) MapTemplates(start int) {
-	allSubjectIds := GetAllSubjectIDsFromFolder(test.PlainTemplateDir)
+	allSubjectIds, err := GetAllSubjectIDsFromFolder(test.PlainTemplateDir)
+	if err != nil {
+		panic(err)
+	}
 	instructions := test.GetInstructions()
+	modalities := test.config.Modalities
 	for i := start; i < len(allSubjectIds); i++ {
 
 		//for i := start; i < len(allSubjectIds); i++ {
 		//println(allSubjectIds[i])
-		subFolder := GetAllFileFromSubFolder(test.PlainTemplateDir, allSubjectIds[i])
-		irisTemplates := GetAllFileFromFolder(subFolder[0])
-		fingerTemplates := GetAllFileFromFolder(subFolder[1])
+		subFolder, err := GetAllFileFromSubFolder(test.PlainTemplateDir, allSubjectIds[i])
+		if err != nil || len(subFolder) < len(modalities) {
+			log.Printf("%v - skipped: no folder for each of %v: %v", allSubjectIds[i], test.config.ModalityNames(), err)
+			continue
+		}
+		files := make([][]string, len(modalities))
+		samples := -1
+		for k := range modalities {
+			if files[k], err = GetAllFileFromFolder(subFolder[k]); err != nil {
+				panic(err)
+			}
+			if samples < 0 || len(files[k]) < samples {
+				samples = len(files[k])
+			}
+		}
 		multiTemplates := make([]MultiTemplate, 0)
-		for j, iris := range irisTemplates {
-			irisT := NewTemplate(iris)
-			fingerT := NewTemplate(fingerTemplates[j], true)
-			templates := []Template{irisT, fingerT}
+	samples:
+		for j := 0; j < samples; j++ {
+			templates := make([]Template, len(modalities))
+			for k, m := range modalities {
+				if templates[k], err = m.ReadTemplate(files[k][j]); err != nil {
+					log.Printf("%v - skipped: %v", files[k][j], err)
+					continue samples
+				}
+			}
 			combined := NewMultiTemplate(templates, instructions, allSubjectIds[i])
 			multiTemplates = append(multiTemplates, combined)
 		}
@@ -144,44 +227,54 @@ func (test *d_testing) MapTemplates(start int) {
 	print("Mapped")
 }
 func (test *d_testing) ReadCiphertexts() {
-	allSubjectIds := GetAllSubjectIDsFromFolder(test.EncryptedTemplateDir)
+	allSubjectIds := test.gallery.SubjectIDs()
 	instructions := test.GetInstructions()
 	for i := 0; i < 3; i++ {
 		//for i := start; i < len(allSubjectIds); i++ {
 		//println(allSubjectIds[i])
-		probe := GetAllFileFromSubFolder(test.EncryptedTemplateDir, allSubjectIds[i])
-		fmt.Println("Read probe: ", probe[0])
-		temp0cs := DeserializeCiphertext(probe[0])
-		temp0 := temp0cs.ConvertToRegularCiphertext()[0]
-		temp1cs := DeserializeCiphertext(probe[1])
-		temp1 := temp1cs.ConvertToRegularCiphertext()[0]
-		dist := test.serverComp.ProcessTemplateInstructionsSingleCT(instructions, temp0, temp1)
+		records := test.gallery.ListSubject(allSubjectIds[i])
+		fmt.Println("Read probe: ", records[0].TemplateID)
+		temp0, _, err := test.gallery.Get(allSubjectIds[i], records[0].TemplateID)
+		if err != nil {
+			panic(err)
+		}
+		temp1, _, err := test.gallery.Get(allSubjectIds[i], records[1].TemplateID)
+		if err != nil {
+			panic(err)
+		}
+		dist, err := test.fusedDistance(instructions, temp0, temp1)
+		if err != nil {
+			panic(err)
+		}
 		dec := test.serverAuth.DecryptMessage(dist)
 		fmt.Println("Distance: ", real(dec[0]))
 	}
 }
 
+// fusedDistance returns the fused distance of the templates in slot 0
+func (test *d_testing) fusedDistance(instructions []*TemplateInstruction, reference *Ciphertext, probe *Ciphertext) (*Ciphertext, error) {
+	scores, err := test.serverComp.ProcessTemplateInstructionsSingleCT(instructions, probe, reference)
+	if err != nil {
+		return nil, err
+	}
+	return test.serverComp.FuseDistances(instructions, scores)
+}
+
 func (test *d_testing) SetCiphertexts(subjectId string) {
 	multiTemplates := test.subjectMap[subjectId]
 	for _, m := range multiTemplates {
-		encPath := ProbePath(test.EncryptedTemplateDir, subjectId, m.GetName())
-		if !FileOrFolderExists(encPath) {
-
-			continue
-		}
-		temp0cs := DeserializeCiphertext(encPath)
-		temp0 := temp0cs.ConvertToRegularCiphertext()[0]
-		m.SetCiphertext(temp0)
+		test.SetCiphertext(m)
 	}
 }
 
 func (test *d_testing) SetCiphertext(subject MultiTemplate) {
-	encPath := ProbePath(test.EncryptedTemplateDir, subject.GetSubjectID(), subject.GetName())
-	if !FileOrFolderExists(encPath) {
+	temp0, _, err := test.gallery.Get(subject.GetSubjectID(), subject.GetName())
+	if err != nil {
+		if !errors.Is(err, ErrRecordNotFound) {
+			log.Println(err)
+		}
 		return
 	}
-	temp0cs := DeserializeCiphertext(encPath)
-	temp0 := temp0cs.ConvertToRegularCiphertext()[0]
 	subject.SetCiphertext(temp0)
 }
 
@@ -211,13 +304,16 @@ func (test *d_testing) MatedComparisonOneSubject(subjectId string) {
 				continue
 			}
 			start := time.Now()
-			distance_ct := test.serverComp.ProcessTemplateInstructionsSingleCT(instructions, ref_ct, probe_ct)
+			distance_ct, err := test.fusedDistance(instructions, ref_ct, probe_ct)
+			if err != nil {
+				log.Println(err)
+				continue
+			}
 			compute_time := time.Since(start).Seconds()
 			start = time.Now()
 			dec := test.serverAuth.DecryptMessage(distance_ct)
 			//Print_decrypted_message(dec)
-			distance_pt := real(dec[0]) + (real(dec[instructions[1].Index]) * 2)
-			//println("[0]:", real(dec[0]), "[", instructions[1].Index, "]:", real(dec[instructions[1].Index])*2, " sum:", distance_pt)
+			distance_pt := real(dec[0])
 			decrypt_time := time.Since(start).Seconds()
 			distance_clear := probe.Distance(reference)
 			//println("clear ", distance_clear)
@@ -226,7 +322,9 @@ func (test *d_testing) MatedComparisonOneSubject(subjectId string) {
 			log.Printf("mated: %v - %v; %v; %v; %v, %v", probe.GetName(), reference.GetName(), distance_pt, distance_clear, compute_time, decrypt_time)
 		}
 	}
-	WriteResultsToFile(mated_path, results_ct, results_pt)
+	if err := WriteResultsToFile(mated_path, results_ct, results_pt); err != nil {
+		log.Println(err)
+	}
 }
 
 func (test *d_testing) NonMatedComparisonOneSubject(probe MultiTemplate, others []MultiTemplate) {
@@ -254,13 +352,16 @@ func (test *d_testing) NonMatedComparisonOneSubject(probe MultiTemplate, others
 			continue
 		}
 		start := time.Now()
-		distance_ct := test.serverComp.ProcessTemplateInstructionsSingleCT(instructions, ref_ct, probe_ct)
+		distance_ct, err := test.fusedDistance(instructions, ref_ct, probe_ct)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
 		compute_time := time.Since(start).Seconds()
 		start = time.Now()
 		dec := test.serverAuth.DecryptMessage(distance_ct)
 		//Print_decrypted_message(dec)
-		distance_pt := real(dec[0]) + (real(dec[instructions[1].Index]) * 2)
-		//println("[0]:", real(dec[0]), "[", instructions[1].Index, "]:", real(dec[instructions[1].Index])*2, " sum:", distance_pt)
+		distance_pt := real(dec[0])
 		decrypt_time := time.Since(start).Seconds()
 		distance_clear := probe.Distance(reference)
 		//println("clear ", distance_clear)
@@ -269,24 +370,34 @@ func (test *d_testing) NonMatedComparisonOneSubject(probe MultiTemplate, others
 		log.Printf("mated: %v - %v; %v; %v; %v, %v", probe.GetName(), reference.GetName(), distance_pt, distance_clear, compute_time, decrypt_time)
 	}
 
-	WriteResultsToFile(nonmated_path, results_ct, results_pt)
+	if err := WriteResultsToFile(nonmated_path, results_ct, results_pt); err != nil {
+		log.Println(err)
+	}
 }
 func (test *d_testing) writeTimingLog(iterations int) {
 	it := 0
-	for k, v := range test.subjectMap {
-		AddSubjectFolder(test.EncryptedTemplateDir, k)
+	for _, v := range test.subjectMap {
 		for _, m := range v {
 			if it == iterations {
 				break
 			}
 			sym_key := test.client.GenerateRandomKey()
-			sym_ct, he_key, s_t, h_t := test.client.EncryptMultipleTemplatesTiming(m.GetTemplates(), sym_key, 1, test.shared.GetMessagesSize())
-			_, sym_time, he_time := test.serverComp.TranscipherFirstMessageTimings(sym_ct, he_key)
-			trans_t := sym_time + he_time
+			test.metrics.Reset()
+			sym_ct, he_key, nonces := test.client.EncryptMultipleTemplatesWithNonces(m.GetTemplates(), sym_key, 1, test.shared.GetMessagesSize())
+			s_t := test.metrics.Stage(StageSymEncrypt).Sum.Seconds()
+			h_t := test.metrics.Stage(StageKeyEncrypt).Sum.Seconds()
 			start := time.Now()
+			if _, err := test.serverComp.TranscipherFirstMessageWithNonces(sym_ct, he_key, nonces); err != nil {
+				panic(err)
+			}
+			trans_t := time.Since(start).Seconds()
+			start = time.Now()
 			test.serverComp.EncryptProbeDirectlySingleCiphertext(ConnectTemplates(m.GetTemplates()))
 			direct := time.Since(start).Seconds()
 			log.Printf("%v; %v;  %v; %v", s_t, h_t, trans_t, direct)
+			if err := test.metrics.WritePrometheus(log.Writer()); err != nil {
+				log.Println(err)
+			}
 			it++
 		}
 	}
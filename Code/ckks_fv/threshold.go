@@ -0,0 +1,109 @@
+package ckks_fv
+
+import (
+	"math"
+	"math/bits"
+)
+
+// SignApproximation configures the approximation of the step function [u < t] for u in [-1, 1].
+// A Chebyshev interpolation of tanh(Steepness*(t-u)) approximates the sign and every
+// iteration of (3x - x^3)/2 sharpens it towards +-1, the result is mapped to {0, 1}.
+type SignApproximation struct {
+	Steepness   float64
+	ChebyDegree int
+	Iterations  int
+}
+
+// NewSignApproximation returns the default SignApproximation
+func NewSignApproximation() SignApproximation {
+	return SignApproximation{
+		Steepness:   8,
+		ChebyDegree: 15,
+		Iterations:  2,
+	}
+}
+
+// chebyshev returns the interpolation of the first approximation of [u < t] on [-1, 1].
+// Without sharpening iterations it already includes the mapping from sign to {0, 1}.
+func (approx SignApproximation) chebyshev(t float64) *ChebyshevInterpolation {
+	k := approx.Steepness
+	last := approx.Iterations == 0
+	return Approximate(func(u complex128) complex128 {
+		s := math.Tanh(k * (t - real(u)))
+		if last {
+			s = (s + 1) / 2
+		}
+		return complex(s, 0)
+	}, -1, 1, approx.ChebyDegree)
+}
+
+// sharpening returns (3x - x^3)/2, the last iteration also maps the sign from {-1, 1} to {0, 1}
+func (approx SignApproximation) sharpening(last bool) *Poly {
+	if last {
+		return NewPoly([]complex128{0.5, 0.75, 0, -0.25})
+	}
+	return NewPoly([]complex128{0, 1.5, 0, -0.5})
+}
+
+// polyLevels returns the number of levels consumed by the evaluation of a polynomial of the given degree
+func polyLevels(degree int) int {
+	return bits.Len(uint(degree))
+}
+
+// ThresholdParameters configure the encrypted comparison of a fused distance against a threshold.
+// The distance is mapped to u = 2*d/MaxDistance - 1 before the sign approximation.
+// The result is near 1 for accepted comparisons (d < Threshold) and near 0 otherwise.
+type ThresholdParameters struct {
+	Threshold   float64
+	MaxDistance float64
+	SignApproximation
+}
+
+// NewThresholdParameters returns ThresholdParameters with default approximation settings
+func NewThresholdParameters(threshold float64, maxDistance float64) *ThresholdParameters {
+	return &ThresholdParameters{
+		Threshold:         threshold,
+		MaxDistance:       maxDistance,
+		SignApproximation: NewSignApproximation(),
+	}
+}
+
+func (thresholdParams *ThresholdParameters) normalizedThreshold() float64 {
+	return 2*thresholdParams.Threshold/thresholdParams.MaxDistance - 1
+}
+
+// EvaluatePlain returns the decision the encrypted evaluation approximates
+func (thresholdParams *ThresholdParameters) EvaluatePlain(distance float64) float64 {
+	if distance < thresholdParams.Threshold {
+		return 1
+	}
+	return 0
+}
+
+// ArgminParameters configure the encrypted search for the best match in a gallery.
+// Distances are divided by MaxDistance, so they must not exceed it.
+// If Threshold is set, the smallest distance is also compared against it.
+type ArgminParameters struct {
+	MaxDistance float64
+	Comparison  SignApproximation
+	Threshold   *ThresholdParameters
+}
+
+// NewArgminParameters returns ArgminParameters with default comparisons and without threshold
+func NewArgminParameters(maxDistance float64) *ArgminParameters {
+	comparison := NewSignApproximation()
+	comparison.Steepness = 12
+	comparison.ChebyDegree = 31
+	return &ArgminParameters{
+		MaxDistance: maxDistance,
+		Comparison:  comparison,
+	}
+}
+
+// normalizedThreshold returns the threshold for distances that are already divided by MaxDistance
+func (argminParams *ArgminParameters) normalizedThreshold() *ThresholdParameters {
+	thresholdParams := *argminParams.Threshold
+	thresholdParams.Threshold /= argminParams.MaxDistance
+	thresholdParams.MaxDistance /= argminParams.MaxDistance
+	return &thresholdParams
+}
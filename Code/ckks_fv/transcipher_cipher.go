@@ -0,0 +1,101 @@
+package ckks_fv
+
+import (
+	"fmt"
+
+	"github.com/ldsec/lattigo/v2/plaincipher"
+)
+
+// TranscipherCipher is a symmetric cipher that can be evaluated homomorphically in the RtF framework.
+// It covers the plaintext keystream used by the client and the FV evaluation used by the computation server.
+type TranscipherCipher interface {
+	// BlockSize returns the state size, which is also the length of the symmetric key
+	BlockSize() int
+	// OutputSize returns the number of keystream words per block
+	OutputSize() int
+	// KeyStream computes one keystream block in the clear, counter is ignored by ciphers without counter
+	KeyStream(nonce []byte, counter []byte, key []uint64) []uint64
+	// EncKey encrypts the symmetric key under FV
+	EncKey(key []uint64) []*Ciphertext
+	// Crypt evaluates the keystream under FV with modulus switching as given in modDown. Every call starts from the
+	// initial states, so the same kCt can be used for any number of nonces.
+	Crypt(nonces [][]byte, counter []byte, kCt []*Ciphertext, modDown []int) []*Ciphertext
+	// CryptAutoModSwitch evaluates the keystream under FV and returns the modDown schedule it found
+	CryptAutoModSwitch(nonces [][]byte, counter []byte, kCt []*Ciphertext, noiseEstimator MFVNoiseEstimator) ([]*Ciphertext, []int)
+	// Reset re-encrypts the initial states with fresh randomness and switches them down by nbInitModDown
+	Reset(nbInitModDown int)
+	// SetEvaluators evaluates the state words concurrently, one goroutine per evaluator
+	SetEvaluators(evaluators []MFVEvaluator)
+}
+
+// NewTranscipherCipher returns the cipher selected in shared, set up with its FV encoder, encryptor and evaluator
+func NewTranscipherCipher(shared Shared) TranscipherCipher {
+	params := shared.GetParams()
+	switch shared.GetCipher() {
+	case HERA:
+		return NewHeraCipher(shared.GetNumRounds(), params, shared.GetFvEncoder(), shared.GetFvEncryptor(), shared.GetFvEvaluator(), shared.GetHeraModDown()[0])
+	case RUBATO:
+		return NewRubatoCipher(shared.GetParamIndex(), params, shared.GetFvEncoder(), shared.GetFvEncryptor(), shared.GetFvEvaluator(), shared.GetHeraModDown()[0])
+	default:
+		panic(fmt.Sprintf("unknown cipher %d", shared.GetCipher()))
+	}
+}
+
+type heraCipher struct {
+	MFVHera
+	plain plaincipher.Cipher
+}
+
+// NewHeraCipher returns HERA as a TranscipherCipher
+func NewHeraCipher(numRound int, params *Parameters, encoder MFVEncoder, encryptor MFVEncryptor, evaluator MFVEvaluator, nbInitModDown int) TranscipherCipher {
+	hera := new(heraCipher)
+	hera.MFVHera = NewMFVHera(numRound, params, encoder, encryptor, evaluator, nbInitModDown)
+	hera.plain = plaincipher.NewHera(plaincipher.HeraParam{NumRound: numRound, PlainModulus: params.PlainModulus()})
+	return hera
+}
+
+func (hera *heraCipher) BlockSize() int {
+	return 16
+}
+
+func (hera *heraCipher) OutputSize() int {
+	return 16
+}
+
+func (hera *heraCipher) KeyStream(nonce []byte, counter []byte, key []uint64) []uint64 {
+	return hera.plain.KeyStream(nonce, counter, key)
+}
+
+func (hera *heraCipher) Crypt(nonces [][]byte, counter []byte, kCt []*Ciphertext, modDown []int) []*Ciphertext {
+	return hera.MFVHera.Crypt(nonces, kCt, modDown)
+}
+
+func (hera *heraCipher) CryptAutoModSwitch(nonces [][]byte, counter []byte, kCt []*Ciphertext, noiseEstimator MFVNoiseEstimator) ([]*Ciphertext, []int) {
+	return hera.MFVHera.CryptAutoModSwitch(nonces, kCt, noiseEstimator)
+}
+
+type rubatoCipher struct {
+	MFVRubato
+	plain plaincipher.Rubato
+}
+
+// NewRubatoCipher returns Rubato with the parameter rubatoParam (RUBATO80S, ..., RUBATO128L) as a TranscipherCipher.
+// The plaintext keystream includes the Gaussian noise of the Rubato parameter.
+func NewRubatoCipher(rubatoParam int, params *Parameters, encoder MFVEncoder, encryptor MFVEncryptor, evaluator MFVEvaluator, nbInitModDown int) TranscipherCipher {
+	rubato := new(rubatoCipher)
+	rubato.MFVRubato = NewMFVRubato(rubatoParam, params, encoder, encryptor, evaluator, nbInitModDown)
+	rubato.plain = plaincipher.NewRubato(RubatoParams[rubatoParam])
+	return rubato
+}
+
+func (rubato *rubatoCipher) BlockSize() int {
+	return rubato.plain.BlockSize()
+}
+
+func (rubato *rubatoCipher) OutputSize() int {
+	return rubato.plain.OutputSize()
+}
+
+func (rubato *rubatoCipher) KeyStream(nonce []byte, counter []byte, key []uint64) []uint64 {
+	return rubato.plain.KeyStream(nonce, counter, key)
+}
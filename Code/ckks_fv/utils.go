@@ -5,41 +5,18 @@ import (
 	"io"
 	"math"
 	"math/big"
-	"math/bits"
 	"os"
 	"path"
 	"sort"
 	"strings"
 
+	"github.com/ldsec/lattigo/v2/plaincipher"
 	"github.com/ldsec/lattigo/v2/ring"
 )
 
-// Returns uniform random value in (0,q) by rejection sampling
+// SampleZqx returns a uniform random value in [0, q) by rejection sampling, see plaincipher.SampleZqx
 func SampleZqx(rand io.Reader, q uint64) (res uint64) {
-	bitLen := bits.Len64(q - 2)
-	byteLen := (bitLen + 7) / 8
-	b := bitLen % 8
-	if b == 0 {
-		b = 8
-	}
-
-	bytes := make([]byte, byteLen)
-	for {
-		_, err := io.ReadFull(rand, bytes)
-		if err != nil {
-			panic(err)
-		}
-		bytes[byteLen-1] &= uint8((1 << b) - 1)
-
-		res = 0
-		for i := 0; i < byteLen; i++ {
-			res += uint64(bytes[i]) << (8 * i)
-		}
-
-		if res < q {
-			return
-		}
-	}
+	return plaincipher.SampleZqx(rand, q)
 }
 
 // StandardDeviation computes the scaled standard deviation of the input vector.
@@ -308,39 +285,53 @@ func Print_decrypted_template_fullCoeffs_WithCompare(dec []complex128, template
 	fmt.Print("\n")
 }
 
-func SaveContext(contextPath string, shared Shared, serverAuth ServerAuth) {
+// SaveContext saves the parameters, nonces, keys and precomputed matrices of the parties to contextPath,
+// LoadPartiesFromContext restores the parties from it without generating keys
+func SaveContext(contextPath string, shared Shared, serverAuth ServerAuth) error {
 	fmt.Println("******************************")
 	fmt.Println("   Context Serialization")
 	fmt.Println("******************************")
 
 	fmt.Println("Context Path: ", contextPath)
 
-	if shared.GetFullCoeffs() {
-		ctx := serverAuth.GetSaveContextFC()
-		SerializeContextFC(ctx, contextPath)
-		fromFile := DeserializeContextFC(contextPath)
-		ctx.PrintContext()
-		fmt.Println("Context From File:")
-		fromFile.PrintContext()
-	} else {
-		ctx := serverAuth.GetSaveContext()
-		SerializeContext(ctx, contextPath)
-		fromFile := DeserializeContext(contextPath)
-		ctx.PrintContext()
-		fmt.Println("Context From File:")
-		fromFile.PrintContext()
-
-		_, Rotkeys, _, BootKeys := shared.GetAllPublicKeys()
-		SerializeBootstrapKeys(BootKeys, "./bootKeys.gob")
-		bootFromFile := DeserializeBootstrappingKeys("./bootKeys.gob")
-		fmt.Println("Bootkeys From File:")
-		fmt.Println(bootFromFile)
-		SerializeRotationKeys(Rotkeys, "./rotkeys.gob")
-		rotfromFile := DeserializeRotationKeys("./rotkeys.gob")
-		fmt.Println("RotKeys From File:")
-		println(rotfromFile)
+	ctx := serverAuth.GetSaveContext()
+	if err := SerializeContext(ctx, contextPath); err != nil {
+		return err
+	}
+	fromFile, err := DeserializeContext(contextPath)
+	if err != nil {
+		return err
 	}
+	ctx.PrintContext()
+	fmt.Println("Context From File:")
+	fromFile.PrintContext()
+	return nil
+}
 
+// LoadPartiesFromContext restores the parties of a context saved by SaveContext.
+// Keys and matrices missing in contexts of older versions are generated.
+func LoadPartiesFromContext(context SaveFile) (Shared, ServerAuth, ServerComp, Client, error) {
+	fmt.Println("\nInit shared")
+	shared, err := Init_From_Context(context)
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+	fmt.Println("\nInit Authentication Server")
+	serverAuth, err := NewServerAuthFromSavedContext(shared, context)
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+	fmt.Println("\nInit Computation Server")
+	serverComp, err := NewServerComp(shared)
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+	fmt.Println("\nInit Client")
+	client, err := NewClient(shared)
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+	return shared, serverAuth, serverComp, client, nil
 }
 
 func FileOrFolderExists(path string) bool {
@@ -350,56 +341,55 @@ func FileOrFolderExists(path string) bool {
 	return true
 }
 
-func GetAllFileFromFolder(folder string) []string {
+// readDirNames returns the names of the entries of folder
+func readDirNames(folder string) ([]string, error) {
 	dir, err := os.Open(folder)
 	if err != nil {
-		panic(err)
+		return nil, fileError("open", folder, err)
 	}
 	defer dir.Close()
-	names, _ := dir.Readdirnames(0)
-	for i, name := range names {
-		names[i] = path.Join(dir.Name(), name)
+	names, err := dir.Readdirnames(0)
+	if err != nil {
+		return nil, fileError("read", folder, err)
 	}
-
-	return names
+	return names, nil
 }
-func GetAllFileFromSubFolder(folder string, subFolder string) []string {
-	folder = path.Join(folder, subFolder)
-	dir, err := os.Open(folder)
+
+func GetAllFileFromFolder(folder string) ([]string, error) {
+	names, err := readDirNames(folder)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
-	defer dir.Close()
-	names, _ := dir.Readdirnames(0)
 	for i, name := range names {
-		names[i] = path.Join(dir.Name(), name)
+		names[i] = path.Join(folder, name)
 	}
 
-	return names
+	return names, nil
+}
+func GetAllFileFromSubFolder(folder string, subFolder string) ([]string, error) {
+	return GetAllFileFromFolder(path.Join(folder, subFolder))
 }
 
-func GetAllSubjectIDsFromFolder(folder string) []string {
-	dir, err := os.Open(folder)
+func GetAllSubjectIDsFromFolder(folder string) ([]string, error) {
+	names, err := readDirNames(folder)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
-	defer dir.Close()
-	names, _ := dir.Readdirnames(0)
 	sort.Strings(names)
-	return names
+	return names, nil
 }
 
-func AddSubjectFolder(folder string, subject string) {
+func AddSubjectFolder(folder string, subject string) error {
 	folder = path.Join(folder, subject)
 	if FileOrFolderExists(folder) {
-		return
+		return nil
 	}
-	os.Mkdir(folder, os.ModePerm)
+	return fileError("create", folder, os.Mkdir(folder, os.ModePerm))
 }
 func ConnectTemplates(templates []Template) []float64 {
 	data := make([]float64, 0)
 	for _, template := range templates {
-		data = append(data, template.GetData()...)
+		data = append(data, template.GetMessage()...)
 	}
 	return data
 }
@@ -420,21 +410,24 @@ func NonMatedPath(encryptedFolder string, subject string) string {
 	return path.Join(encryptedFolder, x)
 }
 
-func WriteResultsToFile(path string, encrypted []float64, plain []float64) {
+func WriteResultsToFile(path string, encrypted []float64, plain []float64) error {
 	f, err := os.Create(path)
 	if err != nil {
-		fmt.Println(err)
+		return fileError("create", path, err)
 	}
-	// remember to close the file
-	defer f.Close()
 
 	for i, e := range encrypted {
 		line := fmt.Sprintf("%6.9f;%6.9f\n", e, plain[i])
-		_, err := f.WriteString(line)
-		if err != nil {
-			fmt.Println(err)
+		if _, err = f.WriteString(line); err != nil {
+			break
 		}
 	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fileError("write", path, err)
+	}
 	fmt.Println("Added Comparison file: ", path)
-
+	return nil
 }
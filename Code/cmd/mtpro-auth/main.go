@@ -0,0 +1,96 @@
+// Command mtpro-auth runs the authentication server of MT-Pro. It holds the secret key, exports the evaluation
+// bundle for the computation server and the client bundle for the clients, and decrypts the comparison results.
+// The evaluation keys are generated and exported only if the evaluation bundle is missing, on later starts they
+// are restored from it.
+// The computation server authenticates with the token in the token file, which is generated if missing.
+// The durations of the pipeline stages are served at /metrics.
+package main
+
+import (
+	"errors"
+	"flag"
+	"log"
+	"net/http"
+	"path/filepath"
+
+	"github.com/ldsec/lattigo/v2/ckks_fv"
+)
+
+func main() {
+	addr := flag.String("addr", ":8443", "listen address")
+	bundlePath := flag.String("bundle", "auth.bundle", "auth bundle, generated with new keys if missing")
+	exportDir := flag.String("export", ".", "folder the evaluation and client bundles are written to")
+	contextID := flag.String("context", "0", "context ID written to new bundles")
+	cipher := flag.Int("cipher", ckks_fv.HERA, "cipher of new keys, 0 for HERA and 1 for Rubato")
+	numRound := flag.Int("rounds", 4, "HERA rounds of new keys")
+	paramIndex := flag.Int("param", 0, "parameter index of new keys")
+	radix := flag.Int("radix", 2, "SlotsToCoeffs radix of new keys")
+	tokenPath := flag.String("token", "service.token", "token file shared with the computation server, generated if missing")
+	flag.Parse()
+
+	var shared ckks_fv.Shared
+	var server ckks_fv.ServerAuth
+	evaluationPath := filepath.Join(*exportDir, "evaluation.bundle")
+	exportEvaluation := false
+	bundle, err := ckks_fv.LoadAuthBundle(*bundlePath)
+	switch {
+	case err == nil:
+		evaluation, err := ckks_fv.LoadEvaluationBundle(evaluationPath)
+		switch {
+		case errors.Is(err, ckks_fv.ErrMissingFile):
+			log.Printf("%s not found, generating the evaluation keys", evaluationPath)
+			exportEvaluation = true
+		case err != nil:
+			log.Fatal(err)
+		}
+		if server, shared, err = ckks_fv.NewServerAuthFromBundle(bundle, evaluation); err != nil {
+			log.Fatal(err)
+		}
+	case errors.Is(err, ckks_fv.ErrMissingFile):
+		log.Printf("%s not found, generating new keys", *bundlePath)
+		if shared, err = ckks_fv.InitWithCipher(*cipher, *numRound, *paramIndex, *radix, true); err != nil {
+			log.Fatal(err)
+		}
+		if server, err = ckks_fv.NewServerAuth(shared); err != nil {
+			log.Fatal(err)
+		}
+		if err = ckks_fv.SerializeKeyBundle(server.GetAuthBundle(*contextID), *bundlePath); err != nil {
+			log.Fatal(err)
+		}
+		exportEvaluation = true
+	default:
+		log.Fatal(err)
+	}
+	if bundle != nil {
+		*contextID = bundle.ContextID
+	}
+	metrics := ckks_fv.NewMetrics()
+	server.SetLogger(ckks_fv.NewTeeLogger(shared.GetLogger(), metrics))
+
+	if exportEvaluation {
+		evaluation, err := server.GetEvaluationBundle(*contextID)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err = ckks_fv.SerializeKeyBundle(evaluation, evaluationPath); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if err = ckks_fv.SerializeKeyBundle(server.GetClientBundle(*contextID), filepath.Join(*exportDir, "client.bundle")); err != nil {
+		log.Fatal(err)
+	}
+
+	token, err := ckks_fv.LoadServiceToken(*tokenPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	handler, err := ckks_fv.NewAuthService(shared, server, token)
+	if err != nil {
+		log.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/", handler)
+	mux.Handle(ckks_fv.RouteMetrics, metrics)
+	log.Printf("authentication server of context %s listening on %s", *contextID, *addr)
+	log.Fatal(http.ListenAndServe(*addr, mux))
+}
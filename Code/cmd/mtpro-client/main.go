@@ -0,0 +1,148 @@
+// Command mtpro-client enrols, verifies and identifies templates against the MT-Pro servers.
+//
+//	mtpro-client [flags] enrol <subject ID> <template ID> <template files...>
+//	mtpro-client [flags] verify <subject ID> <template ID> <template files...>
+//	mtpro-client [flags] identify <template ID> <template files...>
+//	mtpro-client -keys <key store> rotate-key
+//
+// The templates are read with NewTemplate, in the order of the template instructions of the computation server.
+// With -keys, the templates are encrypted under the current key of the key store, which is registered once at the
+// computation server, instead of under a fresh key.
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/ldsec/lattigo/v2/ckks_fv"
+)
+
+func readTemplates(paths []string) []ckks_fv.Template {
+	templates := make([]ckks_fv.Template, len(paths))
+	for i, path := range paths {
+		template, err := ckks_fv.NewTemplate(path)
+		if err != nil {
+			log.Fatal(err)
+		}
+		templates[i] = template
+	}
+	return templates
+}
+
+func usage() {
+	fmt.Fprintf(flag.CommandLine.Output(), "usage: %s [flags] enrol|verify <subject ID> <template ID> <templates...>\n", os.Args[0])
+	fmt.Fprintf(flag.CommandLine.Output(), "       %s [flags] identify <template ID> <templates...>\n", os.Args[0])
+	fmt.Fprintf(flag.CommandLine.Output(), "       %s -keys <key store> rotate-key\n", os.Args[0])
+	flag.PrintDefaults()
+	os.Exit(2)
+}
+
+func main() {
+	bundlePath := flag.String("bundle", "client.bundle", "client bundle exported by the authentication server")
+	compURL := flag.String("comp", "http://localhost:8444", "URL of the computation server")
+	authURL := flag.String("auth", "http://localhost:8443", "URL of the authentication server")
+	modalities := flag.String("modalities", "iris,finger", "comma separated modalities of the templates")
+	keysPath := flag.String("keys", "", "key store of the symmetric keys, created if missing")
+	precompute := flag.Int("precompute", 0, "keystreams the computation server precomputes when a key is registered")
+	tokenPath := flag.String("token", "client.token", "token file of the computation server")
+	flag.Usage = usage
+	flag.Parse()
+	args := flag.Args()
+	if len(args) == 0 || len(args) < 3 && args[0] != "rotate-key" {
+		usage()
+	}
+
+	bundle, err := ckks_fv.LoadClientBundle(*bundlePath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	client, shared, err := ckks_fv.NewClientFromBundle(bundle)
+	if err != nil {
+		log.Fatal(err)
+	}
+	shared.SetLogger(ckks_fv.NewNopLogger())
+	token, err := ioutil.ReadFile(*tokenPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	service := ckks_fv.NewServiceClient(shared, client, *compURL, *authURL, nil)
+	service.SetToken(strings.TrimSpace(string(token)))
+	if *keysPath == "" {
+		if args[0] == "rotate-key" {
+			usage()
+		}
+		if err = run(service, args, *modalities); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	keys, err := ckks_fv.LoadKeyStore(*keysPath, client)
+	if errors.Is(err, ckks_fv.ErrMissingFile) {
+		keys, err = ckks_fv.NewKeyStore(client), nil
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	service.SetKeyStore(keys)
+	service.SetPrecompute(*precompute)
+	err = run(service, args, *modalities)
+	// the key store is saved even if the command failed, as a key may have been registered
+	if saveErr := keys.Save(*keysPath); saveErr != nil {
+		log.Print(saveErr)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// run executes the command in args
+func run(service ckks_fv.ServiceClient, args []string, modalities string) error {
+	var requestID string
+	var err error
+	switch args[0] {
+	case "rotate-key":
+		key, err := service.RotateKey()
+		if err != nil {
+			return err
+		}
+		fmt.Printf("registered key %s\n", key.ID)
+		return nil
+	case "enrol":
+		if len(args) < 4 {
+			usage()
+		}
+		record, err := service.Enrol(args[1], args[2], strings.Split(modalities, ","), readTemplates(args[3:]))
+		if err != nil {
+			return err
+		}
+		fmt.Printf("enrolled %s/%s at level %d\n", record.SubjectID, record.TemplateID, record.Level)
+		return nil
+	case "verify":
+		if len(args) < 4 {
+			usage()
+		}
+		requestID, err = service.Verify(args[1], args[2], readTemplates(args[3:]))
+	case "identify":
+		requestID, err = service.Identify(args[1], readTemplates(args[2:]))
+	default:
+		usage()
+	}
+	if err != nil {
+		return err
+	}
+	decision, err := service.Decision(requestID)
+	if err != nil {
+		return err
+	}
+	if decision.Kind == ckks_fv.ResultIdentification {
+		fmt.Printf("best match %s, accepted %v\n", decision.SubjectID, decision.Accepted)
+	} else {
+		fmt.Printf("accepted %v\n", decision.Accepted)
+	}
+	return nil
+}
@@ -0,0 +1,95 @@
+// Command mtpro-comp runs the computation server of MT-Pro. It transciphers the templates of the clients,
+// keeps the references in a gallery store and sends the encrypted comparison results to the authentication server.
+// The clients authenticate with the token in the client token file, which is generated if missing.
+// The durations of the pipeline stages are served at /metrics.
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/ldsec/lattigo/v2/ckks_fv"
+)
+
+func main() {
+	addr := flag.String("addr", ":8444", "listen address")
+	bundlePath := flag.String("bundle", "evaluation.bundle", "evaluation bundle exported by the authentication server")
+	galleryDir := flag.String("gallery", "gallery", "folder of the gallery store")
+	authURL := flag.String("auth", "http://localhost:8443", "URL of the authentication server")
+	tokenPath := flag.String("token", "service.token", "token file of the authentication server")
+	clientTokenPath := flag.String("client-token", "client.token", "token file of the clients, generated if missing")
+	threshold := flag.Float64("threshold", 0.5, "threshold of the fused distance")
+	maxDistance := flag.Float64("max-distance", 4, "upper bound of the fused distance")
+	identification := flag.Bool("identification", true, "serve identification requests")
+	keystreams := flag.Int("keystreams", 0, "keystreams precomputed for the registered keys of the clients")
+	concurrency := flag.Int("concurrency", 1, "goroutines evaluating the keystreams and half-bootstraps of a request")
+	configPath := flag.String("config", "", "configuration file of the modalities and thresholds, replaces the threshold flags")
+	flag.Parse()
+
+	bundle, err := ckks_fv.LoadEvaluationBundle(*bundlePath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	server, shared, err := ckks_fv.NewServerCompFromBundle(bundle)
+	if err != nil {
+		log.Fatal(err)
+	}
+	server.SetConcurrency(*concurrency)
+	metrics := ckks_fv.NewMetrics()
+	server.SetLogger(ckks_fv.NewTeeLogger(shared.GetLogger(), metrics))
+	gallery, err := ckks_fv.OpenGalleryStore(*galleryDir, bundle.ContextID)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var config *ckks_fv.CompServiceConfig
+	if *configPath != "" {
+		cfg, err := ckks_fv.LoadConfig(*configPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err = cfg.CheckShared(shared); err != nil {
+			log.Fatal(err)
+		}
+		config = &ckks_fv.CompServiceConfig{
+			Instructions: cfg.Instructions(),
+			Threshold:    cfg.ThresholdParameters(),
+			Argmin:       cfg.ArgminParameters(),
+			AuthURL:      *authURL,
+		}
+	} else {
+		irisInstruction := ckks_fv.NewIrisValentinaTemplateInstruction(0)
+		fingerInstruction := ckks_fv.NewFingerValentinaTemplateInstruction(irisInstruction.TemplateLength).SetWeight(2)
+		config = &ckks_fv.CompServiceConfig{
+			Instructions: []*ckks_fv.TemplateInstruction{irisInstruction, fingerInstruction},
+			Threshold:    ckks_fv.NewThresholdParameters(*threshold, *maxDistance),
+			AuthURL:      *authURL,
+		}
+		if *identification {
+			config.Argmin = ckks_fv.NewArgminParameters(*maxDistance)
+			config.Argmin.Threshold = config.Threshold
+		}
+	}
+	config.Keystreams = *keystreams
+	token, err := ioutil.ReadFile(*tokenPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	config.Token = strings.TrimSpace(string(token))
+	if config.ClientToken, err = ckks_fv.LoadServiceToken(*clientTokenPath); err != nil {
+		log.Fatal(err)
+	}
+	handler, err := ckks_fv.NewCompService(shared, server, gallery, config)
+	if err != nil {
+		log.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/", handler)
+	mux.Handle(ckks_fv.RouteMetrics, metrics)
+
+	log.Printf("computation server of context %s listening on %s", bundle.ContextID, *addr)
+	log.Fatal(http.ListenAndServe(*addr, mux))
+}
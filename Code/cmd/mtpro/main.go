@@ -0,0 +1,315 @@
+// Command mtpro runs all parties of MT-Pro in one process on a context file, for experiments without the services.
+//
+//	mtpro keygen [flags]
+//	mtpro enroll [flags] <subject ID> <template ID> <template files...>
+//	mtpro enroll [flags] -templates <template folder>
+//	mtpro transcipher [flags] -out <ciphertext file> <template files...>
+//	mtpro verify [flags] <subject ID> <template ID> <template files...>
+//	mtpro identify [flags] <template ID> <template files...>
+//	mtpro eval [flags]
+//
+// Template files are given in the order of the modalities of the configuration file passed with -config,
+// without it the default configuration with iris followed by finger is used.
+// The probe of verify and identify can also be read from a file written by transcipher with -probe.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/ldsec/lattigo/v2/ckks_fv"
+)
+
+// loadConfig reads the configuration file, an empty path gives the default configuration
+func loadConfig(path string) *ckks_fv.Config {
+	if path == "" {
+		return ckks_fv.DefaultConfig()
+	}
+	config, err := ckks_fv.LoadConfig(path)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return config
+}
+
+// parties holds the parties restored from the context file
+type parties struct {
+	config     *ckks_fv.Config
+	context    ckks_fv.SaveFile
+	shared     ckks_fv.Shared
+	serverAuth ckks_fv.ServerAuth
+	serverComp ckks_fv.ServerComp
+	client     ckks_fv.Client
+}
+
+func loadParties(contextPath string, configPath string) *parties {
+	context, err := ckks_fv.DeserializeContext(contextPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	p := &parties{config: loadConfig(configPath), context: context}
+	if p.shared, p.serverAuth, p.serverComp, p.client, err = ckks_fv.LoadPartiesFromContext(context); err != nil {
+		log.Fatal(err)
+	}
+	if configPath != "" {
+		if err = p.config.CheckShared(p.shared); err != nil {
+			log.Fatal(err)
+		}
+	}
+	return p
+}
+
+func (p *parties) openGallery(galleryDir string) ckks_fv.GalleryStore {
+	gallery, err := ckks_fv.OpenGalleryStore(galleryDir, p.context.GetContextID())
+	if err != nil {
+		log.Fatal(err)
+	}
+	return gallery
+}
+
+// readTemplates reads one template file per modality
+func (p *parties) readTemplates(paths []string) []ckks_fv.Template {
+	if len(paths) != len(p.config.Modalities) {
+		log.Fatalf("%d template files given for the modalities %v", len(paths), p.config.ModalityNames())
+	}
+	templates := make([]ckks_fv.Template, len(paths))
+	for i, path := range paths {
+		template, err := p.config.Modalities[i].ReadTemplate(path)
+		if err != nil {
+			log.Fatal(err)
+		}
+		templates[i] = template
+	}
+	return templates
+}
+
+// transcipher encrypts the templates under a fresh symmetric key and nonces and transciphers them on the computation server
+func (p *parties) transcipher(templates []ckks_fv.Template) *ckks_fv.Ciphertext {
+	key := p.client.GenerateRandomKey()
+	symCiphertexts, encKey, nonces := p.client.EncryptMultipleTemplatesWithNonces(templates, key, 1, p.shared.GetMessagesSize())
+	ct, err := p.serverComp.TranscipherFirstMessageWithNonces(symCiphertexts, encKey, nonces)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return ct
+}
+
+// probe returns the transciphered probe read from probePath, or transciphered from the template files if it is empty
+func (p *parties) probe(probePath string, paths []string) *ckks_fv.Ciphertext {
+	if probePath == "" {
+		return p.transcipher(p.readTemplates(paths))
+	}
+	ct := new(ckks_fv.Ciphertext)
+	if err := ckks_fv.DeserializeWire(ckks_fv.NewWireCodec(p.shared.GetParams()), probePath, ct); err != nil {
+		log.Fatal(err)
+	}
+	return ct
+}
+
+func keygen(args []string) {
+	fs := flag.NewFlagSet("keygen", flag.ExitOnError)
+	contextPath := fs.String("context", "context.bin", "output path of the context file")
+	configPath := fs.String("config", "", "configuration file, replaces the parameter flags")
+	cipher := fs.Int("cipher", ckks_fv.HERA, "cipher, 0 for HERA and 1 for Rubato")
+	numRound := fs.Int("rounds", 4, "HERA rounds")
+	paramIndex := fs.Int("param", 0, "parameter index")
+	radix := fs.Int("radix", 2, "SlotsToCoeffs radix")
+	fullCoeffs := fs.Bool("full-coeffs", true, "transcipher into all coefficients")
+	fs.Parse(args)
+
+	var shared ckks_fv.Shared
+	var err error
+	if *configPath != "" {
+		shared, err = loadConfig(*configPath).Shared()
+	} else {
+		shared, err = ckks_fv.InitWithCipher(*cipher, *numRound, *paramIndex, *radix, *fullCoeffs)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	serverAuth, err := ckks_fv.NewServerAuth(shared)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err = ckks_fv.SaveContext(*contextPath, shared, serverAuth); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func enroll(args []string) {
+	fs := flag.NewFlagSet("enroll", flag.ExitOnError)
+	contextPath := fs.String("context", "context.bin", "context file written by keygen")
+	configPath := fs.String("config", "", "configuration file of the modalities and thresholds")
+	concurrency := fs.Int("concurrency", 1, "goroutines evaluating the keystream and half-bootstraps")
+	galleryDir := fs.String("gallery", "gallery", "folder of the gallery store")
+	templateDir := fs.String("templates", "", "folder of plain templates with one folder per modality and subject, enrols all of them")
+	logPath := fs.String("log", "mtpro.log", "log file of the enrolment of a template folder")
+	fs.Parse(args)
+
+	if *templateDir != "" {
+		test := ckks_fv.NewDatabaseTest(*galleryDir, *templateDir, *contextPath, *logPath)
+		test.SetConfig(loadConfig(*configPath))
+		test.Init_Parties()
+		test.MapTemplates(0)
+		test.TranscipherMap()
+		return
+	}
+	if fs.NArg() < 3 {
+		log.Fatal("usage: mtpro enroll [flags] <subject ID> <template ID> <template files...>")
+	}
+	p := loadParties(*contextPath, *configPath)
+	p.serverComp.SetConcurrency(*concurrency)
+	templates := p.readTemplates(fs.Args()[2:])
+	lengths := make([]int, len(templates))
+	for i, template := range templates {
+		lengths[i] = len(template.GetMessage())
+	}
+	record, err := p.openGallery(*galleryDir).Put(fs.Arg(0), fs.Arg(1), p.config.ModalityNames(), lengths, p.transcipher(templates))
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("enrolled %s/%s at level %d\n", record.SubjectID, record.TemplateID, record.Level)
+}
+
+func transcipher(args []string) {
+	fs := flag.NewFlagSet("transcipher", flag.ExitOnError)
+	contextPath := fs.String("context", "context.bin", "context file written by keygen")
+	configPath := fs.String("config", "", "configuration file of the modalities and thresholds")
+	concurrency := fs.Int("concurrency", 1, "goroutines evaluating the keystream and half-bootstraps")
+	out := fs.String("out", "probe.ct", "output path of the transciphered ciphertext")
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		log.Fatal("usage: mtpro transcipher [flags] <template files...>")
+	}
+
+	p := loadParties(*contextPath, *configPath)
+	p.serverComp.SetConcurrency(*concurrency)
+	ct := p.transcipher(p.readTemplates(fs.Args()))
+	if err := ckks_fv.SerializeWire(ckks_fv.NewWireCodec(p.shared.GetParams()), ct, *out); err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("transciphered to %s at level %d\n", *out, ct.Level())
+}
+
+func verify(args []string) {
+	fs := flag.NewFlagSet("verify", flag.ExitOnError)
+	contextPath := fs.String("context", "context.bin", "context file written by keygen")
+	configPath := fs.String("config", "", "configuration file of the modalities and thresholds")
+	concurrency := fs.Int("concurrency", 1, "goroutines evaluating the keystream and half-bootstraps")
+	galleryDir := fs.String("gallery", "gallery", "folder of the gallery store")
+	probePath := fs.String("probe", "", "transciphered probe written by transcipher, replaces the template files")
+	showDistance := fs.Bool("distance", false, "decrypt and print the fused distance")
+	fs.Parse(args)
+	if fs.NArg() < 2 {
+		log.Fatal("usage: mtpro verify [flags] <subject ID> <template ID> <template files...>")
+	}
+
+	p := loadParties(*contextPath, *configPath)
+	p.serverComp.SetConcurrency(*concurrency)
+	reference, _, err := p.openGallery(*galleryDir).Get(fs.Arg(0), fs.Arg(1))
+	if err != nil {
+		log.Fatal(err)
+	}
+	probe := p.probe(*probePath, fs.Args()[2:])
+	ins := p.config.Instructions()
+	scores, err := p.serverComp.ProcessTemplateInstructionsSingleCT(ins, probe, reference)
+	if err != nil {
+		log.Fatal(err)
+	}
+	distance, err := p.serverComp.FuseDistances(ins, scores)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *showDistance {
+		fmt.Printf("distance %v\n", real(p.serverAuth.DecryptMessage(distance)[0]))
+	}
+	decision, err := p.serverComp.EvaluateThreshold(distance, p.config.ThresholdParameters())
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("accepted %v\n", p.serverAuth.DecryptDecision(decision))
+}
+
+func identify(args []string) {
+	fs := flag.NewFlagSet("identify", flag.ExitOnError)
+	contextPath := fs.String("context", "context.bin", "context file written by keygen")
+	configPath := fs.String("config", "", "configuration file of the modalities and thresholds")
+	concurrency := fs.Int("concurrency", 1, "goroutines evaluating the keystream and half-bootstraps")
+	galleryDir := fs.String("gallery", "gallery", "folder of the gallery store")
+	probePath := fs.String("probe", "", "transciphered probe written by transcipher, replaces the template files")
+	fs.Parse(args)
+	if fs.NArg() < 1 {
+		log.Fatal("usage: mtpro identify [flags] <template ID> <template files...>")
+	}
+
+	p := loadParties(*contextPath, *configPath)
+	p.serverComp.SetConcurrency(*concurrency)
+	probe := p.probe(*probePath, fs.Args()[1:])
+	gallery, layout, err := p.openGallery(*galleryDir).PackGallery(p.serverComp, fs.Arg(0))
+	if err != nil {
+		log.Fatal(err)
+	}
+	argminParams := p.config.ArgminParameters()
+	if argminParams == nil {
+		log.Fatal("identification is disabled in the configuration")
+	}
+	distances, err := p.serverComp.ProcessTemplateInstructionsGallery(p.config.Instructions(), probe, gallery, layout)
+	if err != nil {
+		log.Fatal(err)
+	}
+	bestMatch, decision, err := p.serverComp.FindBestMatch(distances, layout, argminParams)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("best match %s, accepted %v\n", p.serverAuth.DecryptBestMatch(bestMatch, layout), p.serverAuth.DecryptDecision(decision))
+}
+
+func eval(args []string) {
+	fs := flag.NewFlagSet("eval", flag.ExitOnError)
+	contextPath := fs.String("context", "context.bin", "context file, generated with the given parameters if missing")
+	configPath := fs.String("config", "", "configuration file, replaces the parameter flags")
+	plainDir := fs.String("templates", "", "folder of plain templates with one folder per modality and subject")
+	encryptedDir := fs.String("gallery", "gallery", "folder of the transciphered templates and the comparison results")
+	logPath := fs.String("log", "mtpro.log", "log file of the timings and distances")
+	cipher := fs.Int("cipher", ckks_fv.HERA, "cipher, 0 for HERA and 1 for Rubato")
+	numRound := fs.Int("rounds", 4, "HERA rounds")
+	paramIndex := fs.Int("param", 0, "parameter index")
+	radix := fs.Int("radix", 2, "SlotsToCoeffs radix")
+	fullCoeffs := fs.Bool("full-coeffs", true, "transcipher into all coefficients")
+	fs.Parse(args)
+
+	test := ckks_fv.NewDatabaseTest(*encryptedDir, *plainDir, *contextPath, *logPath)
+	if *configPath != "" {
+		test.SetConfig(loadConfig(*configPath))
+	} else {
+		test.SetParameters(*cipher, *numRound, *paramIndex, *radix, *fullCoeffs)
+	}
+	test.Run()
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: %s keygen|enroll|transcipher|verify|identify|eval [flags] [arguments]\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "run %s <command> -h for the flags of a command\n", os.Args[0])
+	os.Exit(2)
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+	commands := map[string]func([]string){
+		"keygen":      keygen,
+		"enroll":      enroll,
+		"transcipher": transcipher,
+		"verify":      verify,
+		"identify":    identify,
+		"eval":        eval,
+	}
+	command, ok := commands[os.Args[1]]
+	if !ok {
+		usage()
+	}
+	command(os.Args[2:])
+}
@@ -0,0 +1,100 @@
+package plaincipher
+
+import (
+	"golang.org/x/crypto/sha3"
+)
+
+// HeraParam is a HERA parameter set
+type HeraParam struct {
+	NumRound     int
+	PlainModulus uint64
+}
+
+const (
+	HERA80 = iota
+	HERA80A
+	HERA128
+	HERA128A
+)
+
+// HeraParams are the HERA parameter sets of the RtF parameters, the A sets use the 25-bit plaintext modulus of the
+// arcsine parameters (RtFHeraParams 2 and 3 in ckks_fv)
+var HeraParams = []HeraParam{
+	{
+		// HERA80
+		NumRound:     4,
+		PlainModulus: 268042241, // 28-bit
+	},
+	{
+		// HERA80A
+		NumRound:     4,
+		PlainModulus: 33292289, // 25-bit
+	},
+	{
+		// HERA128
+		NumRound:     5,
+		PlainModulus: 268042241, // 28-bit
+	},
+	{
+		// HERA128A
+		NumRound:     5,
+		PlainModulus: 33292289, // 25-bit
+	},
+}
+
+type hera struct {
+	param HeraParam
+}
+
+// NewHera returns HERA with the parameter set param. HERA has blocks of 16 words and ignores the counter, each
+// keystream block is derived from the nonce alone.
+func NewHera(param HeraParam) Cipher {
+	return &hera{param: param}
+}
+
+func (hera *hera) BlockSize() int {
+	return 16
+}
+
+func (hera *hera) OutputSize() int {
+	return 16
+}
+
+func (hera *hera) PlainModulus() uint64 {
+	return hera.param.PlainModulus
+}
+
+func (hera *hera) KeyStream(nonce []byte, counter []byte, key []uint64) []uint64 {
+	checkKey(hera, key)
+	t := hera.param.PlainModulus
+	xof := sha3.NewShake256()
+	xof.Write(nonce)
+	rks := roundKeys(xof, hera.param.NumRound, key, t)
+
+	state := initialState(16)
+	addRoundKey(state, rks[0], t)
+	for r := 1; r < hera.param.NumRound; r++ {
+		linearLayer(state, t)
+		cube(state, t)
+		addRoundKey(state, rks[r], t)
+	}
+	linearLayer(state, t)
+	cube(state, t)
+	linearLayer(state, t)
+	addRoundKey(state, rks[hera.param.NumRound], t)
+	return state
+}
+
+func (hera *hera) Encrypt(nonce []byte, counter []byte, key []uint64, message []uint64) []uint64 {
+	return addKeyStream(hera, hera.KeyStream(nonce, counter, key), message, 1)
+}
+
+func (hera *hera) Decrypt(nonce []byte, counter []byte, key []uint64, ciphertext []uint64) []uint64 {
+	return addKeyStream(hera, hera.KeyStream(nonce, counter, key), ciphertext, -1)
+}
+
+func cube(state []uint64, plainModulus uint64) {
+	for i := range state {
+		state[i] = (state[i] * state[i] % plainModulus) * state[i] % plainModulus
+	}
+}
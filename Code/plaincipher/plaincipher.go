@@ -0,0 +1,150 @@
+// Package plaincipher implements the HERA and Rubato stream ciphers over Z_t in the clear, as used by the clients of
+// the RtF transciphering framework. It does not depend on the homomorphic schemes, the FV evaluations of ckks_fv
+// compute the same keystreams under encryption.
+package plaincipher
+
+import (
+	"fmt"
+	"io"
+	"math/bits"
+)
+
+// Cipher is a stream cipher over Z_t: a key of BlockSize words yields, for each nonce and counter, a keystream block
+// of OutputSize words which is added to the message modulo PlainModulus.
+type Cipher interface {
+	BlockSize() int
+	OutputSize() int
+	PlainModulus() uint64
+	// KeyStream returns the keystream block of the nonce and counter
+	KeyStream(nonce []byte, counter []byte, key []uint64) []uint64
+	// Encrypt adds the keystream block of the nonce and counter to the message, of at most OutputSize words
+	Encrypt(nonce []byte, counter []byte, key []uint64, message []uint64) []uint64
+	// Decrypt subtracts the keystream block of the nonce and counter from the ciphertext
+	Decrypt(nonce []byte, counter []byte, key []uint64, ciphertext []uint64) []uint64
+}
+
+// SampleZqx returns a uniform random value in [0, q) read from rand by rejection sampling
+func SampleZqx(rand io.Reader, q uint64) (res uint64) {
+	bitLen := bits.Len64(q - 2)
+	byteLen := (bitLen + 7) / 8
+	b := bitLen % 8
+	if b == 0 {
+		b = 8
+	}
+
+	bytes := make([]byte, byteLen)
+	for {
+		_, err := io.ReadFull(rand, bytes)
+		if err != nil {
+			panic(err)
+		}
+		bytes[byteLen-1] &= uint8((1 << b) - 1)
+
+		res = 0
+		for i := 0; i < byteLen; i++ {
+			res += uint64(bytes[i]) << (8 * i)
+		}
+
+		if res < q {
+			return
+		}
+	}
+}
+
+// GenerateKey returns a key of blocksize words sampled uniformly in Z_t from rand
+func GenerateKey(rand io.Reader, blocksize int, plainModulus uint64) []uint64 {
+	key := make([]uint64, blocksize)
+	for i := range key {
+		key[i] = SampleZqx(rand, plainModulus)
+	}
+	return key
+}
+
+// roundKeys returns the round keys of rounds 0, ..., numRound, the key multiplied by the round constants squeezed
+// from xof
+func roundKeys(xof io.Reader, numRound int, key []uint64, plainModulus uint64) [][]uint64 {
+	rks := make([][]uint64, numRound+1)
+	for r := 0; r <= numRound; r++ {
+		rks[r] = make([]uint64, len(key))
+		for i := range key {
+			rks[r][i] = SampleZqx(xof, plainModulus) * key[i] % plainModulus
+		}
+	}
+	return rks
+}
+
+// initialState returns the constant state (1, ..., blocksize)
+func initialState(blocksize int) []uint64 {
+	state := make([]uint64, blocksize)
+	for i := range state {
+		state[i] = uint64(i + 1)
+	}
+	return state
+}
+
+func addRoundKey(state []uint64, rk []uint64, plainModulus uint64) {
+	for i := range state {
+		state[i] = (state[i] + rk[i]) % plainModulus
+	}
+}
+
+// linearLayerRows holds the first row of the circulant MixColumns and MixRows matrices for each block size
+var linearLayerRows = map[int][]uint64{
+	16: {2, 3, 1, 1},
+	36: {4, 2, 4, 3, 1, 1},
+	64: {5, 3, 4, 3, 6, 2, 1, 1},
+}
+
+// linearLayer applies MixColumns then MixRows to the state seen as a square matrix stored row by row
+func linearLayer(state []uint64, plainModulus uint64) {
+	row, ok := linearLayerRows[len(state)]
+	if !ok {
+		panic(fmt.Sprintf("invalid blocksize %d", len(state)))
+	}
+	n := len(row)
+	buf := make([]uint64, len(state))
+	// MixColumns
+	for i := 0; i < n; i++ {
+		for j := 0; j < n; j++ {
+			var acc uint64
+			for k, c := range row {
+				acc += c * state[((i+k)%n)*n+j]
+			}
+			buf[i*n+j] = acc % plainModulus
+		}
+	}
+	// MixRows
+	for i := 0; i < n; i++ {
+		for j := 0; j < n; j++ {
+			var acc uint64
+			for k, c := range row {
+				acc += c * buf[i*n+(j+k)%n]
+			}
+			state[i*n+j] = acc % plainModulus
+		}
+	}
+}
+
+// checkKey panics if the key does not have the block size of the cipher
+func checkKey(cipher Cipher, key []uint64) {
+	if len(key) != cipher.BlockSize() {
+		panic(fmt.Sprintf("key of %d words, expected %d", len(key), cipher.BlockSize()))
+	}
+}
+
+// addKeyStream adds (sign 1) or subtracts (sign -1) the keystream to the words of in
+func addKeyStream(cipher Cipher, keystream []uint64, in []uint64, sign int) []uint64 {
+	if len(in) > cipher.OutputSize() {
+		panic(fmt.Sprintf("%d words exceed the keystream block of %d words", len(in), cipher.OutputSize()))
+	}
+	t := cipher.PlainModulus()
+	out := make([]uint64, len(in))
+	for i := range in {
+		if sign > 0 {
+			out[i] = (in[i] + keystream[i]) % t
+		} else {
+			out[i] = (in[i] + t - keystream[i]) % t
+		}
+	}
+	return out
+}
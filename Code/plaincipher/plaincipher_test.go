@@ -0,0 +1,98 @@
+package plaincipher
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"reflect"
+	"testing"
+)
+
+// katVector is a known-answer vector of testdata/kat.json, the Rubato keystreams are noiseless
+type katVector struct {
+	Name         string   `json:"name"`
+	NumRound     int      `json:"num_round"`
+	Blocksize    int      `json:"blocksize"`
+	PlainModulus uint64   `json:"plain_modulus"`
+	Key          []uint64 `json:"key"`
+	Nonce        string   `json:"nonce"`
+	Counter      string   `json:"counter,omitempty"`
+	KeyStream    []uint64 `json:"keystream"`
+}
+
+// TestKnownAnswers checks the keystreams of all HERA and Rubato parameter sets against testdata/kat.json
+func TestKnownAnswers(t *testing.T) {
+	data, err := ioutil.ReadFile("testdata/kat.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var vectors []katVector
+	if err := json.Unmarshal(data, &vectors); err != nil {
+		t.Fatal(err)
+	}
+	covered := make(map[string]bool)
+	for _, vector := range vectors {
+		nonce, err := hex.DecodeString(vector.Nonce)
+		if err != nil {
+			t.Fatal(err)
+		}
+		counter, err := hex.DecodeString(vector.Counter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var keystream []uint64
+		if vector.Counter == "" {
+			keystream = NewHera(HeraParam{vector.NumRound, vector.PlainModulus}).KeyStream(nonce, counter, vector.Key)
+		} else {
+			param := RubatoParam{vector.Blocksize, vector.PlainModulus, vector.NumRound, 0}
+			keystream = NewRubato(param).NoiselessKeyStream(nonce, counter, vector.Key)
+		}
+		if !reflect.DeepEqual(keystream, vector.KeyStream) {
+			t.Errorf("%s: keystream %v, expected %v", vector.Name, keystream, vector.KeyStream)
+		}
+		covered[vector.Name] = true
+	}
+	for _, name := range []string{"HERA-80", "HERA-128", "HERA-80-25bit", "HERA-128-25bit", "Rubato-80S", "Rubato-80M",
+		"Rubato-80L", "Rubato-128S", "Rubato-128M", "Rubato-128L"} {
+		if !covered[name] {
+			t.Errorf("no vector for %s", name)
+		}
+	}
+}
+
+// TestEncryptDecrypt checks that decryption recovers the message, up to the bounded noise for Rubato
+func TestEncryptDecrypt(t *testing.T) {
+	nonce, counter := make([]byte, 16), make([]byte, 8)
+	rand.Read(nonce)
+	rand.Read(counter)
+	for _, param := range HeraParams {
+		hera := NewHera(param)
+		key := GenerateKey(rand.Reader, hera.BlockSize(), param.PlainModulus)
+		message := GenerateKey(rand.Reader, hera.OutputSize(), param.PlainModulus)
+		ciphertext := hera.Encrypt(nonce, counter, key, message)
+		if reflect.DeepEqual(ciphertext, message) {
+			t.Errorf("HERA %v: message not encrypted", param)
+		}
+		if decrypted := hera.Decrypt(nonce, counter, key, ciphertext); !reflect.DeepEqual(decrypted, message) {
+			t.Errorf("HERA %v: decrypted %v, expected %v", param, decrypted, message)
+		}
+	}
+	for _, param := range RubatoParams {
+		rubato := NewRubato(param)
+		key := GenerateKey(rand.Reader, rubato.BlockSize(), param.PlainModulus)
+		message := GenerateKey(rand.Reader, rubato.OutputSize(), param.PlainModulus)
+		decrypted := rubato.Decrypt(nonce, counter, key, rubato.Encrypt(nonce, counter, key, message))
+		for i := range message {
+			noise := int64(decrypted[i]) - int64(message[i])
+			if noise > int64(param.PlainModulus)/2 {
+				noise -= int64(param.PlainModulus)
+			} else if noise < -int64(param.PlainModulus)/2 {
+				noise += int64(param.PlainModulus)
+			}
+			if float64(noise) > 6*param.Sigma || float64(-noise) > 6*param.Sigma {
+				t.Errorf("Rubato %v: noise %d on word %d", param, noise, i)
+			}
+		}
+	}
+}
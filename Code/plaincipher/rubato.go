@@ -0,0 +1,184 @@
+package plaincipher
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+	"math"
+
+	"golang.org/x/crypto/sha3"
+)
+
+// RubatoParam is a Rubato parameter set, Sigma is the standard deviation of the Gaussian noise of the keystream
+type RubatoParam struct {
+	Blocksize    int
+	PlainModulus uint64
+	NumRound     int
+	Sigma        float64
+}
+
+const (
+	RUBATO80S = iota
+	RUBATO80M
+	RUBATO80L
+	RUBATO128S
+	RUBATO128M
+	RUBATO128L
+)
+
+// RubatoParams are the Rubato parameter sets, indexed by RUBATO80S, ..., RUBATO128L
+var RubatoParams = []RubatoParam{
+	{
+		// RUBATO80S
+		Blocksize:    16,
+		PlainModulus: 0x3ee0001,
+		NumRound:     2,
+		Sigma:        4.4282593124559027251334012652716387400820308059307747000917767,
+	},
+	{
+		// RUBATO80M
+		Blocksize:    36,
+		PlainModulus: 0x1fc0001,
+		NumRound:     2,
+		Sigma:        1.0771441570838682304378543618228310448848183041453235756979997,
+	},
+	{
+		// RUBATO80L
+		Blocksize:    64,
+		PlainModulus: 0x1fc0001,
+		NumRound:     2,
+		Sigma:        0.63830764864229228470391369589501098956137380986389545226548133,
+	},
+	{
+		// RUBATO128S
+		Blocksize:    16,
+		PlainModulus: 0x3ee0001,
+		NumRound:     5,
+		Sigma:        4.1888939442150431183694336293110096189965156272318139054922212,
+	},
+	{
+		// RUBATO128M
+		Blocksize:    36,
+		PlainModulus: 0x1fc0001,
+		NumRound:     3,
+		Sigma:        1.6356633496458739795537788457309656607510203877762320964302959,
+	},
+	{
+		// RUBATO128L
+		Blocksize:    64,
+		PlainModulus: 0x1fc0001,
+		NumRound:     2,
+		Sigma:        1.6356633496458739795537788457309656607510203877762320964302959,
+	},
+}
+
+// Rubato is the Rubato cipher. Its keystream carries a rounded Gaussian noise of standard deviation Sigma bounded by
+// 6 Sigma on each output word, KeyStream reads the noise from crypto/rand. Decrypt recovers the message up to this noise.
+type Rubato interface {
+	Cipher
+	// NoisyKeyStream returns the keystream block with the noise sampled from noise
+	NoisyKeyStream(nonce []byte, counter []byte, key []uint64, noise io.Reader) []uint64
+	// NoiselessKeyStream returns the keystream block without noise, which is what the FV evaluation computes
+	NoiselessKeyStream(nonce []byte, counter []byte, key []uint64) []uint64
+}
+
+type rubato struct {
+	param RubatoParam
+}
+
+// NewRubato returns Rubato with the parameter set param, a Sigma of zero disables the noise
+func NewRubato(param RubatoParam) Rubato {
+	return &rubato{param: param}
+}
+
+func (rubato *rubato) BlockSize() int {
+	return rubato.param.Blocksize
+}
+
+func (rubato *rubato) OutputSize() int {
+	return rubato.param.Blocksize - 4
+}
+
+func (rubato *rubato) PlainModulus() uint64 {
+	return rubato.param.PlainModulus
+}
+
+func (rubato *rubato) KeyStream(nonce []byte, counter []byte, key []uint64) []uint64 {
+	return rubato.NoisyKeyStream(nonce, counter, key, rand.Reader)
+}
+
+func (rubato *rubato) NoisyKeyStream(nonce []byte, counter []byte, key []uint64, noise io.Reader) []uint64 {
+	state := rubato.NoiselessKeyStream(nonce, counter, key)
+	if rubato.param.Sigma > 0 {
+		t := rubato.param.PlainModulus
+		for i := range state {
+			state[i] = (state[i] + sampleGaussian(noise, rubato.param.Sigma, t)) % t
+		}
+	}
+	return state
+}
+
+func (rubato *rubato) NoiselessKeyStream(nonce []byte, counter []byte, key []uint64) []uint64 {
+	checkKey(rubato, key)
+	t := rubato.param.PlainModulus
+	xof := sha3.NewShake256()
+	xof.Write(nonce)
+	xof.Write(counter)
+	rks := roundKeys(xof, rubato.param.NumRound, key, t)
+
+	state := initialState(rubato.param.Blocksize)
+	addRoundKey(state, rks[0], t)
+	for r := 1; r < rubato.param.NumRound; r++ {
+		linearLayer(state, t)
+		feistel(state, t)
+		addRoundKey(state, rks[r], t)
+	}
+	linearLayer(state, t)
+	feistel(state, t)
+	linearLayer(state, t)
+	addRoundKey(state, rks[rubato.param.NumRound], t)
+	return state[:rubato.OutputSize()]
+}
+
+// Encrypt adds the noisy keystream block to the message
+func (rubato *rubato) Encrypt(nonce []byte, counter []byte, key []uint64, message []uint64) []uint64 {
+	return addKeyStream(rubato, rubato.KeyStream(nonce, counter, key), message, 1)
+}
+
+// Decrypt subtracts the noiseless keystream block from the ciphertext, the result is the message plus the noise
+func (rubato *rubato) Decrypt(nonce []byte, counter []byte, key []uint64, ciphertext []uint64) []uint64 {
+	return addKeyStream(rubato, rubato.NoiselessKeyStream(nonce, counter, key), ciphertext, -1)
+}
+
+func feistel(state []uint64, plainModulus uint64) {
+	for i := len(state) - 1; i > 0; i-- {
+		state[i] = (state[i] + state[i-1]*state[i-1]) % plainModulus
+	}
+}
+
+// sampleGaussian returns a rounded Gaussian sample of standard deviation sigma and absolute value at most 6 sigma,
+// reduced modulo plainModulus
+func sampleGaussian(rand io.Reader, sigma float64, plainModulus uint64) uint64 {
+	bound := math.Floor(6 * sigma)
+	for {
+		// Box-Muller transform of two uniform values in (0, 1]
+		u1, u2 := uniform(rand), uniform(rand)
+		x := math.Round(math.Sqrt(-2*math.Log(u1)) * math.Cos(2*math.Pi*u2) * sigma)
+		if math.Abs(x) > bound {
+			continue
+		}
+		if x < 0 {
+			return plainModulus - uint64(-x)
+		}
+		return uint64(x)
+	}
+}
+
+// uniform returns a uniform value in (0, 1] with 53 bits of precision read from rand
+func uniform(rand io.Reader) float64 {
+	var buf [8]byte
+	if _, err := io.ReadFull(rand, buf[:]); err != nil {
+		panic(err)
+	}
+	return float64(binary.LittleEndian.Uint64(buf[:])>>11+1) / (1 << 53)
+}
@@ -60,6 +60,17 @@ func NewRing(N int, Moduli []uint64) (r *Ring, err error) {
 	return r, r.genNTTParams()
 }
 
+// ShallowCopy creates a shallow copy of this ring in which the moduli and NTT parameters are shared with the
+// receiver and the polynomial pool is reallocated. The receiver and the copy can be used concurrently.
+func (r *Ring) ShallowCopy() *Ring {
+	if r == nil {
+		return nil
+	}
+	ringCopy := *r
+	ringCopy.polypool = r.NewPoly()
+	return &ringCopy
+}
+
 // setParameters initializes a *Ring by setting the required precomputed values (except for the NTT-related values, which are set by the
 // genNTTParams function).
 func (r *Ring) setParameters(N int, Modulus []uint64) error {